@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// gatedMetrics are the per-op benchmark metrics checked for regressions. All
+// of them are better when lower.
+var gatedMetrics = []string{"ns/op", "B/op", "allocs/op"}
+
+// benchProcsSuffix is the -GOMAXPROCS suffix go test appends to names.
+var benchProcsSuffix = regexp.MustCompile(`-\d+$`)
+
+// runBench implements the `bench` subcommand.
+func runBench(args []string) error {
+	if len(args) == 0 || args[0] != "compare" {
+		return fmt.Errorf("usage: %s bench compare [-threshold pct] [-alpha p] <old.txt> <new.txt>", os.Args[0])
+	}
+
+	fs := flag.NewFlagSet("bench compare", flag.ExitOnError)
+	threshold := fs.Float64("threshold", 10, "Maximum allowed slowdown in percent before failing")
+	alpha := fs.Float64("alpha", 0.05, "Significance level a slowdown must reach before failing")
+	fs.Parse(args[1:])
+	if fs.NArg() != 2 {
+		return fmt.Errorf("usage: %s bench compare [-threshold pct] [-alpha p] <old.txt> <new.txt>", os.Args[0])
+	}
+
+	before, err := parseBenchFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	after, err := parseBenchFile(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(after))
+	for name := range after {
+		if _, ok := before[name]; ok {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("no benchmarks in common between %s and %s", fs.Arg(0), fs.Arg(1))
+	}
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "benchmark\tmetric\told\tnew\tdelta\tp")
+	var regressions []string
+	var noisy int
+	for _, name := range names {
+		for _, metric := range gatedMetrics {
+			olds, news := before[name][metric], after[name][metric]
+			if len(olds) == 0 || len(news) == 0 {
+				continue
+			}
+			old, cur := median(olds), median(news)
+			delta := 0.0
+			switch {
+			case old != 0:
+				delta = (cur - old) / old * 100
+			case cur > 0:
+				// Anything is infinitely worse than nothing, such as a first
+				// allocation on a path that had none.
+				delta = math.Inf(1)
+			}
+			p := mannWhitneyP(olds, news)
+			mark := ""
+			if delta > *threshold {
+				if p <= *alpha {
+					mark = " !"
+					regressions = append(regressions, fmt.Sprintf("%s %s %+.1f%% (p=%.3f)", name, metric, delta, p))
+				} else {
+					mark = " ?"
+					noisy++
+				}
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%.6g\t%.6g\t%+.1f%%\t%.3f%s\n", name, metric, old, cur, delta, p, mark)
+		}
+	}
+	tw.Flush()
+
+	if noisy > 0 {
+		fmt.Printf("%d slowdowns above %.1f%% (marked ?) were not significant at p<=%.2f; run with a higher -count to confirm them\n", noisy, *threshold, *alpha)
+	}
+	if len(regressions) > 0 {
+		return fmt.Errorf("%d metrics regressed by more than %.1f%%:\n  %s",
+			len(regressions), *threshold, strings.Join(regressions, "\n  "))
+	}
+	fmt.Printf("No significant regressions above %.1f%%\n", *threshold)
+	return nil
+}
+
+// benchSamples holds every value reported for one benchmark, by metric unit.
+// Running with -count N yields N samples per metric.
+type benchSamples map[string][]float64
+
+// median returns the middle value of samples, which unlike the mean is not
+// dragged by one run that hit a GC or a noisy neighbour.
+func median(samples []float64) float64 {
+	sorted := append([]float64(nil), samples...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// mannWhitneyP returns the two-sided p-value of a Mann-Whitney U test that
+// the two sample sets come from the same distribution, using the normal
+// approximation with tie and continuity corrections. Sets that each repeat a
+// single value, as B/op and allocs/op usually do, differ with certainty if
+// their values differ, however few samples there are.
+func mannWhitneyP(a, b []float64) float64 {
+	if constant(a) && constant(b) {
+		if a[0] == b[0] {
+			return 1
+		}
+		return 0
+	}
+
+	type ranked struct {
+		value float64
+		fromA bool
+	}
+	all := make([]ranked, 0, len(a)+len(b))
+	for _, v := range a {
+		all = append(all, ranked{v, true})
+	}
+	for _, v := range b {
+		all = append(all, ranked{v, false})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].value < all[j].value })
+
+	// Tied values share the average of their ranks.
+	var rankSumA, tieTerm float64
+	for i := 0; i < len(all); {
+		j := i
+		for j < len(all) && all[j].value == all[i].value {
+			j++
+		}
+		rank := float64(i+j+1) / 2
+		for k := i; k < j; k++ {
+			if all[k].fromA {
+				rankSumA += rank
+			}
+		}
+		t := float64(j - i)
+		tieTerm += t*t*t - t
+		i = j
+	}
+
+	n1, n2 := float64(len(a)), float64(len(b))
+	n := n1 + n2
+	u := rankSumA - n1*(n1+1)/2
+	mean := n1 * n2 / 2
+	variance := n1 * n2 / 12 * ((n + 1) - tieTerm/(n*(n-1)))
+	if variance <= 0 {
+		return 1
+	}
+	z := (math.Abs(u-mean) - 0.5) / math.Sqrt(variance)
+	if z < 0 {
+		z = 0
+	}
+	return math.Erfc(z / math.Sqrt2)
+}
+
+func constant(samples []float64) bool {
+	for _, v := range samples {
+		if v != samples[0] {
+			return false
+		}
+	}
+	return true
+}
+
+// parseBenchFile reads `go test -bench` output, keyed by benchmark name
+// without the Benchmark prefix and GOMAXPROCS suffix.
+func parseBenchFile(path string) (map[string]benchSamples, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	results := make(map[string]benchSamples)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || !strings.HasPrefix(fields[0], "Benchmark") {
+			continue
+		}
+		if _, err := strconv.Atoi(fields[1]); err != nil {
+			continue
+		}
+
+		name := benchProcsSuffix.ReplaceAllString(strings.TrimPrefix(fields[0], "Benchmark"), "")
+		samples, ok := results[name]
+		if !ok {
+			samples = make(benchSamples)
+			results[name] = samples
+		}
+		for i := 2; i+1 < len(fields); i += 2 {
+			value, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				continue
+			}
+			samples[fields[i+1]] = append(samples[fields[i+1]], value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return results, nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"t-oai-api/logging"
+)
+
+// runCat implements the `cat` subcommand, printing log files with any
+// compression removed.
+func runCat(paths []string) error {
+	if len(paths) == 0 {
+		return fmt.Errorf("usage: %s cat <file>...", os.Args[0])
+	}
+	for _, path := range paths {
+		r, err := logging.OpenLogReader(path)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(os.Stdout, r)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+	}
+	return nil
+}
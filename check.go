@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"t-oai-api/config"
+	"t-oai-api/proxy"
+)
+
+const (
+	// checkTimeout bounds each upstream test call.
+	checkTimeout = 10 * time.Second
+	// certExpiryWarning is how close to expiry an upstream certificate is
+	// reported.
+	certExpiryWarning = 14 * 24 * time.Hour
+)
+
+// checkResult is one line of the check report.
+type checkResult struct {
+	Status string
+	Name   string
+	Detail string
+}
+
+// checkReport collects results and prints each as it is added.
+type checkReport struct {
+	results []checkResult
+}
+
+func (r *checkReport) add(status, name, format string, args ...any) {
+	result := checkResult{Status: status, Name: name, Detail: fmt.Sprintf(format, args...)}
+	r.results = append(r.results, result)
+	fmt.Printf("%-5s %-10s %s\n", result.Status, result.Name, result.Detail)
+}
+
+func (r *checkReport) count(status string) int {
+	n := 0
+	for _, result := range r.results {
+		if result.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// runCheck implements the check subcommand. It takes the proxy's own flags,
+// validates the configuration they produce without serving traffic, and
+// prints a report. It fails if any check fails.
+func runCheck(args []string) error {
+	cfg := config.LoadArgs(args)
+	report := &checkReport{}
+
+	checkConfig(report, cfg)
+	checkPaths(report, cfg)
+	checkListen(report, "port", ":"+cfg.Port)
+	if cfg.AdminAddr != "" {
+		checkListen(report, "admin", cfg.AdminAddr)
+	}
+	checkUpstreams(report, cfg)
+
+	failed, warned := report.count("FAIL"), report.count("WARN")
+	fmt.Printf("\n%d checks: %d failed, %d warnings\n", len(report.results), failed, warned)
+	if failed > 0 {
+		return fmt.Errorf("configuration check failed")
+	}
+	return nil
+}
+
+// checkConfig builds the proxy from cfg, which loads and validates every
+// configured file and setting, then closes it again. Warm-up is skipped so
+// the check sends no completions.
+func checkConfig(report *checkReport, cfg config.Config) {
+	if _, err := proxy.ParseWarmupTargets(cfg.WarmupTargets, cfg.OpenAIBaseURL); err != nil {
+		report.add("FAIL", "config", "%v", err)
+		return
+	}
+	cfg.WarmupTargets = ""
+	server, err := proxy.NewServer(cfg)
+	if err != nil {
+		report.add("FAIL", "config", "%v", err)
+		return
+	}
+	server.Close()
+	report.add("OK", "config", "settings and configured files are valid")
+}
+
+// checkPaths reports whether the proxy can write where it is configured to.
+func checkPaths(report *checkReport, cfg config.Config) {
+	// created marks directories the proxy creates on first use; the others
+	// must already exist.
+	paths := []struct {
+		name    string
+		dir     string
+		created bool
+	}{
+		{"request log", logDir(cfg.RequestLogFile), true},
+		{"spill dir", cfg.SpillDir, false},
+		{"overflow dir", cfg.LogOverflowDir, true},
+		{"transcripts", cfg.TranscriptDir, true},
+		{"record file", parentDir(cfg.RecordFile), false},
+		{"usage file", parentDir(cfg.UsageFile), false},
+	}
+	for _, p := range paths {
+		if p.dir == "" {
+			continue
+		}
+		if err := checkWritable(p.dir, p.created); err != nil {
+			report.add("FAIL", "path", "%s %s: %v", p.name, p.dir, err)
+			continue
+		}
+		report.add("OK", "path", "%s %s is writable", p.name, p.dir)
+	}
+	if cfg.SpillDir == "" {
+		report.add("OK", "path", "spill dir %s (system temp) is writable", os.TempDir())
+	}
+}
+
+// logDir returns the directory of a log template's files, up to the first
+// placeholder.
+func logDir(template string) string {
+	if template == "" {
+		return ""
+	}
+	if i := strings.Index(template, "{"); i >= 0 {
+		template = template[:i] + "x"
+	}
+	return filepath.Dir(template)
+}
+
+func parentDir(path string) string {
+	if path == "" {
+		return ""
+	}
+	return filepath.Dir(path)
+}
+
+// checkWritable creates and removes a file in dir or, if created is set and
+// dir does not exist yet, in its nearest existing ancestor.
+func checkWritable(dir string, created bool) error {
+	for {
+		info, err := os.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("%s is not a directory", dir)
+			}
+			break
+		}
+		parent := filepath.Dir(dir)
+		if !os.IsNotExist(err) || !created || parent == dir {
+			return err
+		}
+		dir = parent
+	}
+	f, err := os.CreateTemp(dir, ".t-oai-api-check-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func checkListen(report *checkReport, name, addr string) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		report.add("FAIL", name, "cannot listen on %s: %v", addr, err)
+		return
+	}
+	ln.Close()
+	report.add("OK", name, "%s is available", addr)
+}
+
+// checkUpstreams makes a cheap authenticated call to every configured
+// upstream and checks its TLS certificate.
+func checkUpstreams(report *checkReport, cfg config.Config) {
+	upstreams := []string{strings.TrimSuffix(cfg.OpenAIBaseURL, "/")}
+	targets, _ := proxy.ParseWarmupTargets(cfg.WarmupTargets, cfg.OpenAIBaseURL)
+	for _, t := range targets {
+		upstreams = append(upstreams, t.URL)
+	}
+	for _, entry := range strings.Split(cfg.StatusFallbacks, ",") {
+		if _, fallback, ok := strings.Cut(entry, "="); ok {
+			upstreams = append(upstreams, strings.TrimSuffix(strings.TrimSpace(fallback), "/"))
+		}
+	}
+
+	client := &http.Client{Timeout: checkTimeout}
+	if resolver, err := proxy.NewResolver(cfg); err == nil && resolver != nil {
+		client.Transport = resolver.Transport()
+	}
+	seen := make(map[string]bool)
+	for _, upstream := range upstreams {
+		if seen[upstream] {
+			continue
+		}
+		seen[upstream] = true
+		checkUpstream(report, client, upstream, cfg.OpenAIAPIKey)
+	}
+}
+
+// checkUpstream lists the upstream's models, which costs nothing and needs a
+// valid key on most providers.
+func checkUpstream(report *checkReport, client *http.Client, upstream, key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, upstream+"/models", nil)
+	if err != nil {
+		report.add("FAIL", "upstream", "%s: %v", upstream, err)
+		return
+	}
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	started := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		report.add("FAIL", "upstream", "%s is unreachable: %v", upstream, err)
+		return
+	}
+	defer resp.Body.Close()
+	latency := time.Since(started).Round(time.Millisecond)
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		var models struct {
+			Data []json.RawMessage `json:"data"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 16<<20)).Decode(&models)
+		if key == "" {
+			report.add("OK", "upstream", "%s is reachable in %s (%d models, no API key configured)", upstream, latency, len(models.Data))
+		} else {
+			report.add("OK", "upstream", "%s accepted the API key in %s (%d models)", upstream, latency, len(models.Data))
+		}
+	case (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) && key != "":
+		report.add("FAIL", "upstream", "%s rejected the API key: %s", upstream, resp.Status)
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		report.add("WARN", "upstream", "%s is reachable but requires a key, and none is configured; clients must send their own", upstream)
+	default:
+		report.add("WARN", "upstream", "%s is reachable, but GET /models returned %s, so the API key was not verified", upstream, resp.Status)
+	}
+
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		cert := resp.TLS.PeerCertificates[0]
+		left := time.Until(cert.NotAfter)
+		if left < certExpiryWarning {
+			report.add("WARN", "tls", "%s certificate expires %s (in %d days)", req.URL.Host, cert.NotAfter.Format(time.DateOnly), int(left.Hours()/24))
+		} else {
+			report.add("OK", "tls", "%s certificate is valid until %s", req.URL.Host, cert.NotAfter.Format(time.DateOnly))
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"t-oai-api/internal/fakeupstream"
+)
+
+// TestCheckInvalidConfig runs check once: its flags are registered on the
+// global flag set, which allows a single LoadArgs per process.
+func TestCheckInvalidConfig(t *testing.T) {
+	upstream := fakeupstream.New()
+	defer upstream.Close()
+
+	pacing := filepath.Join(t.TempDir(), "pacing.json")
+	os.WriteFile(pacing, []byte(`{"upstreams": [`), 0600)
+
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	err = runCheck([]string{
+		"-url", upstream.URL + "/v1",
+		"-key", "sk-test",
+		"-port", "0",
+		"-spill-dir", t.TempDir(),
+		"-pacing", pacing,
+	})
+	w.Close()
+	os.Stdout = stdout
+	out, _ := io.ReadAll(r)
+
+	if err == nil {
+		t.Fatalf("check accepted an invalid pacing file:\n%s", out)
+	}
+	var configLine string
+	for _, line := range strings.Split(string(out), "\n") {
+		if fields := strings.Fields(line); len(fields) > 1 && fields[1] == "config" {
+			configLine = line
+		}
+	}
+	if !strings.HasPrefix(configLine, "FAIL") || !strings.Contains(configLine, "pacing") {
+		t.Errorf("config line = %q, want a FAIL naming the pacing file\n%s", configLine, out)
+	}
+	// The other checks still run and reach the upstream.
+	if !strings.Contains(string(out), upstream.URL+"/v1 is reachable") {
+		t.Errorf("upstream was not checked:\n%s", out)
+	}
+}
@@ -0,0 +1,617 @@
+package config
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/joho/godotenv"
+
+	"t-oai-api/logging"
+)
+
+// DefaultChunkSize is the relay chunk size used when STREAM_CHUNK_SIZE is not
+// configured.
+const DefaultChunkSize = 32 * 1024
+
+// Config holds the proxy settings, populated from flags and environment
+// variables by Load.
+type Config struct {
+	Port                 string
+	OpenAIBaseURL        string
+	OpenAIAPIKey         string
+	LogRequests          bool
+	LogResponses         bool
+	LogToStdout          bool
+	RequestLogFile       string
+	SpillThreshold       int64
+	SpillDir             string
+	ChunkSize            int
+	AdminAddr            string
+	RecentRequests       int
+	RecentBodies         bool
+	CompressLogs         bool
+	LogFormat            string
+	StreamLogMode        string
+	LogRequestLimit      int
+	LogResponseLimit     int
+	LogNoTruncate        bool
+	LogOverflowDir       string
+	TemplateDir          string
+	PromptVersionsFile   string
+	PromptFamilies       int
+	GuardrailsFile       string
+	EmbeddingCacheDir    string
+	EmbeddingMaxBatch    int
+	AnnotateKeys         string
+	TrustedProxies       string
+	RecordFile           string
+	TranscriptDir        string
+	DNSOverrides         string
+	DNSServer            string
+	DNSCacheTTL          int
+	IPFamily             string
+	DialFallbackDelay    int
+	RateLimitMaxWait     int
+	PacingFile           string
+	PostProcessFile      string
+	StatusFeeds          string
+	StatusInterval       int
+	StatusFallbacks      string
+	StatusFailoverLevel  string
+	MemoryTurns          int
+	MemoryTokens         int
+	MemoryHeader         string
+	MemoryTTL            int
+	ExecOnRequest        string
+	ExecOnResponse       string
+	ExecOnError          string
+	ExecHookTimeout      int
+	StripResponseHeaders string
+	AllowResponseHeaders string
+	UserAgent            string
+	UpstreamHeadersFile  string
+	RoutingDefaultsFile  string
+	RoutingHintHosts     string
+	UsageFile            string
+	PricingFile          string
+	SpendAlerts          string
+	AnomalyFactor        float64
+	SessionSecret        string
+	SessionOrigins       string
+	WarmupTargets        string
+	WarmupIdle           int
+}
+
+// Load parses command-line flags and environment variables (including a .env
+// file). Flags take precedence over the environment.
+func Load() Config {
+	return LoadArgs(os.Args[1:])
+}
+
+// LoadArgs is Load with the flags taken from args, for subcommands that accept
+// the proxy's flags after their name.
+func LoadArgs(args []string) Config {
+	var config Config
+
+	var flagLogRequests, flagLogResponses, flagLogToStdout, flagCompressLogs, flagNoTruncate bool
+	var flagsSet bool
+
+	flag.StringVar(&config.Port, "port", "", "Port for the proxy server to listen on")
+	flag.StringVar(&config.Port, "p", "", "Port for the proxy server to listen on (shorthand)")
+
+	flag.StringVar(&config.OpenAIBaseURL, "url", "", "Base URL for the OpenAI API")
+	flag.StringVar(&config.OpenAIBaseURL, "u", "", "Base URL for the OpenAI API (shorthand)")
+
+	flag.StringVar(&config.OpenAIAPIKey, "key", "", "Your OpenAI API key")
+	flag.StringVar(&config.OpenAIAPIKey, "k", "", "Your OpenAI API key (shorthand)")
+
+	flag.BoolVar(&flagLogRequests, "req", true, "Enable request logging")
+	flag.BoolVar(&flagLogRequests, "r", true, "Enable request logging (shorthand)")
+
+	flag.BoolVar(&flagLogResponses, "resp", true, "Enable response logging")
+	flag.BoolVar(&flagLogResponses, "s", true, "Enable response logging (shorthand)")
+
+	flag.BoolVar(&flagLogToStdout, "stdout", true, "Log to standard output")
+	flag.BoolVar(&flagLogToStdout, "o", true, "Log to standard output (shorthand)")
+
+	flag.StringVar(&config.RequestLogFile, "file", "", "File to log requests and responses")
+	flag.StringVar(&config.RequestLogFile, "f", "", "File to log requests and responses (shorthand)")
+
+	flag.BoolVar(&flagCompressLogs, "compress", false, "Compress logged entries and spilled bodies with zstd")
+
+	flag.StringVar(&config.LogFormat, "format", "", "Log format: text or json")
+	flag.StringVar(&config.StreamLogMode, "stream-log", "", "How streamed responses are logged: raw, deltas, or final")
+	flag.IntVar(&config.LogRequestLimit, "log-request-limit", 0, "Request body bytes inlined into a log entry before truncating (-1 for no limit)")
+	flag.IntVar(&config.LogResponseLimit, "log-response-limit", 0, "Response body bytes inlined into a log entry before truncating (-1 for no limit)")
+	flag.BoolVar(&flagNoTruncate, "no-truncate", false, "Never truncate logged bodies")
+	flag.StringVar(&config.LogOverflowDir, "log-overflow-dir", "", "Directory to save the truncated part of logged bodies to")
+
+	flag.StringVar(&config.TemplateDir, "templates", "", "Directory of server-side prompt templates")
+
+	flag.StringVar(&config.PromptVersionsFile, "prompt-versions", "", "File to persist system prompt version history")
+	flag.IntVar(&config.PromptFamilies, "prompt-families", 0, "Prompt families to track system prompt versions for (0 disables tracking unless -prompt-versions is set, which defaults it to 100)")
+
+	flag.StringVar(&config.GuardrailsFile, "guardrails", "", "JSON file enabling guardrail policy packs per route")
+
+	flag.StringVar(&config.EmbeddingCacheDir, "embedding-cache", "", "Directory for the persistent embeddings cache")
+	flag.IntVar(&config.EmbeddingMaxBatch, "embedding-max-batch", 0, "Maximum inputs per upstream embeddings call (0 splits only when rejected)")
+
+	flag.StringVar(&config.AnnotateKeys, "annotate-keys", "", "Comma-separated client API keys whose JSON responses get an x_proxy object (* for all)")
+
+	flag.StringVar(&config.TrustedProxies, "trusted-proxies", "", "Comma-separated IPs/CIDRs of reverse proxies whose forwarding headers are trusted")
+
+	flag.StringVar(&config.UsageFile, "usage-file", "", "File to persist daily usage history per model and key")
+	flag.StringVar(&config.PricingFile, "pricing", "", "JSON file of model prices in USD per million tokens")
+	flag.StringVar(&config.SpendAlerts, "spend-alerts", "", "Comma-separated projected monthly spend thresholds, e.g. total=500,model:gpt-4o=200")
+
+	flag.Float64Var(&config.AnomalyFactor, "anomaly-factor", 0, "Flag keys whose traffic reaches this multiple of their baseline (0 disables)")
+
+	flag.StringVar(&config.SessionSecret, "session-secret", "", "Secret for signing browser session tokens (enables POST /admin/sessions)")
+	flag.StringVar(&config.SessionOrigins, "session-origins", "", "Comma-separated browser origins allowed to call the proxy with session tokens (* for any)")
+
+	flag.StringVar(&config.WarmupTargets, "warmup", "", "Comma-separated upstream URLs to pre-connect to and models to warm up (model or model@url)")
+	flag.IntVar(&config.WarmupIdle, "warmup-idle", 0, "Seconds without traffic after which warm-up is repeated (0 warms up at startup only)")
+
+	flag.StringVar(&config.StripResponseHeaders, "strip-response-headers", "", "Comma-separated upstream response headers not forwarded to clients (* suffix wildcards)")
+	flag.StringVar(&config.AllowResponseHeaders, "allow-response-headers", "", "Comma-separated upstream response headers forwarded to clients; all others are dropped")
+	flag.StringVar(&config.UserAgent, "user-agent", "", "User-Agent sent upstream; a leading + appends to the client's")
+	flag.StringVar(&config.UpstreamHeadersFile, "upstream-headers", "", "JSON file of headers to add to requests per upstream host")
+	flag.StringVar(&config.RoutingDefaultsFile, "routing-defaults", "", "JSON file of default routing hints (provider, route, models, transforms)")
+	flag.StringVar(&config.RoutingHintHosts, "routing-hint-hosts", "", "Comma-separated upstream hosts that accept routing hints (default openrouter.ai)")
+	flag.IntVar(&config.MemoryTurns, "memory-turns", 0, "Prior turns of a conversation to prepend to chat requests that name one (0 disables conversation memory)")
+	flag.IntVar(&config.MemoryTokens, "memory-tokens", 0, "Estimated tokens of prepended history to keep, dropping the oldest turns first (0 for no limit)")
+	flag.StringVar(&config.MemoryHeader, "memory-header", "", "Request header naming the conversation (default X-Conversation-ID)")
+	flag.IntVar(&config.MemoryTTL, "memory-ttl", 0, "Seconds an idle conversation is remembered (default 3600)")
+	flag.StringVar(&config.PostProcessFile, "postprocess", "", "JSON file of rules rewriting completions for legacy clients (strip fences, extract code, wrap in an envelope)")
+	flag.StringVar(&config.StatusFeeds, "status-feeds", "", "Comma-separated provider status feeds to poll: openai, anthropic, or host=url of a Statuspage JSON feed")
+	flag.IntVar(&config.StatusInterval, "status-interval", 0, "Seconds between polls of the status feeds (default 60)")
+	flag.StringVar(&config.StatusFallbacks, "status-fallbacks", "", "Comma-separated host=url fallbacks to send a host's requests to during a declared incident")
+	flag.StringVar(&config.StatusFailoverLevel, "status-failover-level", "", "Incident impact that triggers failover: minor, major, or critical (default major)")
+	flag.StringVar(&config.ExecOnRequest, "exec-on-request", "", "Command to run with the exchange JSON on stdin when a request is received")
+	flag.StringVar(&config.ExecOnResponse, "exec-on-response", "", "Command to run with the exchange JSON on stdin when a response completes")
+	flag.StringVar(&config.ExecOnError, "exec-on-error", "", "Command to run with the exchange JSON on stdin when a request fails")
+	flag.IntVar(&config.ExecHookTimeout, "exec-timeout", 0, "Seconds an exec hook command may run before it is killed")
+	flag.IntVar(&config.RateLimitMaxWait, "ratelimit-max-wait", 0, "Seconds a request may be queued while its upstream is rate limited (0 relays 429s immediately)")
+	flag.StringVar(&config.PacingFile, "pacing", "", "JSON file of per-upstream TPM/RPM budgets to pace requests to")
+
+	flag.StringVar(&config.RecordFile, "record", "", "File to record full exchanges with timing for replay")
+	flag.StringVar(&config.TranscriptDir, "transcripts", "", "Directory to write a Markdown transcript of each chat completion to")
+
+	flag.StringVar(&config.DNSOverrides, "dns-override", "", "Comma-separated host=ip pins for upstream hosts")
+	flag.StringVar(&config.DNSServer, "dns-server", "", "DNS server (host[:port]) used to resolve upstream hosts")
+	flag.IntVar(&config.DNSCacheTTL, "dns-cache-ttl", 0, "Seconds to cache upstream DNS answers (0 disables caching)")
+	flag.StringVar(&config.IPFamily, "ip-family", "", "IP family for upstream connections: ipv4, ipv6, or auto, optionally per host as host=family")
+	flag.IntVar(&config.DialFallbackDelay, "dial-fallback-delay", 0, "Milliseconds before racing the other IP family (negative disables the race)")
+
+	flag.Int64Var(&config.SpillThreshold, "spill-threshold", 0, "Body size in bytes above which logged bodies are spilled to temp files")
+	flag.StringVar(&config.SpillDir, "spill-dir", "", "Directory for spilled body files")
+
+	flag.IntVar(&config.ChunkSize, "chunk-size", 0, "Chunk size in bytes used when relaying bodies")
+
+	flag.StringVar(&config.AdminAddr, "admin", "", "Address for the admin/diagnostics listener (disabled if empty)")
+	flag.IntVar(&config.RecentRequests, "recent-requests", 0, "Completed requests kept in memory for the admin API (default 100)")
+	flag.BoolVar(&config.RecentBodies, "recent-bodies", false, "Keep the first 64KB of request and response bodies with recent requests")
+
+	flag.Visit(func(f *flag.Flag) {
+		flagsSet = true
+	})
+
+	flag.CommandLine.Parse(args)
+
+	_ = godotenv.Load()
+
+	parseBool := func(envVar string, defaultVal bool) bool {
+		val := os.Getenv(envVar)
+		if val == "" {
+			return defaultVal
+		}
+		boolVal, err := strconv.ParseBool(val)
+		if err != nil {
+			log.Printf("Warning: Invalid value for %s, using default: %v", envVar, defaultVal)
+			return defaultVal
+		}
+		return boolVal
+	}
+
+	if envPort := os.Getenv("PORT"); envPort != "" && config.Port == "" {
+		config.Port = envPort
+	}
+
+	if envURL := os.Getenv("OPENAI_BASE_URL"); envURL != "" && config.OpenAIBaseURL == "" {
+		config.OpenAIBaseURL = envURL
+	}
+
+	if envKey := os.Getenv("OPENAI_API_KEY"); envKey != "" && config.OpenAIAPIKey == "" {
+		config.OpenAIAPIKey = envKey
+	}
+
+	config.LogRequests = flagLogRequests
+	config.LogResponses = flagLogResponses
+	config.LogToStdout = flagLogToStdout
+	config.CompressLogs = flagCompressLogs
+	config.LogNoTruncate = flagNoTruncate
+
+	if !flagsSet {
+		config.LogRequests = parseBool("LOG_REQUESTS", config.LogRequests)
+		config.LogResponses = parseBool("LOG_RESPONSES", config.LogResponses)
+		config.LogToStdout = parseBool("LOG_TO_STDOUT", config.LogToStdout)
+		config.CompressLogs = parseBool("LOG_COMPRESS", config.CompressLogs)
+		config.LogNoTruncate = parseBool("LOG_NO_TRUNCATE", config.LogNoTruncate)
+	}
+
+	if envLogFile := os.Getenv("REQUEST_LOG_FILE"); envLogFile != "" && config.RequestLogFile == "" {
+		config.RequestLogFile = envLogFile
+	}
+
+	if envSpill := os.Getenv("SPILL_THRESHOLD"); envSpill != "" && config.SpillThreshold == 0 {
+		threshold, err := strconv.ParseInt(envSpill, 10, 64)
+		if err != nil {
+			log.Printf("Warning: Invalid value for SPILL_THRESHOLD, using default")
+		} else {
+			config.SpillThreshold = threshold
+		}
+	}
+
+	if envSpillDir := os.Getenv("SPILL_DIR"); envSpillDir != "" && config.SpillDir == "" {
+		config.SpillDir = envSpillDir
+	}
+
+	if envChunk := os.Getenv("STREAM_CHUNK_SIZE"); envChunk != "" && config.ChunkSize == 0 {
+		chunkSize, err := strconv.Atoi(envChunk)
+		if err != nil {
+			log.Printf("Warning: Invalid value for STREAM_CHUNK_SIZE, using default")
+		} else {
+			config.ChunkSize = chunkSize
+		}
+	}
+
+	if envAdmin := os.Getenv("ADMIN_ADDR"); envAdmin != "" && config.AdminAddr == "" {
+		config.AdminAddr = envAdmin
+	}
+
+	if envRecent := os.Getenv("RECENT_REQUESTS"); envRecent != "" && config.RecentRequests == 0 {
+		recent, err := strconv.Atoi(envRecent)
+		if err != nil {
+			log.Printf("Warning: Invalid value for RECENT_REQUESTS, ignoring")
+		} else {
+			config.RecentRequests = recent
+		}
+	}
+
+	if !config.RecentBodies {
+		config.RecentBodies = parseBool("RECENT_BODIES", false)
+	}
+
+	if envFormat := os.Getenv("LOG_FORMAT"); envFormat != "" && config.LogFormat == "" {
+		config.LogFormat = envFormat
+	}
+
+	if envStream := os.Getenv("STREAM_LOG_MODE"); envStream != "" && config.StreamLogMode == "" {
+		config.StreamLogMode = envStream
+	}
+
+	if envLimit := os.Getenv("LOG_REQUEST_LIMIT"); envLimit != "" && config.LogRequestLimit == 0 {
+		limit, err := strconv.Atoi(envLimit)
+		if err != nil {
+			log.Printf("Warning: Invalid value for LOG_REQUEST_LIMIT, using default")
+		} else {
+			config.LogRequestLimit = limit
+		}
+	}
+
+	if envLimit := os.Getenv("LOG_RESPONSE_LIMIT"); envLimit != "" && config.LogResponseLimit == 0 {
+		limit, err := strconv.Atoi(envLimit)
+		if err != nil {
+			log.Printf("Warning: Invalid value for LOG_RESPONSE_LIMIT, using default")
+		} else {
+			config.LogResponseLimit = limit
+		}
+	}
+
+	if envOverflow := os.Getenv("LOG_OVERFLOW_DIR"); envOverflow != "" && config.LogOverflowDir == "" {
+		config.LogOverflowDir = envOverflow
+	}
+
+	if envTemplates := os.Getenv("PROMPT_TEMPLATE_DIR"); envTemplates != "" && config.TemplateDir == "" {
+		config.TemplateDir = envTemplates
+	}
+
+	if envPrompts := os.Getenv("PROMPT_VERSIONS_FILE"); envPrompts != "" && config.PromptVersionsFile == "" {
+		config.PromptVersionsFile = envPrompts
+	}
+
+	if envFamilies := os.Getenv("PROMPT_FAMILIES"); envFamilies != "" && config.PromptFamilies == 0 {
+		families, err := strconv.Atoi(envFamilies)
+		if err != nil {
+			log.Printf("Warning: Invalid value for PROMPT_FAMILIES, ignoring")
+		} else {
+			config.PromptFamilies = families
+		}
+	}
+
+	if envGuardrails := os.Getenv("GUARDRAILS_FILE"); envGuardrails != "" && config.GuardrailsFile == "" {
+		config.GuardrailsFile = envGuardrails
+	}
+
+	if envCache := os.Getenv("EMBEDDING_CACHE_DIR"); envCache != "" && config.EmbeddingCacheDir == "" {
+		config.EmbeddingCacheDir = envCache
+	}
+
+	if envBatch := os.Getenv("EMBEDDING_MAX_BATCH"); envBatch != "" && config.EmbeddingMaxBatch == 0 {
+		maxBatch, err := strconv.Atoi(envBatch)
+		if err != nil {
+			log.Printf("Warning: Invalid value for EMBEDDING_MAX_BATCH, ignoring")
+		} else {
+			config.EmbeddingMaxBatch = maxBatch
+		}
+	}
+
+	if envAnnotate := os.Getenv("ANNOTATE_KEYS"); envAnnotate != "" && config.AnnotateKeys == "" {
+		config.AnnotateKeys = envAnnotate
+	}
+
+	if envTrusted := os.Getenv("TRUSTED_PROXIES"); envTrusted != "" && config.TrustedProxies == "" {
+		config.TrustedProxies = envTrusted
+	}
+
+	if envOverrides := os.Getenv("DNS_OVERRIDES"); envOverrides != "" && config.DNSOverrides == "" {
+		config.DNSOverrides = envOverrides
+	}
+
+	if envDNSServer := os.Getenv("DNS_SERVER"); envDNSServer != "" && config.DNSServer == "" {
+		config.DNSServer = envDNSServer
+	}
+
+	if envTTL := os.Getenv("DNS_CACHE_TTL"); envTTL != "" && config.DNSCacheTTL == 0 {
+		ttl, err := strconv.Atoi(envTTL)
+		if err != nil {
+			log.Printf("Warning: Invalid value for DNS_CACHE_TTL, ignoring")
+		} else {
+			config.DNSCacheTTL = ttl
+		}
+	}
+
+	if envFamily := os.Getenv("UPSTREAM_IP_FAMILY"); envFamily != "" && config.IPFamily == "" {
+		config.IPFamily = envFamily
+	}
+
+	if envDelay := os.Getenv("DIAL_FALLBACK_DELAY_MS"); envDelay != "" && config.DialFallbackDelay == 0 {
+		delay, err := strconv.Atoi(envDelay)
+		if err != nil {
+			log.Printf("Warning: Invalid value for DIAL_FALLBACK_DELAY_MS, ignoring")
+		} else {
+			config.DialFallbackDelay = delay
+		}
+	}
+
+	if envUsage := os.Getenv("USAGE_FILE"); envUsage != "" && config.UsageFile == "" {
+		config.UsageFile = envUsage
+	}
+
+	if envPricing := os.Getenv("PRICING_FILE"); envPricing != "" && config.PricingFile == "" {
+		config.PricingFile = envPricing
+	}
+
+	if envAlerts := os.Getenv("SPEND_ALERTS"); envAlerts != "" && config.SpendAlerts == "" {
+		config.SpendAlerts = envAlerts
+	}
+
+	if envFactor := os.Getenv("ANOMALY_FACTOR"); envFactor != "" && config.AnomalyFactor == 0 {
+		factor, err := strconv.ParseFloat(envFactor, 64)
+		if err != nil {
+			log.Printf("Warning: Invalid value for ANOMALY_FACTOR, ignoring")
+		} else {
+			config.AnomalyFactor = factor
+		}
+	}
+
+	if envSecret := os.Getenv("SESSION_SECRET"); envSecret != "" && config.SessionSecret == "" {
+		config.SessionSecret = envSecret
+	}
+
+	if envOrigins := os.Getenv("SESSION_ORIGINS"); envOrigins != "" && config.SessionOrigins == "" {
+		config.SessionOrigins = envOrigins
+	}
+
+	if envWarmup := os.Getenv("WARMUP_TARGETS"); envWarmup != "" && config.WarmupTargets == "" {
+		config.WarmupTargets = envWarmup
+	}
+
+	if envIdle := os.Getenv("WARMUP_IDLE"); envIdle != "" && config.WarmupIdle == 0 {
+		idle, err := strconv.Atoi(envIdle)
+		if err != nil {
+			log.Printf("Warning: Invalid value for WARMUP_IDLE, ignoring")
+		} else {
+			config.WarmupIdle = idle
+		}
+	}
+
+	if envStrip := os.Getenv("STRIP_RESPONSE_HEADERS"); envStrip != "" && config.StripResponseHeaders == "" {
+		config.StripResponseHeaders = envStrip
+	}
+
+	if envAllow := os.Getenv("ALLOW_RESPONSE_HEADERS"); envAllow != "" && config.AllowResponseHeaders == "" {
+		config.AllowResponseHeaders = envAllow
+	}
+
+	if envUA := os.Getenv("UPSTREAM_USER_AGENT"); envUA != "" && config.UserAgent == "" {
+		config.UserAgent = envUA
+	}
+
+	if envHeaders := os.Getenv("UPSTREAM_HEADERS_FILE"); envHeaders != "" && config.UpstreamHeadersFile == "" {
+		config.UpstreamHeadersFile = envHeaders
+	}
+
+	if envRouting := os.Getenv("ROUTING_DEFAULTS_FILE"); envRouting != "" && config.RoutingDefaultsFile == "" {
+		config.RoutingDefaultsFile = envRouting
+	}
+
+	if envHosts := os.Getenv("ROUTING_HINT_HOSTS"); envHosts != "" && config.RoutingHintHosts == "" {
+		config.RoutingHintHosts = envHosts
+	}
+
+	if envTurns := os.Getenv("MEMORY_TURNS"); envTurns != "" && config.MemoryTurns == 0 {
+		turns, err := strconv.Atoi(envTurns)
+		if err != nil {
+			log.Printf("Warning: Invalid value for MEMORY_TURNS, ignoring")
+		} else {
+			config.MemoryTurns = turns
+		}
+	}
+
+	if envTokens := os.Getenv("MEMORY_TOKENS"); envTokens != "" && config.MemoryTokens == 0 {
+		tokens, err := strconv.Atoi(envTokens)
+		if err != nil {
+			log.Printf("Warning: Invalid value for MEMORY_TOKENS, ignoring")
+		} else {
+			config.MemoryTokens = tokens
+		}
+	}
+
+	if envHeader := os.Getenv("MEMORY_HEADER"); envHeader != "" && config.MemoryHeader == "" {
+		config.MemoryHeader = envHeader
+	}
+
+	if envTTL := os.Getenv("MEMORY_TTL"); envTTL != "" && config.MemoryTTL == 0 {
+		ttl, err := strconv.Atoi(envTTL)
+		if err != nil {
+			log.Printf("Warning: Invalid value for MEMORY_TTL, ignoring")
+		} else {
+			config.MemoryTTL = ttl
+		}
+	}
+
+	if envPost := os.Getenv("POSTPROCESS_FILE"); envPost != "" && config.PostProcessFile == "" {
+		config.PostProcessFile = envPost
+	}
+
+	if envFeeds := os.Getenv("STATUS_FEEDS"); envFeeds != "" && config.StatusFeeds == "" {
+		config.StatusFeeds = envFeeds
+	}
+
+	if envInterval := os.Getenv("STATUS_INTERVAL"); envInterval != "" && config.StatusInterval == 0 {
+		interval, err := strconv.Atoi(envInterval)
+		if err != nil {
+			log.Printf("Warning: Invalid value for STATUS_INTERVAL, ignoring")
+		} else {
+			config.StatusInterval = interval
+		}
+	}
+
+	if envFallbacks := os.Getenv("STATUS_FALLBACKS"); envFallbacks != "" && config.StatusFallbacks == "" {
+		config.StatusFallbacks = envFallbacks
+	}
+
+	if envLevel := os.Getenv("STATUS_FAILOVER_LEVEL"); envLevel != "" && config.StatusFailoverLevel == "" {
+		config.StatusFailoverLevel = envLevel
+	}
+
+	if envExec := os.Getenv("EXEC_ON_REQUEST"); envExec != "" && config.ExecOnRequest == "" {
+		config.ExecOnRequest = envExec
+	}
+
+	if envExec := os.Getenv("EXEC_ON_RESPONSE"); envExec != "" && config.ExecOnResponse == "" {
+		config.ExecOnResponse = envExec
+	}
+
+	if envExec := os.Getenv("EXEC_ON_ERROR"); envExec != "" && config.ExecOnError == "" {
+		config.ExecOnError = envExec
+	}
+
+	if envTimeout := os.Getenv("EXEC_HOOK_TIMEOUT"); envTimeout != "" && config.ExecHookTimeout == 0 {
+		timeout, err := strconv.Atoi(envTimeout)
+		if err != nil {
+			log.Printf("Warning: Invalid value for EXEC_HOOK_TIMEOUT, ignoring")
+		} else {
+			config.ExecHookTimeout = timeout
+		}
+	}
+
+	if envWait := os.Getenv("RATE_LIMIT_MAX_WAIT"); envWait != "" && config.RateLimitMaxWait == 0 {
+		wait, err := strconv.Atoi(envWait)
+		if err != nil {
+			log.Printf("Warning: Invalid value for RATE_LIMIT_MAX_WAIT, ignoring")
+		} else {
+			config.RateLimitMaxWait = wait
+		}
+	}
+
+	if envPacing := os.Getenv("PACING_FILE"); envPacing != "" && config.PacingFile == "" {
+		config.PacingFile = envPacing
+	}
+
+	if envRecord := os.Getenv("RECORD_FILE"); envRecord != "" && config.RecordFile == "" {
+		config.RecordFile = envRecord
+	}
+
+	if envTranscripts := os.Getenv("TRANSCRIPT_DIR"); envTranscripts != "" && config.TranscriptDir == "" {
+		config.TranscriptDir = envTranscripts
+	}
+
+	if config.Port == "" {
+		config.Port = "8080"
+	}
+
+	config.ApplyDefaults()
+
+	return config
+}
+
+// ApplyDefaults fills in unset values and normalises the log format and base
+// URL. Load calls it; callers building a Config by hand get it from
+// proxy.NewServer.
+func (c *Config) ApplyDefaults() {
+	switch c.LogFormat {
+	case logging.FormatText, logging.FormatJSON:
+	case "jsonl":
+		c.LogFormat = logging.FormatJSON
+	case "":
+		c.LogFormat = logging.FormatText
+		if strings.HasSuffix(c.RequestLogFile, ".jsonl") {
+			c.LogFormat = logging.FormatJSON
+		}
+	default:
+		log.Printf("Warning: Invalid value for LOG_FORMAT, using default: %s", logging.FormatText)
+		c.LogFormat = logging.FormatText
+	}
+
+	switch c.StreamLogMode {
+	case logging.StreamRaw, logging.StreamDeltas, logging.StreamFinal:
+	case "":
+		c.StreamLogMode = logging.StreamRaw
+	default:
+		log.Printf("Warning: Invalid value for STREAM_LOG_MODE, using default: %s", logging.StreamRaw)
+		c.StreamLogMode = logging.StreamRaw
+	}
+
+	if c.LogRequestLimit == 0 {
+		c.LogRequestLimit = logging.DefaultRequestLimit
+	}
+	if c.LogResponseLimit == 0 {
+		c.LogResponseLimit = logging.DefaultResponseLimit
+	}
+	if c.LogNoTruncate {
+		c.LogRequestLimit, c.LogResponseLimit = -1, -1
+	}
+
+	if c.ChunkSize <= 0 {
+		c.ChunkSize = DefaultChunkSize
+	}
+
+	if c.SpillThreshold == 0 {
+		c.SpillThreshold = 1 << 20
+	}
+
+	if c.SpillDir == "" {
+		c.SpillDir = os.TempDir()
+	}
+
+	if c.OpenAIBaseURL == "" {
+		c.OpenAIBaseURL = "https://api.openai.com/v1"
+	} else {
+		c.OpenAIBaseURL = strings.TrimSuffix(c.OpenAIBaseURL, "/")
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"t-oai-api/logging"
+)
+
+// credentialHeaders are redacted from the headers in an export bundle, so
+// reviewers do not receive working API keys.
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "Api-Key", "X-Api-Key", "Cookie", "Set-Cookie"}
+
+var unsafeBundleChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// bundleManifest is manifest.json in an export bundle.
+type bundleManifest struct {
+	Created   time.Time         `json:"created"`
+	From      *time.Time        `json:"from,omitempty"`
+	To        *time.Time        `json:"to,omitempty"`
+	Sources   []string          `json:"sources"`
+	Exchanges []*bundleExchange `json:"exchanges"`
+	Files     []bundleFile      `json:"files"`
+	// Errors lists bodies that could not be read back, such as spilled
+	// files deleted since they were logged.
+	Errors []string `json:"errors,omitempty"`
+	Signed bool     `json:"signed"`
+}
+
+type bundleExchange struct {
+	ID        string    `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Method    string    `json:"method,omitempty"`
+	Path      string    `json:"path,omitempty"`
+	Status    string    `json:"status,omitempty"`
+	LatencyMs float64   `json:"latency_ms,omitempty"`
+	Erased    bool      `json:"erased,omitempty"`
+	Files     []string  `json:"files"`
+}
+
+type bundleFile struct {
+	Path   string `json:"path"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// bundleWriter adds read-only files to a tar archive, recording their
+// checksums.
+type bundleWriter struct {
+	tw    *tar.Writer
+	files []bundleFile
+}
+
+func (b *bundleWriter) add(name string, data []byte, modTime time.Time) error {
+	if err := b.tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0444,
+		Size:    int64(len(data)),
+		ModTime: modTime,
+		Format:  tar.FormatPAX,
+	}); err != nil {
+		return err
+	}
+	if _, err := b.tw.Write(data); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	b.files = append(b.files, bundleFile{Path: name, Size: len(data), SHA256: hex.EncodeToString(sum[:])})
+	return nil
+}
+
+// runExport implements the export subcommand.
+func runExport(args []string) error {
+	if len(args) == 0 || args[0] != "bundle" {
+		return fmt.Errorf("usage: %s export bundle [flags] -o <bundle.tar.gz>", os.Args[0])
+	}
+	return runExportBundle(args[1:])
+}
+
+// runExportBundle writes the logged exchanges in a date range, with their
+// full bodies, to a gzipped tar archive with a manifest, a SHA256SUMS file,
+// and optionally an Ed25519 signature over the checksums.
+func runExportBundle(args []string) error {
+	fs := flag.NewFlagSet("export bundle", flag.ExitOnError)
+	logTemplate := fs.String("log", os.Getenv("REQUEST_LOG_FILE"), "Request log file or template to export from")
+	from := fs.String("from", "", "Export exchanges from this date (YYYY-MM-DD) or RFC 3339 time")
+	to := fs.String("to", "", "Export exchanges up to and including this date (YYYY-MM-DD), or before this RFC 3339 time")
+	out := fs.String("o", "", "Bundle file to create; it must not exist")
+	signKey := fs.String("sign", "", "PEM Ed25519 private key (PKCS #8) to sign the bundle with")
+	fs.Parse(args)
+	if *out == "" || *logTemplate == "" || fs.NArg() != 0 {
+		return fmt.Errorf("usage: %s export bundle [-log file] [-from date] [-to date] [-sign key.pem] -o <bundle.tar.gz>", os.Args[0])
+	}
+
+	manifest := &bundleManifest{Created: time.Now().UTC(), Exchanges: []*bundleExchange{}}
+	var err error
+	if manifest.From, err = parseBundleTime(*from, false); err != nil {
+		return err
+	}
+	if manifest.To, err = parseBundleTime(*to, true); err != nil {
+		return err
+	}
+	var key ed25519.PrivateKey
+	if *signKey != "" {
+		if key, err = loadSigningKey(*signKey); err != nil {
+			return err
+		}
+		manifest.Signed = true
+	}
+
+	sources, err := (&logging.RequestLogger{Template: *logTemplate}).Files()
+	if err != nil {
+		return err
+	}
+	sort.Strings(sources)
+	manifest.Sources = sources
+	if len(sources) == 0 {
+		return fmt.Errorf("no log files match %s", *logTemplate)
+	}
+
+	// The request entry dates an exchange; its response follows it in the
+	// logs, possibly in the next day's file.
+	inRange := make(map[string]bool)
+	for _, path := range sources {
+		err := logging.ReadLog(path, func(e *logging.StoredEntry) error {
+			if e.Type == "request" && manifest.includes(e.Time) {
+				inRange[e.ID] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+	}
+
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0444)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	gz := gzip.NewWriter(io.MultiWriter(f, hash))
+	b := &bundleWriter{tw: tar.NewWriter(gz)}
+	err = writeBundle(b, manifest, inRange, key)
+	if err == nil {
+		err = b.tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(*out)
+		return err
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	sidecar := fmt.Sprintf("%s  %s\n", sum, *out)
+	if err := os.WriteFile(*out+".sha256", []byte(sidecar), 0444); err != nil {
+		return err
+	}
+	fmt.Printf("Exported %d exchanges to %s\n", len(manifest.Exchanges), *out)
+	if len(manifest.Errors) > 0 {
+		fmt.Printf("%d bodies could not be read; see errors in manifest.json\n", len(manifest.Errors))
+	}
+	fmt.Printf("sha256 %s\n", sum)
+	return nil
+}
+
+// writeBundle adds the exchanges in inRange, then the manifest, checksums,
+// and signature.
+func writeBundle(b *bundleWriter, manifest *bundleManifest, inRange map[string]bool, key ed25519.PrivateKey) error {
+	exchanges := make(map[string]*bundleExchange)
+	for _, path := range manifest.Sources {
+		err := logging.ReadLog(path, func(e *logging.StoredEntry) error {
+			if !inRange[e.ID] || (e.Type != "request" && e.Type != "response") {
+				return nil
+			}
+			ex, ok := exchanges[e.ID]
+			if !ok {
+				ex = &bundleExchange{ID: e.ID, Timestamp: e.Time}
+				exchanges[e.ID] = ex
+				manifest.Exchanges = append(manifest.Exchanges, ex)
+			}
+
+			meta := e.Metadata()
+			for name := range meta.Headers {
+				for _, credential := range credentialHeaders {
+					if strings.EqualFold(name, credential) {
+						meta.Headers[name] = []string{"[redacted]"}
+					}
+				}
+			}
+			if e.Type == "request" {
+				ex.Method, ex.Path = meta.Method, meta.Path
+			} else {
+				ex.Status, ex.LatencyMs = meta.Status, meta.LatencyMs
+			}
+			ex.Erased = ex.Erased || meta.Erased
+
+			body, err := e.ReadBody()
+			if err != nil {
+				manifest.Errors = append(manifest.Errors, fmt.Sprintf("%s %s body: %v", e.ID, e.Type, err))
+			} else if meta.BodySize == 0 {
+				// Text logs do not record the size of inlined bodies.
+				meta.BodySize = int64(len(body))
+			}
+
+			dir := "exchanges/" + unsafeBundleChars.ReplaceAllString(e.ID, "_") + "/"
+			data, err := json.MarshalIndent(meta, "", "  ")
+			if err != nil {
+				return err
+			}
+			if err := b.add(dir+e.Type+".json", data, e.Time); err != nil {
+				return err
+			}
+			ex.Files = append(ex.Files, dir+e.Type+".json")
+			if len(body) > 0 {
+				if err := b.add(dir+e.Type+".body", body, e.Time); err != nil {
+					return err
+				}
+				ex.Files = append(ex.Files, dir+e.Type+".body")
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+	}
+
+	manifest.Files = b.files
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := b.add("manifest.json", data, manifest.Created); err != nil {
+		return err
+	}
+
+	// SHA256SUMS covers every file before it, in sha256sum -c format.
+	var sums strings.Builder
+	for _, file := range b.files {
+		fmt.Fprintf(&sums, "%s  %s\n", file.SHA256, file.Path)
+	}
+	if err := b.add("SHA256SUMS", []byte(sums.String()), manifest.Created); err != nil {
+		return err
+	}
+	if key == nil {
+		return nil
+	}
+	if err := b.add("SHA256SUMS.sig", ed25519.Sign(key, []byte(sums.String())), manifest.Created); err != nil {
+		return err
+	}
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return err
+	}
+	return b.add("signing-key.pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}), manifest.Created)
+}
+
+// includes reports whether t falls in the manifest's date range.
+func (m *bundleManifest) includes(t time.Time) bool {
+	return (m.From == nil || !t.Before(*m.From)) && (m.To == nil || t.Before(*m.To))
+}
+
+// parseBundleTime parses a -from or -to value. A date as an upper bound means
+// the end of that day, local time.
+func parseBundleTime(value string, end bool) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return &t, nil
+	}
+	t, err := time.ParseInLocation(time.DateOnly, value, time.Local)
+	if err != nil {
+		return nil, fmt.Errorf("invalid date %q: want YYYY-MM-DD or an RFC 3339 time", value)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return &t, nil
+}
+
+// loadSigningKey reads an Ed25519 private key, as written by
+// `openssl genpkey -algorithm ed25519`.
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("signing key %s is not PEM", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing key: %w", err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key %s is not an Ed25519 key", path)
+	}
+	return key, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"t-oai-api/config"
+	"t-oai-api/internal/fakeupstream"
+	"t-oai-api/proxy"
+)
+
+// logExchanges proxies a chat completion per ID to a fake upstream and
+// returns the request log they were written to.
+func logExchanges(t *testing.T, ids ...string) string {
+	t.Helper()
+	upstream := fakeupstream.New()
+	defer upstream.Close()
+
+	logFile := filepath.Join(t.TempDir(), "requests.jsonl")
+	server, err := proxy.NewServer(config.Config{
+		OpenAIBaseURL:  upstream.URL + "/v1",
+		OpenAIAPIKey:   "sk-secret",
+		LogRequests:    true,
+		LogResponses:   true,
+		RequestLogFile: logFile,
+		SpillDir:       t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	front := httptest.NewServer(server)
+	for _, id := range ids {
+		req, _ := http.NewRequest(http.MethodPost, front.URL+"/chat/completions",
+			strings.NewReader(`{"model":"gpt-test","messages":[{"role":"user","content":"`+id+`"}]}`))
+		req.Header.Set("X-Request-ID", id)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	front.Close()
+	server.Close()
+	return logFile
+}
+
+// readBundle returns the files of a gzipped tar archive by name.
+func readBundle(t *testing.T, path string) map[string][]byte {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = data
+	}
+}
+
+func TestExportBundle(t *testing.T) {
+	logFile := logExchanges(t, "req-a", "req-b")
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "export-key.pem")
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+
+	out := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	if err := runExportBundle([]string{"-log", logFile, "-sign", keyFile, "-o", out}); err != nil {
+		t.Fatalf("export bundle: %v", err)
+	}
+
+	// The sidecar checksum covers the archive as written.
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sidecar, err := os.ReadFile(out + ".sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	if want := hex.EncodeToString(sum[:]) + "  " + out + "\n"; string(sidecar) != want {
+		t.Errorf("sidecar = %q, want %q", sidecar, want)
+	}
+
+	// Every file before SHA256SUMS is listed in it with its checksum.
+	files := readBundle(t, out)
+	sums := files["SHA256SUMS"]
+	listed := 0
+	scanner := bufio.NewScanner(bytes.NewReader(sums))
+	for scanner.Scan() {
+		want, name, ok := strings.Cut(scanner.Text(), "  ")
+		if !ok {
+			t.Fatalf("malformed SHA256SUMS line %q", scanner.Text())
+		}
+		sum := sha256.Sum256(files[name])
+		if got := hex.EncodeToString(sum[:]); got != want {
+			t.Errorf("%s: sha256 %s, SHA256SUMS says %s", name, got, want)
+		}
+		listed++
+	}
+	if listed != len(files)-3 {
+		t.Errorf("SHA256SUMS lists %d of %d files", listed, len(files))
+	}
+
+	// The signature verifies with the included key and no longer does once
+	// the checksums are altered.
+	block, _ := pem.Decode(files["signing-key.pub"])
+	if block == nil {
+		t.Fatal("signing-key.pub is not PEM")
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := parsed.(ed25519.PublicKey)
+	if !pub.Equal(key.Public()) {
+		t.Error("bundle carries a different public key")
+	}
+	if !ed25519.Verify(pub, sums, files["SHA256SUMS.sig"]) {
+		t.Error("signature does not verify")
+	}
+	if ed25519.Verify(pub, bytes.Replace(sums, []byte("request"), []byte("Request"), 1), files["SHA256SUMS.sig"]) {
+		t.Error("signature verifies altered checksums")
+	}
+
+	var manifest bundleManifest
+	if err := json.Unmarshal(files["manifest.json"], &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Exchanges) != 2 || !manifest.Signed || len(manifest.Errors) != 0 {
+		t.Errorf("manifest = %s", files["manifest.json"])
+	}
+	if body := string(files["exchanges/req-b/response.body"]); !strings.Contains(body, "echo: req-b") {
+		t.Errorf("response body = %q", body)
+	}
+	if meta := string(files["exchanges/req-a/request.json"]); strings.Contains(meta, "sk-secret") {
+		t.Errorf("request metadata leaks the API key: %s", meta)
+	}
+
+	// An existing bundle is never overwritten.
+	if err := runExportBundle([]string{"-log", logFile, "-o", out}); err == nil {
+		t.Error("export overwrote an existing bundle")
+	}
+}
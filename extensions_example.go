@@ -0,0 +1,40 @@
+//go:build example
+
+// This file shows how to compile custom routing and transform logic into the
+// proxy binary. It is only built with `go build -tags example`; copy it to a
+// file guarded by your own build tag and register your extensions from init.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+
+	"t-oai-api/proxy"
+)
+
+func init() {
+	// Send embeddings to a dedicated deployment when EMBEDDINGS_BASE_URL is set.
+	proxy.RegisterRouter(proxy.RouterFunc(func(r *http.Request, body []byte) (string, error) {
+		if strings.HasSuffix(r.URL.Path, "/embeddings") {
+			return os.Getenv("EMBEDDINGS_BASE_URL"), nil
+		}
+		return "", nil
+	}))
+
+	// Require callers to identify their team.
+	proxy.RegisterRequestHook(proxy.RequestHookFunc(func(r *http.Request, body []byte) ([]byte, error) {
+		if r.Header.Get("X-Team") == "" {
+			return nil, errors.New("missing X-Team header")
+		}
+		return nil, nil
+	}))
+
+	// Hide the upstream organization from clients.
+	proxy.RegisterResponseHook(proxy.ResponseHookFunc(func(r *http.Request, resp *http.Response) error {
+		resp.Header.Del("Openai-Organization")
+		return nil
+	}))
+}
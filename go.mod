@@ -2,4 +2,9 @@ module t-oai-api
 
 go 1.24.1
 
-require github.com/joho/godotenv v1.5.1
+require (
+	github.com/joho/godotenv v1.5.1
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/sys v0.31.0
+	golang.org/x/term v0.30.0
+)
@@ -0,0 +1,293 @@
+// Package fakeupstream is an in-process stand-in for the OpenAI API used by
+// the integration tests. It answers chat completions (plain and streamed) and
+// embeddings deterministically, records every request it receives, and can be
+// told to fail or slow down.
+package fakeupstream
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Request is a request as received by the upstream.
+type Request struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   []byte
+}
+
+// Failure is a canned error response.
+type Failure struct {
+	Status  int
+	Message string
+	Header  http.Header
+}
+
+// Upstream is a fake OpenAI API server.
+type Upstream struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []Request
+	failures []Failure
+	latency  time.Duration
+	maxBatch int
+	gzip     bool
+}
+
+// New starts a fake upstream. Callers must Close it.
+func New() *Upstream {
+	u := &Upstream{}
+	u.Server = httptest.NewServer(http.HandlerFunc(u.serve))
+	return u
+}
+
+// Requests returns a copy of every request received so far.
+func (u *Upstream) Requests() []Request {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]Request(nil), u.requests...)
+}
+
+// FailNext queues an error response for the next request. Queued failures are
+// served in order before normal handling resumes.
+func (u *Upstream) FailNext(f Failure) {
+	u.mu.Lock()
+	u.failures = append(u.failures, f)
+	u.mu.Unlock()
+}
+
+// SetLatency delays every response by d before the first byte is written.
+func (u *Upstream) SetLatency(d time.Duration) {
+	u.mu.Lock()
+	u.latency = d
+	u.mu.Unlock()
+}
+
+// SetMaxBatch makes embeddings requests with more than n inputs fail with the
+// 400 OpenAI returns for oversized batches. Zero disables the limit.
+func (u *Upstream) SetMaxBatch(n int) {
+	u.mu.Lock()
+	u.maxBatch = n
+	u.mu.Unlock()
+}
+
+// SetGzip makes the upstream gzip its responses to requests that accept it.
+func (u *Upstream) SetGzip(enabled bool) {
+	u.mu.Lock()
+	u.gzip = enabled
+	u.mu.Unlock()
+}
+
+// gzipWriter compresses a response, flushing with it for streams.
+type gzipWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+}
+
+func (g *gzipWriter) Write(b []byte) (int, error) {
+	return g.gz.Write(b)
+}
+
+func (g *gzipWriter) Flush() {
+	g.gz.Flush()
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (u *Upstream) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	u.mu.Lock()
+	u.requests = append(u.requests, Request{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Header: r.Header.Clone(),
+		Body:   body,
+	})
+	latency := u.latency
+	maxBatch := u.maxBatch
+	compress := u.gzip && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip")
+	var failure *Failure
+	if len(u.failures) > 0 {
+		failure = &u.failures[0]
+		u.failures = u.failures[1:]
+	}
+	u.mu.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if compress {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		w = &gzipWriter{ResponseWriter: w, gz: gz}
+	}
+
+	if failure != nil {
+		for name, values := range failure.Header {
+			w.Header()[name] = values
+		}
+		writeError(w, failure.Status, failure.Message)
+		return
+	}
+
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/chat/completions"):
+		u.chatCompletions(w, body)
+	case strings.HasSuffix(r.URL.Path, "/embeddings"):
+		u.embeddings(w, body, maxBatch)
+	default:
+		writeError(w, http.StatusNotFound, "unknown endpoint "+r.URL.Path)
+	}
+}
+
+type chatRequest struct {
+	Model    string `json:"model"`
+	Stream   bool   `json:"stream"`
+	Messages []struct {
+		Role    string `json:"role"`
+		Content string `json:"content"`
+	} `json:"messages"`
+}
+
+// chatCompletions replies with "echo: " followed by the last message content,
+// streamed one word per chunk when the request asks for a stream.
+func (u *Upstream) chatCompletions(w http.ResponseWriter, body []byte) {
+	var req chatRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if req.Model == "" {
+		req.Model = "gpt-test"
+	}
+	reply := "echo:"
+	if n := len(req.Messages); n > 0 {
+		reply += " " + req.Messages[n-1].Content
+	}
+	words := strings.Fields(reply)
+	usage := map[string]int{
+		"prompt_tokens":     len(req.Messages),
+		"completion_tokens": len(words),
+		"total_tokens":      len(req.Messages) + len(words),
+	}
+
+	if !req.Stream {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"id":     "chatcmpl-fake",
+			"object": "chat.completion",
+			"model":  req.Model,
+			"choices": []any{map[string]any{
+				"index":         0,
+				"message":       map[string]string{"role": "assistant", "content": reply},
+				"finish_reason": "stop",
+			}},
+			"usage": usage,
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	for i, word := range words {
+		if i > 0 {
+			word = " " + word
+		}
+		writeEvent(w, map[string]any{
+			"id":      "chatcmpl-fake",
+			"object":  "chat.completion.chunk",
+			"model":   req.Model,
+			"choices": []any{map[string]any{"index": 0, "delta": map[string]string{"content": word}}},
+		})
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	writeEvent(w, map[string]any{
+		"id":      "chatcmpl-fake",
+		"object":  "chat.completion.chunk",
+		"model":   req.Model,
+		"choices": []any{},
+		"usage":   usage,
+	})
+	fmt.Fprint(w, "data: [DONE]\n\n")
+}
+
+// Vector is the embedding the upstream returns for an input: its length in
+// bytes and a constant marker, so tests can check which input a vector
+// belongs to.
+func Vector(input string) []float64 {
+	return []float64{float64(len(input)), 0.5}
+}
+
+func (u *Upstream) embeddings(w http.ResponseWriter, body []byte, maxBatch int) {
+	var req struct {
+		Model string          `json:"model"`
+		Input json.RawMessage `json:"input"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	var inputs []string
+	if err := json.Unmarshal(req.Input, &inputs); err != nil {
+		var single string
+		if err := json.Unmarshal(req.Input, &single); err != nil {
+			writeError(w, http.StatusBadRequest, "input must be a string or an array of strings")
+			return
+		}
+		inputs = []string{single}
+	}
+	if maxBatch > 0 && len(inputs) > maxBatch {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Too many inputs. The max number of inputs is %d.", maxBatch))
+		return
+	}
+
+	data := make([]any, len(inputs))
+	for i, input := range inputs {
+		data[i] = map[string]any{"object": "embedding", "index": i, "embedding": Vector(input)}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"object": "list",
+		"data":   data,
+		"model":  req.Model,
+		"usage":  map[string]int{"prompt_tokens": len(inputs), "total_tokens": len(inputs)},
+	})
+}
+
+func writeEvent(w io.Writer, v any) {
+	data, _ := json.Marshal(v)
+	fmt.Fprintf(w, "data: %s\n\n", data)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]any{
+		"error": map[string]any{
+			"message": message,
+			"type":    "invalid_request_error",
+		},
+	})
+}
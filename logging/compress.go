@@ -0,0 +1,227 @@
+package logging
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdMagic is the frame header every zstd stream starts with.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// zstdEncoder is shared by all writers; EncodeAll is safe for concurrent use.
+var zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+
+// compressEntry encodes a single log entry as an independent zstd frame.
+// Frames can be appended to an existing file and still decode as one stream.
+func compressEntry(entry []byte) []byte {
+	return zstdEncoder.EncodeAll(entry, nil)
+}
+
+// compressFile replaces src with a zstd-compressed copy at dst.
+func compressFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	enc, err := zstd.NewWriter(out)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	if _, err := io.Copy(enc, in); err != nil {
+		enc.Close()
+		out.Close()
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// OpenLogReader opens a log or spilled body file, transparently decompressing
+// any part of it that was written with compression enabled. A log that was
+// appended to both with and without compression, for example across restarts
+// with a different LOG_COMPRESS, reads back as one plain stream.
+func OpenLogReader(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &decodingReader{br: bufio.NewReader(f), file: f}, nil
+}
+
+// decodingReader reads a file made of plain text lines and zstd frames,
+// each frame starting where a line or another frame ends.
+type decodingReader struct {
+	br   *bufio.Reader
+	file *os.File
+	dec  *zstd.Decoder
+	// cur is the rest of the current line or frame.
+	cur io.Reader
+	// midLine is set while a line longer than br's buffer is being read.
+	midLine bool
+}
+
+func (r *decodingReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur != nil {
+			n, err := r.cur.Read(p)
+			if err == io.EOF {
+				r.cur = nil
+				if n == 0 {
+					continue
+				}
+				err = nil
+			}
+			return n, err
+		}
+
+		header, err := r.br.Peek(len(zstdMagic))
+		if r.midLine || !bytes.Equal(header, zstdMagic) {
+			line, err := r.br.ReadSlice('\n')
+			r.midLine = err == bufio.ErrBufferFull
+			if len(line) == 0 {
+				return 0, err
+			}
+			n := copy(p, line)
+			if n < len(line) {
+				r.cur = bytes.NewReader(line[n:])
+			}
+			return n, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if r.dec == nil {
+			r.dec, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return 0, err
+			}
+		}
+		if err := r.dec.Reset(&frameReader{r: r.br}); err != nil {
+			return 0, fmt.Errorf("failed to open zstd stream: %w", err)
+		}
+		r.cur = r.dec
+	}
+}
+
+func (r *decodingReader) Close() error {
+	if r.dec != nil {
+		r.dec.Close()
+	}
+	return r.file.Close()
+}
+
+// frameReader yields the bytes of the single zstd frame r is positioned at
+// and then io.EOF, leaving r at whatever follows the frame.
+type frameReader struct {
+	r *bufio.Reader
+	// pending holds header bytes already read from r.
+	pending []byte
+	// content is how many bytes of the current block are left.
+	content  int64
+	started  bool
+	last     bool
+	checksum bool
+	done     bool
+}
+
+func (f *frameReader) Read(p []byte) (int, error) {
+	for len(f.pending) == 0 && f.content == 0 {
+		if f.done {
+			return 0, io.EOF
+		}
+		if err := f.next(); err != nil {
+			return 0, err
+		}
+	}
+	if len(f.pending) > 0 {
+		n := copy(p, f.pending)
+		f.pending = f.pending[n:]
+		return n, nil
+	}
+	if int64(len(p)) > f.content {
+		p = p[:f.content]
+	}
+	n, err := f.r.Read(p)
+	f.content -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// next reads the frame header, the next block header, or the trailing
+// checksum, as described in RFC 8878.
+func (f *frameReader) next() error {
+	switch {
+	case !f.started:
+		f.started = true
+		if err := f.read(len(zstdMagic) + 1); err != nil {
+			return err
+		}
+		descriptor := f.pending[len(zstdMagic)]
+		singleSegment := descriptor&0x20 != 0
+		f.checksum = descriptor&0x04 != 0
+		size := []int{0, 1, 2, 4}[descriptor&0x03]
+		size += []int{0, 2, 4, 8}[descriptor>>6]
+		if !singleSegment {
+			size++ // window descriptor
+		} else if descriptor>>6 == 0 {
+			size++ // one-byte content size
+		}
+		return f.read(size)
+	case !f.last:
+		if err := f.read(3); err != nil {
+			return err
+		}
+		h := f.pending[len(f.pending)-3:]
+		header := uint32(h[0]) | uint32(h[1])<<8 | uint32(h[2])<<16
+		f.last = header&1 != 0
+		switch blockType := header >> 1 & 3; blockType {
+		case 1: // RLE: one byte repeated
+			f.content = 1
+		case 3:
+			return fmt.Errorf("invalid zstd block type")
+		default:
+			f.content = int64(header >> 3)
+		}
+		return nil
+	default:
+		f.done = true
+		if f.checksum {
+			return f.read(4)
+		}
+		return nil
+	}
+}
+
+// read appends n bytes from r to pending.
+func (f *frameReader) read(n int) error {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(f.r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	f.pending = append(f.pending, buf...)
+	return nil
+}
@@ -0,0 +1,75 @@
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestReadLogMixedCompression(t *testing.T) {
+	line := func(id, body string) []byte {
+		return []byte(fmt.Sprintf(`{"type":"request","id":%q,"body":%q}`+"\n", id, body))
+	}
+	// A line longer than the reader's buffer, and one zstd stores as an
+	// RLE block.
+	long := strings.Repeat("0123456789abcdef", 1024)
+	runs := strings.Repeat("a", 512) + "\n"
+
+	var file, plain bytes.Buffer
+	write := func(data []byte, compressed bool) {
+		plain.Write(data)
+		if compressed {
+			data = compressEntry(data)
+		}
+		file.Write(data)
+	}
+	write(line("plain-1", "hi"), false)
+	write(line("frame-1", long), true)
+	write([]byte(runs), true)
+	write(line("plain-2", long), false)
+	enc, _ := zstd.NewWriter(&file, zstd.WithEncoderCRC(true))
+	enc.Write(line("stream-1", "bye"))
+	enc.Close()
+	plain.Write(line("stream-1", "bye"))
+
+	dir := t.TempDir()
+	l := &RequestLogger{Template: filepath.Join(dir, "requests-{date}.jsonl")}
+	os.WriteFile(filepath.Join(dir, "requests-2026-01-01.jsonl"), line("old", ""), 0644)
+	os.WriteFile(filepath.Join(dir, "requests-2026-01-02.jsonl.zst"), file.Bytes(), 0644)
+
+	files, err := l.Files()
+	if err != nil || len(files) != 2 {
+		t.Fatalf("Files() = %v, %v", files, err)
+	}
+	r, err := OpenLogReader(files[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(got, plain.Bytes()) {
+		t.Fatalf("read %d bytes (%v), want %d", len(got), err, plain.Len())
+	}
+
+	var ids []string
+	err = ReadLog(files[1], func(e *StoredEntry) error {
+		ids = append(ids, e.ID)
+		if body, _ := e.ReadBody(); e.ID == "frame-1" && string(body) != long {
+			t.Errorf("frame-1 body is %d bytes", len(body))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"plain-1", "frame-1", "plain-2", "stream-1"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("read %v, want %v", ids, want)
+	}
+}
@@ -0,0 +1,341 @@
+package logging
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// StoredEntry is a log entry read back from a log file in either format.
+type StoredEntry struct {
+	Type string
+	ID   string
+	Time time.Time
+	// Raw is the entry as written: a JSON line, or a text block including
+	// the blank line that ends it.
+	Raw []byte
+	// JSON reports whether Raw is a JSON line.
+	JSON bool
+	// Body is the inlined body, truncated if the entry was.
+	Body         []byte
+	BodyFile     string
+	OverflowFile string
+}
+
+// ReadBody returns the entry's body in full, reading back spilled and overflow
+// files.
+func (e *StoredEntry) ReadBody() ([]byte, error) {
+	body := e.Body
+	if e.BodyFile != "" {
+		return ReadStoredFile(e.BodyFile)
+	}
+	if e.OverflowFile != "" {
+		rest, err := ReadStoredFile(e.OverflowFile)
+		if err != nil {
+			return body, err
+		}
+		body = append(append([]byte(nil), body...), rest...)
+	}
+	return body, nil
+}
+
+// ReadStoredFile reads a spilled body or overflow file, decompressing it if
+// needed.
+func ReadStoredFile(path string) ([]byte, error) {
+	r, err := OpenLogReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// Metadata returns the entry without its body. Text entries carry no body
+// size, and their latency is rounded as the block shows it.
+func (e *StoredEntry) Metadata() LogEntry {
+	if e.JSON {
+		var entry LogEntry
+		if json.Unmarshal(e.Raw, &entry) == nil {
+			entry.Body = nil
+			return entry
+		}
+	}
+
+	entry := LogEntry{Type: e.Type, ID: e.ID, Timestamp: e.Time, BodyFile: e.BodyFile, OverflowFile: e.OverflowFile}
+	lines := strings.Split(string(e.Raw), "\n")
+	if _, latency, ok := strings.Cut(lines[0], "(Latency: "); ok {
+		if d, err := time.ParseDuration(strings.TrimSuffix(latency, ") ====")); err == nil {
+			entry.LatencyMs = float64(d.Microseconds()) / 1000
+		}
+	}
+	if len(lines) > 1 {
+		fields := strings.SplitN(lines[1], " ", 3)
+		if e.Type == "request" && len(fields) == 3 {
+			entry.Method, entry.Path, entry.Proto = fields[0], fields[1], fields[2]
+		} else if len(fields) >= 2 {
+			entry.Proto, entry.Status = fields[0], strings.Join(fields[1:], " ")
+		}
+	}
+	for _, line := range lines[2:] {
+		if line == "(erased)" {
+			entry.Erased = true
+		}
+		if line == "Headers:" {
+			continue
+		}
+		header, ok := strings.CutPrefix(line, "  ")
+		if !ok {
+			// The headers end where the body begins.
+			break
+		}
+		if name, value, ok := strings.Cut(header, ": "); ok {
+			if entry.Headers == nil {
+				entry.Headers = make(map[string][]string)
+			}
+			entry.Headers[name] = append(entry.Headers[name], value)
+		}
+	}
+	return entry
+}
+
+// Files returns the existing log files the logger's template expands to,
+// including those of past days and other endpoints, and copies of them
+// compressed afterwards with a .zst suffix.
+func (l *RequestLogger) Files() ([]string, error) {
+	if l.Template == "" {
+		return nil, nil
+	}
+	pattern := strings.NewReplacer("{date}", "*", "{endpoint}", "*").Replace(l.Template)
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := filepath.Glob(pattern + ".zst")
+	return append(files, compressed...), err
+}
+
+// ReadLog calls fn for each entry in the log file at path, decompressing it if
+// needed. It stops at the first error fn returns.
+func ReadLog(path string, fn func(*StoredEntry) error) error {
+	r, err := OpenLogReader(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return scanLog(r, fn)
+}
+
+// Erase replaces the entries whose IDs are in ids in the log file at path with
+// tombstones that keep the entry's type, ID, timestamp, path, and status but
+// drop its headers, body, and body file references. Compressed files stay
+// compressed. Logging waits while the file is rewritten. It returns the
+// number of entries erased.
+func (l *RequestLogger) Erase(path string, ids map[string]bool) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Close the open handle so the next entry goes to the rewritten file.
+	if open, ok := l.files[path]; ok {
+		open.f.Close()
+		delete(l.files, path)
+	}
+
+	compressed, err := isCompressed(path)
+	if err != nil {
+		return 0, err
+	}
+	r, err := OpenLogReader(path)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".erase-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	out := bufio.NewWriter(tmp)
+
+	erased := 0
+	err = scanLog(r, func(entry *StoredEntry) error {
+		data := entry.Raw
+		if ids[entry.ID] {
+			data = tombstone(entry)
+			erased++
+		}
+		if compressed {
+			data = compressEntry(data)
+		}
+		_, err := out.Write(data)
+		return err
+	})
+	if err == nil {
+		err = out.Flush()
+	}
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to rewrite %s: %w", path, err)
+	}
+	if erased == 0 {
+		return 0, nil
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, err
+	}
+	return erased, nil
+}
+
+func isCompressed(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	header := make([]byte, len(zstdMagic))
+	n, _ := io.ReadFull(f, header)
+	return bytes.Equal(header[:n], zstdMagic), nil
+}
+
+// tombstone returns the erased form of entry.
+func tombstone(entry *StoredEntry) []byte {
+	if entry.JSON {
+		var e LogEntry
+		if json.Unmarshal(entry.Raw, &e) != nil {
+			e = LogEntry{Type: entry.Type, ID: entry.ID}
+		}
+		e.Headers = nil
+		e.Body = nil
+		e.BodyFile = ""
+		e.BodyForm = ""
+		e.Truncated = false
+		e.OverflowFile = ""
+		e.Erased = true
+		data, _ := json.Marshal(e)
+		return append(data, '\n')
+	}
+
+	// Keep the block's heading and request or status line.
+	head, _, _ := bytes.Cut(entry.Raw, []byte("\nHeaders:\n"))
+	return append(head, "\n(erased)\n\n"...)
+}
+
+// scanLog splits a decompressed log into entries. JSON logs hold one entry
+// per line; text logs hold blocks that start with a ==== heading.
+func scanLog(r io.Reader, fn func(*StoredEntry) error) error {
+	br := bufio.NewReader(r)
+	first, _ := br.Peek(1)
+	isJSON := len(first) > 0 && first[0] == '{'
+
+	var block []byte
+	flush := func() error {
+		if len(block) == 0 {
+			return nil
+		}
+		entry := parseTextBlock(block)
+		block = nil
+		return fn(entry)
+	}
+
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			if isJSON {
+				if entry := parseJSONLine(line); entry != nil {
+					if err := fn(entry); err != nil {
+						return err
+					}
+				}
+			} else {
+				if bytes.HasPrefix(line, []byte("==== REQUEST [")) || bytes.HasPrefix(line, []byte("==== RESPONSE [")) {
+					if err := flush(); err != nil {
+						return err
+					}
+				}
+				block = append(block, line...)
+			}
+		}
+		if err == io.EOF {
+			return flush()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func parseJSONLine(line []byte) *StoredEntry {
+	var e struct {
+		Type         string          `json:"type"`
+		ID           string          `json:"id"`
+		Timestamp    time.Time       `json:"timestamp"`
+		Body         json.RawMessage `json:"body"`
+		BodyFile     string          `json:"body_file"`
+		OverflowFile string          `json:"overflow_file"`
+	}
+	if json.Unmarshal(line, &e) != nil {
+		return nil
+	}
+	entry := &StoredEntry{
+		Type:         e.Type,
+		ID:           e.ID,
+		Time:         e.Timestamp,
+		Raw:          line,
+		JSON:         true,
+		Body:         e.Body,
+		BodyFile:     e.BodyFile,
+		OverflowFile: e.OverflowFile,
+	}
+	// Truncated and non-JSON bodies are logged as strings.
+	var s string
+	if json.Unmarshal(e.Body, &s) == nil {
+		entry.Body = []byte(s)
+	}
+	return entry
+}
+
+// parseTextBlock reads back a block written by formatText.
+func parseTextBlock(block []byte) *StoredEntry {
+	entry := &StoredEntry{Raw: block}
+	heading, rest, _ := bytes.Cut(block, []byte("\n"))
+	kind, id, _ := strings.Cut(strings.TrimPrefix(string(heading), "==== "), " [")
+	entry.Type = strings.ToLower(kind)
+	var stamp string
+	entry.ID, stamp, _ = strings.Cut(id, "] ")
+	stamp, _, _ = strings.Cut(stamp, " ")
+	entry.Time, _ = time.Parse(time.RFC3339, stamp)
+
+	idx := bytes.Index(rest, []byte("\nBody"))
+	if idx < 0 {
+		return entry
+	}
+	bodyHeading, body, _ := bytes.Cut(rest[idx+1:], []byte("\n"))
+	if _, file, ok := strings.Cut(string(bodyHeading), "spilled to "); ok {
+		entry.BodyFile = strings.TrimSuffix(file, ")")
+		return entry
+	}
+
+	// The body is followed by a newline, an optional truncation marker, and
+	// the blank line ending the block.
+	body = bytes.TrimSuffix(body, []byte("\n"))
+	body = bytes.TrimSuffix(body, []byte("\n"))
+	if i := bytes.LastIndex(body, []byte("\n... [")); i >= 0 && bytes.Contains(bodyHeading, []byte("truncated")) && !bytes.Contains(body[i+1:], []byte("\n")) {
+		if _, file, ok := strings.Cut(string(body[i+1:]), "remainder in "); ok {
+			entry.OverflowFile = strings.TrimSuffix(file, "]")
+		}
+		body = body[:i]
+	}
+	entry.Body = body
+	return entry
+}
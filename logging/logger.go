@@ -0,0 +1,471 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log formats accepted by NewRequestLogger.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Default body limits of a new RequestLogger. A negative limit disables
+// truncation.
+const (
+	DefaultRequestLimit  = -1
+	DefaultResponseLimit = 10000
+)
+
+// LogEntry is a single logged request or response. The text format renders it
+// as a human-readable block; the JSON format writes it as one JSONL line.
+type LogEntry struct {
+	Type      string              `json:"type"`
+	ID        string              `json:"id"`
+	Timestamp time.Time           `json:"timestamp"`
+	Method    string              `json:"method,omitempty"`
+	Path      string              `json:"path"`
+	Proto     string              `json:"proto"`
+	Status    string              `json:"status,omitempty"`
+	LatencyMs float64             `json:"latency_ms,omitempty"`
+	Headers   map[string][]string `json:"headers"`
+	Body      any                 `json:"body,omitempty"`
+	BodySize  int64               `json:"body_size"`
+	BodyFile  string              `json:"body_file,omitempty"`
+	// BodyForm is set when a stream was condensed before logging, to
+	// StreamDeltas or StreamFinal; BodySize is still the relayed size.
+	BodyForm  string `json:"body_form,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+	// OverflowFile holds the bytes cut from a truncated body; the inlined
+	// body followed by its contents is the full body.
+	OverflowFile string `json:"overflow_file,omitempty"`
+	// Erased marks an entry whose headers and body were removed on request.
+	Erased bool `json:"erased,omitempty"`
+
+	latency time.Duration
+	body    []byte
+}
+
+type pendingRequest struct {
+	started time.Time
+	path    string
+}
+
+type RequestLogger struct {
+	Template    string
+	Format      string
+	LogToStdout bool
+	Compress    bool
+	// StreamMode selects how SSE responses are captured; empty means
+	// StreamRaw.
+	StreamMode string
+	// RequestLimit and ResponseLimit cap the body bytes inlined into an
+	// entry; a negative limit disables truncation.
+	RequestLimit  int
+	ResponseLimit int
+	// OverflowDir, if set, receives the part of each truncated body that
+	// was not inlined.
+	OverflowDir string
+	// Clock supplies entry timestamps; nil means time.Now.
+	Clock func() time.Time
+
+	mu       sync.Mutex
+	files    map[string]*openLog
+	writes   uint64
+	day      string
+	requests map[string]pendingRequest
+}
+
+// maxOpenLogFiles caps the log files a template keeps open at once; the
+// least recently written one is closed to make room for another.
+const maxOpenLogFiles = 32
+
+type openLog struct {
+	f *os.File
+	// lastWrite orders files for closing, by RequestLogger.writes.
+	lastWrite uint64
+}
+
+func NewRequestLogger(template string, format string, logToStdout bool, compress bool) (*RequestLogger, error) {
+	logger := &RequestLogger{
+		Template:      template,
+		Format:        format,
+		LogToStdout:   logToStdout,
+		Compress:      compress,
+		RequestLimit:  DefaultRequestLimit,
+		ResponseLimit: DefaultResponseLimit,
+		files:         make(map[string]*openLog),
+		requests:      make(map[string]pendingRequest),
+	}
+
+	// Open static log paths eagerly so misconfiguration fails at startup.
+	if template != "" && !strings.Contains(template, "{") {
+		if _, err := logger.fileFor(template, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	return logger, nil
+}
+
+func (l *RequestLogger) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for path, open := range l.files {
+		open.f.Close()
+		delete(l.files, path)
+	}
+}
+
+func (l *RequestLogger) now() time.Time {
+	if l.Clock != nil {
+		return l.Clock()
+	}
+	return time.Now()
+}
+
+func (l *RequestLogger) LogRequest(r *http.Request, body *BodySpool) {
+	now := l.now()
+	reqID := r.Header.Get("X-Request-ID")
+	if reqID == "" {
+		reqID = fmt.Sprintf("req-%d", now.UnixNano())
+	}
+
+	l.mu.Lock()
+	l.requests[reqID] = pendingRequest{started: now, path: r.URL.Path}
+	l.mu.Unlock()
+
+	headers := make(map[string][]string, len(r.Header))
+	for name, values := range r.Header {
+		if strings.ToLower(name) == "authorization" {
+			headers[name] = []string{"Bearer [REDACTED]"}
+			continue
+		}
+		headers[name] = values
+	}
+
+	entry := &LogEntry{
+		Type:      "request",
+		ID:        reqID,
+		Timestamp: now,
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Proto:     r.Proto,
+		Headers:   headers,
+		BodySize:  body.Len(),
+	}
+
+	if body.Spilled() {
+		body.Keep()
+		entry.BodyFile = body.StoredPath()
+	} else {
+		l.setBody(entry, body.Bytes(), l.RequestLimit)
+	}
+
+	l.write(entry)
+}
+
+func (l *RequestLogger) LogResponse(reqID string, resp *http.Response, body []byte) {
+	entry := l.responseEntry(reqID, resp)
+	entry.BodySize = int64(len(body))
+	l.setBody(entry, body, l.ResponseLimit)
+
+	l.write(entry)
+}
+
+// setBody inlines body into entry, truncated to limit bytes. The cut bytes go
+// to an overflow file when OverflowDir is set.
+func (l *RequestLogger) setBody(entry *LogEntry, body []byte, limit int) {
+	entry.body = body
+	if limit < 0 || len(body) <= limit {
+		return
+	}
+	entry.body = body[:limit]
+	entry.Truncated = true
+	if l.OverflowDir == "" {
+		return
+	}
+	path, err := l.writeOverflow(entry, body[limit:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing body overflow: %v\n", err)
+		return
+	}
+	entry.OverflowFile = path
+}
+
+func (l *RequestLogger) writeOverflow(entry *LogEntry, data []byte) (string, error) {
+	if err := os.MkdirAll(l.OverflowDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create overflow directory: %w", err)
+	}
+	pattern := unsafePathChars.ReplaceAllString(entry.ID, "_") + "-" + entry.Type + "-*.body"
+	if l.Compress {
+		pattern += ".zst"
+		data = compressEntry(data)
+	}
+	f, err := os.CreateTemp(l.OverflowDir, pattern)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// LogResponseSpool logs a response whose body was captured in a BodySpool.
+// Spilled bodies are referenced by path instead of being inlined.
+func (l *RequestLogger) LogResponseSpool(reqID string, resp *http.Response, body *BodySpool) {
+	if !body.Spilled() {
+		l.LogResponse(reqID, resp, body.Bytes())
+		return
+	}
+	body.Keep()
+
+	entry := l.responseEntry(reqID, resp)
+	entry.BodySize = body.Len()
+	entry.BodyFile = body.StoredPath()
+
+	l.write(entry)
+}
+
+func (l *RequestLogger) responseEntry(reqID string, resp *http.Response) *LogEntry {
+	now := l.now()
+
+	entry := &LogEntry{
+		Type:      "response",
+		ID:        reqID,
+		Timestamp: now,
+		Proto:     resp.Proto,
+		Status:    resp.Status,
+		Headers:   resp.Header,
+	}
+
+	l.mu.Lock()
+	if pending, ok := l.requests[reqID]; ok {
+		entry.latency = now.Sub(pending.started)
+		entry.LatencyMs = float64(entry.latency.Microseconds()) / 1000
+		entry.Path = pending.path
+	} else if resp.Request != nil {
+		entry.Path = resp.Request.URL.Path
+	}
+	l.mu.Unlock()
+
+	return entry
+}
+
+// Done releases the bookkeeping for a request once its response has been
+// fully relayed.
+func (l *RequestLogger) Done(reqID string) {
+	l.mu.Lock()
+	delete(l.requests, reqID)
+	l.mu.Unlock()
+}
+
+func (l *RequestLogger) write(entry *LogEntry) {
+	buf := getLogBuffer()
+	defer putLogBuffer(buf)
+
+	if l.Format == FormatJSON {
+		l.formatJSON(buf, entry)
+	} else {
+		l.formatText(buf, entry)
+	}
+
+	if l.Template != "" {
+		if err := l.writeFile(entry, buf.Bytes()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing log entry: %v\n", err)
+		}
+	}
+
+	if l.LogToStdout {
+		os.Stdout.Write(buf.Bytes())
+		if l.Format == FormatJSON {
+			os.Stdout.Write([]byte{'\n'})
+		}
+	}
+}
+
+func (l *RequestLogger) writeFile(entry *LogEntry, data []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, err := l.fileFor(l.resolvePath(entry), entry.Timestamp.Format("2006-01-02"))
+	if err != nil {
+		return err
+	}
+
+	if l.Compress {
+		_, err = f.Write(compressEntry(append(data, '\n')))
+	} else {
+		_, err = f.Write(append(data, '\n'))
+	}
+	return err
+}
+
+func (l *RequestLogger) formatText(buf *bytes.Buffer, entry *LogEntry) {
+	timestamp := entry.Timestamp.Format(time.RFC3339)
+
+	if entry.Type == "request" {
+		fmt.Fprintf(buf, "==== REQUEST [%s] %s ====\n", entry.ID, timestamp)
+		fmt.Fprintf(buf, "%s %s %s\n", entry.Method, entry.Path, entry.Proto)
+	} else {
+		latencyStr := "unknown"
+		if entry.latency > 0 {
+			latencyStr = entry.latency.String()
+		}
+		fmt.Fprintf(buf, "==== RESPONSE [%s] %s (Latency: %s) ====\n", entry.ID, timestamp, latencyStr)
+		fmt.Fprintf(buf, "%s %s\n", entry.Proto, entry.Status)
+	}
+
+	fmt.Fprintln(buf, "Headers:")
+	for name, values := range entry.Headers {
+		for _, value := range values {
+			fmt.Fprintf(buf, "  %s: %s\n", name, value)
+		}
+	}
+
+	switch {
+	case entry.BodyFile != "":
+		fmt.Fprintf(buf, "Body (%d bytes, spilled to %s)\n", entry.BodySize, entry.BodyFile)
+	case len(entry.body) > 0:
+		if entry.BodyForm != "" {
+			fmt.Fprintf(buf, "Body (%s of a %d-byte stream", entry.BodyForm, entry.BodySize)
+			if entry.Truncated {
+				fmt.Fprintf(buf, ", truncated to %d bytes", len(entry.body))
+			}
+			fmt.Fprintln(buf, "):")
+		} else if entry.Truncated {
+			fmt.Fprintf(buf, "Body (truncated to %d bytes):\n", len(entry.body))
+		} else {
+			fmt.Fprintln(buf, "Body:")
+		}
+		buf.Write(entry.body)
+		buf.WriteByte('\n')
+		switch {
+		case entry.Truncated && entry.OverflowFile != "":
+			fmt.Fprintf(buf, "... [truncated, remainder in %s]\n", entry.OverflowFile)
+		case entry.Truncated && entry.BodyForm == "":
+			fmt.Fprintf(buf, "... [%d more bytes]\n", entry.BodySize-int64(len(entry.body)))
+		}
+	}
+}
+
+func (l *RequestLogger) formatJSON(buf *bytes.Buffer, entry *LogEntry) {
+	if len(entry.body) > 0 {
+		if !entry.Truncated && json.Valid(entry.body) {
+			entry.Body = json.RawMessage(entry.body)
+		} else {
+			entry.Body = string(entry.body)
+		}
+	}
+
+	if err := json.NewEncoder(buf).Encode(entry); err != nil {
+		fmt.Fprintf(os.Stderr, "Error encoding log entry: %v\n", err)
+		return
+	}
+	// Encode terminates the line; the trailing newline is added on write.
+	buf.Truncate(buf.Len() - 1)
+}
+
+var unsafePathChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// logEndpoints are the API endpoints {endpoint} expands to. Requests for a
+// resource under one, such as /v1/files/{id}, are logged with it.
+var logEndpoints = []string{
+	"chat/completions", "completions", "embeddings", "responses", "models",
+	"moderations", "images/generations", "images/edits", "images/variations",
+	"audio/speech", "audio/transcriptions", "audio/translations",
+	"files", "uploads", "batches", "fine_tuning/jobs",
+	"assistants", "threads", "vector_stores", "realtime",
+}
+
+// endpointName turns an API path such as /v1/chat/completions into a file
+// name component such as v1_chat_completions. Paths outside logEndpoints are
+// all named "other", so clients cannot create files of their choosing.
+func endpointName(p string) string {
+	name := strings.Trim(path.Clean("/"+p), "/")
+	prefix := ""
+	if rest, ok := strings.CutPrefix(name, "v1/"); ok {
+		prefix, name = "v1_", rest
+	}
+	for _, endpoint := range logEndpoints {
+		if name == endpoint || strings.HasPrefix(name, endpoint+"/") {
+			return prefix + strings.ReplaceAll(endpoint, "/", "_")
+		}
+	}
+	return "other"
+}
+
+// resolvePath expands {date} and {endpoint} placeholders in the log template
+// for the given entry.
+func (l *RequestLogger) resolvePath(entry *LogEntry) string {
+	if !strings.Contains(l.Template, "{") {
+		return l.Template
+	}
+	return strings.NewReplacer(
+		"{date}", entry.Timestamp.Format("2006-01-02"),
+		"{endpoint}", endpointName(entry.Path),
+	).Replace(l.Template)
+}
+
+// fileFor returns the open file for path, creating it and its parent
+// directories as needed. day is the date of the entry being written: files
+// are all closed when it moves past the last one, so previous days' files do
+// not stay open. The caller must hold l.mu.
+func (l *RequestLogger) fileFor(path, day string) (*os.File, error) {
+	l.writes++
+	if open, ok := l.files[path]; ok {
+		open.lastWrite = l.writes
+		return open.f, nil
+	}
+
+	if day > l.day && strings.Contains(l.Template, "{date}") {
+		for p, open := range l.files {
+			open.f.Close()
+			delete(l.files, p)
+		}
+		l.day = day
+	}
+	if len(l.files) >= maxOpenLogFiles {
+		l.closeLeastRecent()
+	}
+
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create log directory: %w", err)
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %w", err)
+	}
+	l.files[path] = &openLog{f: f, lastWrite: l.writes}
+	return f, nil
+}
+
+// closeLeastRecent closes the file written to longest ago. The caller must
+// hold l.mu.
+func (l *RequestLogger) closeLeastRecent() {
+	var oldest string
+	for p, open := range l.files {
+		if oldest == "" || open.lastWrite < l.files[oldest].lastWrite {
+			oldest = p
+		}
+	}
+	l.files[oldest].f.Close()
+	delete(l.files, oldest)
+}
@@ -0,0 +1,29 @@
+package logging
+
+import (
+	"bytes"
+	"sync"
+)
+
+// maxPooledLogBuffer caps the capacity of log buffers returned to the pool so
+// a single huge entry does not pin memory for the lifetime of the process.
+const maxPooledLogBuffer = 64 * 1024
+
+var logBufferPool = sync.Pool{
+	New: func() any {
+		return new(bytes.Buffer)
+	},
+}
+
+func getLogBuffer() *bytes.Buffer {
+	buf := logBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putLogBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledLogBuffer {
+		return
+	}
+	logBufferPool.Put(buf)
+}
@@ -0,0 +1,34 @@
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func BenchmarkLogBufferAlloc(b *testing.B) {
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			var buf bytes.Buffer
+			fmt.Fprintf(&buf, "==== RESPONSE [%s] ====\n", "req-1")
+			buf.WriteString(strings.Repeat("x", 2048))
+			io.Discard.Write(buf.Bytes())
+		}
+	})
+}
+
+func BenchmarkLogBufferPooled(b *testing.B) {
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			buf := getLogBuffer()
+			fmt.Fprintf(buf, "==== RESPONSE [%s] ====\n", "req-1")
+			buf.WriteString(strings.Repeat("x", 2048))
+			io.Discard.Write(buf.Bytes())
+			putLogBuffer(buf)
+		}
+	})
+}
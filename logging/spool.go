@@ -0,0 +1,159 @@
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// BodySpool accumulates a body in memory up to a threshold and transparently
+// moves it to a temp file once the threshold is exceeded, so large bodies
+// never have to be held in RAM in full.
+type BodySpool struct {
+	threshold int64
+	dir       string
+	mem       bytes.Buffer
+	file      *os.File
+	size      int64
+	keep      bool
+	compress  bool
+}
+
+func NewBodySpool(threshold int64, dir string, compress bool) *BodySpool {
+	return &BodySpool{
+		threshold: threshold,
+		dir:       dir,
+		compress:  compress,
+	}
+}
+
+func (s *BodySpool) Write(p []byte) (int, error) {
+	if s.file == nil && s.threshold > 0 && int64(s.mem.Len()+len(p)) > s.threshold {
+		if err := s.spill(); err != nil {
+			return 0, err
+		}
+	}
+
+	var n int
+	var err error
+	if s.file != nil {
+		n, err = s.file.Write(p)
+	} else {
+		n, err = s.mem.Write(p)
+	}
+	s.size += int64(n)
+	return n, err
+}
+
+func (s *BodySpool) spill() error {
+	f, err := os.CreateTemp(s.dir, "t-oai-body-*")
+	if err != nil {
+		return fmt.Errorf("failed to create spill file: %w", err)
+	}
+	if _, err := f.Write(s.mem.Bytes()); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to write spill file: %w", err)
+	}
+	s.mem = bytes.Buffer{}
+	s.file = f
+	return nil
+}
+
+// Len returns the total number of bytes written to the spool.
+func (s *BodySpool) Len() int64 {
+	return s.size
+}
+
+// Spilled reports whether the body has been moved to disk.
+func (s *BodySpool) Spilled() bool {
+	return s.file != nil
+}
+
+// Path returns the spill file path, or an empty string if the body is still
+// held in memory.
+func (s *BodySpool) Path() string {
+	if s.file == nil {
+		return ""
+	}
+	return s.file.Name()
+}
+
+// StoredPath returns the path the spilled body will occupy once the spool is
+// closed, which differs from Path when compression is enabled.
+func (s *BodySpool) StoredPath() string {
+	if s.file == nil {
+		return ""
+	}
+	if s.compress {
+		return s.file.Name() + ".zst"
+	}
+	return s.file.Name()
+}
+
+// Bytes returns the in-memory body. It is nil once the body has spilled.
+func (s *BodySpool) Bytes() []byte {
+	if s.file != nil {
+		return nil
+	}
+	return s.mem.Bytes()
+}
+
+// Reader returns a reader over the full body, rewinding the spill file if
+// necessary.
+func (s *BodySpool) Reader() (io.Reader, error) {
+	if s.file == nil {
+		return bytes.NewReader(s.mem.Bytes()), nil
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to rewind spill file: %w", err)
+	}
+	return io.LimitReader(s.file, s.size), nil
+}
+
+// Reset discards the current contents so the spool can be refilled, removing
+// any spill file that has not been kept.
+func (s *BodySpool) Reset() {
+	s.Close()
+	s.mem.Reset()
+	s.file = nil
+	s.size = 0
+	s.keep = false
+}
+
+// ReadAll returns the full spooled body, reading it back from disk if it
+// was spilled.
+func (s *BodySpool) ReadAll() ([]byte, error) {
+	if !s.Spilled() {
+		return s.Bytes(), nil
+	}
+	r, err := s.Reader()
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// Keep marks the spill file as referenced from a log entry so Close leaves it
+// on disk.
+func (s *BodySpool) Keep() {
+	s.keep = true
+}
+
+func (s *BodySpool) Close() {
+	if s.file == nil {
+		return
+	}
+	s.file.Close()
+	if !s.keep {
+		os.Remove(s.file.Name())
+		return
+	}
+	if s.compress {
+		if err := compressFile(s.file.Name(), s.StoredPath()); err != nil {
+			log.Printf("Error compressing spilled body %s: %v", s.file.Name(), err)
+		}
+	}
+}
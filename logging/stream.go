@@ -0,0 +1,220 @@
+package logging
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Streaming capture modes accepted in RequestLogger.StreamMode.
+const (
+	// StreamRaw logs each chunk of an SSE stream as it is relayed.
+	StreamRaw = "raw"
+	// StreamDeltas logs one entry per stream whose body is the JSON array of
+	// its event payloads.
+	StreamDeltas = "deltas"
+	// StreamFinal logs one entry per stream whose body is the message
+	// assembled from its deltas, shaped like a non-streaming response.
+	StreamFinal = "final"
+)
+
+// LogStream logs a complete SSE response body condensed according to
+// StreamMode. In StreamRaw mode the chunks have already been logged as they
+// were relayed, so nothing is written.
+func (l *RequestLogger) LogStream(reqID string, resp *http.Response, body *BodySpool) {
+	if l.StreamMode == "" || l.StreamMode == StreamRaw {
+		return
+	}
+	data, err := body.ReadAll()
+	if err != nil {
+		l.LogResponseSpool(reqID, resp, body)
+		return
+	}
+
+	var condensed []byte
+	if l.StreamMode == StreamFinal {
+		condensed = AssembleStream(data)
+	}
+	form := StreamFinal
+	if condensed == nil {
+		// Streams that are not completions keep their events.
+		condensed, _ = json.Marshal(StreamEvents(data))
+		form = StreamDeltas
+	}
+
+	entry := l.responseEntry(reqID, resp)
+	entry.BodySize = body.Len()
+	entry.BodyForm = form
+	l.setBody(entry, condensed, l.ResponseLimit)
+	l.write(entry)
+}
+
+// StreamEvents returns the JSON payloads of an SSE body's data lines in
+// order, skipping the [DONE] sentinel and anything that is not JSON.
+func StreamEvents(body []byte) []json.RawMessage {
+	events := []json.RawMessage{}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(body)+1)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		data = strings.TrimSpace(data)
+		if !ok || data == "[DONE]" || !json.Valid([]byte(data)) {
+			continue
+		}
+		events = append(events, json.RawMessage(data))
+	}
+	return events
+}
+
+type streamToolCall struct {
+	Index    int    `json:"index"`
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type streamMessage struct {
+	Role      string           `json:"role,omitempty"`
+	Content   *string          `json:"content"`
+	Refusal   *string          `json:"refusal,omitempty"`
+	ToolCalls []streamToolCall `json:"tool_calls,omitempty"`
+}
+
+type streamChoice struct {
+	Index        int             `json:"index"`
+	Message      *streamMessage  `json:"message,omitempty"`
+	Delta        *streamMessage  `json:"delta,omitempty"`
+	Text         *string         `json:"text,omitempty"`
+	Logprobs     json.RawMessage `json:"logprobs,omitempty"`
+	FinishReason *string         `json:"finish_reason"`
+}
+
+type streamCompletion struct {
+	ID                string          `json:"id,omitempty"`
+	Object            string          `json:"object,omitempty"`
+	Created           int64           `json:"created,omitempty"`
+	Model             string          `json:"model,omitempty"`
+	SystemFingerprint string          `json:"system_fingerprint,omitempty"`
+	Choices           []streamChoice  `json:"choices"`
+	Usage             json.RawMessage `json:"usage,omitempty"`
+
+	// Type and Response are set on Responses API events.
+	Type     string          `json:"type,omitempty"`
+	Response json.RawMessage `json:"response,omitempty"`
+}
+
+// AssembleStream rebuilds the response a streamed chat or text completion
+// would have returned without streaming, concatenating content, refusal, and
+// tool call argument deltas per choice. For Responses API streams it returns
+// the response carried by the final response.completed event. It returns nil
+// for streams it does not recognize.
+func AssembleStream(body []byte) []byte {
+	var final streamCompletion
+	choices := make(map[int]*streamChoice)
+	for _, raw := range StreamEvents(body) {
+		var event streamCompletion
+		if json.Unmarshal(raw, &event) != nil {
+			continue
+		}
+		if event.Type == "response.completed" && event.Response != nil {
+			return event.Response
+		}
+		if event.ID != "" {
+			final.ID = event.ID
+		}
+		if event.Created != 0 {
+			final.Created = event.Created
+		}
+		if event.Model != "" {
+			final.Model = event.Model
+		}
+		if event.SystemFingerprint != "" {
+			final.SystemFingerprint = event.SystemFingerprint
+		}
+		if event.Usage != nil && string(event.Usage) != "null" {
+			final.Usage = event.Usage
+		}
+		if event.Object != "" {
+			final.Object = strings.TrimSuffix(event.Object, ".chunk")
+		}
+		for _, delta := range event.Choices {
+			choice, ok := choices[delta.Index]
+			if !ok {
+				choice = &streamChoice{Index: delta.Index}
+				choices[delta.Index] = choice
+			}
+			if delta.FinishReason != nil {
+				choice.FinishReason = delta.FinishReason
+			}
+			if delta.Text != nil {
+				choice.Text = appendString(choice.Text, *delta.Text)
+			}
+			if delta.Delta != nil {
+				mergeDelta(choice, delta.Delta)
+			}
+		}
+	}
+	if len(choices) == 0 {
+		return nil
+	}
+
+	for _, choice := range choices {
+		final.Choices = append(final.Choices, *choice)
+	}
+	sort.Slice(final.Choices, func(i, j int) bool { return final.Choices[i].Index < final.Choices[j].Index })
+	data, err := json.Marshal(final)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+func mergeDelta(choice *streamChoice, delta *streamMessage) {
+	if choice.Message == nil {
+		choice.Message = &streamMessage{Role: "assistant"}
+	}
+	msg := choice.Message
+	if delta.Role != "" {
+		msg.Role = delta.Role
+	}
+	if delta.Content != nil {
+		msg.Content = appendString(msg.Content, *delta.Content)
+	}
+	if delta.Refusal != nil {
+		msg.Refusal = appendString(msg.Refusal, *delta.Refusal)
+	}
+	for _, call := range delta.ToolCalls {
+		// Calls are numbered from 0 and each new one takes the next index;
+		// anything else is malformed and dropped rather than trusted to size
+		// the slice.
+		if call.Index < 0 || call.Index > len(msg.ToolCalls) {
+			continue
+		}
+		if call.Index == len(msg.ToolCalls) {
+			msg.ToolCalls = append(msg.ToolCalls, streamToolCall{Index: call.Index})
+		}
+		tc := &msg.ToolCalls[call.Index]
+		if call.ID != "" {
+			tc.ID = call.ID
+		}
+		if call.Type != "" {
+			tc.Type = call.Type
+		}
+		tc.Function.Name += call.Function.Name
+		tc.Function.Arguments += call.Function.Arguments
+	}
+}
+
+func appendString(s *string, more string) *string {
+	if s == nil {
+		return &more
+	}
+	joined := *s + more
+	return &joined
+}
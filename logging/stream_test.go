@@ -0,0 +1,37 @@
+package logging
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestAssembleStreamMalformedToolCalls(t *testing.T) {
+	events := []string{
+		`{"object":"chat.completion.chunk","choices":[{"index":0,"delta":{"role":"assistant","tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"get_weather","arguments":""}}]}}]}`,
+		`{"object":"chat.completion.chunk","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"city\":"}}]}}]}`,
+		`{"object":"chat.completion.chunk","choices":[{"index":0,"delta":{"tool_calls":[{"index":-1,"function":{"arguments":"bad"}}]}}]}`,
+		`{"object":"chat.completion.chunk","choices":[{"index":0,"delta":{"tool_calls":[{"index":2000000000,"function":{"arguments":"bad"}}]}}]}`,
+		`{"object":"chat.completion.chunk","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"Paris\"}"}}]},"finish_reason":"tool_calls"}]}`,
+	}
+	var body strings.Builder
+	for _, event := range events {
+		body.WriteString("data: " + event + "\n\n")
+	}
+	body.WriteString("data: [DONE]\n\n")
+
+	var got struct {
+		Choices []struct {
+			Message struct {
+				ToolCalls []streamToolCall `json:"tool_calls"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(AssembleStream([]byte(body.String())), &got); err != nil {
+		t.Fatal(err)
+	}
+	calls := got.Choices[0].Message.ToolCalls
+	if len(calls) != 1 || calls[0].ID != "call_1" || calls[0].Function.Arguments != `{"city":"Paris"}` {
+		t.Errorf("tool calls = %+v", calls)
+	}
+}
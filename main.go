@@ -1,400 +1,167 @@
 package main
 
 import (
-	"bytes"
-	"flag"
+	"context"
 	"fmt"
-	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
-	"strconv"
-	"strings"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/joho/godotenv"
+	"t-oai-api/config"
+	"t-oai-api/proxy"
 )
 
-type Config struct {
-	Port           string
-	OpenAIBaseURL  string
-	OpenAIAPIKey   string
-	LogRequests    bool
-	LogResponses   bool
-	LogToStdout    bool
-	RequestLogFile string
-}
-
-type RequestLogger struct {
-	LogFile      *os.File
-	LogToFile    bool
-	LogToStdout  bool
-	requestTimes map[string]time.Time
-}
-
-func NewRequestLogger(logFile string, logToStdout bool) (*RequestLogger, error) {
-	logger := &RequestLogger{
-		LogToStdout:  logToStdout,
-		requestTimes: make(map[string]time.Time),
-	}
-
-	if logFile != "" {
-		f, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			return nil, fmt.Errorf("failed to open log file: %w", err)
-		}
-		logger.LogFile = f
-		logger.LogToFile = true
-	}
-
-	return logger, nil
-}
+// shutdownTimeout bounds how long in-flight requests are given to drain
+// after a stop signal before connections are closed.
+const shutdownTimeout = 30 * time.Second
 
-func (l *RequestLogger) Close() {
-	if l.LogFile != nil {
-		l.LogFile.Close()
-	}
-}
-
-func (l *RequestLogger) LogRequest(r *http.Request, body []byte) {
-	now := time.Now()
-	timestamp := now.Format(time.RFC3339)
-	reqID := r.Header.Get("X-Request-ID")
-	if reqID == "" {
-		reqID = fmt.Sprintf("req-%d", now.UnixNano())
-	}
-
-	l.requestTimes[reqID] = now
-
-	var buf bytes.Buffer
-	fmt.Fprintf(&buf, "==== REQUEST [%s] %s ====\n", reqID, timestamp)
-	fmt.Fprintf(&buf, "%s %s %s\n", r.Method, r.URL.Path, r.Proto)
-
-	fmt.Fprintln(&buf, "Headers:")
-	for name, values := range r.Header {
-		if strings.ToLower(name) == "authorization" {
-			fmt.Fprintf(&buf, "  %s: Bearer [REDACTED]\n", name)
-			continue
-		}
-		for _, value := range values {
-			fmt.Fprintf(&buf, "  %s: %s\n", name, value)
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "cat":
+			if err := runCat(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "service":
+			if err := runServiceCommand(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "openapi":
+			if err := runOpenAPI(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "bench":
+			if err := runBench(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "monitor":
+			if err := runMonitor(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "replay":
+			if err := runReplay(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "export":
+			if err := runExport(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "check":
+			if err := runCheck(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
 		}
 	}
 
-	if len(body) > 0 {
-		fmt.Fprintln(&buf, "Body:")
-		fmt.Fprintln(&buf, string(body))
+	service := isWindowsService()
+	if service {
+		enterServiceDir()
 	}
+	cfg := config.Load()
 
-	logData := buf.String()
-
-	if l.LogToFile && l.LogFile != nil {
-		fmt.Fprintln(l.LogFile, logData)
-	}
-
-	if l.LogToStdout {
-		fmt.Print(logData)
-	}
-}
-
-func (l *RequestLogger) LogResponse(reqID string, resp *http.Response, body []byte) {
-	now := time.Now()
-	timestamp := now.Format(time.RFC3339)
-
-	var latency time.Duration
-	latencyStr := "unknown"
-	if requestTime, ok := l.requestTimes[reqID]; ok {
-		latency = now.Sub(requestTime)
-		latencyStr = latency.String()
-		delete(l.requestTimes, reqID)
-	}
-
-	var buf bytes.Buffer
-	fmt.Fprintf(&buf, "==== RESPONSE [%s] %s (Latency: %s) ====\n", reqID, timestamp, latencyStr)
-	fmt.Fprintf(&buf, "%s %s\n", resp.Proto, resp.Status)
-
-	fmt.Fprintln(&buf, "Headers:")
-	for name, values := range resp.Header {
-		for _, value := range values {
-			fmt.Fprintf(&buf, "  %s: %s\n", name, value)
-		}
-	}
-
-	if len(body) > 0 {
-		maxBodySize := 10000
-		bodyToLog := body
-		if len(body) > maxBodySize {
-			bodyToLog = body[:maxBodySize]
-			fmt.Fprintf(&buf, "Body (truncated to %d bytes):\n", maxBodySize)
-		} else {
-			fmt.Fprintln(&buf, "Body:")
-		}
-		fmt.Fprintln(&buf, string(bodyToLog))
-
-		if len(body) > maxBodySize {
-			fmt.Fprintf(&buf, "... [%d more bytes]\n", len(body)-maxBodySize)
+	if service {
+		if err := runService(func(ctx context.Context) error {
+			return serve(ctx, cfg)
+		}); err != nil {
+			log.Fatalf("Service error: %v", err)
 		}
+		return
 	}
 
-	logData := buf.String()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	if l.LogToFile && l.LogFile != nil {
-		fmt.Fprintln(l.LogFile, logData)
-	}
-	if l.LogToStdout {
-		fmt.Print(logData)
+	if err := serve(ctx, cfg); err != nil {
+		log.Fatalf("Server error: %v", err)
 	}
 }
 
-type ProxyServer struct {
-	Config Config
-	Logger *RequestLogger
-}
-
-func NewProxyServer(config Config) (*ProxyServer, error) {
-	logger, err := NewRequestLogger(config.RequestLogFile, config.LogToStdout)
+// serve runs the proxy until ctx is cancelled, then drains in-flight requests.
+// On Windows, console close and system shutdown events arrive as SIGTERM.
+func serve(ctx context.Context, cfg config.Config) error {
+	server, err := proxy.NewServer(cfg)
 	if err != nil {
-		return nil, err
-	}
-
-	return &ProxyServer{
-		Config: config,
-		Logger: logger,
-	}, nil
-}
-
-func (s *ProxyServer) Close() {
-	if s.Logger != nil {
-		s.Logger.Close()
-	}
-}
-
-func (s *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	reqID := r.Header.Get("X-Request-ID")
-	if reqID == "" {
-		reqID = fmt.Sprintf("req-%d", time.Now().UnixNano())
-		r.Header.Set("X-Request-ID", reqID)
-	}
-
-	var bodyBytes []byte
-	var err error
-
-	if r.Body != nil {
-		bodyBytes, err = io.ReadAll(r.Body)
-		if err != nil {
-			http.Error(w, "Error reading request body", http.StatusInternalServerError)
-			return
-		}
-		r.Body.Close()
-		r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
-	}
-
-	if s.Config.LogRequests {
-		s.Logger.LogRequest(r, bodyBytes)
+		return fmt.Errorf("failed to create proxy server: %w", err)
 	}
+	defer server.Close()
 
-	targetURL := s.Config.OpenAIBaseURL + r.URL.Path
-	if r.URL.RawQuery != "" {
-		targetURL += "?" + r.URL.RawQuery
+	httpServer := &http.Server{
+		Addr:         ":" + cfg.Port,
+		Handler:      server,
+		ReadTimeout:  120 * time.Second,
+		WriteTimeout: 120 * time.Second,
+		IdleTimeout:  120 * time.Second,
 	}
 
-	proxyReq, err := http.NewRequest(r.Method, targetURL, bytes.NewBuffer(bodyBytes))
-	if err != nil {
-		http.Error(w, "Error creating proxy request: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
+	log.Printf("Starting OpenAI API proxy server on port %s", cfg.Port)
+	log.Printf("Forwarding requests to %s", cfg.OpenAIBaseURL)
+	log.Printf("Logging: requests=%v, responses=%v, to_stdout=%v, log_file=%s, format=%s, compress=%v",
+		cfg.LogRequests, cfg.LogResponses, cfg.LogToStdout,
+		cfg.RequestLogFile, cfg.LogFormat, cfg.CompressLogs)
 
-	for name, values := range r.Header {
-		if strings.ToLower(name) == "host" {
-			continue
-		}
-		for _, value := range values {
-			proxyReq.Header.Add(name, value)
+	var adminServer *http.Server
+	if cfg.AdminAddr != "" {
+		adminServer = &http.Server{
+			Addr:    cfg.AdminAddr,
+			Handler: server.AdminHandler(),
 		}
-	}
-
-	if proxyReq.Header.Get("Authorization") == "" && s.Config.OpenAIAPIKey != "" {
-		proxyReq.Header.Set("Authorization", "Bearer "+s.Config.OpenAIAPIKey)
-	}
-	client := &http.Client{
-		Timeout: 120 * time.Second,
-	}
-
-	resp, err := client.Do(proxyReq)
-	if err != nil {
-		http.Error(w, "Error forwarding request to OpenAI API: "+err.Error(), http.StatusBadGateway)
-		return
-	}
-	defer resp.Body.Close()
-
-	for name, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(name, value)
+		if !isLoopbackAddr(cfg.AdminAddr) {
+			log.Printf("Warning: admin listener %s is not a loopback address; it has no authentication and serves request bodies and profiles to anyone who can reach it", cfg.AdminAddr)
 		}
-	}
-
-	w.WriteHeader(resp.StatusCode)
-
-	isStreaming := strings.Contains(resp.Header.Get("Content-Type"), "text/event-stream")
-
-	if isStreaming {
-		if s.Config.LogResponses {
-			flusher, ok := w.(http.Flusher)
-			if !ok {
-				http.Error(w, "Streaming not supported", http.StatusInternalServerError)
-				return
+		go func() {
+			log.Printf("Starting admin listener on %s", cfg.AdminAddr)
+			if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("Admin listener error: %v", err)
 			}
-
-			buffer := make([]byte, 4096)
-			for {
-				n, err := resp.Body.Read(buffer)
-				if n > 0 {
-					chunk := buffer[:n]
-					if _, writeErr := w.Write(chunk); writeErr != nil {
-						log.Printf("Error writing response chunk: %v", writeErr)
-						break
-					}
-					flusher.Flush()
-					s.Logger.LogResponse(reqID, resp, chunk)
-				}
-
-				if err != nil {
-					if err != io.EOF {
-						log.Printf("Error reading response body: %v", err)
-					}
-					break
-				}
-			}
-		} else {
-			io.Copy(w, resp.Body)
-		}
-	} else {
-		responseBody, err := io.ReadAll(resp.Body)
-		if err != nil {
-			log.Printf("Error reading response body: %v", err)
-			http.Error(w, "Error reading response from OpenAI API", http.StatusInternalServerError)
-			return
-		}
-
-		if s.Config.LogResponses {
-			s.Logger.LogResponse(reqID, resp, responseBody)
-		}
-
-		w.Write(responseBody)
-	}
-}
-
-func loadConfig() Config {
-	var config Config
-
-	var flagLogRequests, flagLogResponses, flagLogToStdout bool
-	var flagsSet bool
-
-	flag.StringVar(&config.Port, "port", "", "Port for the proxy server to listen on")
-	flag.StringVar(&config.Port, "p", "", "Port for the proxy server to listen on (shorthand)")
-
-	flag.StringVar(&config.OpenAIBaseURL, "url", "", "Base URL for the OpenAI API")
-	flag.StringVar(&config.OpenAIBaseURL, "u", "", "Base URL for the OpenAI API (shorthand)")
-
-	flag.StringVar(&config.OpenAIAPIKey, "key", "", "Your OpenAI API key")
-	flag.StringVar(&config.OpenAIAPIKey, "k", "", "Your OpenAI API key (shorthand)")
-
-	flag.BoolVar(&flagLogRequests, "req", true, "Enable request logging")
-	flag.BoolVar(&flagLogRequests, "r", true, "Enable request logging (shorthand)")
-
-	flag.BoolVar(&flagLogResponses, "resp", true, "Enable response logging")
-	flag.BoolVar(&flagLogResponses, "s", true, "Enable response logging (shorthand)")
-
-	flag.BoolVar(&flagLogToStdout, "stdout", true, "Log to standard output")
-	flag.BoolVar(&flagLogToStdout, "o", true, "Log to standard output (shorthand)")
-
-	flag.StringVar(&config.RequestLogFile, "file", "", "File to log requests and responses")
-	flag.StringVar(&config.RequestLogFile, "f", "", "File to log requests and responses (shorthand)")
-
-	flag.Visit(func(f *flag.Flag) {
-		flagsSet = true
-	})
-
-	flag.Parse()
-
-	_ = godotenv.Load()
-
-	parseBool := func(envVar string, defaultVal bool) bool {
-		val := os.Getenv(envVar)
-		if val == "" {
-			return defaultVal
-		}
-		boolVal, err := strconv.ParseBool(val)
-		if err != nil {
-			log.Printf("Warning: Invalid value for %s, using default: %v", envVar, defaultVal)
-			return defaultVal
-		}
-		return boolVal
+		}()
 	}
 
-	if envPort := os.Getenv("PORT"); envPort != "" && config.Port == "" {
-		config.Port = envPort
-	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- httpServer.ListenAndServe()
+	}()
 
-	if envURL := os.Getenv("OPENAI_BASE_URL"); envURL != "" && config.OpenAIBaseURL == "" {
-		config.OpenAIBaseURL = envURL
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
 	}
 
-	if envKey := os.Getenv("OPENAI_API_KEY"); envKey != "" && config.OpenAIAPIKey == "" {
-		config.OpenAIAPIKey = envKey
-	}
-
-	config.LogRequests = flagLogRequests
-	config.LogResponses = flagLogResponses
-	config.LogToStdout = flagLogToStdout
+	log.Printf("Shutting down, draining in-flight requests (timeout %s)", shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
 
-	if !flagsSet {
-		config.LogRequests = parseBool("LOG_REQUESTS", config.LogRequests)
-		config.LogResponses = parseBool("LOG_RESPONSES", config.LogResponses)
-		config.LogToStdout = parseBool("LOG_TO_STDOUT", config.LogToStdout)
+	if adminServer != nil {
+		adminServer.Shutdown(shutdownCtx)
 	}
-
-	if envLogFile := os.Getenv("REQUEST_LOG_FILE"); envLogFile != "" && config.RequestLogFile == "" {
-		config.RequestLogFile = envLogFile
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("graceful shutdown failed: %w", err)
 	}
-
-	if config.Port == "" {
-		config.Port = "8080"
-	}
-
-	if config.OpenAIBaseURL == "" {
-		config.OpenAIBaseURL = "https://api.openai.com/v1"
-	} else {
-		config.OpenAIBaseURL = strings.TrimSuffix(config.OpenAIBaseURL, "/")
-	}
-
-	return config
+	return nil
 }
 
-func main() {
-	config := loadConfig()
-
-	server, err := NewProxyServer(config)
+// isLoopbackAddr reports whether addr only listens on the loopback interface.
+// An empty host listens on every interface.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
 	if err != nil {
-		log.Fatalf("Failed to create proxy server: %v", err)
+		return false
 	}
-	defer server.Close()
-
-	httpServer := &http.Server{
-		Addr:         ":" + config.Port,
-		Handler:      server,
-		ReadTimeout:  120 * time.Second,
-		WriteTimeout: 120 * time.Second,
-		IdleTimeout:  120 * time.Second,
-	}
-
-	log.Printf("Starting OpenAI API proxy server on port %s", config.Port)
-	log.Printf("Forwarding requests to %s", config.OpenAIBaseURL)
-	log.Printf("Logging: requests=%v, responses=%v, to_stdout=%v, log_file=%s",
-		config.LogRequests, config.LogResponses, config.LogToStdout,
-		config.RequestLogFile)
-
-	if err := httpServer.ListenAndServe(); err != nil {
-		log.Fatalf("Server error: %v", err)
+	if host == "localhost" {
+		return true
 	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
 }
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/joho/godotenv"
+	"golang.org/x/term"
+
+	"t-oai-api/proxy"
+)
+
+const (
+	sparkBuckets   = 30
+	sparkBucketLen = 10 * time.Second
+	maxSparkModels = 5
+)
+
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+type monitorKey int
+
+const (
+	keyNone monitorKey = iota
+	keyQuit
+	keyUp
+	keyDown
+	keyEnter
+	keyBack
+)
+
+// monitor is a terminal UI that polls the admin API of a running proxy.
+type monitor struct {
+	baseURL string
+	client  *http.Client
+
+	list     proxy.RequestList
+	err      error
+	selected int
+	detail   *proxy.Exchange
+	scroll   int
+}
+
+// runMonitor implements the `monitor` subcommand.
+func runMonitor(args []string) error {
+	_ = godotenv.Load()
+
+	fs := flag.NewFlagSet("monitor", flag.ExitOnError)
+	addr := fs.String("admin", os.Getenv("ADMIN_ADDR"), "Admin listener address of the running proxy")
+	interval := fs.Duration("interval", time.Second, "Refresh interval")
+	fs.Parse(args)
+
+	if *addr == "" {
+		return fmt.Errorf("admin address required: pass -admin or set ADMIN_ADDR")
+	}
+	baseURL := *addr
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "http://" + baseURL
+	}
+	if _, err := url.Parse(baseURL); err != nil {
+		return fmt.Errorf("invalid admin address: %w", err)
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return fmt.Errorf("monitor requires an interactive terminal")
+	}
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return fmt.Errorf("failed to enter raw mode: %w", err)
+	}
+	defer term.Restore(fd, state)
+
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer fmt.Print("\x1b[?25h\x1b[?1049l")
+
+	m := &monitor{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: 5 * time.Second},
+	}
+
+	keys := make(chan monitorKey)
+	go readKeys(keys)
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	m.refresh()
+	m.render()
+	for {
+		select {
+		case key := <-keys:
+			if key == keyQuit {
+				return nil
+			}
+			m.handleKey(key)
+		case <-ticker.C:
+			m.refresh()
+		}
+		m.render()
+	}
+}
+
+func readKeys(keys chan<- monitorKey) {
+	buf := make([]byte, 8)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			keys <- keyQuit
+			return
+		}
+		in := string(buf[:n])
+		for in != "" {
+			var key monitorKey
+			switch {
+			case strings.HasPrefix(in, "\x1b[A"):
+				key, in = keyUp, in[3:]
+			case strings.HasPrefix(in, "\x1b[B"):
+				key, in = keyDown, in[3:]
+			default:
+				key, in = decodeKey(in[0]), in[1:]
+			}
+			if key != keyNone {
+				keys <- key
+			}
+		}
+	}
+}
+
+func decodeKey(c byte) monitorKey {
+	switch c {
+	case 'q', 0x03:
+		return keyQuit
+	case 'k':
+		return keyUp
+	case 'j':
+		return keyDown
+	case '\r', '\n':
+		return keyEnter
+	case 0x1b, 'b', 0x7f:
+		return keyBack
+	}
+	return keyNone
+}
+
+func (m *monitor) handleKey(key monitorKey) {
+	if m.detail != nil {
+		switch key {
+		case keyUp:
+			if m.scroll > 0 {
+				m.scroll--
+			}
+		case keyDown:
+			m.scroll++
+		case keyBack:
+			m.detail = nil
+			m.scroll = 0
+		}
+		return
+	}
+
+	switch key {
+	case keyUp:
+		if m.selected > 0 {
+			m.selected--
+		}
+	case keyDown:
+		if m.selected < len(m.list.Requests)-1 {
+			m.selected++
+		}
+	case keyEnter:
+		if m.selected < len(m.list.Requests) {
+			m.loadDetail(m.list.Requests[m.selected].ID)
+		}
+	}
+}
+
+func (m *monitor) fetch(path string, v any) error {
+	resp, err := m.client.Get(m.baseURL + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (m *monitor) refresh() {
+	var list proxy.RequestList
+	if err := m.fetch("/admin/requests", &list); err != nil {
+		m.err = err
+		return
+	}
+	m.err = nil
+	m.list = list
+	if m.selected >= len(list.Requests) {
+		m.selected = max(len(list.Requests)-1, 0)
+	}
+}
+
+func (m *monitor) loadDetail(id string) {
+	var e proxy.Exchange
+	if err := m.fetch("/admin/requests/"+url.PathEscape(id), &e); err != nil {
+		m.err = err
+		return
+	}
+	m.detail = &e
+	m.scroll = 0
+}
+
+func (m *monitor) render() {
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		width, height = 80, 24
+	}
+
+	var lines []string
+	if m.detail != nil {
+		lines = m.detailLines(height)
+	} else {
+		lines = m.listLines(height)
+	}
+
+	var out strings.Builder
+	out.WriteString("\x1b[H\x1b[2J")
+	for i, line := range lines {
+		if i >= height {
+			break
+		}
+		if i > 0 {
+			out.WriteString("\r\n")
+		}
+		out.WriteString(fitWidth(line, width))
+	}
+	os.Stdout.WriteString(out.String())
+}
+
+func (m *monitor) header() string {
+	status := "connected"
+	if m.err != nil {
+		status = "error: " + m.err.Error()
+	}
+	return fmt.Sprintf("\x1b[1mt-oai-api monitor\x1b[0m  %s  in-flight: %d  [%s]",
+		m.baseURL, len(m.list.InFlight), status)
+}
+
+func (m *monitor) listLines(height int) []string {
+	lines := []string{m.header(), ""}
+
+	lines = append(lines, "\x1b[1mThroughput (last 5m, 10s buckets)\x1b[0m")
+	lines = append(lines, modelSparklines(m.list.Requests, time.Now())...)
+	lines = append(lines, "")
+
+	lines = append(lines, fmt.Sprintf("\x1b[1m%-8s  %-28s  %-6s  %-28s  %-22s  %6s  %9s  %7s\x1b[0m",
+		"TIME", "ID", "METHOD", "PATH", "MODEL", "STATUS", "LATENCY", "TOKENS"))
+
+	rows := height - len(lines) - 1
+	start := 0
+	if m.selected >= rows && rows > 0 {
+		start = m.selected - rows + 1
+	}
+	for i := start; i < len(m.list.Requests) && i < start+rows; i++ {
+		e := m.list.Requests[i]
+		line := fmt.Sprintf("%-8s  %-28s  %-6s  %-28s  %-22s  %6d  %8.0fms  %7d",
+			e.Started.Local().Format("15:04:05"), stripControl(e.ID), stripControl(e.Method),
+			stripControl(e.Path), stripControl(e.Model), e.Status, e.DurationMs, e.TotalTokens)
+		if i == m.selected {
+			line = "\x1b[7m" + line + "\x1b[0m"
+		}
+		lines = append(lines, line)
+	}
+
+	lines = append(lines, "\x1b[2mj/k move  enter details  q quit\x1b[0m")
+	return lines
+}
+
+func (m *monitor) detailLines(height int) []string {
+	e := m.detail
+	body := []string{
+		fmt.Sprintf("ID:        %s", stripControl(e.ID)),
+		fmt.Sprintf("Request:   %s %s", stripControl(e.Method), stripControl(e.Path)),
+		fmt.Sprintf("Client:    %s", stripControl(e.ClientIP)),
+		fmt.Sprintf("Model:     %s", stripControl(e.Model)),
+		fmt.Sprintf("Status:    %d", e.Status),
+		fmt.Sprintf("Started:   %s", e.Started.Local().Format(time.RFC3339)),
+		fmt.Sprintf("Latency:   %.1fms", e.DurationMs),
+		fmt.Sprintf("Bytes:     %d in / %d out", e.RequestBytes, e.ResponseBytes),
+		fmt.Sprintf("Tokens:    %d", e.TotalTokens),
+	}
+	if e.Error != "" {
+		body = append(body, fmt.Sprintf("Error:     %s", stripControl(e.Error)))
+	}
+	body = append(body, "", "\x1b[1mRequest body\x1b[0m")
+	body = append(body, prettyBody(e.RequestBody, e.RequestBytes)...)
+	body = append(body, "", "\x1b[1mResponse body\x1b[0m")
+	body = append(body, prettyBody(e.ResponseBody, e.ResponseBytes)...)
+
+	rows := max(height-3, 0)
+	if m.scroll > len(body)-rows {
+		m.scroll = max(len(body)-rows, 0)
+	}
+	end := min(m.scroll+rows, len(body))
+
+	lines := []string{m.header(), ""}
+	lines = append(lines, body[m.scroll:end]...)
+	lines = append(lines, "\x1b[2mj/k scroll  b/esc back  q quit\x1b[0m")
+	return lines
+}
+
+// prettyBody formats a body of size bytes for the detail view. The proxy
+// only keeps bodies with RECENT_BODIES=true, so a missing body that was not
+// empty is shown as not kept.
+func prettyBody(body string, size int64) []string {
+	if body == "" && size > 0 {
+		return []string{fmt.Sprintf("\x1b[2m(%d bytes, not kept; run the proxy with RECENT_BODIES=true)\x1b[0m", size)}
+	}
+	if body == "" {
+		return []string{"(empty)"}
+	}
+	var out bytes.Buffer
+	if json.Indent(&out, []byte(body), "", "  ") == nil {
+		body = out.String()
+	}
+	lines := strings.Split(body, "\n")
+	for i, line := range lines {
+		lines[i] = stripControl(line)
+	}
+	return lines
+}
+
+// stripControl makes text from requests and responses safe to print: escape
+// sequences and other control characters could otherwise recolour, move, or
+// retitle the terminal. They are shown as U+FFFD; tabs are kept.
+func stripControl(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\t':
+			return r
+		case r == '\r':
+			return -1
+		case unicode.IsControl(r):
+			return '\uFFFD'
+		}
+		return r
+	}, s)
+}
+
+// modelSparklines renders one line per model showing token throughput (or
+// request counts for models without usage data) over recent buckets.
+func modelSparklines(requests []proxy.Exchange, now time.Time) []string {
+	type series struct {
+		model    string
+		buckets  [sparkBuckets]int
+		requests int
+		tokens   int
+	}
+
+	byModel := make(map[string]*series)
+	window := sparkBuckets * sparkBucketLen
+	for _, e := range requests {
+		age := now.Sub(e.Started)
+		if age < 0 || age >= window {
+			continue
+		}
+		model := stripControl(e.Model)
+		if model == "" {
+			model = "(unknown)"
+		}
+		s, ok := byModel[model]
+		if !ok {
+			s = &series{model: model}
+			byModel[model] = s
+		}
+		s.requests++
+		s.tokens += e.TotalTokens
+		s.buckets[sparkBuckets-1-int(age/sparkBucketLen)] += max(e.TotalTokens, 1)
+	}
+
+	all := make([]*series, 0, len(byModel))
+	for _, s := range byModel {
+		all = append(all, s)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].requests > all[j].requests
+	})
+	if len(all) > maxSparkModels {
+		all = all[:maxSparkModels]
+	}
+	if len(all) == 0 {
+		return []string{"  (no recent traffic)"}
+	}
+
+	minutes := window.Minutes()
+	lines := make([]string, 0, len(all))
+	for _, s := range all {
+		lines = append(lines, fmt.Sprintf("  %-28s %s  %6.1f req/min  %8.0f tok/min",
+			s.model, sparkline(s.buckets[:]), float64(s.requests)/minutes, float64(s.tokens)/minutes))
+	}
+	return lines
+}
+
+func sparkline(values []int) string {
+	peak := 0
+	for _, v := range values {
+		peak = max(peak, v)
+	}
+	var b strings.Builder
+	for _, v := range values {
+		if peak == 0 || v == 0 {
+			b.WriteRune(' ')
+			continue
+		}
+		b.WriteRune(sparkBlocks[(v*(len(sparkBlocks)-1))/peak])
+	}
+	return b.String()
+}
+
+// fitWidth truncates a line to the terminal width, ignoring ANSI escape
+// sequences when counting visible characters.
+func fitWidth(line string, width int) string {
+	var b strings.Builder
+	visible := 0
+	inEscape := false
+	for _, r := range line {
+		switch {
+		case inEscape:
+			b.WriteRune(r)
+			if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') {
+				inEscape = false
+			}
+		case r == '\x1b':
+			inEscape = true
+			b.WriteRune(r)
+		case r == '\t':
+			b.WriteString("  ")
+			visible += 2
+		default:
+			if visible >= width {
+				continue
+			}
+			b.WriteRune(r)
+			visible++
+		}
+	}
+	return b.String()
+}
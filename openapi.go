@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"t-oai-api/proxy"
+)
+
+// runOpenAPI implements the openapi subcommand, which prints the admin API
+// document without starting the proxy.
+func runOpenAPI(args []string) error {
+	addr := os.Getenv("ADMIN_ADDR")
+	if len(args) > 0 {
+		addr = args[0]
+	}
+	if addr == "" {
+		addr = "127.0.0.1:8081"
+	}
+
+	s := &proxy.Server{}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(s.OpenAPISpec("http://" + addr)); err != nil {
+		return fmt.Errorf("failed to write OpenAPI document: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	requestsTotal    = counter("requests_total")
+	requestsInFlight = counter("requests_in_flight")
+	upstreamErrors   = counter("upstream_errors_total")
+)
+
+type InFlightRequest struct {
+	ID       string    `json:"id"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	ClientIP string    `json:"client_ip"`
+	Started  time.Time `json:"started"`
+	Elapsed  string    `json:"elapsed"`
+}
+
+// InFlightTracker records requests currently being proxied so they can be
+// inspected from the admin listener.
+type InFlightTracker struct {
+	mu       sync.Mutex
+	requests map[string]InFlightRequest
+}
+
+func NewInFlightTracker() *InFlightTracker {
+	return &InFlightTracker{
+		requests: make(map[string]InFlightRequest),
+	}
+}
+
+func (t *InFlightTracker) Start(reqID string, r *http.Request, clientIP string) {
+	t.mu.Lock()
+	t.requests[reqID] = InFlightRequest{
+		ID:       reqID,
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		ClientIP: clientIP,
+		Started:  time.Now(),
+	}
+	t.mu.Unlock()
+
+	requestsTotal.Add(1)
+	requestsInFlight.Add(1)
+}
+
+func (t *InFlightTracker) Done(reqID string) {
+	t.mu.Lock()
+	delete(t.requests, reqID)
+	t.mu.Unlock()
+
+	requestsInFlight.Add(-1)
+}
+
+// Snapshot returns the in-flight requests ordered by start time.
+func (t *InFlightTracker) Snapshot() []InFlightRequest {
+	now := time.Now()
+
+	t.mu.Lock()
+	requests := make([]InFlightRequest, 0, len(t.requests))
+	for _, req := range t.requests {
+		req.Elapsed = now.Sub(req.Started).String()
+		requests = append(requests, req)
+	}
+	t.mu.Unlock()
+
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].Started.Before(requests[j].Started)
+	})
+	return requests
+}
+
+type DebugState struct {
+	Timestamp  time.Time         `json:"timestamp"`
+	Uptime     string            `json:"uptime"`
+	Goroutines int               `json:"goroutines"`
+	Memory     MemoryState       `json:"memory"`
+	InFlight   []InFlightRequest `json:"in_flight"`
+	Queues     QueueState        `json:"queues"`
+	// RateLimits, Pacing, and Providers are the state of the rate limit
+	// queue, pacer, and status monitor, when enabled. A provider with
+	// Failover set has its traffic diverted to the fallback.
+	RateLimits []RateLimitStatus `json:"rate_limits,omitempty"`
+	Pacing     []PacingStatus    `json:"pacing,omitempty"`
+	Providers  []ProviderStatus  `json:"providers,omitempty"`
+}
+
+// QueueState counts the requests currently held before being sent upstream.
+type QueueState struct {
+	RateLimited int `json:"rate_limited"`
+	Paced       int `json:"paced"`
+}
+
+type MemoryState struct {
+	HeapAlloc  uint64 `json:"heap_alloc"`
+	HeapInuse  uint64 `json:"heap_inuse"`
+	Sys        uint64 `json:"sys"`
+	NumGC      uint32 `json:"num_gc"`
+	PauseTotal string `json:"pause_total"`
+}
+
+func (s *Server) DebugState() DebugState {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	now := time.Now()
+	state := DebugState{
+		Timestamp:  now,
+		Uptime:     now.Sub(s.started).String(),
+		Goroutines: runtime.NumGoroutine(),
+		Memory: MemoryState{
+			HeapAlloc:  mem.HeapAlloc,
+			HeapInuse:  mem.HeapInuse,
+			Sys:        mem.Sys,
+			NumGC:      mem.NumGC,
+			PauseTotal: time.Duration(mem.PauseTotalNs).String(),
+		},
+		InFlight: s.InFlight.Snapshot(),
+	}
+	if s.RateLimits != nil {
+		state.RateLimits = s.RateLimits.Status()
+		for _, st := range state.RateLimits {
+			state.Queues.RateLimited += st.Waiting
+		}
+	}
+	if s.Pacer != nil {
+		state.Pacing = s.Pacer.Status()
+		for _, st := range state.Pacing {
+			state.Queues.Paced += st.Waiting
+		}
+	}
+	if s.StatusMonitor != nil {
+		state.Providers = s.StatusMonitor.Statuses()
+	}
+	return state
+}
+
+// AdminHandler serves diagnostics endpoints. It is mounted on a separate
+// listener so profiling data is never exposed on the proxy port. It has no
+// authentication and serves request bodies, so that listener must only be
+// reachable from the host itself.
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	for _, route := range s.adminRoutes() {
+		if route.enabled {
+			mux.HandleFunc(route.Pattern, route.Handler)
+		}
+	}
+
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Annotator decides which clients receive an x_proxy object in their JSON
+// responses, keyed by the API key they authenticate with.
+type Annotator struct {
+	all  bool
+	keys map[string]bool
+}
+
+// NewAnnotator parses a comma-separated list of client API keys, or "*" for
+// every client. It returns nil when spec is empty.
+func NewAnnotator(spec string) *Annotator {
+	a := &Annotator{keys: make(map[string]bool)}
+	for _, key := range strings.Split(spec, ",") {
+		key = strings.TrimSpace(key)
+		switch key {
+		case "":
+		case "*":
+			a.all = true
+		default:
+			a.keys[key] = true
+		}
+	}
+	if !a.all && len(a.keys) == 0 {
+		return nil
+	}
+	return a
+}
+
+// Enabled reports whether responses to r should be annotated.
+func (a *Annotator) Enabled(r *http.Request) bool {
+	if a.all {
+		return true
+	}
+	key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && a.keys[strings.TrimSpace(key)]
+}
+
+// proxyAnnotation is the x_proxy object added to annotated responses.
+type proxyAnnotation struct {
+	RequestID string  `json:"request_id"`
+	Upstream  string  `json:"upstream"`
+	Cache     string  `json:"cache,omitempty"`
+	LatencyMs float64 `json:"latency_ms"`
+}
+
+// annotateResponse adds an x_proxy object to a non-streaming JSON response,
+// replacing its body. Other responses are left untouched.
+func annotateResponse(resp *http.Response, exchange *Exchange, upstream string, now time.Time) error {
+	if !strings.Contains(resp.Header.Get("Content-Type"), "application/json") || resp.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	annotated, ok := injectAnnotation(body, proxyAnnotation{
+		RequestID: exchange.ID,
+		Upstream:  upstream,
+		Cache:     resp.Header.Get("X-Embedding-Cache"),
+		LatencyMs: float64(now.Sub(exchange.Started).Microseconds()) / 1000,
+	})
+	if ok {
+		body = annotated
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Del("Content-Length")
+	return nil
+}
+
+// injectAnnotation appends an x_proxy field to a JSON object without
+// re-encoding the rest of the body. It reports false if body is not an object.
+func injectAnnotation(body []byte, annotation proxyAnnotation) ([]byte, bool) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) < 2 || trimmed[0] != '{' || trimmed[len(trimmed)-1] != '}' || !json.Valid(trimmed) {
+		return nil, false
+	}
+	field, err := json.Marshal(annotation)
+	if err != nil {
+		return nil, false
+	}
+
+	head := bytes.TrimRight(trimmed[:len(trimmed)-1], " \t\r\n")
+	out := make([]byte, 0, len(trimmed)+len(field)+16)
+	out = append(out, head...)
+	if len(head) > 1 {
+		out = append(out, ',')
+	}
+	out = append(out, `"x_proxy":`...)
+	out = append(out, field...)
+	return append(out, '}'), true
+}
@@ -0,0 +1,239 @@
+package proxy
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// anomalyInterval is the window traffic is counted over before it is
+	// folded into the baseline.
+	anomalyInterval = 5 * time.Minute
+	// anomalyWarmup is the number of intervals a key needs before its
+	// baseline is trusted.
+	anomalyWarmup = 12
+	// anomalyAlpha weights the newest interval in the moving baseline.
+	anomalyAlpha = 0.1
+	// anomalyEventLimit is the number of recent events kept for the admin API.
+	anomalyEventLimit = 200
+)
+
+var anomaliesTotal = counter("anomalies_total")
+
+// anomalyFloors are the smallest values per interval that can be flagged, and
+// the smallest baselines compared against, so a quiet key going from one
+// request to ten is not an alert.
+var anomalyFloors = map[string]float64{
+	"requests":   20,
+	"tokens":     20000,
+	"error_rate": 0.05,
+}
+
+// AnomalyEvent records a key whose traffic in the current interval reached
+// the configured multiple of its baseline.
+type AnomalyEvent struct {
+	Time     time.Time `json:"time"`
+	Key      string    `json:"key"`
+	Metric   string    `json:"metric"`
+	Value    float64   `json:"value"`
+	Baseline float64   `json:"baseline"`
+	Ratio    float64   `json:"ratio"`
+}
+
+// KeyBaseline is the learned traffic profile of one client key, per interval.
+type KeyBaseline struct {
+	Key       string  `json:"key"`
+	Intervals int     `json:"intervals"`
+	Warm      bool    `json:"warm"`
+	Requests  float64 `json:"requests"`
+	Tokens    float64 `json:"tokens"`
+	ErrorRate float64 `json:"error_rate"`
+	// Current holds the counts of the interval in progress.
+	Current trafficCounts `json:"current"`
+}
+
+// AnomalyReport is the response of GET /admin/anomalies.
+type AnomalyReport struct {
+	IntervalSeconds int            `json:"interval_seconds"`
+	Factor          float64        `json:"factor"`
+	Events          []AnomalyEvent `json:"events"`
+	Baselines       []KeyBaseline  `json:"baselines"`
+}
+
+type trafficCounts struct {
+	Requests int64 `json:"requests"`
+	Tokens   int64 `json:"tokens"`
+	Errors   int64 `json:"errors"`
+}
+
+func (c trafficCounts) errorRate() float64 {
+	if c.Requests == 0 {
+		return 0
+	}
+	return float64(c.Errors) / float64(c.Requests)
+}
+
+type keyTraffic struct {
+	interval  time.Time
+	current   trafficCounts
+	intervals int
+	requests  float64
+	tokens    float64
+	errorRate float64
+	fired     map[string]bool
+}
+
+// roll closes intervals up to the one containing t, folding each into the
+// baseline. Intervals without traffic count as zero.
+func (k *keyTraffic) roll(t time.Time) {
+	interval := t.Truncate(anomalyInterval)
+	for i := 0; k.interval.Before(interval); i++ {
+		if i == anomalyWarmup*24 {
+			// Long idle gaps all fold to zero; stop stepping one at a time.
+			k.interval = interval
+			break
+		}
+		k.fold()
+		k.interval = k.interval.Add(anomalyInterval)
+	}
+}
+
+func (k *keyTraffic) fold() {
+	c := k.current
+	if k.intervals == 0 {
+		k.requests, k.tokens, k.errorRate = float64(c.Requests), float64(c.Tokens), c.errorRate()
+	} else {
+		k.requests += anomalyAlpha * (float64(c.Requests) - k.requests)
+		k.tokens += anomalyAlpha * (float64(c.Tokens) - k.tokens)
+		if c.Requests > 0 {
+			k.errorRate += anomalyAlpha * (c.errorRate() - k.errorRate)
+		}
+	}
+	k.intervals++
+	k.current = trafficCounts{}
+	k.fired = nil
+}
+
+// AnomalyDetector baselines request rate, token volume, and error rate per
+// client key, and flags keys whose current interval reaches factor times
+// their baseline, such as a leaked key or a runaway agent.
+type AnomalyDetector struct {
+	factor float64
+
+	mu     sync.Mutex
+	keys   map[string]*keyTraffic
+	events []AnomalyEvent
+}
+
+// NewAnomalyDetector returns a detector that alerts at factor times the
+// baseline, or nil if factor is not above 1.
+func NewAnomalyDetector(factor float64) *AnomalyDetector {
+	if factor <= 1 {
+		return nil
+	}
+	return &AnomalyDetector{
+		factor: factor,
+		keys:   make(map[string]*keyTraffic),
+	}
+}
+
+// Observe counts a completed exchange and reports any anomaly it completes.
+// Counts are checked as they grow, so a spike is flagged as soon as it
+// crosses the threshold rather than when its interval ends.
+func (d *AnomalyDetector) Observe(e *Exchange) {
+	d.mu.Lock()
+	k, ok := d.keys[e.Key]
+	if !ok {
+		k = &keyTraffic{interval: e.Started.Truncate(anomalyInterval)}
+		d.keys[e.Key] = k
+	}
+	k.roll(e.Started)
+	k.current.Requests++
+	k.current.Tokens += int64(e.TotalTokens)
+	if e.Status == 0 || e.Status >= 400 {
+		k.current.Errors++
+	}
+
+	var events []AnomalyEvent
+	if k.intervals >= anomalyWarmup {
+		check := func(metric string, value, baseline float64) {
+			if k.fired[metric] || value < anomalyFloors[metric] {
+				return
+			}
+			baseline = max(baseline, anomalyFloors[metric]/d.factor)
+			if value < d.factor*baseline {
+				return
+			}
+			if k.fired == nil {
+				k.fired = make(map[string]bool)
+			}
+			k.fired[metric] = true
+			events = append(events, AnomalyEvent{
+				Time:     e.Started,
+				Key:      e.Key,
+				Metric:   metric,
+				Value:    value,
+				Baseline: baseline,
+				Ratio:    value / baseline,
+			})
+		}
+		check("requests", float64(k.current.Requests), k.requests)
+		check("tokens", float64(k.current.Tokens), k.tokens)
+		if k.current.Requests >= int64(anomalyFloors["requests"]) {
+			check("error_rate", k.current.errorRate(), k.errorRate)
+		}
+	}
+
+	d.events = append(d.events, events...)
+	if over := len(d.events) - anomalyEventLimit; over > 0 {
+		d.events = append(d.events[:0], d.events[over:]...)
+	}
+	d.mu.Unlock()
+
+	for _, ev := range events {
+		anomaliesTotal.Add(1)
+		key := ev.Key
+		if key == "" {
+			key = "(no key)"
+		}
+		log.Printf("Traffic anomaly: key %s %s at %.3g this interval, %.1fx its baseline of %.3g",
+			key, ev.Metric, ev.Value, ev.Ratio, ev.Baseline)
+	}
+}
+
+// Report returns recent events, newest first, and every key's baseline.
+func (d *AnomalyDetector) Report(now time.Time) AnomalyReport {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	report := AnomalyReport{
+		IntervalSeconds: int(anomalyInterval / time.Second),
+		Factor:          d.factor,
+		Events:          make([]AnomalyEvent, 0, len(d.events)),
+		Baselines:       make([]KeyBaseline, 0, len(d.keys)),
+	}
+	for i := len(d.events) - 1; i >= 0; i-- {
+		report.Events = append(report.Events, d.events[i])
+	}
+	for key, k := range d.keys {
+		k.roll(now)
+		report.Baselines = append(report.Baselines, KeyBaseline{
+			Key:       key,
+			Intervals: k.intervals,
+			Warm:      k.intervals >= anomalyWarmup,
+			Requests:  k.requests,
+			Tokens:    k.tokens,
+			ErrorRate: k.errorRate,
+			Current:   k.current,
+		})
+	}
+	sort.Slice(report.Baselines, func(i, j int) bool { return report.Baselines[i].Key < report.Baselines[j].Key })
+	return report
+}
+
+func (s *Server) handleAnomalies(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Anomalies.Report(s.now()))
+}
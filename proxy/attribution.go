@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// UpstreamHeaders sets the outbound User-Agent and adds attribution headers
+// per upstream host, such as HTTP-Referer and X-Title for OpenRouter, which
+// some aggregators use for routing, rankings, and billing.
+type UpstreamHeaders struct {
+	userAgent string
+	// hosts maps a host, host:port, or "*" for every upstream to the
+	// headers to set.
+	hosts map[string]map[string]string
+}
+
+// LoadUpstreamHeaders combines a User-Agent rule with per-host headers read
+// from the JSON file at path. Either may be empty; it returns nil if both are.
+func LoadUpstreamHeaders(userAgent, path string) (*UpstreamHeaders, error) {
+	if userAgent == "" && path == "" {
+		return nil, nil
+	}
+	u := &UpstreamHeaders{userAgent: userAgent}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read upstream headers file: %w", err)
+		}
+		if err := json.Unmarshal(data, &u.hosts); err != nil {
+			return nil, fmt.Errorf("invalid upstream headers file: %w", err)
+		}
+		for host, headers := range u.hosts {
+			for name := range headers {
+				if strings.EqualFold(name, "Host") || slices.ContainsFunc(hopHeaders, func(h string) bool { return strings.EqualFold(h, name) }) {
+					return nil, fmt.Errorf("invalid upstream headers file: %s may not be set (for %s)", name, host)
+				}
+			}
+		}
+	}
+	return u, nil
+}
+
+// Apply sets the headers for req's upstream host: first the User-Agent rule,
+// then the headers for every upstream, then those for the host itself.
+func (u *UpstreamHeaders) Apply(req *http.Request) {
+	if u.userAgent != "" {
+		setUpstreamHeader(req.Header, "User-Agent", u.userAgent)
+	}
+	keys := []string{"*", req.URL.Hostname()}
+	if req.URL.Host != req.URL.Hostname() {
+		keys = append(keys, req.URL.Host)
+	}
+	for _, key := range keys {
+		for name, value := range u.hosts[key] {
+			setUpstreamHeader(req.Header, name, value)
+		}
+	}
+}
+
+// setUpstreamHeader sets name to value. A value starting with + is appended to
+// the current value, separated by a space, and an empty value removes the
+// header.
+func setUpstreamHeader(h http.Header, name, value string) {
+	switch {
+	case value == "" && strings.EqualFold(name, "User-Agent"):
+		// An empty User-Agent stops the transport from adding its own.
+		h.Set(name, "")
+	case value == "":
+		h.Del(name)
+	case strings.HasPrefix(value, "+"):
+		if current := h.Get(name); current != "" {
+			value = current + " " + value[1:]
+		} else {
+			value = value[1:]
+		}
+		h.Set(name, value)
+	default:
+		h.Set(name, value)
+	}
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpstreamHeadersApply(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "upstream-headers.json")
+	os.WriteFile(path, []byte(`{
+		"*": {"X-Title": "proxy"},
+		"openrouter.ai": {"HTTP-Referer": "https://example.com"},
+		"localhost": {"X-Host": "localhost", "X-Title": "host"},
+		"localhost:8443": {"X-Title": "+port"}
+	}`), 0644)
+	u, err := LoadUpstreamHeaders("t-oai-api/1.0", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		url  string
+		want map[string]string
+	}{
+		{"https://openrouter.ai/api/v1/chat/completions", map[string]string{"X-Title": "proxy", "HTTP-Referer": "https://example.com"}},
+		{"http://localhost/v1/chat/completions", map[string]string{"X-Title": "host", "X-Host": "localhost"}},
+		{"http://localhost:8443/v1/chat/completions", map[string]string{"X-Title": "host port", "X-Host": "localhost"}},
+		{"http://localhost:9000/v1/chat/completions", map[string]string{"X-Title": "host", "X-Host": "localhost"}},
+		{"https://api.openai.com/v1/chat/completions", map[string]string{"X-Title": "proxy"}},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodPost, tt.url, nil)
+		u.Apply(req)
+		if got := req.Header.Get("User-Agent"); got != "t-oai-api/1.0" {
+			t.Errorf("%s: User-Agent = %q", tt.url, got)
+		}
+		if len(req.Header) != len(tt.want)+1 {
+			t.Errorf("%s: headers = %v", tt.url, req.Header)
+		}
+		for name, want := range tt.want {
+			if got := req.Header.Get(name); got != want {
+				t.Errorf("%s: %s = %q, want %q", tt.url, name, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// benchConcurrency is the number of simultaneous client streams exercised by
+// BenchmarkForward.
+var benchConcurrency = []int{1, 10, 100, 500}
+
+// BenchmarkForward measures the forwarding hot path end to end for buffered
+// and streamed responses, with logging off and on, at increasing numbers of
+// concurrent streams. Compare runs with `go run . bench compare`.
+func BenchmarkForward(b *testing.B) {
+	buffered := []byte(`{"id":"chatcmpl-bench","object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","content":"` +
+		strings.Repeat("lorem ipsum ", 400) + `"}}],"usage":{"total_tokens":1200}}`)
+	streamed := ssePayload(200)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.RawQuery, "stream") {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write(streamed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(buffered)
+	}))
+	defer upstream.Close()
+
+	for _, mode := range []string{"buffered", "streaming"} {
+		payload := buffered
+		path := "/chat/completions"
+		if mode == "streaming" {
+			payload = streamed
+			path += "?stream"
+		}
+
+		for _, logging := range []bool{false, true} {
+			cfg := Config{
+				OpenAIBaseURL: upstream.URL,
+				SpillDir:      b.TempDir(),
+			}
+			if logging {
+				cfg.LogRequests = true
+				cfg.LogResponses = true
+				cfg.RequestLogFile = filepath.Join(b.TempDir(), "bench.log")
+			}
+			server, err := NewServer(cfg, WithHTTPClient(benchClient()))
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			for _, streams := range benchConcurrency {
+				name := fmt.Sprintf("%s/log=%v/streams=%d", mode, logging, streams)
+				b.Run(name, func(b *testing.B) {
+					b.ReportAllocs()
+					b.SetBytes(int64(len(payload)))
+					runConcurrent(b, streams, func() {
+						req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"model":"gpt-bench","messages":[]}`))
+						rec := httptest.NewRecorder()
+						server.ServeHTTP(rec, req)
+						if rec.Code != http.StatusOK {
+							b.Errorf("status = %d", rec.Code)
+						}
+					})
+				})
+			}
+			server.Close()
+		}
+	}
+}
+
+// benchClient allows enough idle upstream connections that high-concurrency
+// runs measure the proxy rather than TCP connection setup.
+func benchClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = 1000
+	transport.MaxIdleConnsPerHost = 1000
+	return &http.Client{Transport: transport}
+}
+
+// runConcurrent calls fn b.N times in total from exactly n goroutines.
+func runConcurrent(b *testing.B, n int, fn func()) {
+	var remaining atomic.Int64
+	remaining.Store(int64(b.N))
+
+	var wg sync.WaitGroup
+	b.ResetTimer()
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for remaining.Add(-1) >= 0 {
+				fn()
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// defaultFallbackDelay matches the standard library's Happy Eyeballs delay
+// before the other address family is tried.
+const defaultFallbackDelay = 300 * time.Millisecond
+
+type ipFamily string
+
+const (
+	familyAuto ipFamily = "auto"
+	familyIPv4 ipFamily = "ipv4"
+	familyIPv6 ipFamily = "ipv6"
+)
+
+// parseIPFamilies parses a comma-separated list of families. A bare family
+// sets the default, host=family applies to one upstream host.
+func parseIPFamilies(spec string) (map[string]ipFamily, error) {
+	families := make(map[string]ipFamily)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		host, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			host, value = "*", entry
+		}
+		family := ipFamily(strings.ToLower(strings.TrimSpace(value)))
+		switch family {
+		case familyAuto, familyIPv4, familyIPv6:
+		default:
+			return nil, fmt.Errorf("invalid IP family %q: expected ipv4, ipv6, or auto", entry)
+		}
+		families[strings.ToLower(strings.TrimSpace(host))] = family
+	}
+	return families, nil
+}
+
+func (r *Resolver) familyFor(host string) ipFamily {
+	if family, ok := r.families[strings.ToLower(host)]; ok {
+		return family
+	}
+	if family, ok := r.families["*"]; ok {
+		return family
+	}
+	return familyAuto
+}
+
+// DialContext dials addr using LookupHost. Addresses are limited to the
+// host's configured IP family; otherwise both families are raced Happy
+// Eyeballs style, starting the second family after the fallback delay or as
+// soon as the first one fails. TLS still verifies against the original host
+// name, so pinning an address does not weaken certificate checks.
+func (r *Resolver) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return r.dialer.DialContext(ctx, network, addr)
+	}
+
+	addrs, err := r.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	family := r.familyFor(host)
+	switch family {
+	case familyIPv4:
+		addrs = filterAddrs(addrs, netip.Addr.Is4)
+	case familyIPv6:
+		addrs = filterAddrs(addrs, netip.Addr.Is6)
+	}
+	if len(addrs) == 0 {
+		if family != familyAuto {
+			return nil, fmt.Errorf("no %s addresses for %s", family, host)
+		}
+		return nil, fmt.Errorf("no addresses for %s", host)
+	}
+
+	primary := filterAddrs(addrs, func(a netip.Addr) bool { return a.Is4() == addrs[0].Is4() })
+	fallback := filterAddrs(addrs, func(a netip.Addr) bool { return a.Is4() != addrs[0].Is4() })
+	if len(fallback) == 0 || r.fallbackDelay < 0 {
+		return r.dialSerial(ctx, network, addrs, port)
+	}
+	return r.dialParallel(ctx, network, primary, fallback, port)
+}
+
+// dialSerial tries each address in turn until one connects.
+func (r *Resolver) dialSerial(ctx context.Context, network string, addrs []netip.Addr, port string) (net.Conn, error) {
+	var errs []error
+	for _, ip := range addrs {
+		conn, err := r.dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// dialParallel races the primary addresses against the fallback ones, which
+// start after the fallback delay or once the primaries have all failed.
+func (r *Resolver) dialParallel(ctx context.Context, network string, primary, fallback []netip.Addr, port string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, 2)
+	start := func(addrs []netip.Addr, primary bool) {
+		go func() {
+			conn, err := r.dialSerial(ctx, network, addrs, port)
+			results <- dialResult{conn, err, primary}
+		}()
+	}
+
+	start(primary, true)
+	timer := time.NewTimer(r.fallbackDelay)
+	defer timer.Stop()
+
+	fallbackStarted := false
+	var errs []error
+	for pending := 1; pending > 0; {
+		select {
+		case <-timer.C:
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				start(fallback, false)
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				if pending > 0 {
+					go closeLateConn(results)
+				}
+				return res.conn, nil
+			}
+			errs = append(errs, res.err)
+			if res.primary && !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				start(fallback, false)
+			}
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+type dialResult struct {
+	conn    net.Conn
+	err     error
+	primary bool
+}
+
+// closeLateConn closes the connection of a dial that lost the race.
+func closeLateConn(results <-chan dialResult) {
+	if res := <-results; res.conn != nil {
+		res.conn.Close()
+	}
+}
+
+func filterAddrs(addrs []netip.Addr, keep func(netip.Addr) bool) []netip.Addr {
+	var out []netip.Addr
+	for _, a := range addrs {
+		if keep(a) {
+			out = append(out, a)
+		}
+	}
+	return out
+}
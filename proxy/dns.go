@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"t-oai-api/config"
+)
+
+var (
+	dnsCacheHits   = counter("dns_cache_hits_total")
+	dnsCacheMisses = counter("dns_cache_misses_total")
+)
+
+// Resolver resolves upstream hosts for the proxy's dialer. Pinned hosts never
+// touch DNS; everything else goes to the system or a custom resolver, with
+// answers optionally cached for a fixed TTL.
+type Resolver struct {
+	pins     map[string][]netip.Addr
+	resolver *net.Resolver
+	ttl      time.Duration
+	dialer   net.Dialer
+
+	// families maps hosts to the IP family they must be dialed over, with
+	// "*" as the default for unlisted hosts.
+	families      map[string]ipFamily
+	fallbackDelay time.Duration
+
+	mu    sync.Mutex
+	cache map[string]dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+// NewResolver builds a resolver from the DNS and dialing settings in cfg:
+// host=ip pins (repeat a host to pin several addresses), an optional DNS
+// server, a cache TTL, IP family preferences, and the dual-stack fallback
+// delay. It returns nil when none of them is set, leaving the default dialer
+// in place.
+func NewResolver(cfg config.Config) (*Resolver, error) {
+	pins, err := parseDNSOverrides(cfg.DNSOverrides)
+	if err != nil {
+		return nil, err
+	}
+	families, err := parseIPFamilies(cfg.IPFamily)
+	if err != nil {
+		return nil, err
+	}
+	server := cfg.DNSServer
+	ttl := time.Duration(cfg.DNSCacheTTL) * time.Second
+	if len(pins) == 0 && server == "" && ttl <= 0 && len(families) == 0 && cfg.DialFallbackDelay == 0 {
+		return nil, nil
+	}
+
+	r := &Resolver{
+		pins:          pins,
+		resolver:      net.DefaultResolver,
+		ttl:           ttl,
+		families:      families,
+		fallbackDelay: time.Duration(cfg.DialFallbackDelay) * time.Millisecond,
+		dialer:        net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+		cache:         make(map[string]dnsCacheEntry),
+	}
+	if r.fallbackDelay == 0 {
+		r.fallbackDelay = defaultFallbackDelay
+	}
+	if server != "" {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		r.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+	return r, nil
+}
+
+func parseDNSOverrides(spec string) (map[string][]netip.Addr, error) {
+	pins := make(map[string][]netip.Addr)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		host, ip, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid DNS override %q: expected host=ip", entry)
+		}
+		addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+		if err != nil {
+			return nil, fmt.Errorf("invalid DNS override %q: %w", entry, err)
+		}
+		host = strings.ToLower(strings.TrimSpace(host))
+		pins[host] = append(pins[host], addr.Unmap())
+	}
+	return pins, nil
+}
+
+// LookupHost returns the addresses for host, preferring pins, then the cache.
+func (r *Resolver) LookupHost(ctx context.Context, host string) ([]netip.Addr, error) {
+	host = strings.ToLower(host)
+	if addrs, ok := r.pins[host]; ok {
+		return addrs, nil
+	}
+
+	if r.ttl > 0 {
+		r.mu.Lock()
+		entry, ok := r.cache[host]
+		r.mu.Unlock()
+		if ok && time.Now().Before(entry.expires) {
+			dnsCacheHits.Add(1)
+			return entry.addrs, nil
+		}
+		dnsCacheMisses.Add(1)
+	}
+
+	addrs, err := r.resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	for i, addr := range addrs {
+		addrs[i] = addr.Unmap()
+	}
+
+	if r.ttl > 0 {
+		r.mu.Lock()
+		r.cache[host] = dnsCacheEntry{addrs: addrs, expires: time.Now().Add(r.ttl)}
+		r.mu.Unlock()
+	}
+	return addrs, nil
+}
+
+// Transport returns a copy of the default transport that dials through r.
+func (r *Resolver) Transport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = r.DialContext
+	return transport
+}
@@ -0,0 +1,542 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	embeddingCacheHits   = counter("embedding_cache_hits_total")
+	embeddingCacheMisses = counter("embedding_cache_misses_total")
+	embeddingCacheErrors = counter("embedding_cache_errors_total")
+	embeddingBatchSplits = counter("embedding_batch_splits_total")
+)
+
+// EmbeddingCache persists embedding vectors on disk keyed by a hash of the
+// upstream, credential, model, embedding options, and a single input item, so
+// unchanged documents are never re-embedded across pipeline runs. Keying by
+// credential keeps clients with different keys from reading each other's
+// entries, or learning through X-Embedding-Cache what others have embedded.
+type EmbeddingCache struct {
+	dir string
+}
+
+type cachedEmbedding struct {
+	Model     string          `json:"model"`
+	Embedding json.RawMessage `json:"embedding"`
+}
+
+func NewEmbeddingCache(dir string) (*EmbeddingCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create embedding cache directory: %w", err)
+	}
+	return &EmbeddingCache{dir: dir}, nil
+}
+
+func (c *EmbeddingCache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key+".json")
+}
+
+func (c *EmbeddingCache) Get(key string) (json.RawMessage, bool) {
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return nil, false
+	}
+	var entry cachedEmbedding
+	if json.Unmarshal(data, &entry) != nil {
+		return nil, false
+	}
+	return entry.Embedding, true
+}
+
+func (c *EmbeddingCache) Put(key, model string, embedding json.RawMessage) error {
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(cachedEmbedding{Model: model, Embedding: embedding})
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+type EmbeddingCacheStats struct {
+	Entries int64 `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+}
+
+func (c *EmbeddingCache) Stats() (EmbeddingCacheStats, error) {
+	stats := EmbeddingCacheStats{
+		Hits:   embeddingCacheHits.Value(),
+		Misses: embeddingCacheMisses.Value(),
+	}
+	err := filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".json") {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		stats.Entries++
+		stats.Bytes += info.Size()
+		return nil
+	})
+	return stats, err
+}
+
+// Purge removes cached embeddings, restricted to one model when model is set,
+// and returns the number of entries removed.
+func (c *EmbeddingCache) Purge(model string) (int, error) {
+	removed := 0
+	err := filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".json") {
+			return err
+		}
+		if model != "" {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			var entry cachedEmbedding
+			if json.Unmarshal(data, &entry) == nil && entry.Model != model {
+				return nil
+			}
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
+
+// embeddingRequest is a decoded embeddings request with its input normalised
+// to a list of raw items.
+type embeddingRequest struct {
+	fields map[string]json.RawMessage
+	model  string
+	inputs []json.RawMessage
+	single bool
+}
+
+func parseEmbeddingRequest(body []byte) (*embeddingRequest, bool) {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) != nil {
+		return nil, false
+	}
+	var model string
+	if json.Unmarshal(fields["model"], &model) != nil || model == "" {
+		return nil, false
+	}
+	raw, ok := fields["input"]
+	if !ok {
+		return nil, false
+	}
+
+	req := &embeddingRequest{fields: fields, model: model}
+
+	// A string or a flat token array is a single input; an array of strings
+	// or of token arrays is a batch.
+	var items []json.RawMessage
+	if json.Unmarshal(raw, &items) != nil {
+		req.inputs = []json.RawMessage{raw}
+		req.single = true
+		return req, true
+	}
+	if len(items) > 0 && isJSONNumber(items[0]) {
+		req.inputs = []json.RawMessage{raw}
+		req.single = true
+		return req, true
+	}
+	req.inputs = items
+	return req, true
+}
+
+func isJSONNumber(raw json.RawMessage) bool {
+	_, err := strconv.ParseFloat(string(bytes.TrimSpace(raw)), 64)
+	return err == nil
+}
+
+// embeddingCacheScope names the upstream endpoint and credential proxyReq is
+// sent with; cache entries are only shared within a scope.
+func embeddingCacheScope(proxyReq *http.Request) string {
+	u := proxyReq.URL
+	return u.Scheme + "://" + u.Host + u.Path + "\x00" + credentialHash(proxyReq.Header)
+}
+
+// cacheKey hashes the scope, the model, every option that affects the
+// vector, and the input item.
+func (e *embeddingRequest) cacheKey(scope string, input json.RawMessage) string {
+	h := sha256.New()
+	io.WriteString(h, scope)
+	h.Write([]byte{0})
+	io.WriteString(h, e.model)
+	for _, field := range []string{"dimensions", "encoding_format"} {
+		h.Write([]byte{0})
+		h.Write(e.fields[field])
+	}
+	h.Write([]byte{0})
+	h.Write(input)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// body re-encodes the request with the given inputs.
+func (e *embeddingRequest) body(inputs []json.RawMessage) ([]byte, error) {
+	fields := make(map[string]json.RawMessage, len(e.fields))
+	for k, v := range e.fields {
+		fields[k] = v
+	}
+	if e.single && len(inputs) == 1 {
+		fields["input"] = inputs[0]
+	} else {
+		data, err := json.Marshal(inputs)
+		if err != nil {
+			return nil, err
+		}
+		fields["input"] = data
+	}
+	return json.Marshal(fields)
+}
+
+type embeddingData struct {
+	Object    string          `json:"object"`
+	Index     int             `json:"index"`
+	Embedding json.RawMessage `json:"embedding"`
+}
+
+type embeddingResponse struct {
+	Object string          `json:"object"`
+	Data   []embeddingData `json:"data"`
+	Model  string          `json:"model"`
+	Usage  json.RawMessage `json:"usage,omitempty"`
+}
+
+// isEmbeddingsRequest reports whether r targets the embeddings endpoint.
+func isEmbeddingsRequest(r *http.Request) bool {
+	return r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/embeddings")
+}
+
+// embeddingsRoundTrip forwards an embeddings request, serving cached inputs
+// locally when the cache is enabled and splitting batches the upstream rejects
+// as too large. The response preserves the original input order.
+func (s *Server) embeddingsRoundTrip(proxyReq *http.Request, body []byte) (*http.Response, error) {
+	req, ok := parseEmbeddingRequest(body)
+	if !ok || len(req.inputs) == 0 {
+		return s.client.Do(proxyReq)
+	}
+	if s.EmbeddingCache == nil {
+		return s.uncachedEmbeddingsRoundTrip(proxyReq, req)
+	}
+
+	vectors := make([]json.RawMessage, len(req.inputs))
+	keys := make([]string, len(req.inputs))
+	scope := embeddingCacheScope(proxyReq)
+	var missing []int
+	for i, input := range req.inputs {
+		keys[i] = req.cacheKey(scope, input)
+		if v, ok := s.EmbeddingCache.Get(keys[i]); ok {
+			vectors[i] = v
+			embeddingCacheHits.Add(1)
+		} else {
+			missing = append(missing, i)
+			embeddingCacheMisses.Add(1)
+		}
+	}
+
+	cacheStatus := "HIT"
+	header := http.Header{"Content-Type": []string{"application/json"}}
+	usage := json.RawMessage(`{"prompt_tokens":0,"total_tokens":0}`)
+
+	if len(missing) > 0 {
+		cacheStatus = "MISS"
+		if len(missing) < len(req.inputs) {
+			cacheStatus = "PARTIAL"
+		}
+
+		inputs := make([]json.RawMessage, len(missing))
+		for j, i := range missing {
+			inputs[j] = req.inputs[i]
+		}
+		resp, parsed, err := s.fetchEmbeddings(proxyReq, req, inputs)
+		if err != nil {
+			return nil, err
+		}
+		if parsed == nil {
+			return resp, nil
+		}
+
+		for j, v := range parsed.vectors {
+			i := missing[j]
+			vectors[i] = v
+			if err := s.EmbeddingCache.Put(keys[i], req.model, v); err != nil {
+				embeddingCacheErrors.Add(1)
+			}
+		}
+		header = resp.Header.Clone()
+		if len(parsed.usage) > 0 {
+			usage = parsed.usage
+		}
+	}
+
+	header.Set("X-Embedding-Cache", cacheStatus)
+	return mergedEmbeddingsResponse(proxyReq, req, header, vectors, usage)
+}
+
+// uncachedEmbeddingsRoundTrip sends the request body unchanged and only falls
+// back to splitting the batch when the upstream rejects it as too large.
+func (s *Server) uncachedEmbeddingsRoundTrip(proxyReq *http.Request, req *embeddingRequest) (*http.Response, error) {
+	var resp *http.Response
+	if max := s.Config.EmbeddingMaxBatch; max <= 0 || len(req.inputs) <= max {
+		var err error
+		resp, err = s.client.Do(proxyReq)
+		if err != nil || len(req.inputs) < 2 || !mayBeBatchLimit(resp.StatusCode) {
+			return resp, err
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if !isBatchLimitError(resp.StatusCode, body) {
+			return syntheticResponse(proxyReq, resp.StatusCode, resp.Header, body), nil
+		}
+		embeddingBatchSplits.Add(1)
+	}
+
+	resp, parsed, err := s.fetchEmbeddingBatches(proxyReq, req, splitInputs(req.inputs, s.Config.EmbeddingMaxBatch))
+	if err != nil || parsed == nil {
+		return resp, err
+	}
+	return mergedEmbeddingsResponse(proxyReq, req, resp.Header.Clone(), parsed.vectors, parsed.usage)
+}
+
+// embeddingResult holds vectors in input order and the summed usage of every
+// upstream call that produced them.
+type embeddingResult struct {
+	vectors []json.RawMessage
+	usage   json.RawMessage
+}
+
+// fetchEmbeddings sends inputs upstream, splitting the batch in half whenever
+// the upstream rejects it for exceeding its batch or token limits. If any part
+// fails for another reason, that response is returned for relaying and the
+// result is nil.
+func (s *Server) fetchEmbeddings(proxyReq *http.Request, req *embeddingRequest, inputs []json.RawMessage) (*http.Response, *embeddingResult, error) {
+	if max := s.Config.EmbeddingMaxBatch; max > 0 && len(inputs) > max {
+		return s.fetchEmbeddingBatches(proxyReq, req, splitInputs(inputs, max))
+	}
+
+	resp, parsed, err := s.sendEmbeddings(proxyReq, req, inputs)
+	if err != nil {
+		return nil, nil, err
+	}
+	if parsed != nil {
+		result, err := parsed.result(len(inputs))
+		return resp, result, err
+	}
+	if len(inputs) < 2 || !mayBeBatchLimit(resp.StatusCode) {
+		return resp, nil, nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !isBatchLimitError(resp.StatusCode, body) {
+		return syntheticResponse(proxyReq, resp.StatusCode, resp.Header, body), nil, nil
+	}
+	embeddingBatchSplits.Add(1)
+	return s.fetchEmbeddingBatches(proxyReq, req, splitInputs(inputs, 0))
+}
+
+// fetchEmbeddingBatches fetches each batch in turn and concatenates the
+// results. The returned response carries the headers of the first batch.
+func (s *Server) fetchEmbeddingBatches(proxyReq *http.Request, req *embeddingRequest, batches [][]json.RawMessage) (*http.Response, *embeddingResult, error) {
+	var first *http.Response
+	merged := &embeddingResult{}
+	var promptTokens, totalTokens int
+	for _, batch := range batches {
+		resp, result, err := s.fetchEmbeddings(proxyReq, req, batch)
+		if err != nil || result == nil {
+			return resp, nil, err
+		}
+		if first == nil {
+			first = resp
+		}
+		merged.vectors = append(merged.vectors, result.vectors...)
+
+		var usage struct {
+			PromptTokens int `json:"prompt_tokens"`
+			TotalTokens  int `json:"total_tokens"`
+		}
+		if json.Unmarshal(result.usage, &usage) == nil {
+			promptTokens += usage.PromptTokens
+			totalTokens += usage.TotalTokens
+		}
+	}
+
+	usage, err := json.Marshal(map[string]int{"prompt_tokens": promptTokens, "total_tokens": totalTokens})
+	if err != nil {
+		return nil, nil, err
+	}
+	merged.usage = usage
+	return first, merged, nil
+}
+
+// splitInputs divides inputs into batches of at most size items, or into two
+// halves when size is 0.
+func splitInputs(inputs []json.RawMessage, size int) [][]json.RawMessage {
+	if size <= 0 {
+		size = (len(inputs) + 1) / 2
+	}
+	var batches [][]json.RawMessage
+	for len(inputs) > size {
+		batches = append(batches, inputs[:size])
+		inputs = inputs[size:]
+	}
+	return append(batches, inputs)
+}
+
+func mayBeBatchLimit(status int) bool {
+	return status == http.StatusRequestEntityTooLarge || status == http.StatusBadRequest
+}
+
+// batchLimitPattern matches the error messages upstreams use when an
+// embeddings request has too many inputs or tokens.
+var batchLimitPattern = regexp.MustCompile(`(?i)too many|too large|too long|maximum|max_tokens_per_request|exceed|limit`)
+
+// isBatchLimitError reports whether an error response rejects the request for
+// its size. A 413 always does; a 400 only when its message says so.
+func isBatchLimitError(status int, body []byte) bool {
+	if status == http.StatusRequestEntityTooLarge {
+		return true
+	}
+	var apiErr struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &apiErr) != nil {
+		return false
+	}
+	return batchLimitPattern.MatchString(apiErr.Error.Message)
+}
+
+// result orders the response's vectors by index, checking that there is
+// exactly one per input.
+func (r *embeddingResponse) result(n int) (*embeddingResult, error) {
+	if len(r.Data) != n {
+		return nil, fmt.Errorf("upstream returned %d embeddings for %d inputs", len(r.Data), n)
+	}
+	vectors := make([]json.RawMessage, n)
+	for _, d := range r.Data {
+		if d.Index < 0 || d.Index >= n {
+			return nil, fmt.Errorf("upstream returned out of range embedding index %d", d.Index)
+		}
+		vectors[d.Index] = d.Embedding
+	}
+	return &embeddingResult{vectors: vectors, usage: r.Usage}, nil
+}
+
+// mergedEmbeddingsResponse encodes vectors as a single embeddings response.
+func mergedEmbeddingsResponse(proxyReq *http.Request, req *embeddingRequest, header http.Header, vectors []json.RawMessage, usage json.RawMessage) (*http.Response, error) {
+	merged := embeddingResponse{Object: "list", Model: req.model, Usage: usage}
+	for i, v := range vectors {
+		merged.Data = append(merged.Data, embeddingData{Object: "embedding", Index: i, Embedding: v})
+	}
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+
+	header.Del("Content-Length")
+	header.Del("Content-Encoding")
+	return syntheticResponse(proxyReq, http.StatusOK, header, data), nil
+}
+
+// sendEmbeddings posts inputs upstream using proxyReq's URL and headers. On a
+// non-200 status the parsed result is nil and the response is left unread for
+// relaying as-is.
+func (s *Server) sendEmbeddings(proxyReq *http.Request, req *embeddingRequest, inputs []json.RawMessage) (*http.Response, *embeddingResponse, error) {
+	body, err := req.body(inputs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	out := proxyReq.Clone(proxyReq.Context())
+	out.Body = io.NopCloser(bytes.NewReader(body))
+	out.ContentLength = int64(len(body))
+	out.Header.Del("Content-Length")
+	// Let the transport negotiate gzip so the body is decoded for us.
+	out.Header.Del("Accept-Encoding")
+
+	resp, err := s.client.Do(out)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp, nil, nil
+	}
+	defer resp.Body.Close()
+
+	var parsed embeddingResponse
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return nil, nil, fmt.Errorf("invalid embeddings response: %w", err)
+	}
+	return resp, &parsed, nil
+}
+
+// syntheticResponse builds a response the relay path can treat like one
+// received from upstream.
+func syntheticResponse(req *http.Request, status int, header http.Header, body []byte) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+func (s *Server) handleEmbeddingCacheStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := s.EmbeddingCache.Stats()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func (s *Server) handleEmbeddingCachePurge(w http.ResponseWriter, r *http.Request) {
+	removed, err := s.EmbeddingCache.Purge(r.URL.Query().Get("model"))
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"removed": removed})
+}
@@ -0,0 +1,407 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"t-oai-api/logging"
+)
+
+// Subject identifies a data subject's exchanges: those whose request body
+// carries their user field, or a metadata tag naming them.
+type Subject struct {
+	User     string
+	TagKey   string
+	TagValue string
+}
+
+// ParseSubject reads a subject from the user or tag (key:value) query
+// parameter; exactly one must be set.
+func ParseSubject(q url.Values) (Subject, error) {
+	user, tag := q.Get("user"), q.Get("tag")
+	switch {
+	case user != "" && tag != "":
+		return Subject{}, fmt.Errorf("set either user or tag, not both")
+	case user != "":
+		return Subject{User: user}, nil
+	case tag != "":
+		key, value, ok := strings.Cut(tag, ":")
+		if !ok || key == "" {
+			return Subject{}, fmt.Errorf("tag must be key:value")
+		}
+		return Subject{TagKey: key, TagValue: value}, nil
+	}
+	return Subject{}, fmt.Errorf("user or tag is required")
+}
+
+func (s Subject) String() string {
+	if s.User != "" {
+		return "user:" + s.User
+	}
+	return "tag:" + s.TagKey + ":" + s.TagValue
+}
+
+// Matches reports whether the request body belongs to the subject.
+func (s Subject) Matches(body []byte) bool {
+	var fields struct {
+		User     string                     `json:"user"`
+		Metadata map[string]json.RawMessage `json:"metadata"`
+	}
+	if json.Unmarshal(body, &fields) != nil {
+		return false
+	}
+	if s.User != "" {
+		return fields.User == s.User
+	}
+	var value string
+	return json.Unmarshal(fields.Metadata[s.TagKey], &value) == nil && value == s.TagValue
+}
+
+// SubjectExport is everything the proxy stores about a data subject.
+type SubjectExport struct {
+	Subject   string             `json:"subject"`
+	Exported  time.Time          `json:"exported"`
+	Exchanges []ExportedExchange `json:"exchanges"`
+}
+
+// ExportedExchange is one exchange as held by each store.
+type ExportedExchange struct {
+	ID string `json:"id"`
+	// Summary is the exchange as listed by /admin/requests, while retained.
+	Summary *Exchange `json:"summary,omitempty"`
+	// Log holds the exchange's log entries: objects from JSON logs, strings
+	// from text logs.
+	Log []json.RawMessage `json:"log,omitempty"`
+	// Files maps spilled body, overflow, and transcript paths to their
+	// contents.
+	Files     map[string]string `json:"files,omitempty"`
+	Recording *RecordedExchange `json:"recording,omitempty"`
+}
+
+// ErasureReport lists what an erasure removed, or would remove on a dry run.
+type ErasureReport struct {
+	Subject    string    `json:"subject"`
+	DryRun     bool      `json:"dry_run"`
+	Completed  time.Time `json:"completed"`
+	RequestIDs []string  `json:"request_ids"`
+	// LogEntries counts the entries replaced with tombstones per log file.
+	LogEntries   map[string]int `json:"log_entries"`
+	FilesDeleted []string       `json:"files_deleted"`
+	Recordings   int            `json:"recordings"`
+	History      int            `json:"history"`
+	// ConversationTurns counts the turns dropped from conversation memory.
+	ConversationTurns int `json:"conversation_turns"`
+	// NotCovered lists places outside the proxy's reach that may still hold
+	// the subject's data.
+	NotCovered []string `json:"not_covered,omitempty"`
+	Errors     []string `json:"errors,omitempty"`
+}
+
+// subjectData is what locateSubject found, keyed by request ID.
+type subjectData struct {
+	ids        map[string]bool
+	logs       map[string]int
+	entries    map[string][]json.RawMessage
+	files      map[string][]string
+	recordings map[string]*RecordedExchange
+	history    map[string]Exchange
+	errors     []string
+}
+
+// locateSubject finds the subject's exchanges in every store. Request bodies
+// in the logs, the recording, and the history identify them; a second pass
+// over the logs collects their responses and body files.
+func (s *Server) locateSubject(subject Subject) *subjectData {
+	d := &subjectData{
+		ids:        make(map[string]bool),
+		logs:       make(map[string]int),
+		entries:    make(map[string][]json.RawMessage),
+		files:      make(map[string][]string),
+		recordings: make(map[string]*RecordedExchange),
+		history:    make(map[string]Exchange),
+	}
+	fail := func(err error) {
+		d.errors = append(d.errors, err.Error())
+	}
+
+	logFiles, err := s.Logger.Files()
+	if err != nil {
+		fail(err)
+	}
+	for _, path := range logFiles {
+		err := logging.ReadLog(path, func(e *logging.StoredEntry) error {
+			if e.Type != "request" {
+				return nil
+			}
+			body, err := e.ReadBody()
+			if err != nil {
+				fail(err)
+			}
+			if subject.Matches(body) {
+				d.ids[e.ID] = true
+			}
+			return nil
+		})
+		if err != nil {
+			fail(fmt.Errorf("failed to read %s: %w", path, err))
+		}
+	}
+
+	if s.Recorder != nil {
+		recorded, err := s.Recorder.exchanges()
+		if err != nil {
+			fail(err)
+		}
+		for _, e := range recorded {
+			if subject.Matches(e.Body) {
+				d.ids[e.ID] = true
+			}
+			d.recordings[e.ID] = e
+		}
+	}
+
+	for _, e := range s.Recent.List() {
+		// Previews are cut at previewLimit, so long bodies only match
+		// through the logs or the recording.
+		if subject.Matches([]byte(e.RequestBody)) {
+			d.ids[e.ID] = true
+		}
+		d.history[e.ID] = e
+	}
+	for id := range d.recordings {
+		if !d.ids[id] {
+			delete(d.recordings, id)
+		}
+	}
+	for id := range d.history {
+		if !d.ids[id] {
+			delete(d.history, id)
+		}
+	}
+	if len(d.ids) == 0 {
+		return d
+	}
+
+	for _, path := range logFiles {
+		err := logging.ReadLog(path, func(e *logging.StoredEntry) error {
+			if !d.ids[e.ID] {
+				return nil
+			}
+			d.logs[path]++
+			raw := json.RawMessage(e.Raw)
+			if !e.JSON {
+				raw, _ = json.Marshal(string(e.Raw))
+			}
+			d.entries[e.ID] = append(d.entries[e.ID], raw)
+			for _, file := range []string{e.BodyFile, e.OverflowFile} {
+				if file != "" {
+					d.files[e.ID] = append(d.files[e.ID], file)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			fail(fmt.Errorf("failed to read %s: %w", path, err))
+		}
+	}
+
+	if s.Transcripts != nil {
+		names := make(map[string]string, len(d.ids))
+		for id := range d.ids {
+			names["-"+sanitizeFileName(id)+".md"] = id
+		}
+		err := filepath.WalkDir(s.Transcripts.dir, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return err
+			}
+			name := entry.Name()
+			if i := strings.Index(name, "-"); i >= 0 {
+				if id, ok := names[name[i:]]; ok {
+					d.files[id] = append(d.files[id], path)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			fail(fmt.Errorf("failed to search transcripts: %w", err))
+		}
+	}
+	return d
+}
+
+func (d *subjectData) sortedIDs() []string {
+	ids := make([]string, 0, len(d.ids))
+	for id := range d.ids {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// notCovered lists the configured places the proxy cannot search.
+func (s *Server) notCovered() []string {
+	var places []string
+	if s.Config.LogToStdout {
+		places = append(places, "log output to stdout")
+	}
+	if s.ExecHooks != nil {
+		places = append(places, "data kept by exec hook commands")
+	}
+	if s.EmbeddingCache != nil {
+		places = append(places, "embeddings cache, which is keyed by input rather than request")
+	}
+	return places
+}
+
+// ExportSubject collects every stored exchange of subject.
+func (s *Server) ExportSubject(subject Subject) (*SubjectExport, error) {
+	d := s.locateSubject(subject)
+	if len(d.errors) > 0 {
+		return nil, errors.New(strings.Join(d.errors, "; "))
+	}
+
+	export := &SubjectExport{
+		Subject:   subject.String(),
+		Exported:  time.Now().UTC(),
+		Exchanges: []ExportedExchange{},
+	}
+	for _, id := range d.sortedIDs() {
+		exported := ExportedExchange{ID: id, Log: d.entries[id], Recording: d.recordings[id]}
+		if e, ok := d.history[id]; ok {
+			exported.Summary = &e
+		}
+		for _, path := range d.files[id] {
+			data, err := logging.ReadStoredFile(path)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if exported.Files == nil {
+				exported.Files = make(map[string]string)
+			}
+			exported.Files[path] = string(data)
+		}
+		export.Exchanges = append(export.Exchanges, exported)
+	}
+	return export, nil
+}
+
+// EraseSubject removes every stored exchange of subject: log entries become
+// tombstones, body files and transcripts are deleted, and the exchanges are
+// dropped from the recording and the history. A dry run only reports what
+// would be removed. Errors in one store do not stop the others.
+func (s *Server) EraseSubject(subject Subject, dryRun bool) *ErasureReport {
+	d := s.locateSubject(subject)
+	report := &ErasureReport{
+		Subject:      subject.String(),
+		DryRun:       dryRun,
+		RequestIDs:   d.sortedIDs(),
+		LogEntries:   d.logs,
+		FilesDeleted: []string{},
+		Recordings:   len(d.recordings),
+		History:      len(d.history),
+		NotCovered:   s.notCovered(),
+		Errors:       d.errors,
+	}
+	for _, id := range report.RequestIDs {
+		report.FilesDeleted = append(report.FilesDeleted, d.files[id]...)
+	}
+	if dryRun || len(d.ids) == 0 {
+		report.Completed = time.Now().UTC()
+		return report
+	}
+	fail := func(err error) {
+		report.Errors = append(report.Errors, err.Error())
+	}
+
+	for path := range d.logs {
+		n, err := s.Logger.Erase(path, d.ids)
+		if err != nil {
+			fail(err)
+		}
+		report.LogEntries[path] = n
+	}
+
+	deleted := report.FilesDeleted[:0]
+	for _, path := range report.FilesDeleted {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			fail(err)
+			continue
+		}
+		deleted = append(deleted, path)
+	}
+	report.FilesDeleted = deleted
+
+	if s.Recorder != nil && len(d.recordings) > 0 {
+		n, err := s.Recorder.Erase(d.ids)
+		if err != nil {
+			fail(err)
+		}
+		report.Recordings = n
+	}
+	report.History = s.Recent.Remove(d.ids)
+	if s.Memory != nil {
+		report.ConversationTurns = s.Memory.Erase(d.ids)
+	}
+
+	report.Completed = time.Now().UTC()
+	log.Printf("Erased %d exchanges of a data subject (%d log entries, %d files, %d errors)",
+		len(report.RequestIDs), sumCounts(report.LogEntries), len(report.FilesDeleted), len(report.Errors))
+	return report
+}
+
+func sumCounts(counts map[string]int) int {
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	return total
+}
+
+func (s *Server) handleSubjectExport(w http.ResponseWriter, r *http.Request) {
+	subject, err := ParseSubject(r.URL.Query())
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	export, err := s.ExportSubject(subject)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, export)
+}
+
+func (s *Server) handleSubjectErase(w http.ResponseWriter, r *http.Request) {
+	subject, err := ParseSubject(r.URL.Query())
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	dryRun := false
+	if v := r.URL.Query().Get("dry_run"); v != "" {
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "dry_run must be a boolean")
+			return
+		}
+	}
+	report := s.EraseSubject(subject, dryRun)
+	status := http.StatusOK
+	if len(report.Errors) > 0 {
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, report)
+}
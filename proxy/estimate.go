@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// Chat formatting overhead, as documented for OpenAI chat models: each
+	// message is wrapped in a few tokens and the reply is primed with three.
+	tokensPerMessage = 3
+	tokensPerName    = 1
+	tokensPerReply   = 3
+	// tokensPerImage is the fixed cost of a low-detail image input; higher
+	// detail images cost more, depending on their size.
+	tokensPerImage = 85
+)
+
+// CostEstimate is the response of POST /admin/estimate.
+type CostEstimate struct {
+	Model        string `json:"model"`
+	PromptTokens int    `json:"prompt_tokens"`
+	// MaxCompletionTokens is the most the request allows the model to
+	// generate across all choices; nil when the request sets no limit.
+	MaxCompletionTokens *int `json:"max_completion_tokens"`
+	Priced              bool `json:"priced"`
+	// MinCost prices the prompt alone; MaxCost adds a completion of the
+	// maximum length. Costs are in USD.
+	MinCost float64  `json:"min_cost"`
+	MaxCost *float64 `json:"max_cost"`
+	Notes   []string `json:"notes,omitempty"`
+}
+
+// estimateRequest holds the fields of a chat, completion, or embeddings
+// request that affect its token count.
+type estimateRequest struct {
+	Model               string            `json:"model"`
+	Messages            []json.RawMessage `json:"messages"`
+	Prompt              json.RawMessage   `json:"prompt"`
+	Input               json.RawMessage   `json:"input"`
+	Tools               json.RawMessage   `json:"tools"`
+	Functions           json.RawMessage   `json:"functions"`
+	MaxTokens           *int              `json:"max_tokens"`
+	MaxCompletionTokens *int              `json:"max_completion_tokens"`
+	N                   int               `json:"n"`
+}
+
+type estimateMessage struct {
+	Role       string          `json:"role"`
+	Name       string          `json:"name"`
+	Content    json.RawMessage `json:"content"`
+	ToolCalls  json.RawMessage `json:"tool_calls"`
+	ToolCallID string          `json:"tool_call_id"`
+}
+
+// Estimate counts the tokens a request would use without sending it. Counts
+// come from a character-class heuristic rather than the model's tokenizer,
+// so they are approximate, especially for code and non-English text.
+func (s *Server) Estimate(body []byte) (CostEstimate, error) {
+	var req estimateRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return CostEstimate{}, err
+	}
+
+	est := CostEstimate{Model: req.Model}
+	images := 0
+	switch {
+	case req.Messages != nil:
+		for _, raw := range req.Messages {
+			text, n := messageTokens(raw)
+			est.PromptTokens += text
+			images += n
+		}
+		est.PromptTokens += tokensPerReply
+		for _, defs := range []json.RawMessage{req.Tools, req.Functions} {
+			if len(defs) > 0 {
+				est.PromptTokens += estimateTextTokens(string(defs))
+			}
+		}
+	case req.Prompt != nil:
+		est.PromptTokens = inputTokens(req.Prompt)
+	case req.Input != nil:
+		est.PromptTokens = inputTokens(req.Input)
+		zero := 0
+		est.MaxCompletionTokens = &zero
+	}
+	est.PromptTokens += images * tokensPerImage
+	if images > 0 {
+		est.Notes = append(est.Notes, "images are counted at the low-detail rate; high-detail images cost more")
+	}
+
+	if est.MaxCompletionTokens == nil {
+		limit := req.MaxCompletionTokens
+		if limit == nil {
+			limit = req.MaxTokens
+		}
+		if limit != nil {
+			total := *limit * max(req.N, 1)
+			est.MaxCompletionTokens = &total
+		} else {
+			est.Notes = append(est.Notes, "the request sets no max_tokens, so the completion is only bounded by the model's context window")
+		}
+	}
+
+	if cost, ok := s.Pricing.cost(req.Model, UsageTotals{PromptTokens: int64(est.PromptTokens)}); ok {
+		est.Priced = true
+		est.MinCost = cost
+		if est.MaxCompletionTokens != nil {
+			maxCost, _ := s.Pricing.cost(req.Model, UsageTotals{
+				PromptTokens:     int64(est.PromptTokens),
+				CompletionTokens: int64(*est.MaxCompletionTokens),
+			})
+			est.MaxCost = &maxCost
+		}
+	} else {
+		est.Notes = append(est.Notes, "no price is configured for this model")
+	}
+	return est, nil
+}
+
+// messageTokens estimates one chat message including its formatting
+// overhead, returning text tokens and the image count.
+func messageTokens(raw json.RawMessage) (int, int) {
+	var msg estimateMessage
+	if json.Unmarshal(raw, &msg) != nil {
+		return 0, 0
+	}
+	tokens := tokensPerMessage + estimateTextTokens(msg.Role)
+	if msg.Name != "" {
+		tokens += tokensPerName + estimateTextTokens(msg.Name)
+	}
+	text, images := contentTokens(msg.Content)
+	tokens += text
+	if len(msg.ToolCalls) > 0 {
+		tokens += estimateTextTokens(string(msg.ToolCalls))
+	}
+	tokens += estimateTextTokens(msg.ToolCallID)
+	return tokens, images
+}
+
+// contentTokens estimates a message's content, which is either a string or a
+// list of text and image parts, returning text tokens and the image count.
+func contentTokens(raw json.RawMessage) (int, int) {
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		return estimateTextTokens(text), 0
+	}
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if json.Unmarshal(raw, &parts) != nil {
+		return 0, 0
+	}
+	tokens, images := 0, 0
+	for _, p := range parts {
+		if p.Type == "image_url" || p.Type == "input_image" {
+			images++
+			continue
+		}
+		tokens += estimateTextTokens(p.Text)
+	}
+	return tokens, images
+}
+
+// inputTokens estimates a prompt or embeddings input: a string, a list of
+// strings, or pre-tokenized arrays, which are counted exactly.
+func inputTokens(raw json.RawMessage) int {
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		return estimateTextTokens(text)
+	}
+	var texts []string
+	if json.Unmarshal(raw, &texts) == nil {
+		total := 0
+		for _, t := range texts {
+			total += estimateTextTokens(t)
+		}
+		return total
+	}
+	var ids []int
+	if json.Unmarshal(raw, &ids) == nil {
+		return len(ids)
+	}
+	var batches [][]int
+	if json.Unmarshal(raw, &batches) == nil {
+		total := 0
+		for _, b := range batches {
+			total += len(b)
+		}
+		return total
+	}
+	return 0
+}
+
+// estimateTextTokens approximates BPE token counts: runs of ASCII letters and
+// digits cost one token per four characters, each other ASCII symbol costs
+// one, and non-ASCII characters, mostly CJK in practice, cost one each.
+// Whitespace is folded into the following word.
+func estimateTextTokens(s string) int {
+	tokens, run := 0, 0
+	flush := func() {
+		if run > 0 {
+			tokens += (run + 3) / 4
+			run = 0
+		}
+	}
+	for len(s) > 0 {
+		r, size := utf8.DecodeRuneInString(s)
+		s = s[size:]
+		switch {
+		case r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			run++
+		case unicode.IsSpace(r):
+			flush()
+		default:
+			flush()
+			tokens++
+		}
+	}
+	flush()
+	return tokens
+}
+
+func (s *Server) handleEstimate(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	est, err := s.Estimate(body)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, est)
+}
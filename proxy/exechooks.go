@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"t-oai-api/config"
+)
+
+// Lifecycle points at which exec hooks run.
+const (
+	HookRequest  = "request"
+	HookResponse = "response"
+	HookError    = "error"
+)
+
+const (
+	// maxExecHooks caps the hook commands running at once; events arriving
+	// while all slots are busy are dropped rather than queued.
+	maxExecHooks = 16
+	// defaultExecHookTimeout bounds a hook command when none is configured.
+	defaultExecHookTimeout = 30 * time.Second
+	// maxHookOutput is how much of a failing command's output is logged.
+	maxHookOutput = 2048
+)
+
+var (
+	execHooksRun     = counter("exec_hooks_total")
+	execHooksFailed  = counter("exec_hook_failures_total")
+	execHooksDropped = counter("exec_hooks_dropped_total")
+)
+
+// ExecHooks runs external commands at request lifecycle points, writing the
+// exchange as JSON to their stdin. Commands run in the background and cannot
+// change the exchange; use RequestHook and ResponseHook for that.
+type ExecHooks struct {
+	commands map[string][]string
+	timeout  time.Duration
+	slots    chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewExecHooks returns the hooks configured in cfg, or nil if there are none.
+// Commands are split on whitespace and not run through a shell.
+func NewExecHooks(cfg config.Config) (*ExecHooks, error) {
+	h := &ExecHooks{
+		commands: make(map[string][]string),
+		timeout:  time.Duration(cfg.ExecHookTimeout) * time.Second,
+		slots:    make(chan struct{}, maxExecHooks),
+	}
+	if h.timeout <= 0 {
+		h.timeout = defaultExecHookTimeout
+	}
+	for event, command := range map[string]string{
+		HookRequest:  cfg.ExecOnRequest,
+		HookResponse: cfg.ExecOnResponse,
+		HookError:    cfg.ExecOnError,
+	} {
+		args := strings.Fields(command)
+		if len(args) == 0 {
+			continue
+		}
+		if _, err := exec.LookPath(args[0]); err != nil {
+			return nil, fmt.Errorf("invalid %s hook command: %w", event, err)
+		}
+		h.commands[event] = args
+	}
+	if len(h.commands) == 0 {
+		return nil, nil
+	}
+	return h, nil
+}
+
+// Fire runs the command for event, if any, with e on stdin. It does not wait
+// for the command to finish.
+func (h *ExecHooks) Fire(event string, e Exchange) {
+	args, ok := h.commands[event]
+	if !ok {
+		return
+	}
+	select {
+	case h.slots <- struct{}{}:
+	default:
+		execHooksDropped.Add(1)
+		log.Printf("Skipping %s hook for %s: %d hooks already running", event, e.ID, maxExecHooks)
+		return
+	}
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		<-h.slots
+		log.Printf("Error encoding exchange %s for %s hook: %v", e.ID, event, err)
+		return
+	}
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		defer func() { <-h.slots }()
+		h.run(event, args, e.ID, payload)
+	}()
+}
+
+func (h *ExecHooks) run(event string, args []string, reqID string, payload []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(), "HOOK_EVENT="+event, "HOOK_REQUEST_ID="+reqID)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	execHooksRun.Add(1)
+	if err := cmd.Run(); err != nil {
+		execHooksFailed.Add(1)
+		if ctx.Err() != nil {
+			err = fmt.Errorf("timed out after %s", h.timeout)
+		}
+		out := output.Bytes()
+		if len(out) > maxHookOutput {
+			out = out[:maxHookOutput]
+		}
+		log.Printf("The %s hook for %s failed: %v: %s", event, reqID, err, strings.TrimSpace(string(out)))
+	}
+}
+
+// Wait blocks until running hook commands have finished.
+func (h *ExecHooks) Wait() {
+	h.wg.Wait()
+}
+
+// hookEvent returns the event a completed exchange fires.
+func hookEvent(e *Exchange) string {
+	if e.Error != "" || e.Status == 0 || e.Status >= 400 {
+		return HookError
+	}
+	return HookResponse
+}
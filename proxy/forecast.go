@@ -0,0 +1,338 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultLookbackDays is the number of full days before today used to
+// estimate the run rate when the request does not specify one.
+const defaultLookbackDays = 7
+
+// ModelPrice is the cost of a model in USD per million tokens.
+type ModelPrice struct {
+	InputPerMillion  float64 `json:"input_per_million"`
+	OutputPerMillion float64 `json:"output_per_million"`
+}
+
+// Pricing maps model names, or model name prefixes such as "gpt-4o", to
+// prices. The longest matching name wins, so dated snapshots inherit the
+// price of their family unless listed separately.
+type Pricing map[string]ModelPrice
+
+// LoadPricing reads a JSON object of model prices.
+func LoadPricing(path string) (Pricing, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pricing file: %w", err)
+	}
+	var p Pricing
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("invalid pricing file: %w", err)
+	}
+	return p, nil
+}
+
+func (p Pricing) lookup(model string) (ModelPrice, bool) {
+	if price, ok := p[model]; ok {
+		return price, true
+	}
+	best := ""
+	for name := range p {
+		if strings.HasPrefix(model, name) && len(name) > len(best) {
+			best = name
+		}
+	}
+	if best == "" {
+		return ModelPrice{}, false
+	}
+	return p[best], true
+}
+
+// cost prices usage for model, reporting false if the model has no price.
+func (p Pricing) cost(model string, t UsageTotals) (float64, bool) {
+	price, ok := p.lookup(model)
+	if !ok {
+		return 0, false
+	}
+	return (float64(t.PromptTokens)*price.InputPerMillion + float64(t.CompletionTokens)*price.OutputPerMillion) / 1e6, true
+}
+
+// SpendAlertRule is a projected monthly spend limit for all traffic, one
+// model, or one client key.
+type SpendAlertRule struct {
+	// Scope is "total", "model:<name>", or "key:<label>".
+	Scope     string  `json:"scope"`
+	Threshold float64 `json:"threshold"`
+}
+
+// ParseSpendAlerts parses a comma-separated list of scope=amount rules, e.g.
+// "total=500,model:gpt-4o=200,key:sk-...abcd=50".
+func ParseSpendAlerts(spec string) ([]SpendAlertRule, error) {
+	var rules []SpendAlertRule
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid spend alert %q: expected scope=amount", entry)
+		}
+		scope := strings.TrimSpace(entry[:i])
+		if scope != "total" && !strings.HasPrefix(scope, "model:") && !strings.HasPrefix(scope, "key:") {
+			return nil, fmt.Errorf("invalid spend alert %q: scope must be total, model:<name>, or key:<label>", entry)
+		}
+		threshold, err := strconv.ParseFloat(strings.TrimSpace(entry[i+1:]), 64)
+		if err != nil || threshold <= 0 {
+			return nil, fmt.Errorf("invalid spend alert %q: amount must be a positive number", entry)
+		}
+		rules = append(rules, SpendAlertRule{Scope: scope, Threshold: threshold})
+	}
+	return rules, nil
+}
+
+// SpendProjection is month-to-date and projected end-of-month usage for one
+// model, key, or model and key pair. Costs are in USD and only include priced
+// models.
+type SpendProjection struct {
+	Model             string  `json:"model,omitempty"`
+	Key               string  `json:"key,omitempty"`
+	MonthToDateCost   float64 `json:"month_to_date_cost"`
+	DailyRateCost     float64 `json:"daily_rate_cost"`
+	ProjectedCost     float64 `json:"projected_cost"`
+	MonthToDateTokens int64   `json:"month_to_date_tokens"`
+	DailyRateTokens   float64 `json:"daily_rate_tokens"`
+	ProjectedTokens   int64   `json:"projected_tokens"`
+}
+
+func (p *SpendProjection) add(o SpendProjection) {
+	p.MonthToDateCost += o.MonthToDateCost
+	p.DailyRateCost += o.DailyRateCost
+	p.ProjectedCost += o.ProjectedCost
+	p.MonthToDateTokens += o.MonthToDateTokens
+	p.DailyRateTokens += o.DailyRateTokens
+	p.ProjectedTokens += o.ProjectedTokens
+}
+
+// SpendAlert is a rule whose projected spend reaches its threshold.
+type SpendAlert struct {
+	SpendAlertRule
+	ProjectedCost   float64 `json:"projected_cost"`
+	MonthToDateCost float64 `json:"month_to_date_cost"`
+	// Exceeded is set once month-to-date spend alone is over the threshold.
+	Exceeded bool `json:"exceeded"`
+}
+
+// SpendForecast is the response of GET /admin/spend/forecast.
+type SpendForecast struct {
+	Month        string    `json:"month"`
+	GeneratedAt  time.Time `json:"generated_at"`
+	LookbackDays int       `json:"lookback_days"`
+	// RateWindowDays is the span the run rate was measured over, shorter
+	// than the lookback while history is still building up.
+	RateWindowDays float64           `json:"rate_window_days"`
+	RemainingDays  float64           `json:"remaining_days"`
+	Total          SpendProjection   `json:"total"`
+	Models         []SpendProjection `json:"models"`
+	Keys           []SpendProjection `json:"keys"`
+	Lines          []SpendProjection `json:"lines"`
+	Alerts         []SpendAlert      `json:"alerts"`
+	Unpriced       []string          `json:"unpriced_models,omitempty"`
+}
+
+// SpendForecaster projects end-of-month spend from the usage history.
+type SpendForecaster struct {
+	usage   *UsageStore
+	pricing Pricing
+	rules   []SpendAlertRule
+
+	mu    sync.Mutex
+	fired map[string]bool
+}
+
+// NewSpendForecaster prices usage with pricing, which may be nil, and checks
+// the given alert rules.
+func NewSpendForecaster(usage *UsageStore, pricing Pricing, rules []SpendAlertRule) *SpendForecaster {
+	return &SpendForecaster{
+		usage:   usage,
+		pricing: pricing,
+		rules:   rules,
+		fired:   make(map[string]bool),
+	}
+}
+
+// Forecast projects spend for the current UTC month: month-to-date usage plus
+// the average daily run rate over today and the lookback days before it,
+// extended to the end of the month.
+func (f *SpendForecaster) Forecast(now time.Time, lookbackDays int) SpendForecast {
+	now = now.UTC()
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	monthEnd := monthStart.AddDate(0, 1, 0)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	windowStart := today.AddDate(0, 0, -lookbackDays)
+	rateFrom := windowStart
+	if since := f.usage.Since(); since.After(rateFrom) {
+		rateFrom = since
+	}
+	windowDays := max(now.Sub(rateFrom).Hours()/24, 1.0/24)
+	remainingDays := monthEnd.Sub(now).Hours() / 24
+
+	type totals struct{ mtd, window UsageTotals }
+	lines := make(map[usageKey]*totals)
+	line := func(key usageKey) *totals {
+		t, ok := lines[key]
+		if !ok {
+			t = &totals{}
+			lines[key] = t
+		}
+		return t
+	}
+	from := windowStart
+	if monthStart.Before(from) {
+		from = monthStart
+	}
+	for _, rec := range f.usage.Records(from, now) {
+		key := usageKey{rec.Model, rec.Key}
+		if rec.Date >= monthStart.Format(usageDateLayout) {
+			line(key).mtd.add(rec.UsageTotals)
+		}
+		if rec.Date >= windowStart.Format(usageDateLayout) {
+			line(key).window.add(rec.UsageTotals)
+		}
+	}
+
+	forecast := SpendForecast{
+		Month:          monthStart.Format("2006-01"),
+		GeneratedAt:    now,
+		LookbackDays:   lookbackDays,
+		RateWindowDays: windowDays,
+		RemainingDays:  remainingDays,
+		Models:         []SpendProjection{},
+		Keys:           []SpendProjection{},
+		Lines:          []SpendProjection{},
+		Alerts:         []SpendAlert{},
+	}
+	byModel := make(map[string]*SpendProjection)
+	byKey := make(map[string]*SpendProjection)
+	unpriced := make(map[string]bool)
+	for key, t := range lines {
+		mtdCost, priced := f.pricing.cost(key.Model, t.mtd)
+		windowCost, _ := f.pricing.cost(key.Model, t.window)
+		if !priced {
+			unpriced[key.Model] = true
+		}
+		p := SpendProjection{
+			Model:             key.Model,
+			Key:               key.Key,
+			MonthToDateCost:   mtdCost,
+			DailyRateCost:     windowCost / windowDays,
+			MonthToDateTokens: t.mtd.TotalTokens,
+			DailyRateTokens:   float64(t.window.TotalTokens) / windowDays,
+		}
+		p.ProjectedCost = p.MonthToDateCost + p.DailyRateCost*remainingDays
+		p.ProjectedTokens = p.MonthToDateTokens + int64(p.DailyRateTokens*remainingDays)
+		forecast.Lines = append(forecast.Lines, p)
+
+		if byModel[key.Model] == nil {
+			byModel[key.Model] = &SpendProjection{Model: key.Model}
+		}
+		byModel[key.Model].add(p)
+		if byKey[key.Key] == nil {
+			byKey[key.Key] = &SpendProjection{Key: key.Key}
+		}
+		byKey[key.Key].add(p)
+		forecast.Total.add(p)
+	}
+	for _, p := range byModel {
+		forecast.Models = append(forecast.Models, *p)
+	}
+	for _, p := range byKey {
+		forecast.Keys = append(forecast.Keys, *p)
+	}
+	for model := range unpriced {
+		forecast.Unpriced = append(forecast.Unpriced, model)
+	}
+	byProjectedCost := func(ps []SpendProjection) {
+		sort.Slice(ps, func(i, j int) bool {
+			if ps[i].ProjectedCost != ps[j].ProjectedCost {
+				return ps[i].ProjectedCost > ps[j].ProjectedCost
+			}
+			if ps[i].Model != ps[j].Model {
+				return ps[i].Model < ps[j].Model
+			}
+			return ps[i].Key < ps[j].Key
+		})
+	}
+	byProjectedCost(forecast.Lines)
+	byProjectedCost(forecast.Models)
+	byProjectedCost(forecast.Keys)
+	sort.Strings(forecast.Unpriced)
+
+	for _, rule := range f.rules {
+		var p SpendProjection
+		switch {
+		case rule.Scope == "total":
+			p = forecast.Total
+		case strings.HasPrefix(rule.Scope, "model:"):
+			if m := byModel[strings.TrimPrefix(rule.Scope, "model:")]; m != nil {
+				p = *m
+			}
+		case strings.HasPrefix(rule.Scope, "key:"):
+			if k := byKey[strings.TrimPrefix(rule.Scope, "key:")]; k != nil {
+				p = *k
+			}
+		}
+		if p.ProjectedCost >= rule.Threshold {
+			forecast.Alerts = append(forecast.Alerts, SpendAlert{
+				SpendAlertRule:  rule,
+				ProjectedCost:   p.ProjectedCost,
+				MonthToDateCost: p.MonthToDateCost,
+				Exceeded:        p.MonthToDateCost >= rule.Threshold,
+			})
+		}
+	}
+	return forecast
+}
+
+// CheckAlerts logs each alert the first time it fires in a month.
+func (f *SpendForecaster) CheckAlerts(now time.Time) {
+	if len(f.rules) == 0 {
+		return
+	}
+	forecast := f.Forecast(now, defaultLookbackDays)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, alert := range forecast.Alerts {
+		id := forecast.Month + " " + alert.Scope
+		if f.fired[id] {
+			continue
+		}
+		f.fired[id] = true
+		log.Printf("Spend alert: %s projected to reach $%.2f in %s, over the $%.2f threshold ($%.2f so far)",
+			alert.Scope, alert.ProjectedCost, forecast.Month, alert.Threshold, alert.MonthToDateCost)
+	}
+}
+
+func (s *Server) handleSpendForecast(w http.ResponseWriter, r *http.Request) {
+	days := defaultLookbackDays
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 60 {
+			writeAPIError(w, http.StatusBadRequest, "days must be between 0 and 60")
+			return
+		}
+		days = n
+	}
+	writeJSON(w, http.StatusOK, s.Forecaster.Forecast(s.now(), days))
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// viaPseudonym identifies this proxy in Via headers.
+const viaPseudonym = "t-oai-api"
+
+// hopHeaders are meaningful only for a single connection and must not be
+// forwarded (RFC 9110 section 7.6.1).
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders deletes hop-by-hop headers, including any listed in the
+// Connection header.
+func removeHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// addVia appends this proxy to the Via header for a message received over the
+// given protocol version.
+func addVia(h http.Header, major, minor int) {
+	h.Add("Via", fmt.Sprintf("%d.%d %s", major, minor, viaPseudonym))
+}
+
+// TrustedProxies lists the reverse proxies whose forwarding headers are
+// believed when identifying the client.
+type TrustedProxies []netip.Prefix
+
+// ParseTrustedProxies parses a comma-separated list of IP addresses and CIDR
+// ranges.
+func ParseTrustedProxies(spec string) (TrustedProxies, error) {
+	var proxies TrustedProxies
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+			}
+			proxies = append(proxies, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		proxies = append(proxies, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+	return proxies, nil
+}
+
+func (t TrustedProxies) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range t {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the original client. Forwarding headers are
+// only consulted when the direct peer is trusted, and the chain is walked from
+// the nearest hop outwards until the first untrusted address.
+func (t TrustedProxies) ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer, err := netip.ParseAddr(host)
+	if err != nil || !t.contains(peer) {
+		return host
+	}
+
+	chain := forwardedFor(r.Header)
+	client := peer
+	for i := len(chain) - 1; i >= 0; i-- {
+		addr, ok := parseForwardedAddr(chain[i])
+		if !ok {
+			break
+		}
+		client = addr
+		if !t.contains(addr) {
+			break
+		}
+	}
+	return client.Unmap().String()
+}
+
+// forwardedFor returns the client chain from the Forwarded header, falling
+// back to X-Forwarded-For, ordered from the original client to the nearest
+// proxy.
+func forwardedFor(h http.Header) []string {
+	var chain []string
+	for _, value := range h.Values("Forwarded") {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					chain = append(chain, strings.Trim(val, `"`))
+				}
+			}
+		}
+	}
+	if len(chain) > 0 {
+		return chain
+	}
+
+	for _, value := range h.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(value, ",") {
+			chain = append(chain, strings.TrimSpace(addr))
+		}
+	}
+	return chain
+}
+
+// parseForwardedAddr accepts "1.2.3.4", "1.2.3.4:80", "[2001:db8::1]" and
+// "[2001:db8::1]:80". Obfuscated identifiers such as "unknown" are rejected.
+func parseForwardedAddr(s string) (netip.Addr, bool) {
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr(), true
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	return addr, err == nil
+}
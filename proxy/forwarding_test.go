@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := ParseTrustedProxies("10.0.0.0/8, 2001:db8::/32, 127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		peer      string
+		forwarded string
+		xff       string
+		want      string
+	}{
+		{name: "untrusted peer", peer: "203.0.113.9:5000", xff: "1.2.3.4", want: "203.0.113.9"},
+		{name: "trusted peer without headers", peer: "10.0.0.1:5000", want: "10.0.0.1"},
+		{name: "single hop", peer: "10.0.0.1:5000", xff: "1.2.3.4", want: "1.2.3.4"},
+		{name: "spoofed leftmost entry", peer: "10.0.0.1:5000", xff: "6.6.6.6, 1.2.3.4", want: "1.2.3.4"},
+		{name: "spoofed entry behind trusted hops", peer: "10.0.0.1:5000", xff: "6.6.6.6, 1.2.3.4, 10.0.0.5", want: "1.2.3.4"},
+		{name: "spoofed trusted address", peer: "10.0.0.1:5000", xff: "10.9.9.9, 1.2.3.4", want: "1.2.3.4"},
+		{name: "all hops trusted", peer: "10.0.0.1:5000", xff: "10.0.0.7, 10.0.0.5", want: "10.0.0.7"},
+		{name: "trusted single address", peer: "127.0.0.1:5000", xff: "6.6.6.6", want: "6.6.6.6"},
+		{name: "obfuscated nearest hop", peer: "10.0.0.1:5000", xff: "1.2.3.4, unknown", want: "10.0.0.1"},
+		{name: "IPv6 trusted range", peer: "[2001:db8::1]:443", xff: "6.6.6.6, 2a00:1450::1, 2001:db8:ffff::2", want: "2a00:1450::1"},
+		{name: "IPv6 untrusted peer", peer: "[2a00:1450::1]:443", xff: "1.2.3.4", want: "2a00:1450::1"},
+		{name: "IPv4-mapped peer", peer: "[::ffff:10.0.0.1]:443", xff: "1.2.3.4", want: "1.2.3.4"},
+		{name: "Forwarded preferred", peer: "10.0.0.1:5000", forwarded: `for=6.6.6.6, for="[2001:db8::5]:4711";proto=https, for=198.51.100.7`, xff: "1.2.3.4", want: "198.51.100.7"},
+		{name: "Forwarded IPv6 with port", peer: "10.0.0.1:5000", forwarded: `for="[2a00:1450::1]:4711", for=10.0.0.5`, want: "2a00:1450::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodGet, "http://proxy/v1/models", nil)
+			r.RemoteAddr = tt.peer
+			if tt.forwarded != "" {
+				r.Header.Set("Forwarded", tt.forwarded)
+			}
+			if tt.xff != "" {
+				r.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if got := trusted.ClientIP(r); got != tt.want {
+				t.Errorf("ClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// Without trusted proxies forwarding headers are never believed.
+	r, _ := http.NewRequest(http.MethodGet, "http://proxy/v1/models", nil)
+	r.RemoteAddr = "10.0.0.1:5000"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4")
+	if got := TrustedProxies(nil).ClientIP(r); got != "10.0.0.1" {
+		t.Errorf("ClientIP() without trusted proxies = %q", got)
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	for _, spec := range []string{"10.0.0.0/33", "10.0.0", "proxy.internal", "2001:db8::/129"} {
+		if _, err := ParseTrustedProxies(spec); err == nil {
+			t.Errorf("ParseTrustedProxies(%q) succeeded", spec)
+		}
+	}
+	proxies, err := ParseTrustedProxies(" 10.1.2.3/8 , ::ffff:192.0.2.1,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(proxies) != 2 || proxies[0].String() != "10.0.0.0/8" || proxies[1].String() != "192.0.2.1/32" {
+		t.Errorf("ParseTrustedProxies() = %v", proxies)
+	}
+}
+
+func TestRemoveHopHeaders(t *testing.T) {
+	h := http.Header{
+		"Connection":       {"keep-alive, X-Internal-Token"},
+		"Keep-Alive":       {"timeout=5"},
+		"X-Internal-Token": {"secret"},
+		"Te":               {"trailers"},
+		"Authorization":    {"Bearer sk-test"},
+	}
+	removeHopHeaders(h)
+	if len(h) != 1 || h.Get("Authorization") == "" {
+		t.Errorf("headers after removal = %v", h)
+	}
+}
@@ -0,0 +1,858 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// This file implements the subset of GraphQL the admin query endpoint needs:
+// queries with variables, aliases, arguments, named and inline fragments, and
+// @include/@skip. There are no mutations, subscriptions, or introspection
+// beyond __typename; the schema is published as SDL instead.
+
+// gqlSchema is a set of object types, with "Query" as the root.
+type gqlSchema struct {
+	types map[string]*gqlType
+	order []string
+}
+
+type gqlType struct {
+	name        string
+	description string
+	fields      map[string]*gqlField
+	order       []string
+}
+
+// gqlField resolves one field of its parent value. Type is in SDL notation,
+// such as "[Request!]!"; object-typed results are resolved further with the
+// field's selection set.
+type gqlField struct {
+	Type        string
+	Description string
+	Args        []gqlArg
+	Resolve     func(parent any, args map[string]any) (any, error)
+}
+
+type gqlArg struct {
+	Name    string
+	Type    string
+	Default any
+}
+
+func newGQLSchema() *gqlSchema {
+	return &gqlSchema{types: make(map[string]*gqlType)}
+}
+
+// object adds an object type; fields keep the order they are added in.
+func (s *gqlSchema) object(name, description string) *gqlType {
+	t := &gqlType{name: name, description: description, fields: make(map[string]*gqlField)}
+	s.types[name] = t
+	s.order = append(s.order, name)
+	return t
+}
+
+func (t *gqlType) field(name string, f *gqlField) *gqlType {
+	t.fields[name] = f
+	t.order = append(t.order, name)
+	return t
+}
+
+// namedType strips list and non-null markers: "[Request!]!" is "Request".
+func namedType(typ string) string {
+	return strings.Trim(typ, "[]!")
+}
+
+// SDL renders the schema in GraphQL schema definition language.
+func (s *gqlSchema) SDL() string {
+	var b strings.Builder
+	for i, name := range s.order {
+		t := s.types[name]
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		if t.description != "" {
+			fmt.Fprintf(&b, "\"\"\"%s\"\"\"\n", t.description)
+		}
+		fmt.Fprintf(&b, "type %s {\n", name)
+		for _, fname := range t.order {
+			f := t.fields[fname]
+			if f.Description != "" {
+				fmt.Fprintf(&b, "  \"%s\"\n", f.Description)
+			}
+			b.WriteString("  " + fname)
+			if len(f.Args) > 0 {
+				args := make([]string, len(f.Args))
+				for j, a := range f.Args {
+					args[j] = a.Name + ": " + a.Type
+					if a.Default != nil {
+						def, _ := json.Marshal(a.Default)
+						args[j] += " = " + string(def)
+					}
+				}
+				b.WriteString("(" + strings.Join(args, ", ") + ")")
+			}
+			b.WriteString(": " + f.Type + "\n")
+		}
+		b.WriteString("}\n")
+	}
+	return b.String()
+}
+
+// GraphQLRequest is the body of POST /admin/graphql.
+type GraphQLRequest struct {
+	Query         string         `json:"query"`
+	Variables     map[string]any `json:"variables,omitempty"`
+	OperationName string         `json:"operationName,omitempty"`
+}
+
+// GraphQLError is one entry of a response's errors list.
+type GraphQLError struct {
+	Message string `json:"message"`
+	Path    []any  `json:"path,omitempty"`
+}
+
+// GraphQLResponse is the result of executing a request. Data is omitted when
+// the query could not be parsed or validated.
+type GraphQLResponse struct {
+	Data   *gqlMap        `json:"data,omitempty"`
+	Errors []GraphQLError `json:"errors,omitempty"`
+}
+
+// gqlMap is a JSON object that keeps its keys in selection order.
+type gqlMap struct {
+	keys   []string
+	values map[string]any
+}
+
+func (m *gqlMap) set(key string, v any) {
+	if m.values == nil {
+		m.values = make(map[string]any)
+	}
+	if _, ok := m.values[key]; !ok {
+		m.keys = append(m.keys, key)
+	}
+	m.values[key] = v
+}
+
+func (m *gqlMap) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, k := range m.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(k)
+		b.Write(key)
+		b.WriteByte(':')
+		v, err := json.Marshal(m.values[k])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// Execute parses and runs a query against the schema. Field errors null the
+// field and are reported alongside the data that could be resolved.
+func (s *gqlSchema) Execute(req GraphQLRequest, root any) GraphQLResponse {
+	doc, err := parseGQL(req.Query)
+	if err != nil {
+		return GraphQLResponse{Errors: []GraphQLError{{Message: err.Error()}}}
+	}
+	op, err := doc.operation(req.OperationName)
+	if err != nil {
+		return GraphQLResponse{Errors: []GraphQLError{{Message: err.Error()}}}
+	}
+	vars, err := coerceVariables(op.vars, req.Variables)
+	if err != nil {
+		return GraphQLResponse{Errors: []GraphQLError{{Message: err.Error()}}}
+	}
+	ex := &gqlExecutor{schema: s, doc: doc, vars: vars}
+	data := ex.selectFields(s.types["Query"], root, op.selection, nil)
+	return GraphQLResponse{Data: data, Errors: ex.errors}
+}
+
+type gqlExecutor struct {
+	schema *gqlSchema
+	doc    *gqlDocument
+	vars   map[string]any
+	errors []GraphQLError
+}
+
+func (ex *gqlExecutor) fail(path []any, format string, args ...any) {
+	ex.errors = append(ex.errors, GraphQLError{Message: fmt.Sprintf(format, args...), Path: append([]any(nil), path...)})
+}
+
+// collect flattens fragments and applies @include/@skip, grouping fields by
+// response key so repeated selections of a field are merged.
+func (ex *gqlExecutor) collect(t *gqlType, sel []gqlSelection, keys *[]string, groups map[string][]*gqlSelection, visited map[string]bool) {
+	for i := range sel {
+		s := &sel[i]
+		if !ex.included(s.directives) {
+			continue
+		}
+		switch {
+		case s.fragment != "":
+			if visited[s.fragment] {
+				continue
+			}
+			visited[s.fragment] = true
+			frag, ok := ex.doc.fragments[s.fragment]
+			if ok && frag.on == t.name {
+				ex.collect(t, frag.selection, keys, groups, visited)
+			}
+		case s.inline:
+			if s.on == "" || s.on == t.name {
+				ex.collect(t, s.selection, keys, groups, visited)
+			}
+		default:
+			key := s.alias
+			if key == "" {
+				key = s.name
+			}
+			if _, ok := groups[key]; !ok {
+				*keys = append(*keys, key)
+			}
+			groups[key] = append(groups[key], s)
+		}
+	}
+}
+
+func (ex *gqlExecutor) included(directives []gqlDirective) bool {
+	for _, d := range directives {
+		cond, _ := ex.value(d.args["if"]).(bool)
+		if (d.name == "include" && !cond) || (d.name == "skip" && cond) {
+			return false
+		}
+	}
+	return true
+}
+
+func (ex *gqlExecutor) selectFields(t *gqlType, parent any, sel []gqlSelection, path []any) *gqlMap {
+	var keys []string
+	groups := make(map[string][]*gqlSelection)
+	ex.collect(t, sel, &keys, groups, make(map[string]bool))
+
+	result := &gqlMap{}
+	for _, key := range keys {
+		fields := groups[key]
+		first := fields[0]
+		fieldPath := append(path, key)
+		if first.name == "__typename" {
+			result.set(key, t.name)
+			continue
+		}
+		f, ok := t.fields[first.name]
+		if !ok {
+			ex.fail(fieldPath, "Cannot query field %q on type %q", first.name, t.name)
+			result.set(key, nil)
+			continue
+		}
+		args, err := ex.arguments(f, first.args)
+		if err != nil {
+			ex.fail(fieldPath, "%s", err)
+			result.set(key, nil)
+			continue
+		}
+		v, err := f.Resolve(parent, args)
+		if err != nil {
+			ex.fail(fieldPath, "%s", err)
+			result.set(key, nil)
+			continue
+		}
+		var subsel []gqlSelection
+		for _, fs := range fields {
+			subsel = append(subsel, fs.selection...)
+		}
+		result.set(key, ex.complete(f.Type, v, subsel, fieldPath))
+	}
+	return result
+}
+
+// complete resolves a field's value against its selection set: lists element
+// by element, objects through their fields, and scalars as they are.
+func (ex *gqlExecutor) complete(typ string, v any, sel []gqlSelection, path []any) any {
+	if v == nil {
+		return nil
+	}
+	inner := strings.TrimSuffix(typ, "!")
+	if strings.HasPrefix(inner, "[") {
+		items, ok := v.([]any)
+		if !ok {
+			ex.fail(path, "internal error: %T is not a list", v)
+			return nil
+		}
+		out := make([]any, len(items))
+		for i, item := range items {
+			out[i] = ex.complete(inner[1:len(inner)-1], item, sel, append(path, i))
+		}
+		return out
+	}
+	t, isObject := ex.schema.types[inner]
+	switch {
+	case isObject && len(sel) == 0:
+		ex.fail(path, "Field of type %q must have a selection of subfields", inner)
+		return nil
+	case !isObject && len(sel) > 0:
+		ex.fail(path, "Field of scalar type %q must not have a selection", inner)
+		return nil
+	case isObject:
+		return ex.selectFields(t, v, sel, path)
+	}
+	return v
+}
+
+// arguments resolves variables and defaults and checks argument types.
+func (ex *gqlExecutor) arguments(f *gqlField, given map[string]gqlValue) (map[string]any, error) {
+	args := make(map[string]any, len(f.Args))
+	for name := range given {
+		if !slices.ContainsFunc(f.Args, func(a gqlArg) bool { return a.Name == name }) {
+			return nil, fmt.Errorf("unknown argument %q", name)
+		}
+	}
+	for _, a := range f.Args {
+		v := a.Default
+		if raw, ok := given[a.Name]; ok {
+			v = ex.value(raw)
+		}
+		v, err := coerceInput(a.Type, v)
+		if err != nil {
+			return nil, fmt.Errorf("argument %q: %w", a.Name, err)
+		}
+		if v != nil {
+			args[a.Name] = v
+		}
+	}
+	return args, nil
+}
+
+// value turns a parsed literal into a Go value, substituting variables.
+func (ex *gqlExecutor) value(v gqlValue) any {
+	switch {
+	case v.variable != "":
+		return ex.vars[v.variable]
+	case v.list != nil:
+		out := make([]any, len(v.list))
+		for i, item := range v.list {
+			out[i] = ex.value(item)
+		}
+		return out
+	}
+	return v.literal
+}
+
+// coerceInput checks v against an input type and normalizes numbers: JSON
+// variables arrive as float64, literals as int64 or float64, and defaults and
+// already coerced values as int.
+func coerceInput(typ string, v any) (any, error) {
+	nonNull := strings.HasSuffix(typ, "!")
+	typ = strings.TrimSuffix(typ, "!")
+	if v == nil {
+		if nonNull {
+			return nil, fmt.Errorf("expected a non-null %s", typ)
+		}
+		return nil, nil
+	}
+	if strings.HasPrefix(typ, "[") {
+		items, ok := v.([]any)
+		if !ok {
+			items = []any{v}
+		}
+		out := make([]any, len(items))
+		for i, item := range items {
+			c, err := coerceInput(typ[1:len(typ)-1], item)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = c
+		}
+		return out, nil
+	}
+	switch typ {
+	case "Int":
+		switch n := v.(type) {
+		case int:
+			return n, nil
+		case int64:
+			return int(n), nil
+		case float64:
+			if n == float64(int(n)) {
+				return int(n), nil
+			}
+		}
+	case "Float":
+		switch n := v.(type) {
+		case int:
+			return float64(n), nil
+		case int64:
+			return float64(n), nil
+		case float64:
+			return n, nil
+		}
+	case "String", "ID":
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+		if typ == "ID" {
+			if n, ok := v.(int64); ok {
+				return strconv.FormatInt(n, 10), nil
+			}
+		}
+	case "Boolean":
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("expected %s, got %v", typ, v)
+}
+
+func coerceVariables(defs []gqlVariable, given map[string]any) (map[string]any, error) {
+	vars := make(map[string]any, len(defs))
+	for _, d := range defs {
+		v, ok := given[d.name]
+		if !ok && d.def != nil {
+			v = d.def.literal
+		}
+		c, err := coerceInput(d.typ, v)
+		if err != nil {
+			return nil, fmt.Errorf("variable $%s: %w", d.name, err)
+		}
+		vars[d.name] = c
+	}
+	return vars, nil
+}
+
+// Parsed documents.
+
+type gqlDocument struct {
+	operations []gqlOperation
+	fragments  map[string]gqlFragment
+}
+
+type gqlOperation struct {
+	kind      string
+	name      string
+	vars      []gqlVariable
+	selection []gqlSelection
+}
+
+type gqlFragment struct {
+	on        string
+	selection []gqlSelection
+}
+
+type gqlVariable struct {
+	name string
+	typ  string
+	def  *gqlValue
+}
+
+// gqlSelection is a field, a fragment spread (fragment set), or an inline
+// fragment (inline set, optionally with a type condition).
+type gqlSelection struct {
+	alias      string
+	name       string
+	args       map[string]gqlValue
+	directives []gqlDirective
+	selection  []gqlSelection
+	fragment   string
+	inline     bool
+	on         string
+}
+
+type gqlDirective struct {
+	name string
+	args map[string]gqlValue
+}
+
+type gqlValue struct {
+	variable string
+	list     []gqlValue
+	literal  any
+}
+
+func (d *gqlDocument) operation(name string) (*gqlOperation, error) {
+	var op *gqlOperation
+	switch {
+	case name != "":
+		for i := range d.operations {
+			if d.operations[i].name == name {
+				op = &d.operations[i]
+			}
+		}
+		if op == nil {
+			return nil, fmt.Errorf("unknown operation %q", name)
+		}
+	case len(d.operations) == 1:
+		op = &d.operations[0]
+	case len(d.operations) == 0:
+		return nil, fmt.Errorf("document contains no operation")
+	default:
+		return nil, fmt.Errorf("operationName is required when the document contains several operations")
+	}
+	if op.kind != "query" {
+		return nil, fmt.Errorf("only queries are supported, not %s", op.kind)
+	}
+	return op, nil
+}
+
+// Lexing and parsing.
+
+type gqlToken struct {
+	kind byte // 'n'ame, 'i'nt, 'f'loat, 's'tring, 'p'unctuator, 0 at end
+	text string
+	pos  int
+}
+
+type gqlParser struct {
+	src string
+	pos int
+	tok gqlToken
+}
+
+func parseGQL(src string) (doc *gqlDocument, err error) {
+	p := &gqlParser{src: src}
+	defer func() {
+		if r := recover(); r != nil {
+			perr, ok := r.(gqlSyntaxError)
+			if !ok {
+				panic(r)
+			}
+			doc, err = nil, perr
+		}
+	}()
+	p.next()
+	doc = &gqlDocument{fragments: make(map[string]gqlFragment)}
+	for p.tok.kind != 0 {
+		switch {
+		case p.peek('p', "{"):
+			doc.operations = append(doc.operations, gqlOperation{kind: "query", selection: p.selectionSet()})
+		case p.peek('n', "fragment"):
+			p.next()
+			name := p.name()
+			p.expectName("on")
+			on := p.name()
+			p.directives()
+			doc.fragments[name] = gqlFragment{on: on, selection: p.selectionSet()}
+		case p.peek('n', "query"), p.peek('n', "mutation"), p.peek('n', "subscription"):
+			op := gqlOperation{kind: p.tok.text}
+			p.next()
+			if p.tok.kind == 'n' {
+				op.name = p.name()
+			}
+			if p.skip("(") {
+				for !p.skip(")") {
+					p.expect("$")
+					v := gqlVariable{name: p.name()}
+					p.expect(":")
+					v.typ = p.typeRef()
+					if p.skip("=") {
+						def := p.value(true)
+						v.def = &def
+					}
+					op.vars = append(op.vars, v)
+				}
+			}
+			p.directives()
+			op.selection = p.selectionSet()
+			doc.operations = append(doc.operations, op)
+		default:
+			p.fail("unexpected %q", p.tok.text)
+		}
+	}
+	return doc, nil
+}
+
+type gqlSyntaxError struct {
+	msg string
+}
+
+func (e gqlSyntaxError) Error() string { return e.msg }
+
+func (p *gqlParser) fail(format string, args ...any) {
+	line, col := 1, 1
+	for _, r := range p.src[:p.tok.pos] {
+		if r == '\n' {
+			line, col = line+1, 1
+		} else {
+			col++
+		}
+	}
+	panic(gqlSyntaxError{fmt.Sprintf("Syntax error at %d:%d: %s", line, col, fmt.Sprintf(format, args...))})
+}
+
+func (p *gqlParser) next() {
+	src := p.src
+	for p.pos < len(src) {
+		c := src[p.pos]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' {
+			p.pos++
+		} else if c == '#' {
+			for p.pos < len(src) && src[p.pos] != '\n' {
+				p.pos++
+			}
+		} else {
+			break
+		}
+	}
+	start := p.pos
+	p.tok = gqlToken{pos: start}
+	if p.pos >= len(src) {
+		return
+	}
+	c := src[p.pos]
+	switch {
+	case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		for p.pos < len(src) && isNameByte(src[p.pos]) {
+			p.pos++
+		}
+		p.tok.kind, p.tok.text = 'n', src[start:p.pos]
+	case c == '-' || c >= '0' && c <= '9':
+		p.pos++
+		kind := byte('i')
+		for p.pos < len(src) {
+			d := src[p.pos]
+			if d == '.' || d == 'e' || d == 'E' || ((d == '+' || d == '-') && (src[p.pos-1] == 'e' || src[p.pos-1] == 'E')) {
+				kind = 'f'
+			} else if d < '0' || d > '9' {
+				break
+			}
+			p.pos++
+		}
+		p.tok.kind, p.tok.text = kind, src[start:p.pos]
+	case c == '"':
+		p.tok.kind, p.tok.text = 's', p.stringValue()
+	case strings.HasPrefix(src[p.pos:], "..."):
+		p.pos += 3
+		p.tok.kind, p.tok.text = 'p', "..."
+	case strings.IndexByte("{}()[]:!$=@", c) >= 0:
+		p.pos++
+		p.tok.kind, p.tok.text = 'p', string(c)
+	default:
+		p.fail("unexpected character %q", c)
+	}
+}
+
+func isNameByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// stringValue lexes a quoted or block string starting at p.pos.
+func (p *gqlParser) stringValue() string {
+	src := p.src
+	if strings.HasPrefix(src[p.pos:], `"""`) {
+		end := strings.Index(src[p.pos+3:], `"""`)
+		if end < 0 {
+			p.fail("unterminated block string")
+		}
+		s := src[p.pos+3 : p.pos+3+end]
+		p.pos += end + 6
+		return strings.TrimSpace(s)
+	}
+	for i := p.pos + 1; i < len(src); i++ {
+		switch src[i] {
+		case '\\':
+			i++
+		case '\n':
+			p.fail("unterminated string")
+		case '"':
+			s, err := strconv.Unquote(src[p.pos : i+1])
+			if err != nil {
+				// GraphQL escapes are JSON's.
+				if json.Unmarshal([]byte(src[p.pos:i+1]), &s) != nil {
+					p.fail("invalid string %s", src[p.pos:i+1])
+				}
+			}
+			p.pos = i + 1
+			return s
+		}
+	}
+	p.fail("unterminated string")
+	return ""
+}
+
+func (p *gqlParser) peek(kind byte, text string) bool {
+	return p.tok.kind == kind && p.tok.text == text
+}
+
+func (p *gqlParser) skip(punct string) bool {
+	if p.peek('p', punct) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *gqlParser) expect(punct string) {
+	if !p.skip(punct) {
+		p.fail("expected %q, found %q", punct, p.tok.text)
+	}
+}
+
+func (p *gqlParser) expectName(name string) {
+	if !p.peek('n', name) {
+		p.fail("expected %q, found %q", name, p.tok.text)
+	}
+	p.next()
+}
+
+func (p *gqlParser) name() string {
+	if p.tok.kind != 'n' {
+		p.fail("expected a name, found %q", p.tok.text)
+	}
+	name := p.tok.text
+	p.next()
+	return name
+}
+
+func (p *gqlParser) typeRef() string {
+	var typ string
+	if p.skip("[") {
+		typ = "[" + p.typeRef() + "]"
+		p.expect("]")
+	} else {
+		typ = p.name()
+	}
+	if p.skip("!") {
+		typ += "!"
+	}
+	return typ
+}
+
+func (p *gqlParser) selectionSet() []gqlSelection {
+	p.expect("{")
+	var sel []gqlSelection
+	for !p.skip("}") {
+		if p.tok.kind == 0 {
+			p.fail("unterminated selection set")
+		}
+		if p.skip("...") {
+			s := gqlSelection{}
+			switch {
+			case p.peek('n', "on"):
+				p.next()
+				s.inline, s.on = true, p.name()
+			case p.tok.kind == 'n':
+				s.fragment = p.name()
+			default:
+				s.inline = true
+			}
+			s.directives = p.directives()
+			if s.inline {
+				s.selection = p.selectionSet()
+			}
+			sel = append(sel, s)
+			continue
+		}
+		s := gqlSelection{name: p.name()}
+		if p.skip(":") {
+			s.alias, s.name = s.name, p.name()
+		}
+		s.args = p.arguments(false)
+		s.directives = p.directives()
+		if p.peek('p', "{") {
+			s.selection = p.selectionSet()
+		}
+		sel = append(sel, s)
+	}
+	if len(sel) == 0 {
+		p.fail("empty selection set")
+	}
+	return sel
+}
+
+func (p *gqlParser) arguments(constant bool) map[string]gqlValue {
+	if !p.skip("(") {
+		return nil
+	}
+	args := make(map[string]gqlValue)
+	for !p.skip(")") {
+		name := p.name()
+		p.expect(":")
+		args[name] = p.value(constant)
+	}
+	return args
+}
+
+func (p *gqlParser) directives() []gqlDirective {
+	var ds []gqlDirective
+	for p.skip("@") {
+		d := gqlDirective{name: p.name()}
+		d.args = p.arguments(false)
+		if d.name != "include" && d.name != "skip" {
+			p.fail("unknown directive @%s", d.name)
+		}
+		ds = append(ds, d)
+	}
+	return ds
+}
+
+func (p *gqlParser) value(constant bool) gqlValue {
+	tok := p.tok
+	switch tok.kind {
+	case 'p':
+		switch tok.text {
+		case "$":
+			if constant {
+				p.fail("variables are not allowed here")
+			}
+			p.next()
+			return gqlValue{variable: p.name()}
+		case "[":
+			p.next()
+			list := []gqlValue{}
+			for !p.skip("]") {
+				list = append(list, p.value(constant))
+			}
+			return gqlValue{list: list}
+		case "{":
+			p.fail("input objects are not supported")
+		}
+	case 'i':
+		p.next()
+		n, err := strconv.ParseInt(tok.text, 10, 64)
+		if err != nil {
+			p.fail("invalid integer %s", tok.text)
+		}
+		return gqlValue{literal: n}
+	case 'f':
+		p.next()
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			p.fail("invalid number %s", tok.text)
+		}
+		return gqlValue{literal: f}
+	case 's':
+		p.next()
+		return gqlValue{literal: tok.text}
+	case 'n':
+		p.next()
+		switch tok.text {
+		case "true":
+			return gqlValue{literal: true}
+		case "false":
+			return gqlValue{literal: false}
+		case "null":
+			return gqlValue{}
+		}
+		// Enum values are passed to resolvers as strings.
+		return gqlValue{literal: tok.text}
+	}
+	p.fail("expected a value, found %q", tok.text)
+	return gqlValue{}
+}
+
+// gqlList converts a typed slice for list-typed resolvers.
+func gqlList[T any](items []T) []any {
+	out := make([]any, len(items))
+	for i := range items {
+		out[i] = items[i]
+	}
+	return out
+}
@@ -0,0 +1,272 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// defaultUsageDays is the range of the usage queries when from is not given.
+const defaultUsageDays = 30
+
+// gqlUsageTotals is a UsageTotals priced across the models it covers.
+type gqlUsageTotals struct {
+	UsageTotals
+	cost   float64
+	priced bool
+}
+
+// gqlGet builds a resolver-only field reading from a parent of type T.
+func gqlGet[T any](typ, description string, get func(T) any) *gqlField {
+	return &gqlField{
+		Type:        typ,
+		Description: description,
+		Resolve: func(parent any, _ map[string]any) (any, error) {
+			return get(parent.(T)), nil
+		},
+	}
+}
+
+// gqlOptional maps empty strings to null.
+func gqlOptional(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+var usageArgs = []gqlArg{
+	{Name: "from", Type: "String"},
+	{Name: "to", Type: "String"},
+	{Name: "model", Type: "String"},
+	{Name: "key", Type: "String"},
+}
+
+// GraphQLSchema describes recent exchanges, in-flight requests, and usage
+// history for the admin GraphQL endpoint.
+func (s *Server) GraphQLSchema() *gqlSchema {
+	schema := newGQLSchema()
+
+	schema.object("Query", "").
+		field("requests", &gqlField{
+			Type:        "[Request!]!",
+			Description: "Recently completed exchanges, newest first",
+			Args: []gqlArg{
+				{Name: "limit", Type: "Int", Default: 50},
+				{Name: "model", Type: "String"},
+				{Name: "key", Type: "String"},
+				{Name: "path", Type: "String"},
+				{Name: "status", Type: "Int"},
+				{Name: "errorsOnly", Type: "Boolean", Default: false},
+			},
+			Resolve: func(_ any, args map[string]any) (any, error) {
+				var out []Exchange
+				for _, e := range s.Recent.List() {
+					if len(out) == args["limit"].(int) {
+						break
+					}
+					switch {
+					case args["model"] != nil && e.Model != args["model"],
+						args["key"] != nil && e.Key != args["key"],
+						args["path"] != nil && e.Path != args["path"],
+						args["status"] != nil && e.Status != args["status"],
+						args["errorsOnly"].(bool) && e.Status != 0 && e.Status < 400:
+						continue
+					}
+					out = append(out, e)
+				}
+				return gqlList(out), nil
+			},
+		}).
+		field("request", &gqlField{
+			Type:        "Request",
+			Description: "A recent exchange by request ID",
+			Args:        []gqlArg{{Name: "id", Type: "ID!"}},
+			Resolve: func(_ any, args map[string]any) (any, error) {
+				if e, ok := s.Recent.Get(args["id"].(string)); ok {
+					return e, nil
+				}
+				return nil, nil
+			},
+		}).
+		field("inFlight", &gqlField{
+			Type:        "[InFlightRequest!]!",
+			Description: "Requests currently being proxied, oldest first",
+			Resolve: func(any, map[string]any) (any, error) {
+				return gqlList(s.InFlight.Snapshot()), nil
+			},
+		}).
+		field("usage", &gqlField{
+			Type:        "[UsageDay!]!",
+			Description: "Daily usage per model and key between two YYYY-MM-DD dates, by default the last 30 days",
+			Args:        usageArgs,
+			Resolve: func(_ any, args map[string]any) (any, error) {
+				records, err := s.gqlUsage(args)
+				return gqlList(records), err
+			},
+		}).
+		field("usageTotals", &gqlField{
+			Type:        "UsageTotals!",
+			Description: "Usage summed over the same range and filters as usage",
+			Args:        usageArgs,
+			Resolve: func(_ any, args map[string]any) (any, error) {
+				records, err := s.gqlUsage(args)
+				if err != nil {
+					return nil, err
+				}
+				var totals gqlUsageTotals
+				for _, rec := range records {
+					totals.add(rec.UsageTotals)
+					if cost, ok := s.Pricing.cost(rec.Model, rec.UsageTotals); ok {
+						totals.cost += cost
+						totals.priced = true
+					}
+				}
+				return totals, nil
+			},
+		})
+
+	schema.object("Request", "A completed exchange. Bodies are previews of at most 64 KiB.").
+		field("id", gqlGet("ID!", "", func(e Exchange) any { return e.ID })).
+		field("method", gqlGet("String!", "", func(e Exchange) any { return e.Method })).
+		field("path", gqlGet("String!", "", func(e Exchange) any { return e.Path })).
+		field("clientIp", gqlGet("String", "", func(e Exchange) any { return gqlOptional(e.ClientIP) })).
+		field("key", gqlGet("String", "Redacted client key, or session:<id>", func(e Exchange) any { return gqlOptional(e.Key) })).
+		field("model", gqlGet("String", "", func(e Exchange) any { return gqlOptional(e.Model) })).
+		field("started", gqlGet("String!", "RFC 3339 start time", func(e Exchange) any { return e.Started.Format(time.RFC3339Nano) })).
+		field("durationMs", gqlGet("Float!", "", func(e Exchange) any { return e.DurationMs })).
+		field("queuedMs", gqlGet("Float!", "Time spent waiting out upstream rate limits", func(e Exchange) any { return e.QueuedMs })).
+		field("requeues", gqlGet("Int!", "", func(e Exchange) any { return e.Requeues })).
+		field("template", gqlGet("String", "", func(e Exchange) any { return gqlOptional(e.Template) })).
+		field("promptVersion", gqlGet("String", "", func(e Exchange) any { return gqlOptional(e.PromptVersion) })).
+		field("guardrails", gqlGet("[String!]!", "Guardrail rules the request matched", func(e Exchange) any { return gqlList(e.Guardrails) })).
+		field("error", gqlGet("String", "", func(e Exchange) any { return gqlOptional(e.Error) })).
+		field("request", gqlGet("RequestBody!", "", func(e Exchange) any { return e })).
+		field("response", gqlGet("Response!", "", func(e Exchange) any { return e })).
+		field("usage", gqlGet("Usage!", "", func(e Exchange) any { return e }))
+
+	schema.object("RequestBody", "").
+		field("bytes", gqlGet("Int!", "", func(e Exchange) any { return e.RequestBytes })).
+		field("body", gqlGet("String", "", func(e Exchange) any { return gqlOptional(e.RequestBody) }))
+
+	schema.object("Response", "").
+		field("status", gqlGet("Int!", "0 if no response was received", func(e Exchange) any { return e.Status })).
+		field("streaming", gqlGet("Boolean!", "", func(e Exchange) any { return e.Streaming })).
+		field("bytes", gqlGet("Int!", "", func(e Exchange) any { return e.ResponseBytes })).
+		field("body", gqlGet("String", "", func(e Exchange) any { return gqlOptional(e.ResponseBody) }))
+
+	schema.object("Usage", "Token usage reported by the upstream").
+		field("promptTokens", gqlGet("Int!", "", func(e Exchange) any { return e.PromptTokens })).
+		field("completionTokens", gqlGet("Int!", "", func(e Exchange) any { return e.CompletionTokens })).
+		field("totalTokens", gqlGet("Int!", "", func(e Exchange) any { return e.TotalTokens })).
+		field("cost", gqlGet("Float", "USD, or null if the model has no configured price", func(e Exchange) any {
+			cost, ok := s.Pricing.cost(e.Model, UsageTotals{
+				PromptTokens:     int64(e.PromptTokens),
+				CompletionTokens: int64(e.CompletionTokens),
+			})
+			if !ok {
+				return nil
+			}
+			return cost
+		}))
+
+	schema.object("InFlightRequest", "").
+		field("id", gqlGet("ID!", "", func(r InFlightRequest) any { return r.ID })).
+		field("method", gqlGet("String!", "", func(r InFlightRequest) any { return r.Method })).
+		field("path", gqlGet("String!", "", func(r InFlightRequest) any { return r.Path })).
+		field("clientIp", gqlGet("String", "", func(r InFlightRequest) any { return gqlOptional(r.ClientIP) })).
+		field("started", gqlGet("String!", "", func(r InFlightRequest) any { return r.Started.Format(time.RFC3339Nano) })).
+		field("elapsed", gqlGet("String!", "", func(r InFlightRequest) any { return r.Elapsed }))
+
+	schema.object("UsageDay", "One UTC day of usage for a model and key").
+		field("date", gqlGet("String!", "", func(r UsageRecord) any { return r.Date })).
+		field("model", gqlGet("String", "", func(r UsageRecord) any { return gqlOptional(r.Model) })).
+		field("key", gqlGet("String", "", func(r UsageRecord) any { return gqlOptional(r.Key) })).
+		field("requests", gqlGet("Int!", "", func(r UsageRecord) any { return r.Requests })).
+		field("errors", gqlGet("Int!", "", func(r UsageRecord) any { return r.Errors })).
+		field("promptTokens", gqlGet("Int!", "", func(r UsageRecord) any { return r.PromptTokens })).
+		field("completionTokens", gqlGet("Int!", "", func(r UsageRecord) any { return r.CompletionTokens })).
+		field("totalTokens", gqlGet("Int!", "", func(r UsageRecord) any { return r.TotalTokens })).
+		field("cost", gqlGet("Float", "USD, or null if the model has no configured price", func(r UsageRecord) any {
+			if cost, ok := s.Pricing.cost(r.Model, r.UsageTotals); ok {
+				return cost
+			}
+			return nil
+		}))
+
+	schema.object("UsageTotals", "").
+		field("requests", gqlGet("Int!", "", func(t gqlUsageTotals) any { return t.Requests })).
+		field("errors", gqlGet("Int!", "", func(t gqlUsageTotals) any { return t.Errors })).
+		field("promptTokens", gqlGet("Int!", "", func(t gqlUsageTotals) any { return t.PromptTokens })).
+		field("completionTokens", gqlGet("Int!", "", func(t gqlUsageTotals) any { return t.CompletionTokens })).
+		field("totalTokens", gqlGet("Int!", "", func(t gqlUsageTotals) any { return t.TotalTokens })).
+		field("cost", gqlGet("Float", "USD for the models with a configured price, or null if none has one", func(t gqlUsageTotals) any {
+			if !t.priced {
+				return nil
+			}
+			return t.cost
+		}))
+
+	return schema
+}
+
+// gqlUsage returns the usage records selected by the usage query arguments.
+func (s *Server) gqlUsage(args map[string]any) ([]UsageRecord, error) {
+	to := s.now().UTC()
+	if v, ok := args["to"].(string); ok {
+		t, err := time.Parse(usageDateLayout, v)
+		if err != nil {
+			return nil, fmt.Errorf("to must be a YYYY-MM-DD date")
+		}
+		to = t
+	}
+	from := to.AddDate(0, 0, 1-defaultUsageDays)
+	if v, ok := args["from"].(string); ok {
+		t, err := time.Parse(usageDateLayout, v)
+		if err != nil {
+			return nil, fmt.Errorf("from must be a YYYY-MM-DD date")
+		}
+		from = t
+	}
+
+	var records []UsageRecord
+	for _, rec := range s.Usage.Records(from, to) {
+		if (args["model"] != nil && rec.Model != args["model"]) || (args["key"] != nil && rec.Key != args["key"]) {
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+func (s *Server) handleGraphQL(w http.ResponseWriter, r *http.Request) {
+	var req GraphQLRequest
+	if r.Method == http.MethodGet {
+		q := r.URL.Query()
+		req.Query = q.Get("query")
+		req.OperationName = q.Get("operationName")
+		if v := q.Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				writeJSON(w, http.StatusBadRequest, GraphQLResponse{Errors: []GraphQLError{{Message: "invalid variables: " + err.Error()}}})
+				return
+			}
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, GraphQLResponse{Errors: []GraphQLError{{Message: "invalid JSON body: " + err.Error()}}})
+		return
+	}
+
+	resp := s.GraphQLSchema().Execute(req, s)
+	status := http.StatusOK
+	if resp.Data == nil {
+		// The query could not be parsed or validated, so nothing ran.
+		status = http.StatusBadRequest
+	}
+	writeJSON(w, status, resp)
+}
+
+func (s *Server) handleGraphQLSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, s.GraphQLSchema().SDL())
+}
@@ -0,0 +1,333 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	GuardrailBlock = "block"
+	GuardrailFlag  = "flag"
+	GuardrailLog   = "log"
+)
+
+var (
+	guardrailChecks   = counterMap("guardrail_checks_total")
+	guardrailTriggers = counterMap("guardrail_triggers_total")
+)
+
+// policyPack is a built-in set of patterns applied to one kind of message
+// content.
+type policyPack struct {
+	// roles selects which message roles are inspected.
+	roles    []string
+	patterns []string
+}
+
+var policyPacks = map[string]policyPack{
+	// jailbreak looks for common attempts to talk the model out of its
+	// instructions in user turns.
+	"jailbreak": {
+		roles: []string{"user"},
+		patterns: []string{
+			`ignore (all )?(of )?(your |the )?(previous|prior|above) (instructions|rules|prompts?)`,
+			`\bdo anything now\b`,
+			`\byou are (now )?DAN\b`,
+			`\b(developer|god|jailbreak) mode\b`,
+			`pretend (that )?(you are|to be) .{0,40}(without|no) (any )?(restrictions|filters|rules)`,
+			`(reveal|print|repeat|show) (me )?(your|the) (system prompt|hidden instructions|initial instructions)`,
+		},
+	},
+	// prompt_injection looks for instructions smuggled into tool results.
+	"prompt_injection": {
+		roles: []string{"tool", "function", "function_call_output"},
+		patterns: []string{
+			`ignore (all )?(of )?(the )?(previous|prior|above) (instructions|messages)`,
+			`disregard (all )?(the |your )?(previous|prior|above|earlier)`,
+			`\bnew instructions\s*:`,
+			`\byou (must|should) now\b`,
+			`\bsystem prompt\b`,
+			`<\|im_start\|>|<\|im_end\|>|\[INST\]`,
+			`\bassistant\s*:\s*sure`,
+		},
+	},
+	// profanity is a deliberately small base list; extend it with "words" in
+	// the rule configuration.
+	"profanity": {
+		roles: []string{"user"},
+		patterns: []string{
+			`\b(fuck\w*|shit\w*|bitch\w*|asshole\w*|bastard\w*|cunt\w*|dickhead\w*|motherfuck\w*)\b`,
+		},
+	},
+}
+
+// GuardrailRule enables one policy pack on a set of routes.
+type GuardrailRule struct {
+	Pack   string   `json:"pack"`
+	Routes []string `json:"routes"`
+	Action string   `json:"action"`
+	Words  []string `json:"words"`
+
+	roles    []string
+	patterns []*regexp.Regexp
+}
+
+func (r *GuardrailRule) matchesRoute(path string) bool {
+	if len(r.Routes) == 0 {
+		return true
+	}
+	for _, route := range r.Routes {
+		if route == "*" || strings.HasPrefix(path, route) {
+			return true
+		}
+	}
+	return false
+}
+
+type GuardrailHit struct {
+	Pack   string `json:"pack"`
+	Action string `json:"action"`
+	Match  string `json:"match"`
+}
+
+// Guardrails evaluates configured policy packs against request messages.
+type Guardrails struct {
+	rules []*GuardrailRule
+
+	mu     sync.Mutex
+	checks map[string]int64
+	hits   map[string]int64
+}
+
+// LoadGuardrails reads rules from a JSON file of the form
+// {"rules": [{"pack": "jailbreak", "routes": ["/v1/chat"], "action": "block"}]}.
+func LoadGuardrails(path string) (*Guardrails, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read guardrails file: %w", err)
+	}
+	var cfg struct {
+		Rules []*GuardrailRule `json:"rules"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("invalid guardrails file: %w", err)
+	}
+
+	for _, rule := range cfg.Rules {
+		pack, ok := policyPacks[rule.Pack]
+		if !ok {
+			return nil, fmt.Errorf("unknown guardrail pack %q", rule.Pack)
+		}
+		switch rule.Action {
+		case GuardrailBlock, GuardrailFlag, GuardrailLog:
+		case "":
+			rule.Action = GuardrailLog
+		default:
+			return nil, fmt.Errorf("invalid action %q for guardrail pack %s", rule.Action, rule.Pack)
+		}
+
+		rule.roles = pack.roles
+		patterns := pack.patterns
+		for _, word := range rule.Words {
+			patterns = append(patterns, `\b`+regexp.QuoteMeta(word)+`\b`)
+		}
+		for _, p := range patterns {
+			re, err := regexp.Compile(`(?i)` + p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern in guardrail pack %s: %w", rule.Pack, err)
+			}
+			rule.patterns = append(rule.patterns, re)
+		}
+	}
+
+	return &Guardrails{
+		rules:  cfg.Rules,
+		checks: make(map[string]int64),
+		hits:   make(map[string]int64),
+	}, nil
+}
+
+// guardedMessage is one piece of role-tagged content from a request body.
+type guardedMessage struct {
+	role string
+	text string
+}
+
+// requestMessages extracts role-tagged text from chat completions and
+// Responses API request bodies.
+func requestMessages(body []byte) []guardedMessage {
+	var req struct {
+		Messages []struct {
+			Role    string          `json:"role"`
+			Content json.RawMessage `json:"content"`
+		} `json:"messages"`
+		Input json.RawMessage `json:"input"`
+	}
+	if json.Unmarshal(body, &req) != nil {
+		return nil
+	}
+
+	var messages []guardedMessage
+	for _, m := range req.Messages {
+		messages = append(messages, guardedMessage{role: m.Role, text: contentText(m.Content)})
+	}
+
+	if len(req.Input) > 0 {
+		var input string
+		if json.Unmarshal(req.Input, &input) == nil {
+			messages = append(messages, guardedMessage{role: "user", text: input})
+		} else {
+			var items []struct {
+				Type    string          `json:"type"`
+				Role    string          `json:"role"`
+				Content json.RawMessage `json:"content"`
+				Output  string          `json:"output"`
+			}
+			json.Unmarshal(req.Input, &items)
+			for _, item := range items {
+				if item.Type == "function_call_output" {
+					messages = append(messages, guardedMessage{role: item.Type, text: item.Output})
+					continue
+				}
+				messages = append(messages, guardedMessage{role: item.Role, text: contentText(item.Content)})
+			}
+		}
+	}
+	return messages
+}
+
+// Check runs every rule enabled for path against the request body and returns
+// the rules that triggered. Each rule reports at most one hit.
+func (g *Guardrails) Check(path string, body []byte) []GuardrailHit {
+	var messages []guardedMessage
+	var hits []GuardrailHit
+
+	for _, rule := range g.rules {
+		if !rule.matchesRoute(path) {
+			continue
+		}
+		if messages == nil {
+			messages = requestMessages(body)
+		}
+
+		g.record(rule, false)
+		if match := rule.match(messages); match != "" {
+			g.record(rule, true)
+			hits = append(hits, GuardrailHit{Pack: rule.Pack, Action: rule.Action, Match: match})
+		}
+	}
+	return hits
+}
+
+func (r *GuardrailRule) match(messages []guardedMessage) string {
+	for _, m := range messages {
+		if !containsString(r.roles, m.role) {
+			continue
+		}
+		for _, re := range r.patterns {
+			if match := re.FindString(m.text); match != "" {
+				return match
+			}
+		}
+	}
+	return ""
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *Guardrails) record(rule *GuardrailRule, hit bool) {
+	key := rule.Pack + ":" + rule.Action
+
+	g.mu.Lock()
+	if hit {
+		g.hits[key]++
+	} else {
+		g.checks[key]++
+	}
+	g.mu.Unlock()
+
+	if hit {
+		guardrailTriggers.Add(key, 1)
+	} else {
+		guardrailChecks.Add(key, 1)
+	}
+}
+
+type GuardrailStats struct {
+	Rule        string  `json:"rule"`
+	Checks      int64   `json:"checks"`
+	Triggers    int64   `json:"triggers"`
+	TriggerRate float64 `json:"trigger_rate"`
+}
+
+func (g *Guardrails) Stats() []GuardrailStats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	stats := make([]GuardrailStats, 0, len(g.checks))
+	for key, checks := range g.checks {
+		s := GuardrailStats{Rule: key, Checks: checks, Triggers: g.hits[key]}
+		if checks > 0 {
+			s.TriggerRate = float64(s.Triggers) / float64(checks)
+		}
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Rule < stats[j].Rule
+	})
+	return stats
+}
+
+// applyGuardrails evaluates the request and reports whether it was blocked.
+// Flagged hits are surfaced to the client in the X-Guardrail-Flags header.
+func (s *Server) applyGuardrails(w http.ResponseWriter, r *http.Request, exchange *Exchange, body []byte) bool {
+	hits := s.Guardrails.Check(r.URL.Path, body)
+	if len(hits) == 0 {
+		return false
+	}
+
+	var flags []string
+	for _, hit := range hits {
+		log.Printf("Guardrail %s triggered on %s [%s]: %q (action: %s)", hit.Pack, r.URL.Path, exchange.ID, hit.Match, hit.Action)
+		exchange.Guardrails = append(exchange.Guardrails, hit.Pack)
+
+		switch hit.Action {
+		case GuardrailBlock:
+			exchange.Status = http.StatusBadRequest
+			exchange.Error = "blocked by guardrail " + hit.Pack
+			writeJSON(w, http.StatusBadRequest, map[string]any{
+				"error": map[string]any{
+					"message": fmt.Sprintf("Request blocked by %s policy", hit.Pack),
+					"type":    "guardrail_violation",
+					"code":    hit.Pack,
+				},
+			})
+			return true
+		case GuardrailFlag:
+			flags = append(flags, hit.Pack)
+		}
+	}
+
+	if len(flags) > 0 {
+		w.Header().Set("X-Guardrail-Flags", strings.Join(flags, ","))
+	}
+	return false
+}
+
+func (s *Server) handleGuardrailStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Guardrails.Stats())
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// essentialHeaders are forwarded under an allow-list policy even when not
+// listed: clients need them to read the body and back off, and Via is the
+// proxy's own.
+var essentialHeaders = []string{"content-type", "content-length", "content-encoding", "retry-after", "via"}
+
+// HeaderPolicy decides which upstream response headers reach clients, so a
+// shared deployment does not reveal the upstream account's rate limits,
+// organization, or CDN. It only affects what clients see; logs and
+// recordings keep every upstream header.
+type HeaderPolicy struct {
+	strip []string
+	allow []string
+}
+
+// NewHeaderPolicy parses comma-separated header name patterns to strip and,
+// optionally, to allow exclusively. A trailing * matches any suffix. It
+// returns nil if both are empty.
+func NewHeaderPolicy(strip, allow string) *HeaderPolicy {
+	p := &HeaderPolicy{strip: headerPatterns(strip), allow: headerPatterns(allow)}
+	if p.strip == nil && p.allow == nil {
+		return nil
+	}
+	if p.allow != nil {
+		p.allow = append(p.allow, essentialHeaders...)
+	}
+	return p
+}
+
+func headerPatterns(spec string) []string {
+	var patterns []string
+	for _, p := range strings.Split(spec, ",") {
+		if p = strings.ToLower(strings.TrimSpace(p)); p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+func matchHeader(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Forward reports whether the response header name may be sent to clients.
+func (p *HeaderPolicy) Forward(name string) bool {
+	name = strings.ToLower(name)
+	if p.allow != nil && !matchHeader(p.allow, name) {
+		return false
+	}
+	return !matchHeader(p.strip, name)
+}
+
+// copyResponseHeaders copies the upstream headers the policy forwards to dst.
+func (p *HeaderPolicy) copyResponseHeaders(dst, src http.Header) {
+	for name, values := range src {
+		if p != nil && !p.Forward(name) {
+			continue
+		}
+		for _, value := range values {
+			dst.Add(name, value)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"net/http"
+	"sync"
+)
+
+// Router picks the upstream base URL for a request, e.g. to send some models
+// to a different provider. Returning "" keeps the configured OPENAI_BASE_URL.
+// body is the whole request body, read back from disk if it spilled.
+type Router interface {
+	Route(r *http.Request, body []byte) (string, error)
+}
+
+// RequestHook runs before a request is logged and forwarded. It may modify
+// r's headers, which are copied to the upstream request, and returns the body
+// to forward; returning nil keeps the body unchanged. An error rejects the
+// request with a 400. body is the whole request body, read back from disk if
+// it spilled.
+type RequestHook interface {
+	HandleRequest(r *http.Request, body []byte) ([]byte, error)
+}
+
+// ResponseHook runs when the upstream response arrives, before anything is
+// written to the client. It may modify resp's headers or replace resp.Body.
+// An error aborts the request with a 502.
+type ResponseHook interface {
+	HandleResponse(r *http.Request, resp *http.Response) error
+}
+
+// RouterFunc adapts a function to the Router interface.
+type RouterFunc func(r *http.Request, body []byte) (string, error)
+
+func (f RouterFunc) Route(r *http.Request, body []byte) (string, error) {
+	return f(r, body)
+}
+
+// RequestHookFunc adapts a function to the RequestHook interface.
+type RequestHookFunc func(r *http.Request, body []byte) ([]byte, error)
+
+func (f RequestHookFunc) HandleRequest(r *http.Request, body []byte) ([]byte, error) {
+	return f(r, body)
+}
+
+// ResponseHookFunc adapts a function to the ResponseHook interface.
+type ResponseHookFunc func(r *http.Request, resp *http.Response) error
+
+func (f ResponseHookFunc) HandleResponse(r *http.Request, resp *http.Response) error {
+	return f(r, resp)
+}
+
+// The registry holds extensions compiled into the binary. Files guarded by a
+// build tag call the Register functions from init, and NewServer attaches
+// whatever was registered.
+var (
+	registryMu      sync.Mutex
+	registeredRoute Router
+	registeredReq   []RequestHook
+	registeredResp  []ResponseHook
+)
+
+// RegisterRouter sets the router used by servers created afterwards. Only one
+// router can be registered; a later call replaces an earlier one.
+func RegisterRouter(router Router) {
+	registryMu.Lock()
+	registeredRoute = router
+	registryMu.Unlock()
+}
+
+// RegisterRequestHook adds a hook run, in registration order, on every request
+// of servers created afterwards.
+func RegisterRequestHook(hook RequestHook) {
+	registryMu.Lock()
+	registeredReq = append(registeredReq, hook)
+	registryMu.Unlock()
+}
+
+// RegisterResponseHook adds a hook run, in registration order, on every
+// response of servers created afterwards.
+func RegisterResponseHook(hook ResponseHook) {
+	registryMu.Lock()
+	registeredResp = append(registeredResp, hook)
+	registryMu.Unlock()
+}
+
+func registeredExtensions() (Router, []RequestHook, []ResponseHook) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	return registeredRoute,
+		append([]RequestHook(nil), registeredReq...),
+		append([]ResponseHook(nil), registeredResp...)
+}
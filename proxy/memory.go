@@ -0,0 +1,350 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"t-oai-api/config"
+	"t-oai-api/logging"
+)
+
+const (
+	defaultMemoryHeader = "X-Conversation-ID"
+	defaultMemoryTTL    = time.Hour
+	// maxConversations caps the conversations held at once; the least
+	// recently used one is forgotten to make room.
+	maxConversations = 10000
+	// maxMemoryReply caps how much of a reply is buffered to be remembered;
+	// longer replies end the turn without being stored.
+	maxMemoryReply = 4 << 20
+)
+
+// ConversationMemory gives stateless clients multi-turn conversations. It
+// stores the turns of each conversation, named by a request header, and
+// prepends them to the next chat request in the same conversation.
+// Conversations are held in memory, per client key, and are lost on restart.
+type ConversationMemory struct {
+	// Header names the request header carrying the conversation ID.
+	Header string
+	turns  int
+	tokens int
+	ttl    time.Duration
+
+	mu            sync.Mutex
+	conversations map[memoryKey]*conversation
+}
+
+// memoryKey scopes conversation IDs to the client's credential, so one client
+// cannot read another's conversation by guessing its ID. The scope is a hash
+// of the client key, or the session ID for session tokens: key labels are
+// for display only and two keys can share one.
+type memoryKey struct {
+	scope string
+	id    string
+}
+
+type conversation struct {
+	label   string
+	turns   []memoryTurn
+	updated time.Time
+}
+
+// memoryTurn is the messages a client sent in one request followed by the
+// reply.
+type memoryTurn struct {
+	requestID string
+	messages  []json.RawMessage
+	tokens    int
+}
+
+// ConversationInfo describes one stored conversation.
+type ConversationInfo struct {
+	ID      string    `json:"id"`
+	Key     string    `json:"key,omitempty"`
+	Turns   int       `json:"turns"`
+	Tokens  int       `json:"tokens"`
+	Updated time.Time `json:"updated"`
+}
+
+// NewConversationMemory returns the memory configured in cfg, or nil if
+// MemoryTurns is not positive.
+func NewConversationMemory(cfg config.Config) *ConversationMemory {
+	if cfg.MemoryTurns <= 0 {
+		return nil
+	}
+	m := &ConversationMemory{
+		Header:        cfg.MemoryHeader,
+		turns:         cfg.MemoryTurns,
+		tokens:        cfg.MemoryTokens,
+		ttl:           time.Duration(cfg.MemoryTTL) * time.Second,
+		conversations: make(map[memoryKey]*conversation),
+	}
+	if m.Header == "" {
+		m.Header = defaultMemoryHeader
+	}
+	if m.ttl <= 0 {
+		m.ttl = defaultMemoryTTL
+	}
+	return m
+}
+
+// memoryCapture holds the new messages of one request and captures its reply
+// as it is relayed.
+type memoryCapture struct {
+	key       memoryKey
+	label     string
+	requestID string
+	messages  []json.RawMessage
+	reply     bytes.Buffer
+	truncated bool
+}
+
+func (c *memoryCapture) Write(p []byte) (int, error) {
+	if c.reply.Len()+len(p) > maxMemoryReply {
+		c.truncated = true
+	} else {
+		c.reply.Write(p)
+	}
+	return len(p), nil
+}
+
+// Inject prepends the stored turns of conversation id to a chat request body,
+// after its leading system messages. It returns the new body, the number of
+// turns prepended, and a capture with which to remember the exchange. The
+// body is nil for requests left alone: those that are not JSON, and those
+// that already carry assistant messages, since their client keeps its own
+// history.
+func (m *ConversationMemory) Inject(scope, id, requestID string, body []byte) ([]byte, int, *memoryCapture) {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) != nil {
+		return nil, 0, nil
+	}
+	var messages []json.RawMessage
+	if json.Unmarshal(fields["messages"], &messages) != nil {
+		return nil, 0, nil
+	}
+	system := 0
+	for i, raw := range messages {
+		var msg struct {
+			Role string `json:"role"`
+		}
+		json.Unmarshal(raw, &msg)
+		switch {
+		case msg.Role == "assistant":
+			return nil, 0, nil
+		case (msg.Role == "system" || msg.Role == "developer") && i == system:
+			system++
+		}
+	}
+
+	k := memoryKey{scope, id}
+	m.mu.Lock()
+	var history []memoryTurn
+	if conv, ok := m.conversations[k]; ok {
+		if time.Since(conv.updated) > m.ttl {
+			delete(m.conversations, k)
+		} else {
+			history = conv.turns
+		}
+	}
+	// Drop the oldest turns until the rest fit the token budget.
+	if m.tokens > 0 {
+		total := 0
+		for _, turn := range history {
+			total += turn.tokens
+		}
+		for len(history) > 0 && total > m.tokens {
+			total -= history[0].tokens
+			history = history[1:]
+		}
+	}
+	combined := append([]json.RawMessage(nil), messages[:system]...)
+	for _, turn := range history {
+		combined = append(combined, turn.messages...)
+	}
+	m.mu.Unlock()
+	combined = append(combined, messages[system:]...)
+
+	capture := &memoryCapture{key: k, requestID: requestID, messages: append([]json.RawMessage(nil), messages[system:]...)}
+	if len(history) == 0 {
+		return body, 0, capture
+	}
+	fields["messages"], _ = json.Marshal(combined)
+	injected, err := json.Marshal(fields)
+	if err != nil {
+		return nil, 0, nil
+	}
+	return injected, len(history), capture
+}
+
+// Remember appends a completed exchange to its conversation as a new turn.
+func (m *ConversationMemory) Remember(c *memoryCapture, streaming bool) {
+	if c.truncated {
+		return
+	}
+	reply := replyMessage(c.reply.Bytes(), streaming)
+	if reply == nil {
+		return
+	}
+	turn := memoryTurn{requestID: c.requestID, messages: append(c.messages, reply)}
+	for _, raw := range turn.messages {
+		tokens, images := messageTokens(raw)
+		turn.tokens += tokens + images*tokensPerImage
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	conv, ok := m.conversations[c.key]
+	if !ok {
+		if len(m.conversations) >= maxConversations {
+			m.evictOldest()
+		}
+		conv = &conversation{}
+		m.conversations[c.key] = conv
+	}
+	conv.label = c.label
+	conv.turns = append(conv.turns, turn)
+	if len(conv.turns) > m.turns {
+		conv.turns = append([]memoryTurn(nil), conv.turns[len(conv.turns)-m.turns:]...)
+	}
+	conv.updated = time.Now()
+}
+
+// evictOldest forgets expired conversations, or failing that the least
+// recently used one. The caller must hold m.mu.
+func (m *ConversationMemory) evictOldest() {
+	var oldest memoryKey
+	var oldestAt time.Time
+	for k, conv := range m.conversations {
+		if time.Since(conv.updated) > m.ttl {
+			delete(m.conversations, k)
+			continue
+		}
+		if oldestAt.IsZero() || conv.updated.Before(oldestAt) {
+			oldest, oldestAt = k, conv.updated
+		}
+	}
+	if len(m.conversations) >= maxConversations {
+		delete(m.conversations, oldest)
+	}
+}
+
+// replyMessage returns the first choice's message from a chat completion
+// response, reassembling streamed responses from their deltas.
+func replyMessage(body []byte, streaming bool) json.RawMessage {
+	if streaming {
+		if body = logging.AssembleStream(body); body == nil {
+			return nil
+		}
+	}
+	var resp struct {
+		Choices []struct {
+			Index   int             `json:"index"`
+			Message json.RawMessage `json:"message"`
+		} `json:"choices"`
+	}
+	if json.Unmarshal(body, &resp) != nil {
+		return nil
+	}
+	for _, choice := range resp.Choices {
+		if choice.Index == 0 && choice.Message != nil {
+			return choice.Message
+		}
+	}
+	return nil
+}
+
+// Erase removes the turns of the given requests from every conversation and
+// returns how many were removed.
+func (m *ConversationMemory) Erase(ids map[string]bool) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	removed := 0
+	for k, conv := range m.conversations {
+		kept := conv.turns[:0]
+		for _, turn := range conv.turns {
+			if ids[turn.requestID] {
+				removed++
+				continue
+			}
+			kept = append(kept, turn)
+		}
+		conv.turns = kept
+		if len(kept) == 0 {
+			delete(m.conversations, k)
+		}
+	}
+	return removed
+}
+
+// Forget drops every conversation with the given ID and returns how many
+// there were.
+func (m *ConversationMemory) Forget(id string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	removed := 0
+	for k := range m.conversations {
+		if k.id == id {
+			delete(m.conversations, k)
+			removed++
+		}
+	}
+	return removed
+}
+
+// List describes the unexpired conversations, most recently used first.
+func (m *ConversationMemory) List() []ConversationInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]ConversationInfo, 0, len(m.conversations))
+	for k, conv := range m.conversations {
+		if time.Since(conv.updated) > m.ttl {
+			continue
+		}
+		info := ConversationInfo{ID: k.id, Key: conv.label, Turns: len(conv.turns), Updated: conv.updated}
+		for _, turn := range conv.turns {
+			info.Tokens += turn.tokens
+		}
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Updated.After(list[j].Updated) })
+	return list
+}
+
+// injectMemory prepends the conversation's stored turns to a chat request
+// that names one, returning the capture with which to remember it.
+func (s *Server) injectMemory(w http.ResponseWriter, r *http.Request, exchange *Exchange, session *SessionClaims, reqBody *logging.BodySpool, body []byte) *memoryCapture {
+	id := r.Header.Get(s.Memory.Header)
+	scope := "key:" + credentialHash(r.Header)
+	if session != nil {
+		scope = "session:" + session.ID
+	}
+	body, turns, capture := s.Memory.Inject(scope, id, exchange.ID, body)
+	if capture == nil {
+		return nil
+	}
+	capture.label = exchange.Key
+	if turns > 0 {
+		reqBody.Reset()
+		reqBody.Write(body)
+	}
+	w.Header().Set("X-Conversation-Turns", strconv.Itoa(turns))
+	return capture
+}
+
+func (s *Server) handleListConversations(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Memory.List())
+}
+
+func (s *Server) handleForgetConversation(w http.ResponseWriter, r *http.Request) {
+	if s.Memory.Forget(r.PathValue("id")) == 0 {
+		writeAPIError(w, http.StatusNotFound, "conversation not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"forgotten": true})
+}
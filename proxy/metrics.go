@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"expvar"
+	"sync"
+)
+
+// metricsName is the expvar variable every proxy metric is published under,
+// so embedding the package cannot collide with the host program's variables.
+const metricsName = "toai"
+
+var (
+	metricsOnce sync.Once
+	metricsMap  *expvar.Map
+	// metricsMu serializes creating the nested maps of counterMap metrics.
+	metricsMu sync.Mutex
+)
+
+// metrics returns the proxy's expvar map, publishing it on first use.
+func metrics() *expvar.Map {
+	metricsOnce.Do(func() {
+		if m, ok := expvar.Get(metricsName).(*expvar.Map); ok {
+			metricsMap = m
+			return
+		}
+		metricsMap = expvar.NewMap(metricsName)
+	})
+	return metricsMap
+}
+
+// counter is an integer metric in the proxy's expvar map. Gauges such as
+// queue depths are counters that are also decremented.
+type counter string
+
+func (c counter) Add(delta int64) {
+	metrics().Add(string(c), delta)
+}
+
+func (c counter) Value() int64 {
+	if v, ok := metrics().Get(string(c)).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// counterMap is a metric in the proxy's expvar map holding one integer per
+// key, such as a guardrail rule or an upstream host.
+type counterMap string
+
+func (c counterMap) get() *expvar.Map {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	m, ok := metrics().Get(string(c)).(*expvar.Map)
+	if !ok {
+		m = new(expvar.Map)
+		metrics().Set(string(c), m)
+	}
+	return m
+}
+
+func (c counterMap) Add(key string, delta int64) {
+	c.get().Add(key, delta)
+}
+
+func (c counterMap) Set(key string, value int64) {
+	v := new(expvar.Int)
+	v.Set(value)
+	c.get().Set(key, v)
+}
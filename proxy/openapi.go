@@ -0,0 +1,469 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// adminRoute describes one admin API endpoint. The route table drives both the
+// admin mux and the generated OpenAPI document, so the two cannot drift.
+type adminRoute struct {
+	Pattern string
+	Summary string
+	Handler http.HandlerFunc
+	// Request is the JSON body the route accepts; nil means none.
+	Request     any
+	Response    any
+	ContentType string
+	Query       []adminParam
+	// Requires names the setting that enables the route; empty means always.
+	Requires string
+	enabled  bool
+}
+
+type adminParam struct {
+	Name        string
+	Description string
+}
+
+func (s *Server) adminRoutes() []adminRoute {
+	return []adminRoute{
+		{
+			Pattern:  "GET /readyz",
+			Summary:  "Readiness, with warnings for upstream providers reporting incidents",
+			Handler:  s.handleReadyz,
+			Response: Readiness{},
+			enabled:  true,
+		},
+		{
+			Pattern:  "GET /admin/openapi.json",
+			Summary:  "This OpenAPI document",
+			Handler:  s.handleOpenAPISpec,
+			Response: map[string]any{},
+			enabled:  true,
+		},
+		{
+			Pattern:  "GET /admin/debug/state",
+			Summary:  "Runtime state: uptime, goroutines, memory, and in-flight requests",
+			Handler:  func(w http.ResponseWriter, r *http.Request) { writeJSON(w, http.StatusOK, s.DebugState()) },
+			Response: DebugState{},
+			enabled:  true,
+		},
+		{
+			Pattern:  "GET /admin/requests",
+			Summary:  "In-flight requests and summaries of recent exchanges, newest first",
+			Handler:  s.handleListRequests,
+			Response: RequestList{},
+			enabled:  true,
+		},
+		{
+			Pattern:  "GET /admin/requests/{id}",
+			Summary:  "A recent exchange including request and response body previews",
+			Handler:  s.handleGetRequest,
+			Response: Exchange{},
+			enabled:  true,
+		},
+		{
+			Pattern:  "POST /admin/graphql",
+			Summary:  "Run a GraphQL query over recent exchanges, in-flight requests, and usage history",
+			Handler:  s.handleGraphQL,
+			Request:  GraphQLRequest{},
+			Response: GraphQLResponse{},
+			enabled:  true,
+		},
+		{
+			Pattern:  "GET /admin/graphql",
+			Summary:  "Run a GraphQL query passed in the query string",
+			Handler:  s.handleGraphQL,
+			Response: GraphQLResponse{},
+			Query: []adminParam{
+				{Name: "query", Description: "GraphQL query document"},
+				{Name: "variables", Description: "JSON object of variable values"},
+				{Name: "operationName", Description: "Operation to run when the document has several"},
+			},
+			enabled: true,
+		},
+		{
+			Pattern:     "GET /admin/graphql/schema",
+			Summary:     "The GraphQL schema in schema definition language",
+			Handler:     s.handleGraphQLSchema,
+			Response:    "",
+			ContentType: "text/plain",
+			enabled:     true,
+		},
+		{
+			Pattern:  "GET /admin/subjects/export",
+			Summary:  "Every stored exchange of a data subject, from logs, body files, transcripts, the recording, and the history",
+			Handler:  s.handleSubjectExport,
+			Response: SubjectExport{},
+			Query: []adminParam{
+				{Name: "user", Description: "Match the user field of request bodies"},
+				{Name: "tag", Description: "Match a request metadata tag, as key:value"},
+			},
+			enabled: true,
+		},
+		{
+			Pattern:  "POST /admin/subjects/erase",
+			Summary:  "Erase every stored exchange of a data subject and report what was removed",
+			Handler:  s.handleSubjectErase,
+			Response: ErasureReport{},
+			Query: []adminParam{
+				{Name: "user", Description: "Match the user field of request bodies"},
+				{Name: "tag", Description: "Match a request metadata tag, as key:value"},
+				{Name: "dry_run", Description: "Only report what would be erased"},
+			},
+			enabled: true,
+		},
+		{
+			Pattern:  "GET /admin/prompts",
+			Summary:  "System prompt versions per family with metric shifts between versions",
+			Handler:  s.handlePromptReport,
+			Response: []PromptFamilyReport{},
+			enabled:  s.Prompts != nil,
+		},
+		{
+			Pattern:     "GET /admin/prompts/{family}/diff",
+			Summary:     "Line diff between two versions of a family's system prompt",
+			Handler:     s.handlePromptDiff,
+			Response:    "",
+			ContentType: "text/plain",
+			Query: []adminParam{
+				{Name: "from", Description: "Version to diff from, e.g. v1"},
+				{Name: "to", Description: "Version to diff to, e.g. v2"},
+			},
+			enabled: s.Prompts != nil,
+		},
+		{
+			Pattern:  "POST /admin/estimate",
+			Summary:  "Estimate prompt tokens, maximum completion tokens, and cost range of a request body without sending it",
+			Handler:  s.handleEstimate,
+			Request:  map[string]any{},
+			Response: CostEstimate{},
+			enabled:  true,
+		},
+		{
+			Pattern:  "POST /admin/warmup",
+			Summary:  "Pre-connect to the warm-up targets and load their models now",
+			Handler:  s.handleWarmup,
+			Response: []WarmupResult{},
+			Requires: "WARMUP_TARGETS",
+			enabled:  len(s.WarmupTargets) > 0,
+		},
+		{
+			Pattern:  "GET /admin/spend/forecast",
+			Summary:  "Month-to-date and projected end-of-month spend per model and key, with triggered alerts",
+			Handler:  s.handleSpendForecast,
+			Response: SpendForecast{},
+			Query: []adminParam{
+				{Name: "days", Description: "Full days before today used for the run rate (default 7)"},
+			},
+			enabled: true,
+		},
+		{
+			Pattern:  "GET /admin/anomalies",
+			Summary:  "Recent traffic anomaly events, newest first, and the baseline learned for each key",
+			Handler:  s.handleAnomalies,
+			Response: AnomalyReport{},
+			Requires: "ANOMALY_FACTOR",
+			enabled:  s.Anomalies != nil,
+		},
+		{
+			Pattern:  "POST /admin/sessions",
+			Summary:  "Mint a short-lived session token limited to given models, a token budget, and an expiry",
+			Handler:  s.handleMintSession,
+			Request:  SessionRequest{},
+			Response: SessionToken{},
+			Requires: "SESSION_SECRET",
+			enabled:  s.Sessions != nil,
+		},
+		{
+			Pattern:  "GET /admin/sessions",
+			Summary:  "Unexpired session tokens with their usage",
+			Handler:  s.handleListSessions,
+			Response: []Session{},
+			Requires: "SESSION_SECRET",
+			enabled:  s.Sessions != nil,
+		},
+		{
+			Pattern:  "DELETE /admin/sessions/{id}",
+			Summary:  "Revoke a session token before it expires",
+			Handler:  s.handleRevokeSession,
+			Response: map[string]bool{},
+			Requires: "SESSION_SECRET",
+			enabled:  s.Sessions != nil,
+		},
+		{
+			Pattern:  "GET /admin/conversations",
+			Summary:  "Remembered conversations with their turn and token counts",
+			Handler:  s.handleListConversations,
+			Response: []ConversationInfo{},
+			Requires: "MEMORY_TURNS",
+			enabled:  s.Memory != nil,
+		},
+		{
+			Pattern:  "DELETE /admin/conversations/{id}",
+			Summary:  "Forget a conversation",
+			Handler:  s.handleForgetConversation,
+			Response: map[string]bool{},
+			Requires: "MEMORY_TURNS",
+			enabled:  s.Memory != nil,
+		},
+		{
+			Pattern:  "GET /admin/embeddings-cache",
+			Summary:  "Embeddings cache size and hit counts",
+			Handler:  s.handleEmbeddingCacheStats,
+			Response: EmbeddingCacheStats{},
+			Requires: "EMBEDDING_CACHE_DIR",
+			enabled:  s.EmbeddingCache != nil,
+		},
+		{
+			Pattern:  "DELETE /admin/embeddings-cache",
+			Summary:  "Purge the embeddings cache",
+			Handler:  s.handleEmbeddingCachePurge,
+			Response: map[string]int{},
+			Query: []adminParam{
+				{Name: "model", Description: "Only purge entries for this model"},
+			},
+			Requires: "EMBEDDING_CACHE_DIR",
+			enabled:  s.EmbeddingCache != nil,
+		},
+		{
+			Pattern:  "GET /admin/guardrails",
+			Summary:  "Check and trigger counts per guardrail rule",
+			Handler:  s.handleGuardrailStats,
+			Response: []GuardrailStats{},
+			Requires: "GUARDRAILS_FILE",
+			enabled:  s.Guardrails != nil,
+		},
+		{
+			Pattern:  "GET /admin/ratelimits",
+			Summary:  "Rate-limited upstream hosts with queue depth and when they reopen",
+			Handler:  s.handleRateLimits,
+			Response: []RateLimitStatus{},
+			Requires: "RATE_LIMIT_MAX_WAIT",
+			enabled:  s.RateLimits != nil,
+		},
+		{
+			Pattern:  "GET /admin/pacing",
+			Summary:  "Pacing budgets per upstream and key with their backlog and waiting requests",
+			Handler:  s.handlePacing,
+			Response: []PacingStatus{},
+			Requires: "PACING_FILE",
+			enabled:  s.Pacer != nil,
+		},
+		{
+			Pattern:  "GET /admin/templates",
+			Summary:  "Loaded prompt templates grouped by name",
+			Handler:  s.handleListTemplates,
+			Response: map[string][]*PromptTemplate{},
+			Requires: "PROMPT_TEMPLATE_DIR",
+			enabled:  s.Templates != nil,
+		},
+		{
+			Pattern:  "POST /admin/templates/reload",
+			Summary:  "Reload prompt templates from disk",
+			Handler:  s.handleReloadTemplates,
+			Response: map[string][]*PromptTemplate{},
+			Requires: "PROMPT_TEMPLATE_DIR",
+			enabled:  s.Templates != nil,
+		},
+	}
+}
+
+var pathParamPattern = regexp.MustCompile(`\{([^}]+)\}`)
+
+// OpenAPISpec builds an OpenAPI 3 document for the admin API served at
+// serverURL. Routes that are disabled in this configuration are still
+// described, noting the setting that enables them.
+func (s *Server) OpenAPISpec(serverURL string) map[string]any {
+	gen := &schemaGenerator{components: make(map[string]any)}
+	paths := make(map[string]map[string]any)
+
+	for _, route := range s.adminRoutes() {
+		method, path, _ := strings.Cut(route.Pattern, " ")
+
+		var params []any
+		for _, m := range pathParamPattern.FindAllStringSubmatch(path, -1) {
+			params = append(params, map[string]any{
+				"name":     m[1],
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]any{"type": "string"},
+			})
+		}
+		for _, q := range route.Query {
+			params = append(params, map[string]any{
+				"name":        q.Name,
+				"in":          "query",
+				"description": q.Description,
+				"schema":      map[string]any{"type": "string"},
+			})
+		}
+
+		contentType := route.ContentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		description := route.Summary
+		if route.Requires != "" {
+			description += ". Only available when " + route.Requires + " is set."
+		}
+
+		op := map[string]any{
+			"summary":     route.Summary,
+			"description": description,
+			"operationId": operationID(method, path),
+			"responses": map[string]any{
+				"200": map[string]any{
+					"description": "OK",
+					"content": map[string]any{
+						contentType: map[string]any{"schema": gen.schema(reflect.TypeOf(route.Response))},
+					},
+				},
+				"default": map[string]any{
+					"description": "Error",
+					"content": map[string]any{
+						"application/json": map[string]any{"schema": map[string]any{"$ref": "#/components/schemas/Error"}},
+					},
+				},
+			},
+		}
+		if params != nil {
+			op["parameters"] = params
+		}
+		if route.Request != nil {
+			op["requestBody"] = map[string]any{
+				"required": true,
+				"content": map[string]any{
+					"application/json": map[string]any{"schema": gen.schema(reflect.TypeOf(route.Request))},
+				},
+			}
+		}
+
+		if paths[path] == nil {
+			paths[path] = make(map[string]any)
+		}
+		paths[path][strings.ToLower(method)] = op
+	}
+
+	gen.components["Error"] = gen.structSchema(reflect.TypeOf(APIError{}))
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "Transparent OpenAI Proxy admin API",
+			"version": "1.0.0",
+		},
+		"servers":    []any{map[string]any{"url": serverURL}},
+		"paths":      paths,
+		"components": map[string]any{"schemas": gen.components},
+	}
+}
+
+// operationID derives a stable identifier such as getAdminRequestsById.
+func operationID(method, path string) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(method))
+	for _, part := range strings.FieldsFunc(path, func(r rune) bool {
+		return r == '/' || r == '-' || r == '{' || r == '}'
+	}) {
+		if strings.Contains(path, "{"+part+"}") {
+			b.WriteString("By")
+		}
+		b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	return b.String()
+}
+
+// schemaGenerator derives JSON schemas from Go types using their json tags.
+// Named struct types become shared components.
+type schemaGenerator struct {
+	components map[string]any
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+func (g *schemaGenerator) schema(t reflect.Type) map[string]any {
+	if t == nil {
+		return map[string]any{}
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t == rawMessageType:
+		return map[string]any{}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		name := t.Name()
+		if name == "" {
+			return g.structSchema(t)
+		}
+		if _, ok := g.components[name]; !ok {
+			// Reserve the name first so recursive types terminate.
+			g.components[name] = nil
+			g.components[name] = g.structSchema(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	default:
+		return map[string]any{}
+	}
+}
+
+func (g *schemaGenerator) structSchema(t reflect.Type) map[string]any {
+	properties := make(map[string]any)
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = g.schema(field.Type)
+		if !strings.Contains(opts, "omitempty") {
+			required = append(required, name)
+		}
+	}
+
+	schema := map[string]any{"type": "object", "properties": properties}
+	if required != nil {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func (s *Server) handleOpenAPISpec(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.OpenAPISpec("http://"+r.Host))
+}
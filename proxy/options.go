@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"t-oai-api/config"
+)
+
+// Config is the proxy configuration. It is an alias so embedders only need to
+// import this package.
+type Config = config.Config
+
+// Option customises a Server created by New or NewServer.
+type Option func(*Server)
+
+// WithRouter sets the router, replacing any registered with RegisterRouter.
+func WithRouter(router Router) Option {
+	return func(s *Server) {
+		s.Router = router
+	}
+}
+
+// WithRequestHook adds a request hook after any registered ones.
+func WithRequestHook(hook RequestHook) Option {
+	return func(s *Server) {
+		s.RequestHooks = append(s.RequestHooks, hook)
+	}
+}
+
+// WithResponseHook adds a response hook after any registered ones.
+func WithResponseHook(hook ResponseHook) Option {
+	return func(s *Server) {
+		s.ResponseHooks = append(s.ResponseHooks, hook)
+	}
+}
+
+// WithHTTPClient sets the client used for upstream requests, e.g. to supply a
+// custom transport.
+func WithHTTPClient(client *http.Client) Option {
+	return func(s *Server) {
+		s.client = client
+	}
+}
+
+// New returns the proxy as an http.Handler for mounting in an existing mux,
+// typically under http.StripPrefix so upstream paths line up:
+//
+//	mux.Handle("/openai/", http.StripPrefix("/openai", proxy.New(cfg)))
+//
+// The handler is a *Server; call Close on shutdown to flush logs and state.
+// If cfg cannot be loaded the error is logged and every request gets a 500;
+// use NewServer to handle the error instead.
+func New(cfg Config, opts ...Option) http.Handler {
+	s, err := NewServer(cfg, opts...)
+	if err != nil {
+		log.Printf("Error creating proxy: %v", err)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			writeAPIError(w, http.StatusInternalServerError, "proxy is misconfigured: "+err.Error())
+		})
+	}
+	return s
+}
+
+// WithClock replaces the clock used for request IDs, timings, and log
+// timestamps, e.g. with a virtual clock during replay.
+func WithClock(now func() time.Time) Option {
+	return func(s *Server) {
+		s.now = now
+		s.Logger.Clock = now
+	}
+}
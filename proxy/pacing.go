@@ -0,0 +1,341 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"t-oai-api/logging"
+)
+
+// defaultPacingMaxWait bounds how long a request is held for its budget when
+// a rule sets no max_wait.
+const defaultPacingMaxWait = 60 * time.Second
+
+var (
+	pacingQueueDepth = counter("pacing_queue_depth")
+	pacingDelayed    = counter("pacing_delayed_total")
+	pacingTimeouts   = counter("pacing_timeouts_total")
+)
+
+// PacingLimit is an upstream's budget per minute; zero means unlimited.
+type PacingLimit struct {
+	TPM int `json:"tpm"`
+	RPM int `json:"rpm"`
+}
+
+// PacingRule paces the requests to one upstream host.
+type PacingRule struct {
+	PacingLimit
+	// Burst is how many seconds' worth of budget may go out at once; zero
+	// spaces every request evenly.
+	Burst float64 `json:"burst"`
+	// MaxWait is how many seconds a request may be held before it is
+	// answered with a 429 instead.
+	MaxWait float64 `json:"max_wait"`
+	// PerKey gives every client key its own budget, for upstreams that
+	// limit each API key separately.
+	PerKey bool `json:"per_key"`
+	// Keys sets budgets for individual client keys, by the label shown in
+	// /admin/requests. They are charged on top of the shared budget, or
+	// with PerKey replace the key's own.
+	Keys map[string]PacingLimit `json:"keys"`
+}
+
+// Pacer spreads requests over time so each upstream stays under its
+// tokens-per-minute and requests-per-minute limits, rather than sending them
+// as they arrive and handling the 429s that follow. Each budget is a leaky
+// bucket that drains at the configured rate; a request's estimated tokens
+// are charged when it is sent and corrected by its reported usage once it
+// completes.
+type Pacer struct {
+	// rules maps a host, host:port, or "*" for every upstream to its rule.
+	rules map[string]*PacingRule
+
+	mu           sync.Mutex
+	buckets      map[pacingKey]*pacingBucket
+	reservations map[*Exchange]pacingReservation
+}
+
+type pacingKey struct {
+	upstream string
+	key      string
+}
+
+// pacingBucket tracks when each budget is next free: the time the bucket
+// drains of everything already charged to it.
+type pacingBucket struct {
+	limit      PacingLimit
+	burst      time.Duration
+	tokensAt   time.Time
+	requestsAt time.Time
+	waiting    int
+	delayed    int64
+}
+
+type pacingReservation struct {
+	buckets []*pacingBucket
+	tokens  int
+}
+
+// PacingStatus is the state of one budget.
+type PacingStatus struct {
+	Upstream string `json:"upstream"`
+	Key      string `json:"key,omitempty"`
+	TPM      int    `json:"tpm,omitempty"`
+	RPM      int    `json:"rpm,omitempty"`
+	// TokenBacklogMs and RequestBacklogMs are how long the budgets take to
+	// drain of what has already been charged to them.
+	TokenBacklogMs   float64 `json:"token_backlog_ms"`
+	RequestBacklogMs float64 `json:"request_backlog_ms"`
+	Waiting          int     `json:"waiting"`
+	Delayed          int64   `json:"delayed_total"`
+}
+
+// LoadPacer reads pacing rules from the JSON file at path, keyed by upstream
+// host, host:port, or "*". It returns nil if path is empty.
+func LoadPacer(path string) (*Pacer, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pacing file: %w", err)
+	}
+	p := &Pacer{
+		buckets:      make(map[pacingKey]*pacingBucket),
+		reservations: make(map[*Exchange]pacingReservation),
+	}
+	if err := json.Unmarshal(data, &p.rules); err != nil {
+		return nil, fmt.Errorf("invalid pacing file: %w", err)
+	}
+	for host, rule := range p.rules {
+		if rule == nil || rule.Burst < 0 || rule.MaxWait < 0 {
+			return nil, fmt.Errorf("invalid pacing file: bad rule for %s", host)
+		}
+		limits := []PacingLimit{rule.PacingLimit}
+		for _, limit := range rule.Keys {
+			limits = append(limits, limit)
+		}
+		for _, limit := range limits {
+			if limit.TPM < 0 || limit.RPM < 0 || (limit.TPM == 0 && limit.RPM == 0) {
+				return nil, fmt.Errorf("invalid pacing file: %s needs a positive tpm or rpm", host)
+			}
+		}
+	}
+	return p, nil
+}
+
+// rule returns the rule for target and the name it is configured under,
+// preferring host:port, then the hostname, then "*".
+func (p *Pacer) rule(target *url.URL) (*PacingRule, string) {
+	for _, name := range []string{target.Host, target.Hostname(), "*"} {
+		if rule, ok := p.rules[name]; ok {
+			return rule, name
+		}
+	}
+	return nil, ""
+}
+
+func tokenInterval(tokens, tpm int) time.Duration {
+	return time.Duration(float64(tokens) / float64(tpm) * float64(time.Minute))
+}
+
+func later(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
+
+// next returns the earliest time a request of tokens may be sent.
+func (b *pacingBucket) next(now time.Time, tokens int) time.Time {
+	start := now
+	if b.limit.RPM > 0 {
+		start = later(start, b.requestsAt.Add(-b.burst))
+	}
+	if b.limit.TPM > 0 && tokens > 0 {
+		start = later(start, b.tokensAt.Add(-b.burst))
+	}
+	return start
+}
+
+// charge adds a request sent at start to the budgets; negative counts refund.
+func (b *pacingBucket) charge(start time.Time, requests, tokens int) {
+	if b.limit.RPM > 0 {
+		b.requestsAt = later(b.requestsAt, start).Add(time.Duration(requests) * time.Minute / time.Duration(b.limit.RPM))
+	}
+	if b.limit.TPM > 0 {
+		b.tokensAt = later(b.tokensAt, start).Add(tokenInterval(tokens, b.limit.TPM))
+	}
+}
+
+// bucketsFor returns the budgets a request from key to the upstream configured
+// under name is charged to, creating them as needed: the shared budget and
+// the key's entry in Keys, or with PerKey the key's own. The caller must hold
+// p.mu.
+func (p *Pacer) bucketsFor(name string, rule *PacingRule, key string) []*pacingBucket {
+	bucket := func(key string, limit PacingLimit) *pacingBucket {
+		b, found := p.buckets[pacingKey{name, key}]
+		if !found {
+			b = &pacingBucket{limit: limit, burst: time.Duration(rule.Burst * float64(time.Second))}
+			p.buckets[pacingKey{name, key}] = b
+		}
+		return b
+	}
+	keyLimit, found := rule.Keys[key]
+	if rule.PerKey {
+		if !found {
+			keyLimit = rule.PacingLimit
+		}
+		return []*pacingBucket{bucket(key, keyLimit)}
+	}
+	buckets := []*pacingBucket{bucket("", rule.PacingLimit)}
+	if found {
+		buckets = append(buckets, bucket(key, keyLimit))
+	}
+	return buckets
+}
+
+// Wait holds e's request until all of target's budgets allow tokens more,
+// charges them, and returns how long it waited. If the wait would exceed the rule's
+// max_wait it returns at once with ok false and the time the request could
+// go, without charging anything.
+func (p *Pacer) Wait(ctx context.Context, target *url.URL, e *Exchange, tokens int) (waited time.Duration, until time.Time, ok bool, err error) {
+	rule, name := p.rule(target)
+	if rule == nil {
+		return 0, time.Time{}, true, nil
+	}
+	maxWait := defaultPacingMaxWait
+	if rule.MaxWait > 0 {
+		maxWait = time.Duration(rule.MaxWait * float64(time.Second))
+	}
+
+	p.mu.Lock()
+	buckets := p.bucketsFor(name, rule, e.Key)
+	now := time.Now()
+	until = now
+	for _, b := range buckets {
+		until = later(until, b.next(now, tokens))
+	}
+	delay := until.Sub(now)
+	if delay > maxWait {
+		p.mu.Unlock()
+		return 0, until, false, nil
+	}
+	for _, b := range buckets {
+		b.charge(until, 1, tokens)
+	}
+	p.reservations[e] = pacingReservation{buckets: buckets, tokens: tokens}
+	if delay <= 0 {
+		p.mu.Unlock()
+		return 0, until, true, nil
+	}
+	for _, b := range buckets {
+		b.waiting++
+		b.delayed++
+	}
+	p.mu.Unlock()
+	pacingQueueDepth.Add(1)
+	pacingDelayed.Add(1)
+
+	timer := time.NewTimer(delay)
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timer.C:
+	}
+	timer.Stop()
+	pacingQueueDepth.Add(-1)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, b := range buckets {
+		b.waiting--
+	}
+	if err != nil {
+		// The request was never sent, so give its budget back.
+		for _, b := range buckets {
+			b.charge(until, -1, -tokens)
+		}
+		delete(p.reservations, e)
+		return time.Since(now), until, false, err
+	}
+	return time.Since(now), until, true, nil
+}
+
+// Settle corrects the tokens charged for e by the usage the upstream reported,
+// once the exchange is complete. Without reported usage the estimate stands.
+func (p *Pacer) Settle(e *Exchange) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r, ok := p.reservations[e]
+	if !ok {
+		return
+	}
+	delete(p.reservations, e)
+	if e.TotalTokens <= 0 {
+		return
+	}
+	for _, b := range r.buckets {
+		if b.limit.TPM > 0 {
+			b.tokensAt = b.tokensAt.Add(tokenInterval(e.TotalTokens-r.tokens, b.limit.TPM))
+		}
+	}
+}
+
+// Status reports every budget in use, by upstream and key.
+func (p *Pacer) Status() []PacingStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	backlog := func(t time.Time) float64 {
+		return float64(max(t.Sub(now), 0).Microseconds()) / 1000
+	}
+	statuses := make([]PacingStatus, 0, len(p.buckets))
+	for k, b := range p.buckets {
+		statuses = append(statuses, PacingStatus{
+			Upstream:         k.upstream,
+			Key:              k.key,
+			TPM:              b.limit.TPM,
+			RPM:              b.limit.RPM,
+			TokenBacklogMs:   backlog(b.tokensAt),
+			RequestBacklogMs: backlog(b.requestsAt),
+			Waiting:          b.waiting,
+			Delayed:          b.delayed,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Upstream != statuses[j].Upstream {
+			return statuses[i].Upstream < statuses[j].Upstream
+		}
+		return statuses[i].Key < statuses[j].Key
+	})
+	return statuses
+}
+
+// requestTokens estimates the tokens a request will use: its prompt plus the
+// completion limit it sets. Spilled bodies are counted at four bytes a token.
+func (s *Server) requestTokens(body *logging.BodySpool) int {
+	if body.Spilled() {
+		return int(body.Len() / 4)
+	}
+	est, err := s.Estimate(body.Bytes())
+	if err != nil {
+		return 0
+	}
+	if est.MaxCompletionTokens != nil {
+		return est.PromptTokens + *est.MaxCompletionTokens
+	}
+	return est.PromptTokens
+}
+
+func (s *Server) handlePacing(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Pacer.Status())
+}
@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"sync"
+
+	"t-oai-api/config"
+)
+
+// BufferPool hands out fixed-size byte slices for relaying bodies, so
+// concurrent streams reuse chunks instead of allocating one per request.
+type BufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+func NewBufferPool(size int) *BufferPool {
+	if size <= 0 {
+		size = config.DefaultChunkSize
+	}
+	p := &BufferPool{size: size}
+	p.pool.New = func() any {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return p
+}
+
+func (p *BufferPool) Get() *[]byte {
+	return p.pool.Get().(*[]byte)
+}
+
+func (p *BufferPool) Put(buf *[]byte) {
+	if buf == nil || cap(*buf) != p.size {
+		return
+	}
+	*buf = (*buf)[:p.size]
+	p.pool.Put(buf)
+}
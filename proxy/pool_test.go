@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"t-oai-api/config"
+)
+
+func ssePayload(events int) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < events; i++ {
+		fmt.Fprintf(&buf, "data: {\"choices\":[{\"delta\":{\"content\":\"token %d\"}}]}\n\n", i)
+	}
+	buf.WriteString("data: [DONE]\n\n")
+	return buf.Bytes()
+}
+
+func relayChunks(dst io.Writer, src io.Reader, buf []byte) {
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			dst.Write(buf[:n])
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func BenchmarkStreamRelayAlloc(b *testing.B) {
+	payload := ssePayload(200)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(payload)))
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			buf := make([]byte, config.DefaultChunkSize)
+			relayChunks(io.Discard, bytes.NewReader(payload), buf)
+		}
+	})
+}
+
+func BenchmarkStreamRelayPooled(b *testing.B) {
+	payload := ssePayload(200)
+	pool := NewBufferPool(config.DefaultChunkSize)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(payload)))
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			buf := pool.Get()
+			relayChunks(io.Discard, bytes.NewReader(payload), *buf)
+			pool.Put(buf)
+		}
+	})
+}
+
+func BenchmarkProxyStreaming(b *testing.B) {
+	payload := ssePayload(200)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write(payload)
+	}))
+	defer upstream.Close()
+
+	server, err := NewServer(config.Config{
+		OpenAIBaseURL:  upstream.URL,
+		SpillThreshold: 1 << 20,
+		SpillDir:       b.TempDir(),
+		ChunkSize:      config.DefaultChunkSize,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer server.Close()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(payload)))
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			req := httptest.NewRequest(http.MethodPost, "/chat/completions", strings.NewReader(`{"stream":true}`))
+			server.ServeHTTP(httptest.NewRecorder(), req)
+		}
+	})
+}
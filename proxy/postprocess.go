@@ -0,0 +1,315 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// PostProcessRule rewrites the completions of the responses to matching
+// requests, for clients that expect a different shape than the API returns.
+type PostProcessRule struct {
+	// Path is a path.Match pattern for the request path, e.g.
+	// "/v1/chat/completions"; empty matches every path.
+	Path string `json:"path"`
+	// Model is a path.Match pattern for the requested model, e.g. "gpt-4o*".
+	Model string `json:"model"`
+	// Header is "Name: value", a request header the client must send, or
+	// just "Name" to require it with any value.
+	Header string `json:"header"`
+	// Steps are applied in order to the content of every choice.
+	Steps []string `json:"steps"`
+	// Envelope is a text/template that replaces the whole response body.
+	Envelope string `json:"envelope"`
+	// ContentType is the Content-Type of an enveloped body (default
+	// application/json).
+	ContentType string `json:"content_type"`
+
+	index         int
+	envelope      *template.Template
+	streamWarning sync.Once
+}
+
+// PostProcessors rewrite non-streaming completions before they are returned
+// to the client: the first rule matching a request applies. Streamed
+// responses are never rewritten, and a rule that matches one logs a warning
+// the first time it does.
+type PostProcessors struct {
+	rules []*PostProcessRule
+}
+
+// postProcessSteps are the transformations a rule's steps can name.
+var postProcessSteps = map[string]func(string) string{
+	"trim":             strings.TrimSpace,
+	"strip_fences":     stripFences,
+	"first_code_block": firstCodeBlock,
+	"extract_json":     extractJSON,
+}
+
+// envelopeFuncs are available to envelope templates.
+var envelopeFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// LoadPostProcessors reads a JSON list of rules from path. It returns nil if
+// path is empty.
+func LoadPostProcessors(path string) (*PostProcessors, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read post-processing file: %w", err)
+	}
+	p := &PostProcessors{}
+	if err := json.Unmarshal(data, &p.rules); err != nil {
+		return nil, fmt.Errorf("invalid post-processing file: %w", err)
+	}
+	for i, rule := range p.rules {
+		if rule == nil {
+			return nil, fmt.Errorf("invalid post-processing file: rule %d is empty", i)
+		}
+		rule.index = i
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("invalid post-processing file: rule %d: %w", i, err)
+		}
+	}
+	return p, nil
+}
+
+func (rule *PostProcessRule) compile() error {
+	for _, pattern := range []string{rule.Path, rule.Model} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad pattern %q", pattern)
+		}
+	}
+	for _, step := range rule.Steps {
+		if postProcessSteps[step] == nil {
+			return fmt.Errorf("unknown step %q", step)
+		}
+	}
+	if len(rule.Steps) == 0 && rule.Envelope == "" {
+		return fmt.Errorf("needs steps or an envelope")
+	}
+	if rule.Envelope != "" {
+		tmpl, err := template.New("envelope").Funcs(envelopeFuncs).Option("missingkey=zero").Parse(rule.Envelope)
+		if err != nil {
+			return err
+		}
+		rule.envelope = tmpl
+	}
+	if rule.ContentType == "" {
+		rule.ContentType = "application/json"
+	}
+	return nil
+}
+
+// Match returns the first rule matching r for model, or nil.
+func (p *PostProcessors) Match(r *http.Request, model string) *PostProcessRule {
+	for _, rule := range p.rules {
+		if rule.Path != "" {
+			if ok, _ := path.Match(rule.Path, r.URL.Path); !ok {
+				continue
+			}
+		}
+		if rule.Model != "" {
+			if ok, _ := path.Match(rule.Model, model); !ok {
+				continue
+			}
+		}
+		if rule.Header != "" {
+			name, value, hasValue := strings.Cut(rule.Header, ":")
+			got := r.Header.Get(strings.TrimSpace(name))
+			if got == "" || (hasValue && got != strings.TrimSpace(value)) {
+				continue
+			}
+		}
+		return rule
+	}
+	return nil
+}
+
+// envelopeData is what an envelope template is executed against.
+type envelopeData struct {
+	// Content is the first choice's content after the rule's steps, and
+	// Contents that of every choice.
+	Content      string
+	Contents     []string
+	ID           string
+	Model        string
+	FinishReason string
+	Usage        map[string]any
+	// Response is the whole upstream response.
+	Response map[string]any
+}
+
+// Apply rewrites a chat or text completion response body. It returns false
+// if the body is not a completion, in which case it should be left alone.
+func (rule *PostProcessRule) Apply(body []byte) ([]byte, bool, error) {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) != nil {
+		return nil, false, nil
+	}
+	var choices []map[string]json.RawMessage
+	if json.Unmarshal(fields["choices"], &choices) != nil || len(choices) == 0 {
+		return nil, false, nil
+	}
+
+	data := envelopeData{}
+	for i, choice := range choices {
+		// Chat completions carry message.content, text completions text.
+		var message map[string]json.RawMessage
+		var content string
+		var err error
+		if json.Unmarshal(choice["message"], &message) == nil && message != nil {
+			err = json.Unmarshal(message["content"], &content)
+		} else {
+			err = json.Unmarshal(choice["text"], &content)
+		}
+		if err != nil {
+			// Leave tool calls and other non-text content alone.
+			data.Contents = append(data.Contents, "")
+			continue
+		}
+		for _, step := range rule.Steps {
+			content = postProcessSteps[step](content)
+		}
+		encoded, _ := json.Marshal(content)
+		if message != nil {
+			message["content"] = encoded
+			choice["message"], _ = json.Marshal(message)
+		} else {
+			choice["text"] = encoded
+		}
+		if i == 0 {
+			data.Content = content
+			json.Unmarshal(choice["finish_reason"], &data.FinishReason)
+		}
+		data.Contents = append(data.Contents, content)
+	}
+
+	if rule.envelope == nil {
+		fields["choices"], _ = json.Marshal(choices)
+		out, err := json.Marshal(fields)
+		return out, err == nil, err
+	}
+
+	json.Unmarshal(fields["id"], &data.ID)
+	json.Unmarshal(fields["model"], &data.Model)
+	json.Unmarshal(fields["usage"], &data.Usage)
+	json.Unmarshal(body, &data.Response)
+	var buf bytes.Buffer
+	if err := rule.envelope.Execute(&buf, data); err != nil {
+		return nil, false, fmt.Errorf("post-processing envelope: %w", err)
+	}
+	return buf.Bytes(), true, nil
+}
+
+// postProcessResponse applies rule to a successful non-streaming JSON
+// response, replacing its body, and returns the usage the upstream reported
+// so it is still recorded when the envelope drops it. Other responses are
+// left untouched.
+func postProcessResponse(resp *http.Response, rule *PostProcessRule) (*tokenUsage, error) {
+	if strings.Contains(resp.Header.Get("Content-Type"), "text/event-stream") {
+		rule.streamWarning.Do(func() {
+			log.Printf("Warning: post-processing rule %d matched a streamed response, which is passed through unchanged", rule.index)
+		})
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Header.Get("Content-Type"), "application/json") || resp.Header.Get("Content-Encoding") != "" {
+		return nil, nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	usage := parseUsage(body, false)
+
+	processed, ok, err := rule.Apply(body)
+	if ok {
+		body = processed
+		if rule.envelope != nil {
+			resp.Header.Set("Content-Type", rule.ContentType)
+		}
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Del("Content-Length")
+	return &usage, err
+}
+
+// stripFences removes Markdown code fence lines, keeping what they enclose.
+func stripFences(s string) string {
+	lines := strings.Split(s, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if !strings.HasPrefix(strings.TrimSpace(line), "```") {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "\n")
+}
+
+// firstCodeBlock returns the contents of the first fenced code block, or s if
+// there is none. An unclosed block runs to the end.
+func firstCodeBlock(s string) string {
+	var block []string
+	inside := false
+	for _, line := range strings.Split(s, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			if inside {
+				return strings.Join(block, "\n")
+			}
+			inside = true
+			continue
+		}
+		if inside {
+			block = append(block, line)
+		}
+	}
+	if !inside {
+		return s
+	}
+	return strings.Join(block, "\n")
+}
+
+// extractJSON returns the first JSON object or array in s, or s if there is
+// none. After a failed attempt the search resumes at the character the
+// decoder rejected rather than at the next bracket, so s is read once: a
+// value nested inside malformed JSON is not found.
+func extractJSON(s string) string {
+	for i := strings.IndexAny(s, "{["); i >= 0; {
+		var raw json.RawMessage
+		err := json.NewDecoder(strings.NewReader(s[i:])).Decode(&raw)
+		if err == nil {
+			return string(raw)
+		}
+		var syntaxErr *json.SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			// Unexpected EOF: the rest of s is an unfinished value.
+			return s
+		}
+		i += int(syntaxErr.Offset) - 1
+		next := strings.IndexAny(s[i:], "{[")
+		if next < 0 {
+			return s
+		}
+		i += next
+	}
+	return s
+}
@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExtractJSON(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{`Here you go: {"ok": true} Anything else?`, `{"ok": true}`},
+		{`The list is [1, 2] as asked.`, `[1, 2]`},
+		{`[see below]: {"ok": true}`, `{"ok": true}`},
+		{`{a {"ok": 1}}`, `{"ok": 1}`},
+		{`{{"ok": 1}}`, `{"ok": 1}`},
+		{`no JSON here`, `no JSON here`},
+		{`unfinished: {"ok": tr`, `unfinished: {"ok": tr`},
+	}
+	for _, tt := range tests {
+		if got := extractJSON(tt.in); got != tt.want {
+			t.Errorf("extractJSON(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	// Unclosed brackets are read once, not once per bracket.
+	long := strings.Repeat("[", 1<<20)
+	if got := extractJSON(long); got != long {
+		t.Errorf("extractJSON of unclosed brackets returned %d bytes", len(got))
+	}
+}
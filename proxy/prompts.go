@@ -0,0 +1,448 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PromptVersion is one distinct system prompt seen within a prompt family,
+// along with the traffic metrics observed while it was in use.
+type PromptVersion struct {
+	ID          string    `json:"id"`
+	Fingerprint string    `json:"fingerprint"`
+	Prompt      string    `json:"prompt"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+	Requests    int       `json:"requests"`
+	Errors      int       `json:"errors"`
+	TotalMs     float64   `json:"total_ms"`
+	TotalTokens int       `json:"total_tokens"`
+}
+
+// PromptFamily groups the versions of one logical prompt. Families are named
+// by the X-Prompt-Name request header, falling back to the model.
+type PromptFamily struct {
+	Name     string           `json:"name"`
+	Versions []*PromptVersion `json:"versions"`
+	// Assigned counts the versions ever assigned, so IDs are not reused
+	// after old versions are dropped.
+	Assigned int `json:"assigned,omitempty"`
+
+	lastSeen      time.Time
+	byFingerprint map[string]*PromptVersion
+}
+
+const (
+	// defaultPromptFamilies is the family cap when only a versions file is
+	// configured.
+	defaultPromptFamilies = 100
+	// maxPromptVersions is how many versions each family keeps.
+	maxPromptVersions = 50
+)
+
+// PromptTracker fingerprints system prompts and assigns sequential version IDs
+// per family. State is optionally persisted so IDs are stable across restarts.
+// It keeps at most maxFamilies families of maxPromptVersions versions each,
+// dropping the least recently seen.
+type PromptTracker struct {
+	path        string
+	maxFamilies int
+
+	mu       sync.Mutex
+	families map[string]*PromptFamily
+	dirty    bool
+}
+
+// NewPromptTracker returns a tracker of up to maxFamilies families, persisted
+// to path if it is set, or nil if neither is set.
+func NewPromptTracker(path string, maxFamilies int) (*PromptTracker, error) {
+	if path == "" && maxFamilies <= 0 {
+		return nil, nil
+	}
+	if maxFamilies <= 0 {
+		maxFamilies = defaultPromptFamilies
+	}
+	t := &PromptTracker{
+		path:        path,
+		maxFamilies: maxFamilies,
+		families:    make(map[string]*PromptFamily),
+	}
+	if path == "" {
+		return t, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read prompt versions: %w", err)
+	}
+	var families []*PromptFamily
+	if err := json.Unmarshal(data, &families); err != nil {
+		return nil, fmt.Errorf("invalid prompt versions file: %w", err)
+	}
+	for _, f := range families {
+		f.Assigned = max(f.Assigned, len(f.Versions))
+		f.byFingerprint = make(map[string]*PromptVersion, len(f.Versions))
+		for _, v := range f.Versions {
+			f.byFingerprint[v.Fingerprint] = v
+			if v.LastSeen.After(f.lastSeen) {
+				f.lastSeen = v.LastSeen
+			}
+		}
+		t.families[f.Name] = f
+	}
+	for len(t.families) > t.maxFamilies {
+		t.dropLeastRecentFamily()
+	}
+	return t, nil
+}
+
+// extractSystemPrompt returns the system/developer instructions of a chat,
+// Anthropic-style, or Responses API request body.
+func extractSystemPrompt(body []byte) string {
+	var req struct {
+		Messages []struct {
+			Role    string          `json:"role"`
+			Content json.RawMessage `json:"content"`
+		} `json:"messages"`
+		System       json.RawMessage `json:"system"`
+		Instructions string          `json:"instructions"`
+	}
+	if json.Unmarshal(body, &req) != nil {
+		return ""
+	}
+
+	var parts []string
+	if req.Instructions != "" {
+		parts = append(parts, req.Instructions)
+	}
+	if len(req.System) > 0 {
+		parts = append(parts, contentText(req.System))
+	}
+	for _, m := range req.Messages {
+		if m.Role == "system" || m.Role == "developer" {
+			parts = append(parts, contentText(m.Content))
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// contentText flattens a message content value, which may be a string or an
+// array of typed parts.
+func contentText(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if json.Unmarshal(raw, &parts) != nil {
+		return ""
+	}
+	texts := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p.Text != "" {
+			texts = append(texts, p.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+func fingerprint(prompt string) string {
+	sum := sha256.Sum256([]byte(prompt))
+	return hex.EncodeToString(sum[:6])
+}
+
+// Resolve returns the version reference ("family@vN") for prompt, assigning a
+// new version if this fingerprint has not been seen in the family before.
+func (t *PromptTracker) Resolve(family, prompt string) string {
+	fp := fingerprint(prompt)
+
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, ok := t.families[family]
+	if !ok {
+		if len(t.families) >= t.maxFamilies {
+			t.dropLeastRecentFamily()
+		}
+		f = &PromptFamily{Name: family, byFingerprint: make(map[string]*PromptVersion)}
+		t.families[family] = f
+	}
+	f.lastSeen = now
+	if v, ok := f.byFingerprint[fp]; ok {
+		return family + "@" + v.ID
+	}
+
+	if len(f.Versions) >= maxPromptVersions {
+		f.dropLeastRecentVersion()
+	}
+	f.Assigned++
+	v := &PromptVersion{
+		ID:          fmt.Sprintf("v%d", f.Assigned),
+		Fingerprint: fp,
+		Prompt:      prompt,
+		FirstSeen:   now,
+		LastSeen:    now,
+	}
+	f.Versions = append(f.Versions, v)
+	f.byFingerprint[fp] = v
+	t.dirty = true
+	return family + "@" + v.ID
+}
+
+// dropLeastRecentFamily forgets the family seen longest ago. The caller must
+// hold t.mu.
+func (t *PromptTracker) dropLeastRecentFamily() {
+	var oldest *PromptFamily
+	for _, f := range t.families {
+		if oldest == nil || f.lastSeen.Before(oldest.lastSeen) {
+			oldest = f
+		}
+	}
+	delete(t.families, oldest.Name)
+	t.dirty = true
+}
+
+// dropLeastRecentVersion forgets the version seen longest ago, keeping the
+// rest in the order they appeared.
+func (f *PromptFamily) dropLeastRecentVersion() {
+	oldest := 0
+	for i, v := range f.Versions {
+		if v.LastSeen.Before(f.Versions[oldest].LastSeen) {
+			oldest = i
+		}
+	}
+	delete(f.byFingerprint, f.Versions[oldest].Fingerprint)
+	f.Versions = append(f.Versions[:oldest], f.Versions[oldest+1:]...)
+}
+
+// Observe records the outcome of an exchange against its prompt version.
+func (t *PromptTracker) Observe(ref string, e *Exchange) {
+	family, id, ok := strings.Cut(ref, "@")
+	if !ok {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, ok := t.families[family]
+	if !ok {
+		return
+	}
+	for _, v := range f.Versions {
+		if v.ID != id {
+			continue
+		}
+		v.LastSeen = time.Now()
+		v.Requests++
+		v.TotalMs += e.DurationMs
+		v.TotalTokens += e.TotalTokens
+		if e.Status >= 400 || e.Error != "" {
+			v.Errors++
+		}
+		t.dirty = true
+		return
+	}
+}
+
+// Save writes the tracker state to disk if it changed since the last save.
+func (t *PromptTracker) Save() error {
+	if t.path == "" {
+		return nil
+	}
+
+	t.mu.Lock()
+	if !t.dirty {
+		t.mu.Unlock()
+		return nil
+	}
+	data, err := json.MarshalIndent(t.sortedFamilies(), "", "  ")
+	t.dirty = false
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := t.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write prompt versions: %w", err)
+	}
+	return os.Rename(tmp, t.path)
+}
+
+// sortedFamilies returns families by name. The caller must hold t.mu.
+func (t *PromptTracker) sortedFamilies() []*PromptFamily {
+	families := make([]*PromptFamily, 0, len(t.families))
+	for _, f := range t.families {
+		families = append(families, f)
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].Name < families[j].Name
+	})
+	return families
+}
+
+type PromptVersionReport struct {
+	ID           string    `json:"id"`
+	Fingerprint  string    `json:"fingerprint"`
+	FirstSeen    time.Time `json:"first_seen"`
+	LastSeen     time.Time `json:"last_seen"`
+	Requests     int       `json:"requests"`
+	ErrorRate    float64   `json:"error_rate"`
+	AvgLatencyMs float64   `json:"avg_latency_ms"`
+	AvgTokens    float64   `json:"avg_tokens"`
+
+	// Changes relative to the previous version, in percent (error rate in
+	// percentage points). Absent for the first version.
+	LatencyChangePct *float64 `json:"latency_change_pct,omitempty"`
+	TokensChangePct  *float64 `json:"tokens_change_pct,omitempty"`
+	ErrorRateChange  *float64 `json:"error_rate_change,omitempty"`
+}
+
+type PromptFamilyReport struct {
+	Name     string                `json:"name"`
+	Versions []PromptVersionReport `json:"versions"`
+}
+
+// Report summarises every family's versions in the order they appeared, with
+// metric shifts relative to the preceding version.
+func (t *PromptTracker) Report() []PromptFamilyReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var reports []PromptFamilyReport
+	for _, f := range t.sortedFamilies() {
+		report := PromptFamilyReport{Name: f.Name}
+		var prev *PromptVersionReport
+		for _, v := range f.Versions {
+			r := PromptVersionReport{
+				ID:          v.ID,
+				Fingerprint: v.Fingerprint,
+				FirstSeen:   v.FirstSeen,
+				LastSeen:    v.LastSeen,
+				Requests:    v.Requests,
+			}
+			if v.Requests > 0 {
+				r.ErrorRate = float64(v.Errors) / float64(v.Requests)
+				r.AvgLatencyMs = v.TotalMs / float64(v.Requests)
+				r.AvgTokens = float64(v.TotalTokens) / float64(v.Requests)
+			}
+			if prev != nil && prev.Requests > 0 && r.Requests > 0 {
+				r.LatencyChangePct = percentChange(prev.AvgLatencyMs, r.AvgLatencyMs)
+				r.TokensChangePct = percentChange(prev.AvgTokens, r.AvgTokens)
+				delta := (r.ErrorRate - prev.ErrorRate) * 100
+				r.ErrorRateChange = &delta
+			}
+			report.Versions = append(report.Versions, r)
+			prev = &report.Versions[len(report.Versions)-1]
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+func percentChange(before, after float64) *float64 {
+	if before == 0 {
+		return nil
+	}
+	pct := (after - before) / before * 100
+	return &pct
+}
+
+// Diff returns a line diff between two versions of a family's prompt.
+func (t *PromptTracker) Diff(family, from, to string) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, ok := t.families[family]
+	if !ok {
+		return "", fmt.Errorf("unknown prompt family %q", family)
+	}
+	var a, b *PromptVersion
+	for _, v := range f.Versions {
+		if v.ID == from {
+			a = v
+		}
+		if v.ID == to {
+			b = v
+		}
+	}
+	if a == nil || b == nil {
+		return "", fmt.Errorf("unknown version in %s..%s", from, to)
+	}
+	return lineDiff(a.Prompt, b.Prompt), nil
+}
+
+// lineDiff renders a minimal unified-style diff of two texts using the
+// longest common subsequence of their lines.
+func lineDiff(a, b string) string {
+	x := strings.Split(a, "\n")
+	y := strings.Split(b, "\n")
+
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var out strings.Builder
+	i, j := 0, 0
+	for i < len(x) && j < len(y) {
+		switch {
+		case x[i] == y[j]:
+			fmt.Fprintf(&out, "  %s\n", x[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			fmt.Fprintf(&out, "- %s\n", x[i])
+			i++
+		default:
+			fmt.Fprintf(&out, "+ %s\n", y[j])
+			j++
+		}
+	}
+	for ; i < len(x); i++ {
+		fmt.Fprintf(&out, "- %s\n", x[i])
+	}
+	for ; j < len(y); j++ {
+		fmt.Fprintf(&out, "+ %s\n", y[j])
+	}
+	return out.String()
+}
+
+func (s *Server) handlePromptReport(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Prompts.Report())
+}
+
+func (s *Server) handlePromptDiff(w http.ResponseWriter, r *http.Request) {
+	diff, err := s.Prompts.Diff(r.PathValue("family"), r.URL.Query().Get("from"), r.URL.Query().Get("to"))
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, diff)
+}
@@ -0,0 +1,280 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"t-oai-api/logging"
+)
+
+var (
+	rateLimitQueueDepth = counter("ratelimit_queue_depth")
+	rateLimitRequeued   = counter("ratelimit_requeued_total")
+	rateLimitTimeouts   = counter("ratelimit_queue_timeouts_total")
+)
+
+// RateLimitQueue holds requests for upstream hosts that answered 429 with a
+// Retry-After, releasing them together once the advised delay has passed.
+// Hosts are tracked per credential, since providers rate limit each account
+// separately and one key's 429 says nothing about another's.
+type RateLimitQueue struct {
+	maxWait time.Duration
+
+	mu    sync.Mutex
+	hosts map[rateLimitKey]*rateLimitedHost
+}
+
+// rateLimitKey names an upstream host as seen with one credential.
+type rateLimitKey struct {
+	host       string
+	credential string
+}
+
+type rateLimitedHost struct {
+	label       string
+	until       time.Time
+	waiting     int
+	rateLimited int64
+}
+
+// RateLimitStatus is the queue state for one upstream host and credential.
+type RateLimitStatus struct {
+	Host         string    `json:"host"`
+	Key          string    `json:"key,omitempty"`
+	BlockedUntil time.Time `json:"blocked_until"`
+	Blocked      bool      `json:"blocked"`
+	Waiting      int       `json:"waiting"`
+	RateLimited  int64     `json:"rate_limited_total"`
+}
+
+// NewRateLimitQueue returns a queue that holds each request for at most
+// maxWait in total, or nil if maxWait is not positive.
+func NewRateLimitQueue(maxWait time.Duration) *RateLimitQueue {
+	if maxWait <= 0 {
+		return nil
+	}
+	return &RateLimitQueue{
+		maxWait: maxWait,
+		hosts:   make(map[rateLimitKey]*rateLimitedHost),
+	}
+}
+
+// rateLimitKeyFor returns the host and credential req is sent with.
+func rateLimitKeyFor(req *http.Request) rateLimitKey {
+	return rateLimitKey{host: req.URL.Host, credential: credentialHash(req.Header)}
+}
+
+// prune forgets blocks that have ended and that nobody waits on, so the
+// queue only holds hosts and credentials that are currently limited. It must
+// be called with q.mu held.
+func (q *RateLimitQueue) prune(now time.Time) {
+	for key, h := range q.hosts {
+		if h.waiting == 0 && !h.until.After(now) {
+			delete(q.hosts, key)
+		}
+	}
+}
+
+// Block holds new requests for key until the given time. An earlier time
+// never shortens an existing block. label names the credential in Status.
+func (q *RateLimitQueue) Block(key rateLimitKey, label string, until time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.prune(time.Now())
+	h, ok := q.hosts[key]
+	if !ok {
+		h = &rateLimitedHost{}
+		q.hosts[key] = h
+	}
+	h.label = label
+	h.rateLimited++
+	if until.After(h.until) {
+		h.until = until
+	}
+}
+
+// Wait blocks while key is rate limited and returns how long it waited. If
+// the block outlasts deadline it returns immediately with ok false and the
+// time the block ends.
+func (q *RateLimitQueue) Wait(ctx context.Context, key rateLimitKey, deadline time.Time) (waited time.Duration, until time.Time, ok bool, err error) {
+	start := time.Now()
+	for {
+		q.mu.Lock()
+		h, blocked := q.hosts[key]
+		now := time.Now()
+		if !blocked || !h.until.After(now) {
+			q.mu.Unlock()
+			return now.Sub(start), until, true, nil
+		}
+		until = h.until
+		if until.After(deadline) {
+			q.mu.Unlock()
+			return now.Sub(start), until, false, nil
+		}
+		h.waiting++
+		q.mu.Unlock()
+		rateLimitQueueDepth.Add(1)
+
+		timer := time.NewTimer(until.Sub(now))
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-timer.C:
+		}
+		timer.Stop()
+
+		q.mu.Lock()
+		h.waiting--
+		q.mu.Unlock()
+		rateLimitQueueDepth.Add(-1)
+		if err != nil {
+			return time.Since(start), until, false, err
+		}
+	}
+}
+
+// Status reports every host and credential that is currently rate limited,
+// by host name.
+func (q *RateLimitQueue) Status() []RateLimitStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	q.prune(now)
+	statuses := make([]RateLimitStatus, 0, len(q.hosts))
+	for key, h := range q.hosts {
+		statuses = append(statuses, RateLimitStatus{
+			Host:         key.host,
+			Key:          h.label,
+			BlockedUntil: h.until,
+			Blocked:      h.until.After(now),
+			Waiting:      h.waiting,
+			RateLimited:  h.rateLimited,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Host != statuses[j].Host {
+			return statuses[i].Host < statuses[j].Host
+		}
+		return statuses[i].Key < statuses[j].Key
+	})
+	return statuses
+}
+
+// retryAfter returns when the upstream asked to be retried, from
+// retry-after-ms or Retry-After in seconds or as an HTTP date.
+func retryAfter(h http.Header, now time.Time) (time.Time, bool) {
+	if v := h.Get("Retry-After-Ms"); v != "" {
+		if ms, err := strconv.ParseFloat(v, 64); err == nil && ms >= 0 {
+			return now.Add(time.Duration(ms * float64(time.Millisecond))), true
+		}
+	}
+	v := h.Get("Retry-After")
+	if v == "" {
+		return time.Time{}, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return now.Add(time.Duration(secs) * time.Second), true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// roundTrip sends proxyReq upstream. With a Pacer, it is first held until its
+// upstream's budget allows it. With a RateLimitQueue, requests to a
+// rate-limited host and credential first wait out the advised delay, and a
+// 429 carrying Retry-After is re-dispatched once the delay passes, as long as
+// the total wait fits in the queue's maximum. Otherwise the 429 is relayed as
+// is.
+func (s *Server) roundTrip(r, proxyReq *http.Request, reqBody *logging.BodySpool, exchange *Exchange) (*http.Response, error) {
+	send := func(req *http.Request) (*http.Response, error) {
+		// Embedding bodies too large to read into memory are sent as they
+		// are, without caching or splitting.
+		if isEmbeddingsRequest(r) && reqBody.Len() <= maxInspectBytes {
+			body, err := reqBody.ReadAll()
+			if err != nil {
+				return nil, err
+			}
+			return s.embeddingsRoundTrip(req, body)
+		}
+		return s.client.Do(req)
+	}
+	if s.Pacer != nil {
+		waited, until, ok, err := s.Pacer.Wait(r.Context(), proxyReq.URL, exchange, s.requestTokens(reqBody))
+		exchange.PacedMs = float64(waited.Microseconds()) / 1000
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			pacingTimeouts.Add(1)
+			return rateLimitedResponse(proxyReq, until), nil
+		}
+	}
+	if s.RateLimits == nil {
+		return send(proxyReq)
+	}
+
+	key := rateLimitKeyFor(proxyReq)
+	deadline := time.Now().Add(s.RateLimits.maxWait)
+	for attempt := 0; ; attempt++ {
+		waited, until, ok, err := s.RateLimits.Wait(r.Context(), key, deadline)
+		exchange.QueuedMs += float64(waited.Microseconds()) / 1000
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			rateLimitTimeouts.Add(1)
+			return rateLimitedResponse(proxyReq, until), nil
+		}
+
+		// Each re-dispatch is a fresh request: the transport may still hold
+		// the previous one's body.
+		req := proxyReq
+		if attempt > 0 {
+			body, err := reqBody.Reader()
+			if err != nil {
+				return nil, err
+			}
+			req = proxyReq.Clone(proxyReq.Context())
+			req.Body = io.NopCloser(body)
+		}
+		resp, err := send(req)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+			return resp, err
+		}
+		until, ok = retryAfter(resp.Header, time.Now())
+		if !ok {
+			return resp, nil
+		}
+		s.RateLimits.Block(key, keyLabel(proxyReq), until)
+		if until.After(deadline) {
+			return resp, nil
+		}
+		resp.Body.Close()
+		rateLimitRequeued.Add(1)
+		exchange.Requeues++
+	}
+}
+
+// rateLimitedResponse answers for an upstream that is still rate limited past
+// the request's queue budget, without sending it.
+func rateLimitedResponse(req *http.Request, until time.Time) *http.Response {
+	secs := int(time.Until(until).Seconds() + 0.999)
+	header := http.Header{
+		"Content-Type": []string{"application/json"},
+		"Retry-After":  []string{strconv.Itoa(secs)},
+	}
+	body := fmt.Sprintf(`{"error":{"message":"upstream %s is rate limited; retry in %ds","type":"rate_limit_error"}}`, req.URL.Host, secs)
+	return syntheticResponse(req, http.StatusTooManyRequests, header, []byte(body))
+}
+
+func (s *Server) handleRateLimits(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.RateLimits.Status())
+}
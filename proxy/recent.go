@@ -0,0 +1,336 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultRecentRequests is the number of completed exchanges kept in
+	// memory for the admin API and the monitor.
+	defaultRecentRequests = 100
+	// previewLimit caps how much of each body is retained for drill-down
+	// when RECENT_BODIES is set.
+	previewLimit = 64 * 1024
+	// tailLimit is how much of the end of a body is kept for reading the
+	// final SSE usage event of long streams.
+	tailLimit = 8 * 1024
+)
+
+// Exchange summarises one proxied request/response pair.
+type Exchange struct {
+	ID               string    `json:"id"`
+	Method           string    `json:"method"`
+	Path             string    `json:"path"`
+	ClientIP         string    `json:"client_ip,omitempty"`
+	Key              string    `json:"key,omitempty"`
+	Model            string    `json:"model,omitempty"`
+	Status           int       `json:"status"`
+	Streaming        bool      `json:"streaming"`
+	Started          time.Time `json:"started"`
+	DurationMs       float64   `json:"duration_ms"`
+	RequestBytes     int64     `json:"request_bytes"`
+	ResponseBytes    int64     `json:"response_bytes"`
+	PromptTokens     int       `json:"prompt_tokens,omitempty"`
+	CompletionTokens int       `json:"completion_tokens,omitempty"`
+	TotalTokens      int       `json:"total_tokens,omitempty"`
+	Template         string    `json:"template,omitempty"`
+	PromptVersion    string    `json:"prompt_version,omitempty"`
+	Guardrails       []string  `json:"guardrails,omitempty"`
+	QueuedMs         float64   `json:"queued_ms,omitempty"`
+	PacedMs          float64   `json:"paced_ms,omitempty"`
+	FailoverFrom     string    `json:"failover_from,omitempty"`
+	Requeues         int       `json:"requeues,omitempty"`
+	Error            string    `json:"error,omitempty"`
+
+	RequestBody  string `json:"request_body,omitempty"`
+	ResponseBody string `json:"response_body,omitempty"`
+}
+
+// Summary returns a copy of the exchange without bodies.
+func (e Exchange) Summary() Exchange {
+	e.RequestBody = ""
+	e.ResponseBody = ""
+	return e
+}
+
+// ExchangeHistory is a fixed-size ring of recently completed exchanges.
+type ExchangeHistory struct {
+	mu      sync.Mutex
+	entries []Exchange
+	next    int
+	full    bool
+}
+
+func NewExchangeHistory(size int) *ExchangeHistory {
+	return &ExchangeHistory{
+		entries: make([]Exchange, size),
+	}
+}
+
+func (h *ExchangeHistory) Add(e Exchange) {
+	h.mu.Lock()
+	h.entries[h.next] = e
+	h.next = (h.next + 1) % len(h.entries)
+	if h.next == 0 {
+		h.full = true
+	}
+	h.mu.Unlock()
+}
+
+// List returns the retained exchanges, newest first.
+func (h *ExchangeHistory) List() []Exchange {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	n := h.next
+	if h.full {
+		n = len(h.entries)
+	}
+	list := make([]Exchange, 0, n)
+	for i := 1; i <= n; i++ {
+		idx := (h.next - i + len(h.entries)) % len(h.entries)
+		if h.entries[idx].ID == "" {
+			// Removed by Remove.
+			continue
+		}
+		list = append(list, h.entries[idx])
+	}
+	return list
+}
+
+// Remove drops the retained exchanges whose IDs are in ids and returns how
+// many were removed.
+func (h *ExchangeHistory) Remove(ids map[string]bool) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	removed := 0
+	for i := range h.entries {
+		if h.entries[i].ID != "" && ids[h.entries[i].ID] {
+			h.entries[i] = Exchange{}
+			removed++
+		}
+	}
+	return removed
+}
+
+func (h *ExchangeHistory) Get(id string) (Exchange, bool) {
+	for _, e := range h.List() {
+		if e.ID == id {
+			return e, true
+		}
+	}
+	return Exchange{}, false
+}
+
+// previewBuffer retains the first previewLimit and last tailLimit bytes
+// written to it while counting the full length. It also picks the top-level
+// usage object out of a JSON body of any length.
+type previewBuffer struct {
+	buf   bytes.Buffer
+	tail  []byte
+	n     int64
+	usage usageScanner
+}
+
+func (p *previewBuffer) Write(b []byte) (int, error) {
+	p.n += int64(len(b))
+	p.usage.Write(b)
+	if room := previewLimit - p.buf.Len(); room > 0 {
+		if len(b) > room {
+			p.buf.Write(b[:room])
+		} else {
+			p.buf.Write(b)
+		}
+	}
+
+	p.tail = append(p.tail, b...)
+	if len(p.tail) > tailLimit {
+		p.tail = append(p.tail[:0], p.tail[len(p.tail)-tailLimit:]...)
+	}
+	return len(b), nil
+}
+
+// Tail returns the last bytes written.
+func (p *previewBuffer) Tail() []byte {
+	return p.tail
+}
+
+func (p *previewBuffer) Bytes() []byte {
+	return p.buf.Bytes()
+}
+
+func (p *previewBuffer) Len() int64 {
+	return p.n
+}
+
+// Usage returns the token usage reported in the body written so far: the
+// top-level usage object of a JSON body, or the last usage event of a stream,
+// which comes just before [DONE] and so is within the tail.
+func (p *previewBuffer) Usage(streaming bool) tokenUsage {
+	if streaming {
+		return parseUsage(p.tail, true)
+	}
+	return parseUsage(p.usage.usage, false)
+}
+
+// usageScanner is a writer that captures the value of the top-level "usage"
+// key of a JSON document as it streams past, without buffering the rest.
+type usageScanner struct {
+	depth     int
+	inString  bool
+	escape    bool
+	key       []byte
+	lastKey   string
+	pending   bool
+	capturing bool
+	capture   []byte
+	// usage is the captured object wrapped as {"usage":...}, once complete.
+	usage []byte
+}
+
+// maxUsageBytes bounds the captured usage object.
+const maxUsageBytes = 16 * 1024
+
+func (u *usageScanner) Write(b []byte) (int, error) {
+	for _, c := range b {
+		u.scan(c)
+	}
+	return len(b), nil
+}
+
+func (u *usageScanner) scan(c byte) {
+	if u.capturing {
+		u.capture = append(u.capture, c)
+		if len(u.capture) > maxUsageBytes {
+			u.capturing, u.capture = false, nil
+		}
+	}
+	if u.inString {
+		switch {
+		case u.escape:
+			u.escape = false
+		case c == '\\':
+			u.escape = true
+		case c == '"':
+			u.inString = false
+			if u.depth == 1 && !u.capturing {
+				u.lastKey = string(u.key)
+			}
+			return
+		}
+		if u.depth == 1 && len(u.key) < len("usage")+1 {
+			u.key = append(u.key, c)
+		}
+		return
+	}
+
+	if u.pending {
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			return
+		case '{':
+			u.capturing, u.capture = true, append(u.capture[:0], c)
+		}
+		u.pending = false
+	}
+	switch c {
+	case '"':
+		u.inString = true
+		u.key = u.key[:0]
+	case '{', '[':
+		u.depth++
+	case '}', ']':
+		u.depth--
+		if u.capturing && u.depth == 1 {
+			u.usage = append(append([]byte(`{"usage":`), u.capture...), '}')
+			u.capturing, u.capture = false, nil
+		}
+	case ':':
+		u.pending = u.depth == 1 && u.lastKey == "usage"
+		u.lastKey = ""
+	case ',':
+		u.lastKey = ""
+	}
+}
+
+// parseModel extracts the model name from an OpenAI-style JSON request body.
+func parseModel(body []byte) string {
+	var req struct {
+		Model string `json:"model"`
+	}
+	if json.Unmarshal(body, &req) != nil {
+		return ""
+	}
+	return req.Model
+}
+
+type usagePayload struct {
+	Usage *tokenUsage `json:"usage"`
+}
+
+// tokenUsage is the usage object of an OpenAI-style response. Embeddings
+// responses only report prompt and total tokens.
+type tokenUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// parseUsage extracts the usage object from a JSON response body, or from the
+// last SSE event carrying usage when the response was streamed.
+func parseUsage(body []byte, streaming bool) tokenUsage {
+	if !streaming {
+		var payload usagePayload
+		if json.Unmarshal(body, &payload) != nil || payload.Usage == nil {
+			return tokenUsage{}
+		}
+		return *payload.Usage
+	}
+
+	var usage tokenUsage
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 0, 64*1024), previewLimit)
+	for scanner.Scan() {
+		data, ok := bytes.CutPrefix(scanner.Bytes(), []byte("data: "))
+		if !ok || !bytes.Contains(data, []byte(`"usage"`)) {
+			continue
+		}
+		var payload usagePayload
+		if json.Unmarshal(data, &payload) == nil && payload.Usage != nil {
+			usage = *payload.Usage
+		}
+	}
+	return usage
+}
+
+// RequestList is the response of GET /admin/requests.
+type RequestList struct {
+	InFlight []InFlightRequest `json:"in_flight"`
+	Requests []Exchange        `json:"requests"`
+}
+
+func (s *Server) handleListRequests(w http.ResponseWriter, r *http.Request) {
+	list := s.Recent.List()
+	for i := range list {
+		list[i] = list[i].Summary()
+	}
+	writeJSON(w, http.StatusOK, RequestList{
+		InFlight: s.InFlight.Snapshot(),
+		Requests: list,
+	})
+}
+
+func (s *Server) handleGetRequest(w http.ResponseWriter, r *http.Request) {
+	e, ok := s.Recent.Get(r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "request not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, e)
+}
@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RecordedChunk is one piece of a response body as relayed to the client.
+type RecordedChunk struct {
+	// OffsetMs is the time since the request started.
+	OffsetMs float64 `json:"offset_ms"`
+	Data     []byte  `json:"data"`
+}
+
+// RecordedExchange is a complete exchange with the timing needed to replay it:
+// when the request started, and when every response chunk was relayed.
+type RecordedExchange struct {
+	ID             string          `json:"id"`
+	Started        time.Time       `json:"started"`
+	Method         string          `json:"method"`
+	Path           string          `json:"path"`
+	Header         http.Header     `json:"header"`
+	Body           []byte          `json:"body"`
+	Status         int             `json:"status"`
+	ResponseHeader http.Header     `json:"response_header"`
+	Chunks         []RecordedChunk `json:"chunks"`
+	Error          string          `json:"error,omitempty"`
+}
+
+// ResponseBody concatenates the recorded chunks.
+func (e *RecordedExchange) ResponseBody() []byte {
+	var body []byte
+	for _, c := range e.Chunks {
+		body = append(body, c.Data...)
+	}
+	return body
+}
+
+// Recorder appends complete exchanges to a session file, one JSON object per
+// line, for later replay.
+type Recorder struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// NewRecorder opens path for appending, creating it if needed.
+func NewRecorder(path string) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open record file: %w", err)
+	}
+	return &Recorder{path: path, file: f}, nil
+}
+
+// Record appends one exchange to the session file.
+func (r *Recorder) Record(e *RecordedExchange) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err = r.file.Write(append(data, '\n'))
+	return err
+}
+
+// Erase removes the exchanges whose IDs are in ids from the session file and
+// returns how many were removed. Recording waits while the file is rewritten.
+func (r *Recorder) Erase(ids map[string]bool) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	in, err := os.Open(r.path)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(r.path), filepath.Base(r.path)+".erase-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	removed := 0
+	out := bufio.NewWriter(tmp)
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 0, 64*1024), 256<<20)
+	for scanner.Scan() {
+		var e struct {
+			ID string `json:"id"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &e) == nil && ids[e.ID] {
+			removed++
+			continue
+		}
+		out.Write(scanner.Bytes())
+		out.WriteByte('\n')
+	}
+	err = scanner.Err()
+	if err == nil {
+		err = out.Flush()
+	}
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || removed == 0 {
+		return 0, err
+	}
+
+	if err := os.Rename(tmp.Name(), r.path); err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return removed, fmt.Errorf("failed to reopen record file: %w", err)
+	}
+	r.file.Close()
+	r.file = f
+	return removed, nil
+}
+
+// exchanges reads back the session file without racing a write.
+func (r *Recorder) exchanges() ([]*RecordedExchange, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return LoadRecording(r.path)
+}
+
+// Close closes the session file.
+func (r *Recorder) Close() error {
+	return r.file.Close()
+}
+
+// LoadRecording reads a session file written by a Recorder, in the order the
+// exchanges started.
+func LoadRecording(path string) ([]*RecordedExchange, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var exchanges []*RecordedExchange
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 256<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e RecordedExchange
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		exchanges = append(exchanges, &e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(exchanges, func(i, j int) bool {
+		return exchanges[i].Started.Before(exchanges[j].Started)
+	})
+	return exchanges, nil
+}
+
+// chunkRecorder captures response chunks with their offset from the start of
+// the exchange as they are written to the client.
+type chunkRecorder struct {
+	exchange *RecordedExchange
+	now      func() time.Time
+}
+
+func (c *chunkRecorder) Write(p []byte) (int, error) {
+	c.exchange.Chunks = append(c.exchange.Chunks, RecordedChunk{
+		OffsetMs: float64(c.now().Sub(c.exchange.Started).Microseconds()) / 1000,
+		Data:     append([]byte(nil), p...),
+	})
+	return len(p), nil
+}
+
+// newRecordedExchange captures the request side of an exchange. Credentials
+// are redacted just as in the request log.
+func newRecordedExchange(r *http.Request, started time.Time, body []byte) *RecordedExchange {
+	header := r.Header.Clone()
+	for name := range header {
+		if strings.EqualFold(name, "Authorization") {
+			header[name] = []string{"Bearer [REDACTED]"}
+		}
+	}
+	return &RecordedExchange{
+		ID:      r.Header.Get("X-Request-ID"),
+		Started: started,
+		Method:  r.Method,
+		Path:    r.URL.RequestURI(),
+		Header:  header,
+		Body:    body,
+	}
+}
@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+)
+
+// defaultRoutingHintHosts are the upstreams that understand routing hints
+// when ROUTING_HINT_HOSTS is not set.
+const defaultRoutingHintHosts = "openrouter.ai"
+
+// routingHintFields are the top-level request fields that steer an
+// aggregator's choice of provider rather than the model's output.
+var routingHintFields = []string{"provider", "route", "models", "transforms"}
+
+// providerEnums lists the accepted values of enumerated provider preferences.
+var providerEnums = map[string][]string{
+	"data_collection": {"allow", "deny"},
+	"sort":            {"price", "throughput", "latency"},
+}
+
+// RoutingHints validates OpenRouter-style routing hints in request bodies,
+// fills in proxy-level defaults for upstreams that understand them, and
+// strips them from requests to upstreams that would reject them.
+type RoutingHints struct {
+	defaults map[string]json.RawMessage
+	hosts    []string
+}
+
+// LoadRoutingHints reads default hints from the JSON file at defaultsPath, if
+// set. hosts is a comma-separated list of upstream hosts that accept hints,
+// including their subdomains, or "*" for all.
+func LoadRoutingHints(defaultsPath, hosts string) (*RoutingHints, error) {
+	if hosts == "" {
+		hosts = defaultRoutingHintHosts
+	}
+	h := &RoutingHints{}
+	for _, host := range strings.Split(hosts, ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			h.hosts = append(h.hosts, host)
+		}
+	}
+	if defaultsPath == "" {
+		return h, nil
+	}
+
+	data, err := os.ReadFile(defaultsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read routing defaults: %w", err)
+	}
+	if err := json.Unmarshal(data, &h.defaults); err != nil {
+		return nil, fmt.Errorf("invalid routing defaults: %w", err)
+	}
+	for name := range h.defaults {
+		if !slices.Contains(routingHintFields, name) {
+			return nil, fmt.Errorf("invalid routing defaults: %q is not a routing hint (expected one of %s)", name, strings.Join(routingHintFields, ", "))
+		}
+	}
+	if err := validateRoutingHints(h.defaults); err != nil {
+		return nil, fmt.Errorf("invalid routing defaults: %w", err)
+	}
+	return h, nil
+}
+
+// accepts reports whether the upstream at target understands routing hints.
+func (h *RoutingHints) accepts(target *url.URL) bool {
+	host := strings.ToLower(target.Hostname())
+	for _, allowed := range h.hosts {
+		if allowed == "*" || host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply returns the body to send to target, or nil to send it unchanged. An
+// error means the request's hints are invalid.
+func (h *RoutingHints) Apply(body []byte, target *url.URL) ([]byte, error) {
+	accepts := h.accepts(target)
+	if !accepts || len(h.defaults) == 0 {
+		// Skip parsing bodies that cannot contain a hint.
+		found := false
+		for _, name := range routingHintFields {
+			if bytes.Contains(body, []byte(`"`+name+`"`)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, nil
+		}
+	}
+
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) != nil {
+		// Not a JSON object; leave it to the upstream to reject.
+		return nil, nil
+	}
+	hints := make(map[string]json.RawMessage)
+	for _, name := range routingHintFields {
+		if v, ok := fields[name]; ok {
+			hints[name] = v
+		}
+	}
+	if err := validateRoutingHints(hints); err != nil {
+		return nil, err
+	}
+
+	if !accepts {
+		if len(hints) == 0 {
+			return nil, nil
+		}
+		for name := range hints {
+			delete(fields, name)
+		}
+		return json.Marshal(fields)
+	}
+
+	changed := false
+	for name, def := range h.defaults {
+		current, ok := fields[name]
+		switch {
+		case !ok:
+			fields[name] = def
+			changed = true
+		case name == "provider":
+			// Merge provider preferences key by key; the request wins.
+			merged, err := mergeObjects(def, current)
+			if err != nil {
+				return nil, err
+			}
+			fields[name] = merged
+			changed = true
+		}
+	}
+	if !changed {
+		return nil, nil
+	}
+	return json.Marshal(fields)
+}
+
+func mergeObjects(base, override json.RawMessage) (json.RawMessage, error) {
+	var a, b map[string]json.RawMessage
+	if err := json.Unmarshal(base, &a); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(override, &b); err != nil {
+		return nil, err
+	}
+	maps.Copy(a, b)
+	return json.Marshal(a)
+}
+
+// validateRoutingHints checks the shape of known hint fields. Unknown
+// provider preferences are passed through for forward compatibility.
+func validateRoutingHints(hints map[string]json.RawMessage) error {
+	for name, raw := range hints {
+		switch name {
+		case "route":
+			var route string
+			if json.Unmarshal(raw, &route) != nil || route != "fallback" {
+				return fmt.Errorf(`route must be "fallback"`)
+			}
+		case "models", "transforms":
+			var list []string
+			if json.Unmarshal(raw, &list) != nil {
+				return fmt.Errorf("%s must be an array of strings", name)
+			}
+		case "provider":
+			var prefs map[string]json.RawMessage
+			if json.Unmarshal(raw, &prefs) != nil || prefs == nil {
+				return fmt.Errorf("provider must be an object")
+			}
+			if err := validateProviderPrefs(prefs); err != nil {
+				return fmt.Errorf("provider.%w", err)
+			}
+		}
+	}
+	return nil
+}
+
+func validateProviderPrefs(prefs map[string]json.RawMessage) error {
+	for key, raw := range prefs {
+		switch key {
+		case "order", "only", "ignore", "quantizations":
+			var list []string
+			if json.Unmarshal(raw, &list) != nil {
+				return fmt.Errorf("%s must be an array of strings", key)
+			}
+		case "allow_fallbacks", "require_parameters":
+			var b bool
+			if json.Unmarshal(raw, &b) != nil {
+				return fmt.Errorf("%s must be a boolean", key)
+			}
+		case "data_collection", "sort":
+			var s string
+			if json.Unmarshal(raw, &s) != nil || !slices.Contains(providerEnums[key], s) {
+				return fmt.Errorf("%s must be one of %s", key, strings.Join(providerEnums[key], ", "))
+			}
+		case "max_price":
+			var prices map[string]float64
+			if json.Unmarshal(raw, &prices) != nil {
+				return fmt.Errorf("max_price must be an object of numbers")
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,823 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"t-oai-api/config"
+	"t-oai-api/logging"
+)
+
+// maxInspectBytes caps the request bodies that templates, guardrails,
+// conversation memory, and routing hints read back from disk once spilled.
+const maxInspectBytes = 32 << 20
+
+// Server is the transparent proxy. It forwards every request to the configured
+// upstream, logging and recording the exchange on the way.
+type Server struct {
+	Config         config.Config
+	Logger         *logging.RequestLogger
+	Buffers        *BufferPool
+	InFlight       *InFlightTracker
+	Recent         *ExchangeHistory
+	Templates      *TemplateStore
+	Prompts        *PromptTracker
+	Guardrails     *Guardrails
+	EmbeddingCache *EmbeddingCache
+	Annotator      *Annotator
+	TrustedProxies TrustedProxies
+	Router         Router
+	RequestHooks   []RequestHook
+	ResponseHooks  []ResponseHook
+	Recorder       *Recorder
+	Transcripts    *TranscriptWriter
+	ExecHooks      *ExecHooks
+	HeaderPolicy   *HeaderPolicy
+	Attribution    *UpstreamHeaders
+	RoutingHints   *RoutingHints
+	Pacer          *Pacer
+	Memory         *ConversationMemory
+	PostProcessors *PostProcessors
+	StatusMonitor  *StatusMonitor
+	Resolver       *Resolver
+	RateLimits     *RateLimitQueue
+	Usage          *UsageStore
+	Pricing        Pricing
+	Forecaster     *SpendForecaster
+	Anomalies      *AnomalyDetector
+	Sessions       *SessionManager
+	WarmupTargets  []WarmupTarget
+	client         *http.Client
+	started        time.Time
+	now            func() time.Time
+	lastRequest    atomic.Int64
+	lastWarmup     atomic.Int64
+	done           chan struct{}
+}
+
+// NewServer builds a proxy from cfg, loading every optional component it
+// enables. Extensions registered with RegisterRouter, RegisterRequestHook, and
+// RegisterResponseHook are attached first, then opts are applied.
+func NewServer(cfg config.Config, opts ...Option) (*Server, error) {
+	cfg.ApplyDefaults()
+
+	logger, err := logging.NewRequestLogger(cfg.RequestLogFile, cfg.LogFormat, cfg.LogToStdout, cfg.CompressLogs)
+	if err != nil {
+		return nil, err
+	}
+	logger.StreamMode = cfg.StreamLogMode
+	logger.RequestLimit = cfg.LogRequestLimit
+	logger.ResponseLimit = cfg.LogResponseLimit
+	logger.OverflowDir = cfg.LogOverflowDir
+
+	var templates *TemplateStore
+	if cfg.TemplateDir != "" {
+		templates, err = NewTemplateStore(cfg.TemplateDir)
+		if err != nil {
+			logger.Close()
+			return nil, err
+		}
+	}
+
+	prompts, err := NewPromptTracker(cfg.PromptVersionsFile, cfg.PromptFamilies)
+	if err != nil {
+		logger.Close()
+		return nil, err
+	}
+
+	var embeddingCache *EmbeddingCache
+	if cfg.EmbeddingCacheDir != "" {
+		embeddingCache, err = NewEmbeddingCache(cfg.EmbeddingCacheDir)
+		if err != nil {
+			logger.Close()
+			return nil, err
+		}
+	}
+
+	var guardrails *Guardrails
+	if cfg.GuardrailsFile != "" {
+		guardrails, err = LoadGuardrails(cfg.GuardrailsFile)
+		if err != nil {
+			logger.Close()
+			return nil, err
+		}
+	}
+
+	trustedProxies, err := ParseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		logger.Close()
+		return nil, err
+	}
+
+	resolver, err := NewResolver(cfg)
+	if err != nil {
+		logger.Close()
+		return nil, err
+	}
+
+	usage, err := NewUsageStore(cfg.UsageFile)
+	if err != nil {
+		logger.Close()
+		return nil, err
+	}
+
+	var pricing Pricing
+	if cfg.PricingFile != "" {
+		pricing, err = LoadPricing(cfg.PricingFile)
+		if err != nil {
+			logger.Close()
+			return nil, err
+		}
+	}
+
+	spendAlerts, err := ParseSpendAlerts(cfg.SpendAlerts)
+	if err != nil {
+		logger.Close()
+		return nil, err
+	}
+
+	warmupTargets, err := ParseWarmupTargets(cfg.WarmupTargets, cfg.OpenAIBaseURL)
+	if err != nil {
+		logger.Close()
+		return nil, err
+	}
+
+	attribution, err := LoadUpstreamHeaders(cfg.UserAgent, cfg.UpstreamHeadersFile)
+	if err != nil {
+		logger.Close()
+		return nil, err
+	}
+
+	routingHints, err := LoadRoutingHints(cfg.RoutingDefaultsFile, cfg.RoutingHintHosts)
+	if err != nil {
+		logger.Close()
+		return nil, err
+	}
+
+	pacer, err := LoadPacer(cfg.PacingFile)
+	if err != nil {
+		logger.Close()
+		return nil, err
+	}
+
+	postProcessors, err := LoadPostProcessors(cfg.PostProcessFile)
+	if err != nil {
+		logger.Close()
+		return nil, err
+	}
+
+	statusMonitor, err := NewStatusMonitor(cfg)
+	if err != nil {
+		logger.Close()
+		return nil, err
+	}
+
+	execHooks, err := NewExecHooks(cfg)
+	if err != nil {
+		logger.Close()
+		return nil, err
+	}
+
+	var recorder *Recorder
+	if cfg.RecordFile != "" {
+		recorder, err = NewRecorder(cfg.RecordFile)
+		if err != nil {
+			logger.Close()
+			return nil, err
+		}
+	}
+
+	var transcripts *TranscriptWriter
+	if cfg.TranscriptDir != "" {
+		transcripts, err = NewTranscriptWriter(cfg.TranscriptDir)
+		if err != nil {
+			if recorder != nil {
+				recorder.Close()
+			}
+			logger.Close()
+			return nil, err
+		}
+	}
+
+	historySize := cfg.RecentRequests
+	if historySize <= 0 {
+		historySize = defaultRecentRequests
+	}
+
+	router, requestHooks, responseHooks := registeredExtensions()
+
+	s := &Server{
+		Config:         cfg,
+		Logger:         logger,
+		Buffers:        NewBufferPool(cfg.ChunkSize),
+		InFlight:       NewInFlightTracker(),
+		Recent:         NewExchangeHistory(historySize),
+		Templates:      templates,
+		Prompts:        prompts,
+		Guardrails:     guardrails,
+		EmbeddingCache: embeddingCache,
+		Annotator:      NewAnnotator(cfg.AnnotateKeys),
+		TrustedProxies: trustedProxies,
+		Router:         router,
+		RequestHooks:   requestHooks,
+		ResponseHooks:  responseHooks,
+		Recorder:       recorder,
+		Transcripts:    transcripts,
+		ExecHooks:      execHooks,
+		HeaderPolicy:   NewHeaderPolicy(cfg.StripResponseHeaders, cfg.AllowResponseHeaders),
+		Attribution:    attribution,
+		RoutingHints:   routingHints,
+		Pacer:          pacer,
+		Memory:         NewConversationMemory(cfg),
+		PostProcessors: postProcessors,
+		StatusMonitor:  statusMonitor,
+		Resolver:       resolver,
+		RateLimits:     NewRateLimitQueue(time.Duration(cfg.RateLimitMaxWait) * time.Second),
+		Usage:          usage,
+		Pricing:        pricing,
+		Forecaster:     NewSpendForecaster(usage, pricing, spendAlerts),
+		Anomalies:      NewAnomalyDetector(cfg.AnomalyFactor),
+		Sessions:       NewSessionManager(cfg.SessionSecret, cfg.SessionOrigins),
+		WarmupTargets:  warmupTargets,
+		client: &http.Client{
+			Timeout: 120 * time.Second,
+		},
+		started: time.Now(),
+		now:     time.Now,
+		done:    make(chan struct{}),
+	}
+	if resolver != nil {
+		s.client.Transport = resolver.Transport()
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	go s.persistLoop()
+	if len(s.WarmupTargets) > 0 {
+		go s.warmupLoop(time.Duration(cfg.WarmupIdle) * time.Second)
+	}
+	if s.StatusMonitor != nil {
+		go s.StatusMonitor.Run(s.client, s.done)
+	}
+
+	return s, nil
+}
+
+// persistLoop periodically flushes state that outlives the process.
+func (s *Server) persistLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if s.Prompts != nil {
+				if err := s.Prompts.Save(); err != nil {
+					log.Printf("Error saving prompt versions: %v", err)
+				}
+			}
+			if err := s.Usage.Save(); err != nil {
+				log.Printf("Error saving usage history: %v", err)
+			}
+			s.Forecaster.CheckAlerts(s.now())
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Server) Close() {
+	close(s.done)
+	if s.Prompts != nil {
+		if err := s.Prompts.Save(); err != nil {
+			log.Printf("Error saving prompt versions: %v", err)
+		}
+	}
+	if err := s.Usage.Save(); err != nil {
+		log.Printf("Error saving usage history: %v", err)
+	}
+	if s.Recorder != nil {
+		s.Recorder.Close()
+	}
+	if s.ExecHooks != nil {
+		s.ExecHooks.Wait()
+	}
+	if s.Logger != nil {
+		s.Logger.Close()
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.Sessions != nil && s.Sessions.handleCORS(w, r) {
+		return
+	}
+
+	reqID := r.Header.Get("X-Request-ID")
+	if reqID == "" {
+		reqID = fmt.Sprintf("req-%d", s.now().UnixNano())
+		r.Header.Set("X-Request-ID", reqID)
+	}
+
+	clientIP := s.TrustedProxies.ClientIP(r)
+	s.lastRequest.Store(time.Now().UnixNano())
+
+	s.InFlight.Start(reqID, r, clientIP)
+	defer s.InFlight.Done(reqID)
+	defer s.Logger.Done(reqID)
+
+	exchange := &Exchange{
+		ID:       reqID,
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		ClientIP: clientIP,
+		Key:      keyLabel(r),
+		Started:  s.now(),
+	}
+	respPreview := &previewBuffer{}
+	var recorded *RecordedExchange
+	var session *SessionClaims
+	var sessionReserved int64
+	// stripUsage is set when the client's stream only carries a usage event
+	// because the session asked the upstream for it.
+	var stripUsage bool
+	var transcript *transcriptCapture
+	var memory *memoryCapture
+	var upstreamUsage *tokenUsage
+	var recordWriter io.Writer = io.Discard
+	defer func() {
+		exchange.DurationMs = float64(s.now().Sub(exchange.Started).Microseconds()) / 1000
+		exchange.ResponseBytes = respPreview.Len()
+		if s.Config.RecentBodies {
+			exchange.ResponseBody = string(respPreview.Bytes())
+		}
+		usage := respPreview.Usage(exchange.Streaming)
+		if upstreamUsage != nil {
+			// Post-processing may have rewritten the body without its usage.
+			usage = *upstreamUsage
+		}
+		exchange.PromptTokens = usage.PromptTokens
+		exchange.CompletionTokens = usage.CompletionTokens
+		exchange.TotalTokens = usage.TotalTokens
+		if session != nil {
+			s.Sessions.Charge(session.ID, sessionReserved, exchange.TotalTokens)
+		}
+		if s.Pacer != nil {
+			s.Pacer.Settle(exchange)
+		}
+		if memory != nil && exchange.Status == http.StatusOK {
+			s.Memory.Remember(memory, exchange.Streaming)
+		}
+		if exchange.PromptVersion != "" {
+			s.Prompts.Observe(exchange.PromptVersion, exchange)
+		}
+		s.Recent.Add(*exchange)
+		s.Usage.Record(exchange)
+		if s.Anomalies != nil {
+			s.Anomalies.Observe(exchange)
+		}
+		if recorded != nil {
+			recorded.Status = exchange.Status
+			recorded.Error = exchange.Error
+			if err := s.Recorder.Record(recorded); err != nil {
+				log.Printf("Error recording exchange %s: %v", reqID, err)
+			}
+		}
+		if s.ExecHooks != nil {
+			s.ExecHooks.Fire(hookEvent(exchange), *exchange)
+		}
+		if transcript != nil && exchange.Status != 0 {
+			if _, err := s.Transcripts.Write(exchange, transcript); err != nil {
+				log.Printf("Error writing transcript for %s: %v", reqID, err)
+			}
+		}
+	}()
+
+	if token, ok := sessionToken(r); ok && s.Sessions != nil {
+		claims, err := s.Sessions.Verify(token, s.now())
+		if err != nil {
+			exchange.Status = http.StatusUnauthorized
+			exchange.Error = err.Error()
+			writeAPIError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		session = &claims
+		exchange.Key = "session:" + claims.ID
+		// The upstream request is sent with the proxy's own key.
+		r.Header.Del("Authorization")
+	} else if s.Sessions != nil && s.Sessions.allowOrigin(r.Header.Get("Origin")) {
+		// Browsers on allowed origins must not get the proxy's key by leaving
+		// out Authorization, or spend a real key outside any session.
+		exchange.Status = http.StatusUnauthorized
+		exchange.Error = errSessionRequired.Error()
+		writeAPIError(w, http.StatusUnauthorized, errSessionRequired.Error())
+		return
+	}
+
+	reqBody := logging.NewBodySpool(s.Config.SpillThreshold, s.Config.SpillDir, s.Config.CompressLogs)
+	defer reqBody.Close()
+
+	buffer := s.Buffers.Get()
+	defer s.Buffers.Put(buffer)
+
+	if r.Body != nil {
+		_, err := io.CopyBuffer(reqBody, r.Body, *buffer)
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, "Error reading request body", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if s.Recorder != nil {
+		body, ok := s.inspectBody(w, exchange, reqBody, "recording")
+		if !ok {
+			return
+		}
+		recorded = newRecordedExchange(r, exchange.Started, body)
+		recordWriter = &chunkRecorder{exchange: recorded, now: s.now}
+	}
+
+	if s.Templates != nil {
+		body, ok := s.inspectBody(w, exchange, reqBody, "prompt templates")
+		if !ok {
+			return
+		}
+		expanded, tmpl, err := s.Templates.Expand(body)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if expanded != nil {
+			reqBody.Reset()
+			reqBody.Write(expanded)
+			exchange.Template = tmpl.Ref()
+			w.Header().Set("X-Prompt-Template", tmpl.Ref())
+		}
+	}
+
+	for _, hook := range s.RequestHooks {
+		body, ok := s.inspectBody(w, exchange, reqBody, "request hooks")
+		if !ok {
+			return
+		}
+		body, err := hook.HandleRequest(r, body)
+		if err != nil {
+			exchange.Status = http.StatusBadRequest
+			exchange.Error = err.Error()
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if body != nil {
+			reqBody.Reset()
+			reqBody.Write(body)
+		}
+	}
+
+	if s.Guardrails != nil {
+		body, ok := s.inspectBody(w, exchange, reqBody, "guardrails")
+		if !ok || s.applyGuardrails(w, r, exchange, body) {
+			return
+		}
+	}
+
+	if s.Memory != nil && r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/chat/completions") && r.Header.Get(s.Memory.Header) != "" {
+		body, ok := s.inspectBody(w, exchange, reqBody, "conversation memory")
+		if !ok {
+			return
+		}
+		if memory = s.injectMemory(w, r, exchange, session, reqBody, body); memory != nil {
+			recordWriter = io.MultiWriter(recordWriter, memory)
+		}
+	}
+
+	exchange.RequestBytes = reqBody.Len()
+	if preview := reqBody.Bytes(); preview != nil {
+		exchange.Model = parseModel(preview)
+		if system := extractSystemPrompt(preview); system != "" && s.Prompts != nil {
+			family := r.Header.Get("X-Prompt-Name")
+			if family == "" {
+				family = exchange.Model
+			}
+			if family == "" {
+				family = "default"
+			}
+			exchange.PromptVersion = s.Prompts.Resolve(family, system)
+		}
+		if s.Config.RecentBodies {
+			exchange.RequestBody = string(preview[:min(len(preview), previewLimit)])
+		}
+	}
+
+	if session != nil {
+		// The model must be known to scope the session, even when the body
+		// spilled to disk.
+		body, ok := s.inspectBody(w, exchange, reqBody, "session tokens")
+		if !ok {
+			return
+		}
+		if exchange.Model == "" {
+			exchange.Model = parseModel(body)
+		}
+		estimate := int64(max(s.requestTokens(reqBody), 1))
+		if status, err := s.Sessions.Authorize(*session, r.URL.Path, exchange.Model, estimate); err != nil {
+			exchange.Status = status
+			exchange.Error = err.Error()
+			writeAPIError(w, status, err.Error())
+			return
+		}
+		sessionReserved = estimate
+		// Sessions are charged from the usage the upstream reports, which
+		// streams only include on request.
+		if body = forceStreamUsage(body); body != nil {
+			reqBody.Reset()
+			reqBody.Write(body)
+			stripUsage = true
+		}
+	}
+
+	if s.Transcripts != nil && r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/chat/completions") {
+		body, err := reqBody.ReadAll()
+		if err != nil {
+			http.Error(w, "Error reading request body", http.StatusInternalServerError)
+			return
+		}
+		transcript = &transcriptCapture{request: body}
+		recordWriter = io.MultiWriter(recordWriter, transcript)
+	}
+
+	if s.Config.LogRequests {
+		s.Logger.LogRequest(r, reqBody)
+	}
+	if s.ExecHooks != nil {
+		s.ExecHooks.Fire(HookRequest, *exchange)
+	}
+
+	upstream := s.Config.OpenAIBaseURL
+	if s.Router != nil {
+		body, ok := s.inspectBody(w, exchange, reqBody, "routing")
+		if !ok {
+			return
+		}
+		routed, err := s.Router.Route(r, body)
+		if err != nil {
+			exchange.Status = http.StatusBadGateway
+			exchange.Error = err.Error()
+			writeAPIError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		if routed != "" {
+			upstream = strings.TrimSuffix(routed, "/")
+		}
+	}
+	if s.StatusMonitor != nil {
+		if fallback := s.StatusMonitor.Fallback(upstream); fallback != "" {
+			statusFailovers.Add(1)
+			exchange.FailoverFrom = upstream
+			upstream = fallback
+		}
+	}
+
+	if s.RoutingHints != nil && r.Method == http.MethodPost {
+		if target, err := url.Parse(upstream); err == nil {
+			body, ok := s.inspectBody(w, exchange, reqBody, "routing hints")
+			if !ok {
+				return
+			}
+			body, err = s.RoutingHints.Apply(body, target)
+			if err != nil {
+				exchange.Status = http.StatusBadRequest
+				exchange.Error = err.Error()
+				writeAPIError(w, http.StatusBadRequest, "invalid routing hints: "+err.Error())
+				return
+			}
+			if body != nil {
+				reqBody.Reset()
+				reqBody.Write(body)
+			}
+		}
+	}
+
+	targetURL := upstream + r.URL.Path
+	if r.URL.RawQuery != "" {
+		targetURL += "?" + r.URL.RawQuery
+	}
+
+	bodyReader, err := reqBody.Reader()
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusInternalServerError)
+		return
+	}
+
+	proxyReq, err := http.NewRequest(r.Method, targetURL, bodyReader)
+	if err != nil {
+		http.Error(w, "Error creating proxy request: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	proxyReq.ContentLength = reqBody.Len()
+
+	for name, values := range r.Header {
+		if strings.ToLower(name) == "host" {
+			continue
+		}
+		for _, value := range values {
+			proxyReq.Header.Add(name, value)
+		}
+	}
+	removeHopHeaders(proxyReq.Header)
+	addVia(proxyReq.Header, r.ProtoMajor, r.ProtoMinor)
+
+	if proxyReq.Header.Get("Authorization") == "" && s.Config.OpenAIAPIKey != "" {
+		proxyReq.Header.Set("Authorization", "Bearer "+s.Config.OpenAIAPIKey)
+	}
+	if s.Attribution != nil {
+		s.Attribution.Apply(proxyReq)
+	}
+
+	annotate := s.Annotator != nil && s.Annotator.Enabled(r)
+	var postProcess *PostProcessRule
+	if s.PostProcessors != nil {
+		postProcess = s.PostProcessors.Match(r, exchange.Model)
+	}
+	// Let the transport negotiate gzip so the body is decoded for us: usage
+	// accounting, annotation, transcripts, and post-processing all read it.
+	proxyReq.Header.Del("Accept-Encoding")
+
+	resp, err := s.roundTrip(r, proxyReq, reqBody, exchange)
+	if err != nil {
+		upstreamErrors.Add(1)
+		exchange.Status = http.StatusBadGateway
+		exchange.Error = err.Error()
+		http.Error(w, "Error forwarding request to OpenAI API: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, hook := range s.ResponseHooks {
+		if err := hook.HandleResponse(r, resp); err != nil {
+			exchange.Status = http.StatusBadGateway
+			exchange.Error = err.Error()
+			writeAPIError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+	}
+
+	if postProcess != nil {
+		upstreamUsage, err = postProcessResponse(resp, postProcess)
+		if err != nil {
+			upstreamErrors.Add(1)
+			exchange.Status = http.StatusBadGateway
+			exchange.Error = err.Error()
+			writeAPIError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+	}
+
+	if annotate {
+		if err := annotateResponse(resp, exchange, proxyReq.URL.Host, s.now()); err != nil {
+			upstreamErrors.Add(1)
+			exchange.Status = http.StatusBadGateway
+			exchange.Error = err.Error()
+			http.Error(w, "Error reading response from OpenAI API: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+
+	removeHopHeaders(resp.Header)
+	addVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+
+	s.HeaderPolicy.copyResponseHeaders(w.Header(), resp.Header)
+	if origin := r.Header.Get("Origin"); s.Sessions != nil && s.Sessions.allowOrigin(origin) {
+		// Replace any upstream CORS policy rather than sending two.
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+
+	if recorded != nil {
+		recorded.ResponseHeader = resp.Header.Clone()
+	}
+
+	w.WriteHeader(resp.StatusCode)
+
+	isStreaming := strings.Contains(resp.Header.Get("Content-Type"), "text/event-stream")
+	exchange.Status = resp.StatusCode
+	exchange.Streaming = isStreaming
+
+	if isStreaming {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+			return
+		}
+
+		// Outside raw mode the stream is logged once it is complete.
+		var streamBody *logging.BodySpool
+		if s.Config.LogResponses && s.Config.StreamLogMode != logging.StreamRaw {
+			streamBody = logging.NewBodySpool(s.Config.SpillThreshold, s.Config.SpillDir, s.Config.CompressLogs)
+			defer streamBody.Close()
+		}
+
+		var client io.Writer = w
+		if stripUsage {
+			stripper := &usageStripper{w: w}
+			defer stripper.Close()
+			client = stripper
+		}
+
+		for {
+			n, err := resp.Body.Read(*buffer)
+			if n > 0 {
+				chunk := (*buffer)[:n]
+				if _, writeErr := client.Write(chunk); writeErr != nil {
+					log.Printf("Error writing response chunk: %v", writeErr)
+					break
+				}
+				flusher.Flush()
+				respPreview.Write(chunk)
+				recordWriter.Write(chunk)
+				if streamBody != nil {
+					streamBody.Write(chunk)
+				} else if s.Config.LogResponses {
+					s.Logger.LogResponse(reqID, resp, chunk)
+				}
+			}
+
+			if err != nil {
+				if err != io.EOF {
+					log.Printf("Error reading response body: %v", err)
+				}
+				break
+			}
+		}
+		if streamBody != nil {
+			s.Logger.LogStream(reqID, resp, streamBody)
+		}
+	} else {
+		if !s.Config.LogResponses {
+			if _, err := io.CopyBuffer(io.MultiWriter(w, respPreview, recordWriter), resp.Body, *buffer); err != nil {
+				log.Printf("Error copying response body: %v", err)
+			}
+			return
+		}
+
+		respBody := logging.NewBodySpool(s.Config.SpillThreshold, s.Config.SpillDir, s.Config.CompressLogs)
+		defer respBody.Close()
+
+		if _, err := io.CopyBuffer(io.MultiWriter(w, respBody, respPreview, recordWriter), resp.Body, *buffer); err != nil {
+			log.Printf("Error copying response body: %v", err)
+		}
+
+		s.Logger.LogResponseSpool(reqID, resp, respBody)
+	}
+}
+
+// inspectBody returns the whole request body for a feature that reads or
+// rewrites it, reading it back if it spilled to disk. Bodies over
+// maxInspectBytes are refused with a 413 rather than passed on unchecked.
+func (s *Server) inspectBody(w http.ResponseWriter, exchange *Exchange, reqBody *logging.BodySpool, feature string) ([]byte, bool) {
+	if reqBody.Len() > maxInspectBytes {
+		exchange.Status = http.StatusRequestEntityTooLarge
+		exchange.Error = fmt.Sprintf("request body of %d bytes is too large for %s (limit %d)", reqBody.Len(), feature, maxInspectBytes)
+		writeAPIError(w, http.StatusRequestEntityTooLarge, exchange.Error)
+		return nil, false
+	}
+	body, err := reqBody.ReadAll()
+	if err != nil {
+		exchange.Status = http.StatusInternalServerError
+		exchange.Error = err.Error()
+		http.Error(w, "Error reading request body", http.StatusInternalServerError)
+		return nil, false
+	}
+	return body, true
+}
+
+// APIError is the body of every error the proxy and its admin API answer
+// with, in the shape the OpenAI API uses.
+type APIError struct {
+	Error APIErrorDetail `json:"error"`
+}
+
+type APIErrorDetail struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	// Code is the status in snake case, such as not_found.
+	Code string `json:"code"`
+}
+
+// writeAPIError responds with an OpenAI-style error object so clients surface
+// proxy-side rejections the same way as upstream errors.
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	errType := "invalid_request_error"
+	if status >= http.StatusInternalServerError {
+		errType = "server_error"
+	}
+	writeJSON(w, status, APIError{Error: APIErrorDetail{
+		Message: message,
+		Type:    errType,
+		Code:    strings.ToLower(strings.ReplaceAll(http.StatusText(status), " ", "_")),
+	}})
+}
@@ -0,0 +1,425 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// sessionTokenPrefix marks bearer tokens minted by the proxy.
+	sessionTokenPrefix = "sess_"
+	defaultSessionTTL  = 15 * time.Minute
+	maxSessionTTL      = 24 * time.Hour
+)
+
+// defaultSessionEndpoints are the API endpoints a session may call when it
+// is minted without a list: the ones browsers use to generate text and
+// embeddings, but not files, batches, or fine-tuning.
+var defaultSessionEndpoints = []string{"chat/completions", "completions", "embeddings"}
+
+// errSessionRequired rejects browser requests from allowed origins that do
+// not carry a session token.
+var errSessionRequired = errors.New("requests from browsers must use a session token")
+
+// SessionClaims are the limits signed into a session token.
+type SessionClaims struct {
+	ID    string `json:"id"`
+	Label string `json:"label,omitempty"`
+	// Models lists the models the session may call; empty allows any.
+	Models []string `json:"models,omitempty"`
+	// Endpoints lists the API endpoints the session may call, such as
+	// chat/completions; empty means defaultSessionEndpoints.
+	Endpoints []string `json:"endpoints,omitempty"`
+	// TokenBudget caps the total tokens the session may use; 0 is unlimited.
+	TokenBudget int64 `json:"token_budget,omitempty"`
+	ExpiresAt   int64 `json:"exp"`
+}
+
+// Session is a minted session with the tokens it has used so far.
+type Session struct {
+	SessionClaims
+	Expires    time.Time `json:"expires_at"`
+	TokensUsed int64     `json:"tokens_used"`
+	// TokensReserved is held for requests still in flight, until they are
+	// charged what they actually used.
+	TokensReserved int64 `json:"tokens_reserved"`
+	Requests       int64 `json:"requests"`
+	Revoked        bool  `json:"revoked,omitempty"`
+}
+
+// SessionRequest is the body of POST /admin/sessions.
+type SessionRequest struct {
+	Label       string   `json:"label,omitempty"`
+	Models      []string `json:"models,omitempty"`
+	Endpoints   []string `json:"endpoints,omitempty"`
+	TokenBudget int64    `json:"token_budget,omitempty"`
+	TTLSeconds  int      `json:"ttl_seconds,omitempty"`
+}
+
+// SessionToken is the response of POST /admin/sessions.
+type SessionToken struct {
+	Token string `json:"token"`
+	Session
+}
+
+// SessionManager mints and checks short-lived, scope-limited tokens that
+// browsers can use against the proxy in place of a real API key. Tokens are
+// signed, so they stay valid across restarts until they expire, but usage
+// and revocations are only tracked in memory.
+type SessionManager struct {
+	secret  []byte
+	origins []string
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+// NewSessionManager returns a manager signing with secret, or nil if secret is
+// empty. origins is a comma-separated list of browser origins allowed to call
+// the proxy with a session token, or "*".
+func NewSessionManager(secret, origins string) *SessionManager {
+	if secret == "" {
+		return nil
+	}
+	m := &SessionManager{
+		secret:   []byte(secret),
+		sessions: make(map[string]*Session),
+	}
+	for _, origin := range strings.Split(origins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			m.origins = append(m.origins, strings.TrimSuffix(origin, "/"))
+		}
+	}
+	return m
+}
+
+// Mint creates a session token for req.
+func (m *SessionManager) Mint(req SessionRequest, now time.Time) (SessionToken, error) {
+	ttl := defaultSessionTTL
+	if req.TTLSeconds > 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+	if ttl > maxSessionTTL {
+		return SessionToken{}, fmt.Errorf("ttl_seconds may be at most %d", int(maxSessionTTL/time.Second))
+	}
+	if req.TokenBudget < 0 {
+		return SessionToken{}, errors.New("token_budget must not be negative")
+	}
+
+	endpoints := defaultSessionEndpoints
+	if len(req.Endpoints) > 0 {
+		endpoints = make([]string, 0, len(req.Endpoints))
+		for _, endpoint := range req.Endpoints {
+			if endpoint = sessionEndpoint(endpoint); endpoint == "" {
+				return SessionToken{}, errors.New("endpoints must not be empty")
+			}
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+
+	id := make([]byte, 9)
+	if _, err := rand.Read(id); err != nil {
+		return SessionToken{}, err
+	}
+	claims := SessionClaims{
+		ID:          hex.EncodeToString(id),
+		Label:       req.Label,
+		Models:      req.Models,
+		Endpoints:   endpoints,
+		TokenBudget: req.TokenBudget,
+		ExpiresAt:   now.Add(ttl).Unix(),
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return SessionToken{}, err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	token := sessionTokenPrefix + encoded + "." + m.sign(encoded)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session := m.session(claims)
+	return SessionToken{Token: token, Session: *session}, nil
+}
+
+func (m *SessionManager) sign(payload string) string {
+	mac := hmac.New(sha256.New, m.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// session returns the tracked state for claims, creating it for tokens minted
+// before a restart. m.mu must be held.
+func (m *SessionManager) session(claims SessionClaims) *Session {
+	s, ok := m.sessions[claims.ID]
+	if !ok {
+		s = &Session{SessionClaims: claims, Expires: time.Unix(claims.ExpiresAt, 0).UTC()}
+		m.sessions[claims.ID] = s
+	}
+	return s
+}
+
+// Verify checks a session token's signature and expiry.
+func (m *SessionManager) Verify(token string, now time.Time) (SessionClaims, error) {
+	var claims SessionClaims
+	payload, sig, ok := strings.Cut(strings.TrimPrefix(token, sessionTokenPrefix), ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(m.sign(payload))) {
+		return claims, errors.New("invalid session token")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil || json.Unmarshal(data, &claims) != nil {
+		return claims, errors.New("invalid session token")
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return claims, errors.New("session token has expired")
+	}
+	return claims, nil
+}
+
+// Authorize checks that the session may send another request to the API path
+// for model and reserves estimate tokens of its budget for it, so concurrent
+// requests cannot all spend the same remainder. Every authorized request
+// must be charged with the same estimate once it completes.
+func (m *SessionManager) Authorize(claims SessionClaims, path, model string, estimate int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.session(claims)
+	switch {
+	case s.Revoked:
+		return http.StatusUnauthorized, errors.New("session has been revoked")
+	case !s.allowsPath(path):
+		return http.StatusForbidden, fmt.Errorf("session is not allowed to call %s", path)
+	case len(s.Models) > 0 && !slices.Contains(s.Models, model):
+		return http.StatusForbidden, fmt.Errorf("session is not allowed to use model %q", model)
+	case s.TokenBudget > 0 && s.TokensUsed+s.TokensReserved >= s.TokenBudget:
+		return http.StatusTooManyRequests, errors.New("session token budget is exhausted")
+	}
+	s.Requests++
+	s.TokensReserved += estimate
+	return 0, nil
+}
+
+// allowsPath reports whether an API path such as /v1/chat/completions, or a
+// resource under it, is one of the session's endpoints.
+func (c SessionClaims) allowsPath(p string) bool {
+	endpoints := c.Endpoints
+	if len(endpoints) == 0 {
+		endpoints = defaultSessionEndpoints
+	}
+	name := sessionEndpoint(path.Clean("/" + p))
+	for _, endpoint := range endpoints {
+		if name == endpoint || strings.HasPrefix(name, endpoint+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionEndpoint normalizes an endpoint such as /v1/chat/completions to
+// chat/completions.
+func sessionEndpoint(endpoint string) string {
+	endpoint = strings.Trim(endpoint, "/ ")
+	if rest, ok := strings.CutPrefix(endpoint, "v1/"); ok {
+		endpoint = rest
+	}
+	return endpoint
+}
+
+// Charge releases the tokens reserved for a completed request and adds the
+// tokens it used to its session.
+func (m *SessionManager) Charge(id string, reserved int64, tokens int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.sessions[id]; ok {
+		s.TokensReserved -= reserved
+		s.TokensUsed += int64(tokens)
+	}
+}
+
+// Revoke invalidates a session before it expires.
+func (m *SessionManager) Revoke(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if ok {
+		s.Revoked = true
+	}
+	return ok
+}
+
+// List returns unexpired sessions, soonest to expire first, forgetting expired
+// ones.
+func (m *SessionManager) List(now time.Time) []Session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sessions := make([]Session, 0, len(m.sessions))
+	for id, s := range m.sessions {
+		if now.Unix() >= s.ExpiresAt {
+			delete(m.sessions, id)
+			continue
+		}
+		sessions = append(sessions, *s)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ExpiresAt < sessions[j].ExpiresAt })
+	return sessions
+}
+
+// allowOrigin reports whether a browser at origin may call the proxy.
+func (m *SessionManager) allowOrigin(origin string) bool {
+	return origin != "" && (slices.Contains(m.origins, "*") || slices.Contains(m.origins, origin))
+}
+
+// handleCORS sets CORS headers for allowed browser origins and answers
+// preflight requests, reporting whether the request has been handled.
+func (m *SessionManager) handleCORS(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if !m.allowOrigin(origin) {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Add("Vary", "Origin")
+	if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-Request-ID")
+	w.Header().Set("Access-Control-Max-Age", "600")
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// sessionToken returns the session token r authenticates with, if any.
+func sessionToken(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	token = strings.TrimSpace(token)
+	return token, ok && strings.HasPrefix(token, sessionTokenPrefix)
+}
+
+// forceStreamUsage returns body with stream_options.include_usage set if it
+// asks for a stream, or nil if it does not or already includes usage.
+func forceStreamUsage(body []byte) []byte {
+	var req map[string]json.RawMessage
+	if json.Unmarshal(body, &req) != nil {
+		return nil
+	}
+	var stream bool
+	if json.Unmarshal(req["stream"], &stream) != nil || !stream {
+		return nil
+	}
+	var options map[string]json.RawMessage
+	if raw, ok := req["stream_options"]; ok && json.Unmarshal(raw, &options) != nil {
+		return nil
+	}
+	if options == nil {
+		options = make(map[string]json.RawMessage)
+	}
+	if string(options["include_usage"]) == "true" {
+		return nil
+	}
+	options["include_usage"] = json.RawMessage("true")
+	req["stream_options"], _ = json.Marshal(options)
+	out, err := json.Marshal(req)
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+// usageStripper relays a stream to w without the final usage event, for
+// clients that did not ask for one and only get it because forceStreamUsage
+// requested it. Events are passed on as soon as they are complete.
+type usageStripper struct {
+	w       io.Writer
+	pending []byte
+}
+
+func (u *usageStripper) Write(p []byte) (int, error) {
+	u.pending = append(u.pending, p...)
+	rest := u.pending
+	for {
+		end := bytes.Index(rest, []byte("\n\n"))
+		if end < 0 {
+			break
+		}
+		event := rest[:end+2]
+		rest = rest[end+2:]
+		if isUsageEvent(event) {
+			continue
+		}
+		if _, err := u.w.Write(event); err != nil {
+			return 0, err
+		}
+	}
+	u.pending = u.pending[:copy(u.pending, rest)]
+	return len(p), nil
+}
+
+// Close writes out an incomplete final event.
+func (u *usageStripper) Close() error {
+	if len(u.pending) == 0 {
+		return nil
+	}
+	_, err := u.w.Write(u.pending)
+	u.pending = nil
+	return err
+}
+
+// isUsageEvent reports whether an SSE event is the usage-only chunk that
+// stream_options.include_usage adds: no choices and a usage object.
+func isUsageEvent(event []byte) bool {
+	data, ok := bytes.CutPrefix(bytes.TrimSpace(event), []byte("data:"))
+	if !ok {
+		return false
+	}
+	var chunk struct {
+		Choices []json.RawMessage `json:"choices"`
+		Usage   json.RawMessage   `json:"usage"`
+	}
+	if json.Unmarshal(data, &chunk) != nil {
+		return false
+	}
+	return chunk.Choices != nil && len(chunk.Choices) == 0 && len(chunk.Usage) > 0 && string(chunk.Usage) != "null"
+}
+
+func (s *Server) handleMintSession(w http.ResponseWriter, r *http.Request) {
+	var req SessionRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return
+		}
+	}
+	token, err := s.Sessions.Mint(req, s.now())
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, token)
+}
+
+func (s *Server) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Sessions.List(s.now()))
+}
+
+func (s *Server) handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	if !s.Sessions.Revoke(r.PathValue("id")) {
+		writeAPIError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"revoked": true})
+}
@@ -0,0 +1,329 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"t-oai-api/config"
+)
+
+const (
+	defaultStatusInterval = time.Minute
+	// statusPollTimeout bounds one poll of a status feed.
+	statusPollTimeout = 10 * time.Second
+)
+
+var (
+	providerStatus   = counterMap("provider_status")
+	statusFailovers  = counter("status_failovers_total")
+	statusPollErrors = counter("status_poll_errors_total")
+)
+
+// knownStatusFeeds are the feeds STATUS_FEEDS can name by provider, keyed by
+// the API host they report on.
+var knownStatusFeeds = map[string][2]string{
+	"openai":    {"api.openai.com", "https://status.openai.com/api/v2/summary.json"},
+	"anthropic": {"api.anthropic.com", "https://status.anthropic.com/api/v2/summary.json"},
+}
+
+// statusLevels orders the indicators and incident impacts a Statuspage feed
+// reports.
+var statusLevels = map[string]int{
+	"none":        0,
+	"maintenance": 1,
+	"minor":       1,
+	"major":       2,
+	"critical":    3,
+}
+
+// StatusMonitor polls provider status pages and reports degraded upstreams.
+// During a declared incident at or above its failover level, requests for an
+// upstream with a fallback are sent to the fallback instead.
+type StatusMonitor struct {
+	feeds     map[string]string
+	fallbacks map[string]string
+	level     string
+	interval  time.Duration
+
+	mu     sync.Mutex
+	status map[string]*ProviderStatus
+}
+
+// ProviderStatus is the last polled status of one upstream host.
+type ProviderStatus struct {
+	Host        string           `json:"host"`
+	Feed        string           `json:"feed"`
+	Indicator   string           `json:"indicator,omitempty"`
+	Description string           `json:"description,omitempty"`
+	Incidents   []StatusIncident `json:"incidents,omitempty"`
+	Checked     time.Time        `json:"checked,omitzero"`
+	Error       string           `json:"error,omitempty"`
+	// Failover is the fallback requests for Host are sent to while the
+	// incident lasts.
+	Failover string `json:"failover,omitempty"`
+}
+
+// StatusIncident is an unresolved incident on a provider's status page.
+type StatusIncident struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Impact string `json:"impact"`
+	URL    string `json:"url,omitempty"`
+}
+
+// statusSummary is the subset of a Statuspage summary.json or status.json
+// document the monitor reads.
+type statusSummary struct {
+	Status struct {
+		Indicator   string `json:"indicator"`
+		Description string `json:"description"`
+	} `json:"status"`
+	Incidents []struct {
+		Name      string `json:"name"`
+		Status    string `json:"status"`
+		Impact    string `json:"impact"`
+		Shortlink string `json:"shortlink"`
+	} `json:"incidents"`
+}
+
+// NewStatusMonitor returns the monitor configured in cfg, or nil if no status
+// feeds are set. Feeds are provider names from knownStatusFeeds or host=url
+// pairs; fallbacks are host=url pairs naming the base URL to fail over to.
+func NewStatusMonitor(cfg config.Config) (*StatusMonitor, error) {
+	if strings.TrimSpace(cfg.StatusFeeds) == "" {
+		return nil, nil
+	}
+	m := &StatusMonitor{
+		feeds:     make(map[string]string),
+		fallbacks: make(map[string]string),
+		level:     cfg.StatusFailoverLevel,
+		interval:  time.Duration(cfg.StatusInterval) * time.Second,
+		status:    make(map[string]*ProviderStatus),
+	}
+	for _, entry := range strings.Split(cfg.StatusFeeds, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		host, feed, ok := strings.Cut(entry, "=")
+		if !ok {
+			known, found := knownStatusFeeds[strings.ToLower(entry)]
+			if !found {
+				return nil, fmt.Errorf("invalid status feed %q: want a known provider or host=url", entry)
+			}
+			host, feed = known[0], known[1]
+		}
+		if !strings.HasPrefix(feed, "http://") && !strings.HasPrefix(feed, "https://") {
+			return nil, fmt.Errorf("invalid status feed %q: %q is not an http(s) URL", entry, feed)
+		}
+		m.feeds[strings.TrimSpace(host)] = strings.TrimSpace(feed)
+	}
+	for _, entry := range strings.Split(cfg.StatusFallbacks, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		host, fallback, ok := strings.Cut(entry, "=")
+		if !ok || (!strings.HasPrefix(fallback, "http://") && !strings.HasPrefix(fallback, "https://")) {
+			return nil, fmt.Errorf("invalid status fallback %q: want host=url", entry)
+		}
+		host = strings.TrimSpace(host)
+		if _, ok := m.feeds[host]; !ok {
+			return nil, fmt.Errorf("invalid status fallback %q: no status feed for %s", entry, host)
+		}
+		m.fallbacks[host] = strings.TrimSuffix(strings.TrimSpace(fallback), "/")
+	}
+	if m.level == "" {
+		m.level = "major"
+	}
+	if _, ok := statusLevels[m.level]; !ok || m.level == "none" {
+		return nil, fmt.Errorf("invalid status failover level %q: want minor, major, or critical", m.level)
+	}
+	if m.interval <= 0 {
+		m.interval = defaultStatusInterval
+	}
+	for host, feed := range m.feeds {
+		m.status[host] = &ProviderStatus{Host: host, Feed: feed}
+	}
+	return m, nil
+}
+
+// Run polls every feed at once and then once per interval until done is
+// closed.
+func (m *StatusMonitor) Run(client *http.Client, done <-chan struct{}) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		m.pollAll(client)
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+func (m *StatusMonitor) pollAll(client *http.Client) {
+	var wg sync.WaitGroup
+	for host, feed := range m.feeds {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			summary, err := fetchStatus(client, feed)
+			m.update(host, summary, err)
+		}()
+	}
+	wg.Wait()
+}
+
+func fetchStatus(client *http.Client, feed string) (*statusSummary, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), statusPollTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, feed, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status feed returned %s", resp.Status)
+	}
+	var summary statusSummary
+	if err := json.NewDecoder(resp.Body).Decode(&summary); err != nil {
+		return nil, fmt.Errorf("invalid status feed: %w", err)
+	}
+	if summary.Status.Indicator == "" {
+		return nil, fmt.Errorf("invalid status feed: no status indicator")
+	}
+	return &summary, nil
+}
+
+// update records a poll of host's feed, logging changes of status. A failed
+// poll keeps the last known status.
+func (m *StatusMonitor) update(host string, summary *statusSummary, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := m.status[host]
+	if err != nil {
+		statusPollErrors.Add(1)
+		if st.Error != err.Error() {
+			log.Printf("Warning: failed to poll status feed for %s: %v", host, err)
+		}
+		st.Error = err.Error()
+		return
+	}
+
+	previous, previousFailover := st.Indicator, st.Failover
+	st.Checked = time.Now()
+	st.Error = ""
+	st.Indicator = summary.Status.Indicator
+	st.Description = summary.Status.Description
+	st.Incidents = nil
+	level := statusLevels[st.Indicator]
+	for _, inc := range summary.Incidents {
+		if inc.Status == "resolved" || inc.Status == "postmortem" {
+			continue
+		}
+		st.Incidents = append(st.Incidents, StatusIncident{Name: inc.Name, Status: inc.Status, Impact: inc.Impact, URL: inc.Shortlink})
+		level = max(level, statusLevels[inc.Impact])
+	}
+	st.Failover = ""
+	if fallback, ok := m.fallbacks[host]; ok && len(st.Incidents) > 0 && level >= statusLevels[m.level] {
+		st.Failover = fallback
+	}
+
+	providerStatus.Set(host, int64(level))
+
+	switch {
+	case st.Indicator == previous && st.Failover == previousFailover:
+	case level == 0 && previous != "":
+		log.Printf("Provider status for %s recovered: %s", host, st.Description)
+	case level > 0:
+		log.Printf("Warning: provider status for %s is %s: %s%s", host, st.Indicator, st.Description, incidentSuffix(st))
+	}
+}
+
+func incidentSuffix(st *ProviderStatus) string {
+	var b strings.Builder
+	for _, inc := range st.Incidents {
+		fmt.Fprintf(&b, " [incident: %s (%s)]", inc.Name, inc.Impact)
+	}
+	if st.Failover != "" {
+		fmt.Fprintf(&b, "; failing over to %s", st.Failover)
+	}
+	return b.String()
+}
+
+// Fallback returns the base URL to send requests for upstream to while its
+// provider has a declared incident, or "" to keep upstream.
+func (m *StatusMonitor) Fallback(upstream string) string {
+	target, err := url.Parse(upstream)
+	if err != nil {
+		return ""
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, host := range []string{target.Host, target.Hostname()} {
+		if st, ok := m.status[host]; ok {
+			return st.Failover
+		}
+	}
+	return ""
+}
+
+// Statuses returns the last polled status of every upstream, by host.
+func (m *StatusMonitor) Statuses() []ProviderStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	statuses := make([]ProviderStatus, 0, len(m.status))
+	for _, st := range m.status {
+		statuses = append(statuses, *st)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Host < statuses[j].Host })
+	return statuses
+}
+
+// Readiness is the response of GET /readyz.
+type Readiness struct {
+	// Status is "ok", or "degraded" while a monitored provider reports a
+	// problem. The proxy keeps serving either way. Warnings also cover
+	// status feeds that could not be polled.
+	Status    string           `json:"status"`
+	Uptime    string           `json:"uptime"`
+	Warnings  []string         `json:"warnings,omitempty"`
+	Providers []ProviderStatus `json:"providers,omitempty"`
+}
+
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ready := Readiness{Status: "ok", Uptime: time.Since(s.started).String()}
+	if s.StatusMonitor != nil {
+		ready.Providers = s.StatusMonitor.Statuses()
+		for _, st := range ready.Providers {
+			switch {
+			case st.Indicator != "" && st.Indicator != "none":
+				ready.Status = "degraded"
+				ready.Warnings = append(ready.Warnings, fmt.Sprintf("%s is %s: %s%s", st.Host, st.Indicator, st.Description, incidentSuffix(&st)))
+			case len(st.Incidents) > 0:
+				ready.Status = "degraded"
+				ready.Warnings = append(ready.Warnings, fmt.Sprintf("%s has an open incident%s", st.Host, incidentSuffix(&st)))
+			}
+			if st.Error != "" {
+				// An unreachable status page says nothing about the provider.
+				ready.Warnings = append(ready.Warnings, fmt.Sprintf("status of %s is unknown: %s", st.Host, st.Error))
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, ready)
+}
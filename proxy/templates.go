@@ -0,0 +1,268 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// PromptTemplate is one version of a server-side request template. Body is a
+// JSON request body whose string values may contain text/template actions
+// referencing the client's vars, e.g. "Summarise {{.ticket}}".
+type PromptTemplate struct {
+	Name    string         `json:"name"`
+	Version int            `json:"version"`
+	Body    map[string]any `json:"body"`
+}
+
+// Ref identifies the template version, e.g. support_reply@v3.
+func (t *PromptTemplate) Ref() string {
+	return fmt.Sprintf("%s@v%d", t.Name, t.Version)
+}
+
+// TemplateStore holds prompt templates loaded from a directory laid out as
+// <dir>/<name>/v<N>.json. A plain <dir>/<name>.json is treated as version 1.
+type TemplateStore struct {
+	dir string
+
+	mu        sync.RWMutex
+	templates map[string][]*PromptTemplate
+}
+
+func NewTemplateStore(dir string) (*TemplateStore, error) {
+	store := &TemplateStore{dir: dir}
+	if err := store.Reload(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Reload re-reads every template from disk, replacing the current set only if
+// all of them parse.
+func (t *TemplateStore) Reload() error {
+	entries, err := os.ReadDir(t.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read template directory: %w", err)
+	}
+
+	templates := make(map[string][]*PromptTemplate)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			versions, err := os.ReadDir(filepath.Join(t.dir, entry.Name()))
+			if err != nil {
+				return fmt.Errorf("failed to read template %s: %w", entry.Name(), err)
+			}
+			for _, v := range versions {
+				num, ok := parseTemplateVersion(strings.TrimSuffix(v.Name(), ".json"))
+				if v.IsDir() || !strings.HasSuffix(v.Name(), ".json") || !ok {
+					continue
+				}
+				tmpl, err := loadPromptTemplate(filepath.Join(t.dir, entry.Name(), v.Name()), entry.Name(), num)
+				if err != nil {
+					return err
+				}
+				templates[entry.Name()] = append(templates[entry.Name()], tmpl)
+			}
+			continue
+		}
+
+		if name, ok := strings.CutSuffix(entry.Name(), ".json"); ok {
+			tmpl, err := loadPromptTemplate(filepath.Join(t.dir, entry.Name()), name, 1)
+			if err != nil {
+				return err
+			}
+			templates[name] = append(templates[name], tmpl)
+		}
+	}
+
+	for _, versions := range templates {
+		sort.Slice(versions, func(i, j int) bool {
+			return versions[i].Version < versions[j].Version
+		})
+	}
+
+	t.mu.Lock()
+	t.templates = templates
+	t.mu.Unlock()
+	return nil
+}
+
+func loadPromptTemplate(path, name string, version int) (*PromptTemplate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read template %s: %w", path, err)
+	}
+	var body map[string]any
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil, fmt.Errorf("invalid template %s: %w", path, err)
+	}
+	return &PromptTemplate{Name: name, Version: version, Body: body}, nil
+}
+
+// parseTemplateVersion accepts "v3", "3", or a JSON number.
+func parseTemplateVersion(v string) (int, bool) {
+	n, err := strconv.Atoi(strings.TrimPrefix(v, "v"))
+	return n, err == nil && n > 0
+}
+
+// Get returns the requested version, or the latest when version is 0.
+func (t *TemplateStore) Get(name string, version int) (*PromptTemplate, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	versions := t.templates[name]
+	if len(versions) == 0 {
+		return nil, false
+	}
+	if version == 0 {
+		return versions[len(versions)-1], true
+	}
+	for _, tmpl := range versions {
+		if tmpl.Version == version {
+			return tmpl, true
+		}
+	}
+	return nil, false
+}
+
+// List returns every template version, grouped by name.
+func (t *TemplateStore) List() map[string][]*PromptTemplate {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	list := make(map[string][]*PromptTemplate, len(t.templates))
+	for name, versions := range t.templates {
+		list[name] = append([]*PromptTemplate(nil), versions...)
+	}
+	return list
+}
+
+// templateRequest is the client-facing shape of a templated request. Any other
+// top-level fields are kept and override the template's values.
+type templateRequest struct {
+	Template        string          `json:"template"`
+	TemplateVersion json.RawMessage `json:"template_version"`
+	Vars            map[string]any  `json:"vars"`
+}
+
+// Expand rewrites a templated request body into a regular API request. It
+// returns nil with no error when the body does not reference a template.
+func (t *TemplateStore) Expand(body []byte) ([]byte, *PromptTemplate, error) {
+	if !bytes.Contains(body, []byte(`"template"`)) {
+		return nil, nil, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) != nil {
+		return nil, nil, nil
+	}
+	if _, ok := fields["template"]; !ok {
+		return nil, nil, nil
+	}
+
+	var req templateRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, nil, fmt.Errorf("invalid template request: %w", err)
+	}
+
+	version := 0
+	if len(req.TemplateVersion) > 0 {
+		raw := strings.Trim(string(req.TemplateVersion), `"`)
+		v, ok := parseTemplateVersion(raw)
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid template_version %s", req.TemplateVersion)
+		}
+		version = v
+	}
+
+	tmpl, ok := t.Get(req.Template, version)
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown template %q", req.Template)
+	}
+
+	expanded, err := expandValue(tmpl.Body, req.Vars)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to expand template %s: %w", tmpl.Ref(), err)
+	}
+	out := expanded.(map[string]any)
+
+	for name, raw := range fields {
+		switch name {
+		case "template", "template_version", "vars":
+			continue
+		}
+		var v any
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, nil, err
+		}
+		out[name] = v
+	}
+
+	data, err := json.Marshal(out)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, tmpl, nil
+}
+
+// expandValue walks a decoded JSON value, executing every string as a
+// text/template against vars. Missing vars are an error rather than "<no value>".
+func expandValue(v any, vars map[string]any) (any, error) {
+	switch v := v.(type) {
+	case string:
+		if !strings.Contains(v, "{{") {
+			return v, nil
+		}
+		tmpl, err := template.New("").Option("missingkey=error").Parse(v)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, vars); err != nil {
+			return nil, err
+		}
+		return buf.String(), nil
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for key, value := range v {
+			expanded, err := expandValue(value, vars)
+			if err != nil {
+				return nil, err
+			}
+			out[key] = expanded
+		}
+		return out, nil
+	case []any:
+		out := make([]any, len(v))
+		for i, value := range v {
+			expanded, err := expandValue(value, vars)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = expanded
+		}
+		return out, nil
+	default:
+		return v, nil
+	}
+}
+
+func (s *Server) handleListTemplates(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Templates.List())
+}
+
+func (s *Server) handleReloadTemplates(w http.ResponseWriter, r *http.Request) {
+	if err := s.Templates.Reload(); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, s.Templates.List())
+}
@@ -0,0 +1,271 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"t-oai-api/logging"
+)
+
+// maxTranscriptResponse caps how much of a response is buffered for its
+// transcript; longer responses are rendered from what fits.
+const maxTranscriptResponse = 8 << 20
+
+// TranscriptWriter renders completed chat exchanges as Markdown, one file per
+// exchange under a YYYY/MM/DD directory tree, for people to read alongside the
+// machine logs.
+type TranscriptWriter struct {
+	dir string
+}
+
+// NewTranscriptWriter writes transcripts under dir, creating it if needed.
+func NewTranscriptWriter(dir string) (*TranscriptWriter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create transcript directory: %w", err)
+	}
+	return &TranscriptWriter{dir: dir}, nil
+}
+
+// transcriptCapture holds the request sent upstream and the response relayed
+// to the client for one chat exchange.
+type transcriptCapture struct {
+	request   []byte
+	response  bytes.Buffer
+	truncated bool
+}
+
+func (c *transcriptCapture) Write(p []byte) (int, error) {
+	if room := maxTranscriptResponse - c.response.Len(); len(p) > room {
+		c.response.Write(p[:room])
+		c.truncated = true
+	} else {
+		c.response.Write(p)
+	}
+	return len(p), nil
+}
+
+// Write renders e and its captured bodies and returns the file written.
+func (t *TranscriptWriter) Write(e *Exchange, c *transcriptCapture) (string, error) {
+	started := e.Started.UTC()
+	dir := filepath.Join(t.dir, started.Format("2006"), started.Format("01"), started.Format("02"))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	name := started.Format("150405.000") + "-" + sanitizeFileName(e.ID) + ".md"
+	path := filepath.Join(dir, name)
+	return path, os.WriteFile(path, renderTranscript(e, c), 0644)
+}
+
+// sanitizeFileName keeps request IDs, which clients may set, from escaping the
+// transcript directory.
+func sanitizeFileName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+type transcriptMessage struct {
+	Role       string               `json:"role"`
+	Name       string               `json:"name"`
+	Content    json.RawMessage      `json:"content"`
+	Refusal    string               `json:"refusal"`
+	ToolCalls  []transcriptToolCall `json:"tool_calls"`
+	ToolCallID string               `json:"tool_call_id"`
+}
+
+type transcriptToolCall struct {
+	ID       string `json:"id"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type transcriptChoice struct {
+	Index        int               `json:"index"`
+	Message      transcriptMessage `json:"message"`
+	FinishReason string            `json:"finish_reason"`
+}
+
+type transcriptResponse struct {
+	Choices []transcriptChoice `json:"choices"`
+	Error   *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func renderTranscript(e *Exchange, c *transcriptCapture) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Chat %s\n\n", e.ID)
+	fmt.Fprintf(&b, "- **Time:** %s\n", e.Started.UTC().Format("2006-01-02 15:04:05 MST"))
+	if e.Model != "" {
+		fmt.Fprintf(&b, "- **Model:** %s\n", e.Model)
+	}
+	if e.Key != "" {
+		fmt.Fprintf(&b, "- **Key:** %s\n", e.Key)
+	}
+	fmt.Fprintf(&b, "- **Status:** %d in %.0f ms", e.Status, e.DurationMs)
+	if e.Streaming {
+		b.WriteString(", streamed")
+	}
+	b.WriteString("\n")
+	if e.TotalTokens > 0 {
+		fmt.Fprintf(&b, "- **Tokens:** %d prompt + %d completion = %d\n", e.PromptTokens, e.CompletionTokens, e.TotalTokens)
+	}
+
+	var req struct {
+		Messages []transcriptMessage `json:"messages"`
+	}
+	if err := json.Unmarshal(c.request, &req); err != nil {
+		b.WriteString("\n*The request body is not valid JSON.*\n")
+	}
+	for _, msg := range req.Messages {
+		writeTranscriptMessage(&b, msg, "")
+	}
+
+	if e.Error != "" && c.response.Len() == 0 {
+		fmt.Fprintf(&b, "\n## Error\n\n%s\n", e.Error)
+		return []byte(b.String())
+	}
+
+	var resp transcriptResponse
+	if e.Streaming {
+		resp = assembleStream(c.response.Bytes())
+	} else if err := json.Unmarshal(c.response.Bytes(), &resp); err != nil {
+		b.WriteString("\n## Response\n\n")
+		writeFenced(&b, "", c.response.String())
+	}
+	if resp.Error != nil {
+		fmt.Fprintf(&b, "\n## Error\n\n%s\n", resp.Error.Message)
+	}
+	for _, choice := range resp.Choices {
+		heading := ""
+		if len(resp.Choices) > 1 {
+			heading = fmt.Sprintf("choice %d", choice.Index)
+		}
+		if choice.FinishReason != "" && choice.FinishReason != "stop" && choice.FinishReason != "tool_calls" {
+			heading = strings.TrimPrefix(heading+", finished by "+choice.FinishReason, ", ")
+		}
+		if choice.Message.Role == "" {
+			choice.Message.Role = "assistant"
+		}
+		writeTranscriptMessage(&b, choice.Message, heading)
+	}
+	if c.truncated {
+		fmt.Fprintf(&b, "\n*The response was truncated to %d bytes for this transcript.*\n", maxTranscriptResponse)
+	}
+	return []byte(b.String())
+}
+
+// writeTranscriptMessage renders one turn: its text, then any tool calls as
+// JSON code blocks. Tool results are fenced too, since they are usually
+// machine output.
+func writeTranscriptMessage(b *strings.Builder, msg transcriptMessage, note string) {
+	heading := strings.ToUpper(msg.Role[:min(1, len(msg.Role))]) + msg.Role[min(1, len(msg.Role)):]
+	if msg.Name != "" {
+		heading += " (" + msg.Name + ")"
+	}
+	if msg.ToolCallID != "" {
+		heading += " — result of `" + msg.ToolCallID + "`"
+	}
+	if note != "" {
+		heading += " — " + note
+	}
+	fmt.Fprintf(b, "\n## %s\n\n", heading)
+
+	// Blocks after the first are separated by a blank line.
+	sep := ""
+	text := transcriptContent(msg.Content)
+	switch {
+	case msg.Role == "tool" || msg.Role == "function":
+		writeFenced(b, "", text)
+		sep = "\n"
+	case text != "":
+		b.WriteString(strings.TrimRight(text, "\n") + "\n")
+		sep = "\n"
+	}
+	if msg.Refusal != "" {
+		fmt.Fprintf(b, "%s> **Refused:** %s\n", sep, msg.Refusal)
+		sep = "\n"
+	}
+	for _, call := range msg.ToolCalls {
+		fmt.Fprintf(b, "%s**Tool call** `%s`", sep, call.Function.Name)
+		sep = "\n"
+		if call.ID != "" {
+			fmt.Fprintf(b, " (`%s`)", call.ID)
+		}
+		b.WriteString("\n\n")
+		args := call.Function.Arguments
+		var indented bytes.Buffer
+		if json.Indent(&indented, []byte(args), "", "  ") == nil {
+			args = indented.String()
+		}
+		writeFenced(b, "json", args)
+	}
+}
+
+// transcriptContent flattens message content, which is a string or a list of
+// parts, into Markdown.
+func transcriptContent(raw json.RawMessage) string {
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		return text
+	}
+	var parts []struct {
+		Type     string `json:"type"`
+		Text     string `json:"text"`
+		ImageURL struct {
+			URL string `json:"url"`
+		} `json:"image_url"`
+	}
+	if json.Unmarshal(raw, &parts) != nil {
+		return ""
+	}
+	var out []string
+	for _, p := range parts {
+		switch {
+		case p.Type == "text" || p.Text != "":
+			out = append(out, p.Text)
+		case p.Type == "image_url" && !strings.HasPrefix(p.ImageURL.URL, "data:"):
+			out = append(out, fmt.Sprintf("*[image: %s]*", p.ImageURL.URL))
+		default:
+			out = append(out, fmt.Sprintf("*[%s]*", strings.ReplaceAll(p.Type, "_", " ")))
+		}
+	}
+	return strings.Join(out, "\n\n")
+}
+
+// writeFenced writes s as a code block, with a fence longer than any backtick
+// run inside it.
+func writeFenced(b *strings.Builder, lang, s string) {
+	fence := "```"
+	for strings.Contains(s, fence) {
+		fence += "`"
+	}
+	fmt.Fprintf(b, "%s%s\n%s\n%s\n", fence, lang, strings.TrimRight(s, "\n"), fence)
+}
+
+// assembleStream rebuilds the final choices of a streamed chat completion from
+// its SSE deltas, or picks out the error of a stream that failed.
+func assembleStream(body []byte) transcriptResponse {
+	var resp transcriptResponse
+	if data := logging.AssembleStream(body); data != nil {
+		json.Unmarshal(data, &resp)
+		return resp
+	}
+	for _, raw := range logging.StreamEvents(body) {
+		var event transcriptResponse
+		if json.Unmarshal(raw, &event) == nil && event.Error != nil {
+			resp.Error = event.Error
+		}
+	}
+	return resp
+}
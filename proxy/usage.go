@@ -0,0 +1,245 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// usageRetention is how long daily usage totals are kept.
+const usageRetention = 90 * 24 * time.Hour
+
+// usageDateLayout formats the UTC day a usage bucket covers.
+const usageDateLayout = "2006-01-02"
+
+// UsageTotals accumulates traffic for one model and client key.
+type UsageTotals struct {
+	Requests         int64 `json:"requests"`
+	Errors           int64 `json:"errors"`
+	PromptTokens     int64 `json:"prompt_tokens"`
+	CompletionTokens int64 `json:"completion_tokens"`
+	TotalTokens      int64 `json:"total_tokens"`
+}
+
+func (t *UsageTotals) add(o UsageTotals) {
+	t.Requests += o.Requests
+	t.Errors += o.Errors
+	t.PromptTokens += o.PromptTokens
+	t.CompletionTokens += o.CompletionTokens
+	t.TotalTokens += o.TotalTokens
+}
+
+// UsageRecord is one day of usage for a model and client key, as persisted.
+type UsageRecord struct {
+	Date  string `json:"date"`
+	Model string `json:"model"`
+	Key   string `json:"key,omitempty"`
+	UsageTotals
+}
+
+type usageKey struct {
+	Model string
+	Key   string
+}
+
+// UsageStore keeps daily token and request totals per model and client key,
+// optionally persisted to a JSON file.
+type UsageStore struct {
+	path string
+
+	mu    sync.Mutex
+	since time.Time
+	days  map[string]map[usageKey]*UsageTotals
+	dirty bool
+}
+
+type usageFile struct {
+	Since   time.Time     `json:"since"`
+	Records []UsageRecord `json:"records"`
+}
+
+// NewUsageStore loads the usage history at path, if any. An empty path keeps
+// history in memory only.
+func NewUsageStore(path string) (*UsageStore, error) {
+	u := &UsageStore{
+		path:  path,
+		since: time.Now(),
+		days:  make(map[string]map[usageKey]*UsageTotals),
+	}
+	if path == "" {
+		return u, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return u, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read usage history: %w", err)
+	}
+	var file usageFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid usage history file: %w", err)
+	}
+	if !file.Since.IsZero() {
+		u.since = file.Since
+	}
+	for _, rec := range file.Records {
+		u.bucket(rec.Date, usageKey{rec.Model, rec.Key}).add(rec.UsageTotals)
+	}
+	return u, nil
+}
+
+func (u *UsageStore) bucket(date string, key usageKey) *UsageTotals {
+	day, ok := u.days[date]
+	if !ok {
+		day = make(map[usageKey]*UsageTotals)
+		u.days[date] = day
+	}
+	t, ok := day[key]
+	if !ok {
+		t = &UsageTotals{}
+		day[key] = t
+	}
+	return t
+}
+
+// Record adds a completed exchange to its day's totals. Requests that name no
+// model, such as model listings, are not counted.
+func (u *UsageStore) Record(e *Exchange) {
+	if e.Model == "" {
+		return
+	}
+	totals := UsageTotals{
+		Requests:         1,
+		PromptTokens:     int64(e.PromptTokens),
+		CompletionTokens: int64(e.CompletionTokens),
+		TotalTokens:      int64(e.TotalTokens),
+	}
+	if e.Status == 0 || e.Status >= 400 {
+		totals.Errors = 1
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.bucket(e.Started.UTC().Format(usageDateLayout), usageKey{e.Model, e.Key}).add(totals)
+	u.dirty = true
+}
+
+// Since returns when usage recording began.
+func (u *UsageStore) Since() time.Time {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.since
+}
+
+// Records returns the daily totals for UTC days from through to inclusive,
+// ordered by date, model, and key.
+func (u *UsageStore) Records(from, to time.Time) []UsageRecord {
+	first := from.UTC().Format(usageDateLayout)
+	last := to.UTC().Format(usageDateLayout)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var records []UsageRecord
+	for date, day := range u.days {
+		if date < first || date > last {
+			continue
+		}
+		for key, t := range day {
+			records = append(records, UsageRecord{Date: date, Model: key.Model, Key: key.Key, UsageTotals: *t})
+		}
+	}
+	sortUsageRecords(records)
+	return records
+}
+
+func sortUsageRecords(records []UsageRecord) {
+	sort.Slice(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if a.Date != b.Date {
+			return a.Date < b.Date
+		}
+		if a.Model != b.Model {
+			return a.Model < b.Model
+		}
+		return a.Key < b.Key
+	})
+}
+
+// Save writes the usage history if it changed, dropping days older than the
+// retention period.
+func (u *UsageStore) Save() error {
+	if u.path == "" {
+		return nil
+	}
+
+	u.mu.Lock()
+	if !u.dirty {
+		u.mu.Unlock()
+		return nil
+	}
+	cutoff := time.Now().Add(-usageRetention).UTC().Format(usageDateLayout)
+	file := usageFile{Since: u.since}
+	for date, day := range u.days {
+		if date < cutoff {
+			delete(u.days, date)
+			continue
+		}
+		for key, t := range day {
+			file.Records = append(file.Records, UsageRecord{Date: date, Model: key.Model, Key: key.Key, UsageTotals: *t})
+		}
+	}
+	sortUsageRecords(file.Records)
+	data, err := json.MarshalIndent(file, "", "  ")
+	u.dirty = false
+	u.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := u.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write usage history: %w", err)
+	}
+	return os.Rename(tmp, u.path)
+}
+
+// credentialHash identifies the credential in h's Authorization header
+// without revealing it, so state kept per upstream account is not shared
+// between keys. It is empty when h carries no credential.
+func credentialHash(h http.Header) string {
+	auth := h.Get("Authorization")
+	if auth == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(auth))
+	return hex.EncodeToString(sum[:8])
+}
+
+// keyLabel identifies the client key of r without revealing it, in the
+// sk-...abcd form provider dashboards use. It is empty when r carries no key.
+func keyLabel(r *http.Request) string {
+	key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" {
+		return ""
+	}
+	if len(key) <= 8 {
+		return "..." + key[len(key)-min(len(key), 2):]
+	}
+	prefix, _, found := strings.Cut(key, "-")
+	if !found || len(prefix) > 8 {
+		prefix = key[:3]
+	} else {
+		prefix += "-"
+	}
+	return prefix + "..." + key[len(key)-4:]
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// warmupTimeout bounds a single pre-connect or warm-up request. Loading model
+// weights on a local server can take a while.
+const warmupTimeout = 2 * time.Minute
+
+// WarmupTarget is an upstream to pre-connect to, and optionally a model to
+// load there with a one-token request.
+type WarmupTarget struct {
+	URL   string `json:"url"`
+	Model string `json:"model,omitempty"`
+}
+
+// WarmupResult reports one pre-connect or warm-up request.
+type WarmupResult struct {
+	WarmupTarget
+	Status     int     `json:"status,omitempty"`
+	DurationMs float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// ParseWarmupTargets parses a comma-separated list of upstream base URLs to
+// pre-connect to and models to warm up, either as model@url or as a bare
+// model name on the default upstream.
+func ParseWarmupTargets(spec, defaultURL string) ([]WarmupTarget, error) {
+	var targets []WarmupTarget
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		t := WarmupTarget{URL: entry}
+		if model, url, ok := strings.Cut(entry, "@"); ok {
+			t = WarmupTarget{URL: url, Model: model}
+		} else if !strings.Contains(entry, "://") {
+			t = WarmupTarget{URL: defaultURL, Model: entry}
+		}
+		t.URL = strings.TrimSuffix(t.URL, "/")
+		if !strings.HasPrefix(t.URL, "http://") && !strings.HasPrefix(t.URL, "https://") {
+			return nil, fmt.Errorf("invalid warm-up target %q: %q is not an http(s) URL", entry, t.URL)
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// Warmup pre-connects to every warm-up target, leaving the connection idle in
+// the pool for the next request, and sends a one-token chat completion for
+// each model so local servers load its weights.
+func (s *Server) Warmup(ctx context.Context) []WarmupResult {
+	results := make([]WarmupResult, len(s.WarmupTargets))
+	done := make(chan struct{})
+	for i, t := range s.WarmupTargets {
+		go func() {
+			results[i] = s.warmupTarget(ctx, t)
+			done <- struct{}{}
+		}()
+	}
+	for range s.WarmupTargets {
+		<-done
+	}
+	s.lastWarmup.Store(time.Now().UnixNano())
+	return results
+}
+
+func (s *Server) warmupTarget(ctx context.Context, t WarmupTarget) WarmupResult {
+	ctx, cancel := context.WithTimeout(ctx, warmupTimeout)
+	defer cancel()
+
+	result := WarmupResult{WarmupTarget: t}
+	start := time.Now()
+	var req *http.Request
+	var err error
+	if t.Model == "" {
+		req, err = http.NewRequestWithContext(ctx, http.MethodHead, t.URL, nil)
+	} else {
+		body, _ := json.Marshal(map[string]any{
+			"model":      t.Model,
+			"messages":   []map[string]string{{"role": "user", "content": "hi"}},
+			"max_tokens": 1,
+		})
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, t.URL+"/chat/completions", bytes.NewReader(body))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+	}
+	if err == nil {
+		req.Header.Set("X-Request-ID", fmt.Sprintf("warmup-%d", start.UnixNano()))
+		addVia(req.Header, 1, 1)
+		if s.Config.OpenAIAPIKey != "" {
+			req.Header.Set("Authorization", "Bearer "+s.Config.OpenAIAPIKey)
+		}
+		if s.Attribution != nil {
+			s.Attribution.Apply(req)
+		}
+		var resp *http.Response
+		if resp, err = s.client.Do(req); err == nil {
+			// Drain the body so the connection goes back to the pool.
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			result.Status = resp.StatusCode
+		}
+	}
+	result.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// warmupLoop warms up at startup and again whenever the proxy has seen no
+// upstream traffic or warm-up for the idle period.
+func (s *Server) warmupLoop(idle time.Duration) {
+	s.logWarmup(s.Warmup(context.Background()))
+	if idle <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(max(idle/4, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			last := max(s.lastRequest.Load(), s.lastWarmup.Load())
+			if time.Since(time.Unix(0, last)) >= idle {
+				s.logWarmup(s.Warmup(context.Background()))
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Server) logWarmup(results []WarmupResult) {
+	for _, r := range results {
+		target := r.URL
+		if r.Model != "" {
+			target = r.Model + "@" + r.URL
+		}
+		if r.Error != "" {
+			log.Printf("Warm-up of %s failed after %.0fms: %s", target, r.DurationMs, r.Error)
+			continue
+		}
+		log.Printf("Warmed up %s in %.0fms (status %d)", target, r.DurationMs, r.Status)
+	}
+}
+
+func (s *Server) handleWarmup(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Warmup(r.Context()))
+}
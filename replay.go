@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"t-oai-api/config"
+	"t-oai-api/proxy"
+)
+
+// replayClock is a virtual clock that stands still between replay events, so
+// request IDs, timings, and log timestamps match the recording exactly.
+type replayClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *replayClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// advance moves the clock forward to t. It never moves backwards, so events
+// from concurrent exchanges keep the clock monotonic.
+func (c *replayClock) advance(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t.After(c.now) {
+		c.now = t
+	}
+}
+
+// replaySession drives one replay: a fake upstream serving the recorded
+// responses, and the proxy in between.
+type replaySession struct {
+	exchanges []*proxy.RecordedExchange
+	byID      map[string]*proxy.RecordedExchange
+	speed     float64
+	clock     *replayClock
+
+	mu   sync.Mutex
+	sent map[string]time.Time
+}
+
+// runReplay implements the replay subcommand, which replays a session captured
+// with -record against a fresh proxy.
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := fs.Float64("speed", 1, "Pacing multiplier; 2 replays twice as fast, 0 as fast as possible")
+	frozen := fs.Bool("frozen-clock", false, "Run the proxy on a virtual clock that only advances at recorded events")
+	logFile := fs.String("log", "", "Write the replayed request log to this file")
+	fs.Parse(args)
+	if fs.NArg() != 1 || *speed < 0 {
+		return fmt.Errorf("usage: %s replay [-speed n] [-frozen-clock] [-log file] <session.jsonl>", os.Args[0])
+	}
+
+	exchanges, err := proxy.LoadRecording(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if len(exchanges) == 0 {
+		return fmt.Errorf("no exchanges in %s", fs.Arg(0))
+	}
+
+	rs := &replaySession{
+		exchanges: exchanges,
+		byID:      make(map[string]*proxy.RecordedExchange, len(exchanges)),
+		speed:     *speed,
+		sent:      make(map[string]time.Time),
+	}
+	for _, e := range exchanges {
+		rs.byID[e.ID] = e
+	}
+
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer upstream.Close()
+	go http.Serve(upstream, http.HandlerFunc(rs.serveUpstream))
+
+	cfg := config.Config{OpenAIBaseURL: "http://" + upstream.Addr().String()}
+	if *logFile != "" {
+		cfg.LogRequests = true
+		cfg.LogResponses = true
+		cfg.RequestLogFile = *logFile
+	}
+	var opts []proxy.Option
+	if *frozen {
+		rs.clock = &replayClock{now: exchanges[0].Started}
+		opts = append(opts, proxy.WithClock(rs.clock.Now))
+	}
+	server, err := proxy.NewServer(cfg, opts...)
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+
+	front, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer front.Close()
+	go http.Serve(front, server)
+
+	fmt.Printf("Replaying %d exchanges from %s\n", len(exchanges), fs.Arg(0))
+	mismatches := rs.drive("http://" + front.Addr().String())
+	if mismatches > 0 {
+		return fmt.Errorf("%d of %d exchanges differed from the recording", mismatches, len(exchanges))
+	}
+	fmt.Println("All exchanges matched the recording")
+	return nil
+}
+
+// drive sends every recorded request at its original offset from the start of
+// the session and reports how many responses differed from the recording.
+func (rs *replaySession) drive(base string) int {
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	start := time.Now()
+	first := rs.exchanges[0].Started
+
+	results := make([]string, len(rs.exchanges))
+	var mismatches int
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i, e := range rs.exchanges {
+		rs.sleepUntil(start, e.Started.Sub(first))
+		if rs.clock != nil {
+			rs.clock.advance(e.Started)
+		}
+		rs.mu.Lock()
+		rs.sent[e.ID] = time.Now()
+		rs.mu.Unlock()
+
+		wg.Add(1)
+		go func(i int, e *proxy.RecordedExchange) {
+			defer wg.Done()
+			diff := replayExchange(client, base, e)
+			mu.Lock()
+			defer mu.Unlock()
+			if diff == "" {
+				results[i] = fmt.Sprintf("ok        %s %s %s", e.ID, e.Method, e.Path)
+				return
+			}
+			mismatches++
+			results[i] = fmt.Sprintf("MISMATCH  %s %s %s: %s", e.ID, e.Method, e.Path, diff)
+		}(i, e)
+	}
+	wg.Wait()
+
+	for _, line := range results {
+		fmt.Println(line)
+	}
+	return mismatches
+}
+
+// replayExchange sends one recorded request and describes how the response
+// differed from the recording, or returns "" if it matched.
+func replayExchange(client *http.Client, base string, e *proxy.RecordedExchange) string {
+	req, err := http.NewRequest(e.Method, base+e.Path, bytes.NewReader(e.Body))
+	if err != nil {
+		return err.Error()
+	}
+	for name, values := range e.Header {
+		if name == "Content-Length" {
+			continue
+		}
+		req.Header[name] = values
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err.Error()
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Sprintf("reading response: %v", err)
+	}
+
+	if resp.StatusCode != e.Status {
+		return fmt.Sprintf("status %d, recorded %d", resp.StatusCode, e.Status)
+	}
+	if want := e.ResponseBody(); !bytes.Equal(body, want) {
+		return fmt.Sprintf("body differs at byte %d (%d bytes, recorded %d)", firstDifference(body, want), len(body), len(want))
+	}
+	return ""
+}
+
+// serveUpstream plays the upstream side of a recorded exchange, writing each
+// chunk at its original offset from when the request was sent.
+func (rs *replaySession) serveUpstream(w http.ResponseWriter, r *http.Request) {
+	io.Copy(io.Discard, r.Body)
+	id := r.Header.Get("X-Request-ID")
+	e, ok := rs.byID[id]
+	if !ok {
+		http.Error(w, "no recorded exchange for request "+id, http.StatusNotFound)
+		return
+	}
+	rs.mu.Lock()
+	sent := rs.sent[id]
+	rs.mu.Unlock()
+
+	for name, values := range e.ResponseHeader {
+		switch name {
+		case "Content-Length", "Via":
+			continue
+		}
+		w.Header()[name] = values
+	}
+	if len(e.Chunks) > 0 {
+		rs.sleepUntil(sent, offsetDuration(e.Chunks[0].OffsetMs))
+	}
+	status := e.Status
+	if status == 0 {
+		status = http.StatusBadGateway
+	}
+	w.WriteHeader(status)
+
+	flusher, _ := w.(http.Flusher)
+	for _, c := range e.Chunks {
+		rs.sleepUntil(sent, offsetDuration(c.OffsetMs))
+		if rs.clock != nil {
+			rs.clock.advance(e.Started.Add(offsetDuration(c.OffsetMs)))
+		}
+		if _, err := w.Write(c.Data); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// sleepUntil waits until offset after start, scaled by the replay speed.
+func (rs *replaySession) sleepUntil(start time.Time, offset time.Duration) {
+	if rs.speed == 0 {
+		return
+	}
+	time.Sleep(time.Until(start.Add(time.Duration(float64(offset) / rs.speed))))
+}
+
+func offsetDuration(ms float64) time.Duration {
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+func firstDifference(a, b []byte) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return min(len(a), len(b))
+}
@@ -0,0 +1,22 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+func isWindowsService() bool {
+	return false
+}
+
+func enterServiceDir() {}
+
+func runService(run func(ctx context.Context) error) error {
+	return fmt.Errorf("running as a service is only supported on Windows")
+}
+
+func runServiceCommand(args []string) error {
+	return fmt.Errorf("the service command is only supported on Windows; use systemd or another supervisor instead")
+}
@@ -0,0 +1,153 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const serviceName = "TransparentOAIProxy"
+
+func isWindowsService() bool {
+	ok, err := svc.IsWindowsService()
+	if err != nil {
+		log.Printf("Warning: could not determine service state: %v", err)
+		return false
+	}
+	return ok
+}
+
+type serviceHandler struct {
+	run func(ctx context.Context) error
+}
+
+func (h *serviceHandler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	const accepted = svc.AcceptStop | svc.AcceptShutdown
+
+	status <- svc.Status{State: svc.StartPending}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- h.run(ctx)
+	}()
+
+	status <- svc.Status{State: svc.Running, Accepts: accepted}
+
+	for {
+		select {
+		case err := <-errCh:
+			if err != nil {
+				log.Printf("Service error: %v", err)
+				return false, 1
+			}
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending, WaitHint: uint32((shutdownTimeout + 5*time.Second).Milliseconds())}
+				cancel()
+				if err := <-errCh; err != nil {
+					log.Printf("Service error: %v", err)
+					return false, 1
+				}
+				return false, 0
+			}
+		}
+	}
+}
+
+// enterServiceDir changes to the executable's directory. Services start in
+// System32, so it must run before the configuration is loaded for relative
+// paths such as .env and log files to resolve next to the executable.
+func enterServiceDir() {
+	exe, err := os.Executable()
+	if err != nil {
+		log.Printf("Warning: could not resolve executable path: %v", err)
+		return
+	}
+	if err := os.Chdir(filepath.Dir(exe)); err != nil {
+		log.Printf("Warning: could not change to %s: %v", filepath.Dir(exe), err)
+	}
+}
+
+// runService hands control to the Windows service manager, cancelling the
+// context passed to run when a stop or shutdown request arrives.
+func runService(run func(ctx context.Context) error) error {
+	return svc.Run(serviceName, &serviceHandler{run: run})
+}
+
+// runServiceCommand implements the `service` subcommand. Arguments after
+// `install` are stored as the service's command line flags.
+func runServiceCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s service install|uninstall|start|stop [flags]", os.Args[0])
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	switch args[0] {
+	case "install":
+		exe, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("failed to resolve executable path: %w", err)
+		}
+		s, err := m.CreateService(serviceName, exe, mgr.Config{
+			DisplayName: "Transparent OpenAI API Proxy",
+			Description: "Logs and forwards requests to the OpenAI API.",
+			StartType:   mgr.StartAutomatic,
+		}, args[1:]...)
+		if err != nil {
+			return fmt.Errorf("failed to install service: %w", err)
+		}
+		s.Close()
+		log.Printf("Installed service %s", serviceName)
+	case "uninstall":
+		s, err := m.OpenService(serviceName)
+		if err != nil {
+			return fmt.Errorf("service %s is not installed: %w", serviceName, err)
+		}
+		defer s.Close()
+		if err := s.Delete(); err != nil {
+			return fmt.Errorf("failed to uninstall service: %w", err)
+		}
+		log.Printf("Uninstalled service %s", serviceName)
+	case "start":
+		s, err := m.OpenService(serviceName)
+		if err != nil {
+			return fmt.Errorf("service %s is not installed: %w", serviceName, err)
+		}
+		defer s.Close()
+		if err := s.Start(); err != nil {
+			return fmt.Errorf("failed to start service: %w", err)
+		}
+	case "stop":
+		s, err := m.OpenService(serviceName)
+		if err != nil {
+			return fmt.Errorf("service %s is not installed: %w", serviceName, err)
+		}
+		defer s.Close()
+		if _, err := s.Control(svc.Stop); err != nil {
+			return fmt.Errorf("failed to stop service: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown service command %q", args[0])
+	}
+	return nil
+}